@@ -0,0 +1,233 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"strings"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/logger"
+)
+
+// Buckets and files carry ACLs naming their owner and the permissions granted to other
+// identities. A file's owner is the origin that created it, which for an authenticated
+// client is always its own identity, and a bucket's owner is whoever created it. A command
+// on a file is allowed if the file's ACL or its bucket's ACL allows it, so the owner of a
+// bucket has every permission on the files in it. Buckets and files without an owner are
+// open to everyone. ACLs are only enforced on nodes that require authentication, as the
+// origin a caller claims cannot be trusted otherwise, and trusted peers replicate, scrub
+// and repair files on behalf of their owners, so their commands are not checked either.
+
+var errAccessDenied = errors.New("access denied")
+
+// commandPermissions maps the commands that act on a bucket or file to the permission they
+// need. Other commands are not checked.
+var commandPermissions = map[string]datamgmt.Permission{
+    "send":          datamgmt.PermWrite,
+    "sync":          datamgmt.PermWrite,
+    "status":        datamgmt.PermWrite,
+    "fetch":         datamgmt.PermRead,
+    "stat":          datamgmt.PermRead,
+    "versions":      datamgmt.PermList,
+    "delete":        datamgmt.PermDelete,
+    "delete-bucket": datamgmt.PermDelete,
+}
+
+// Authorize returns errAccessDenied unless identity holds permission on the file data
+// describes, or on its bucket if data names no file. A file name that is not a single path
+// element is refused outright, as it could name a file outside the bucket checked.
+func (s *StorageService) Authorize(identity string, data *datamgmt.Data, permission datamgmt.Permission) error {
+    if err := validateFileName(data); err != nil {
+        return err
+    }
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    owned := false
+    for _, acl := range s.acls(data) {
+        if acl.Allows(identity, permission) {
+            return nil
+        }
+        owned = owned || acl.Owner != "" || len(acl.Grants) > 0
+    }
+    if !owned {
+        return nil
+    }
+    return fmt.Errorf("%w: %s may not %s %s", errAccessDenied, identity, permission, aclTarget(data))
+}
+
+// acls returns the ACL of the file data describes, if any, followed by that of its bucket.
+// A deleted file keeps the ACL it last had, which still guards its older versions and the
+// name itself. The caller must hold the mutex.
+func (s *StorageService) acls(data *datamgmt.Data) []*datamgmt.ACL {
+    var acls []*datamgmt.ACL
+    if data.Filename != "" {
+        if path, err := s.generateFilePath(data); err == nil {
+            if manifest, err := s.loadManifest(path); err == nil {
+                acls = append(acls, &manifest.ACL)
+            }
+        }
+    }
+    if data.Bucket != "" {
+        if bucket, err := s.loadBucket(data.Bucket); err == nil {
+            acls = append(acls, &bucket.ACL)
+        }
+    }
+    return acls
+}
+
+// ACL returns the ACL of the file data describes, or of its bucket if data names no file.
+func (s *StorageService) ACL(data *datamgmt.Data) (*datamgmt.ACL, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if data.Filename == "" {
+        bucket, err := s.loadBucket(data.Bucket)
+        if err != nil {
+            return nil, err
+        }
+        return &bucket.ACL, nil
+    }
+    manifest, err := s.liveManifest(data)
+    if err != nil {
+        return nil, err
+    }
+    return &manifest.ACL, nil
+}
+
+// SetGrants replaces the permissions granted on the file data describes, or on its bucket
+// if data names no file. The owner is left as it is.
+func (s *StorageService) SetGrants(data *datamgmt.Data, grants map[string][]datamgmt.Permission) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if data.Filename == "" {
+        bucket, err := s.loadBucket(data.Bucket)
+        if err != nil {
+            return err
+        }
+        bucket.ACL.Grants = grants
+        content, err := json.Marshal(bucket)
+        if err != nil {
+            return err
+        }
+        return writeFileAtomic(s.bucketPath(bucket.Name), content)
+    }
+    manifest, err := s.liveManifest(data)
+    if err != nil {
+        return err
+    }
+    manifest.ACL.Grants = grants
+    path, _ := s.generateFilePath(data)
+    return s.saveManifest(path, manifest)
+}
+
+// liveManifest loads the latest manifest of a file that is not deleted. The caller must
+// hold the mutex.
+func (s *StorageService) liveManifest(data *datamgmt.Data) (*Manifest, error) {
+    path, err := s.generateFilePath(data)
+    if err != nil {
+        return nil, err
+    }
+    manifest, err := s.loadManifest(path)
+    if err != nil {
+        return nil, err
+    }
+    if manifest.Deleted {
+        return nil, fmt.Errorf("file %s is deleted: %w", data.Key(), fs.ErrNotExist)
+    }
+    return manifest, nil
+}
+
+func aclTarget(data *datamgmt.Data) string {
+    if data.Filename == "" {
+        return "bucket " + data.Bucket
+    }
+    return data.Key()
+}
+
+// unchecked reports whether the commands of an identity bypass ACLs: those of trusted
+// peers, and of anyone on a node that does not require authentication.
+func unchecked(identity string) bool {
+    return identity == anonymous || strings.HasPrefix(identity, peerPrefix)
+}
+
+// authorize checks that a caller may run the command in data. An authenticated client
+// always acts as its own origin, so the files it creates are owned by its identity. A
+// caller holding a capability acts as its issuer, and may only run the commands it grants
+// on its file that its issuer may still run. Only trusted peers forward writes, so no one
+// else can create a bucket with the settings a forwarded write carries.
+func (s *Server) authorize(caller *caller, data *datamgmt.Data) error {
+    if !unchecked(caller.identity) {
+        data.Forwarded = false
+    }
+    permission, ok := commandPermissions[data.Command]
+    if caller.capability != nil {
+        if !ok || !caller.capability.allows(data, permission) {
+            return fmt.Errorf("%w: capability does not allow %s of %s", errAccessDenied, data.Command, aclTarget(data))
+        }
+        data.OriginID = caller.capability.Issuer
+        if unchecked(data.OriginID) {
+            return nil
+        }
+        return s.storage.Authorize(data.OriginID, data, permission)
+    }
+    if unchecked(caller.identity) {
+        return nil
+    }
+    data.OriginID = caller.identity
+    if !ok {
+        return nil
+    }
+    return s.storage.Authorize(data.OriginID, data, permission)
+}
+
+// handleSetACLCommand replaces the grants on a file, or on a bucket if data names no file,
+// with those in data.ACL. Only the owner may change them.
+func (s *Server) handleSetACLCommand(identity string, data *datamgmt.Data, conn net.Conn) error {
+    if data.ACL == nil {
+        return s.respond(conn, data, errors.New("no grants given"))
+    }
+    acl, err := s.storage.ACL(data)
+    if err != nil {
+        return s.respond(conn, data, err)
+    }
+    if !unchecked(identity) && acl.Owner != "" && acl.Owner != data.OriginID {
+        return s.respond(conn, data, fmt.Errorf("%w: only the owner %s may change the grants on %s", errAccessDenied, acl.Owner, aclTarget(data)))
+    }
+    if err := s.storage.SetGrants(data, data.ACL.Grants); err != nil {
+        return s.respond(conn, data, err)
+    }
+    logger.Log.WithFields(map[string]interface{}{"target": aclTarget(data), "identity": identity}).Info("Grants changed")
+    return s.respond(conn, data, nil)
+}
+
+// requestSetACL asks a peer to replace the grants on a file or bucket.
+func (s *Server) requestSetACL(address string, data *datamgmt.Data) error {
+    request := *data
+    request.Command = "set-acl"
+    response, err := s.request(address, &request)
+    if err != nil {
+        return err
+    }
+    response.Close()
+    return nil
+}
+
+// parseGrant reads a "<identity>=<permission>[,<permission>]..." argument of the set-acl
+// command into grants.
+func parseGrant(arg string, grants map[string][]datamgmt.Permission) error {
+    identity, list, found := strings.Cut(arg, "=")
+    if !found || identity == "" {
+        return fmt.Errorf("expected <identity>=<permission>[,<permission>]..., got %q", arg)
+    }
+    permissions, err := parseOperations(list)
+    if err != nil {
+        return err
+    }
+    grants[identity] = append(grants[identity], permissions...)
+    return nil
+}
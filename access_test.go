@@ -0,0 +1,228 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+)
+
+func TestServer_AccessControl(t *testing.T) {
+    node := startTestServer(t, "127.0.0.1:3383", nil, func(node *Server) {
+        node.credentials = &Credentials{Clients: map[string]string{"alice": "alice-token", "bob": "bob-token"}}
+    })
+    alice, bob := testClient(t, "alice-token"), testClient(t, "bob-token")
+    denied := func(err error) bool {
+        var rejected *peerError
+        return errors.As(err, &rejected) && strings.Contains(err.Error(), errAccessDenied.Error())
+    }
+
+    bucket := &datamgmt.Data{Command: "create-bucket", Bucket: "private", Settings: &datamgmt.Bucket{Versioned: true}}
+    if err := alice.requestBucketChange("127.0.0.1:3383", bucket); err != nil {
+        t.Fatalf("create-bucket error = %v", err)
+    }
+    path := filepath.Join(t.TempDir(), "secret.txt")
+    os.WriteFile(path, []byte("alice's secret"), 0600)
+    file, err := os.Open(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+    data := &datamgmt.Data{ID: "1", Filename: "secret", Extension: "txt", OriginID: "someone-else", Bucket: "private"}
+    if err := alice.syncData("127.0.0.1:3383", data, file); err != nil {
+        t.Fatalf("syncData() error = %v", err)
+    }
+    if acl, err := node.storage.ACL(data); err != nil || acl.Owner != "client:alice" {
+        t.Fatalf("Expected alice to own the file whatever origin is claimed, got %+v, %v", acl, err)
+    }
+
+    if _, err := bob.fetchRange("127.0.0.1:3383", data, 0, 5); !denied(err) {
+        t.Errorf("Expected bob's read to be denied, got %v", err)
+    }
+    if buckets, err := bob.requestBuckets("127.0.0.1:3383"); err != nil || len(buckets) != 0 {
+        t.Errorf("Expected bob to see no buckets, got %+v, %v", buckets, err)
+    }
+    if report, err := bob.requestUsage("127.0.0.1:3383"); err != nil || len(report.Origins) != 0 || len(report.Namespaces) != 0 || len(report.Buckets) != 0 {
+        t.Errorf("Expected bob to see no usage but bob's own, got %+v, %v", report, err)
+    }
+    if report, err := alice.requestUsage("127.0.0.1:3383"); err != nil || report.Origins["client:alice"].Bytes == 0 || len(report.Origins) != 1 {
+        t.Errorf("Expected alice's usage alone, got %+v, %v", report, err)
+    }
+    grants := &datamgmt.Data{Bucket: "private", ACL: &datamgmt.ACL{Grants: map[string][]datamgmt.Permission{"client:bob": {datamgmt.PermRead}}}}
+    if err := bob.requestSetACL("127.0.0.1:3383", grants); !denied(err) {
+        t.Errorf("Expected bob to be unable to grant bob access, got %v", err)
+    }
+    if err := alice.requestSetACL("127.0.0.1:3383", grants); err != nil {
+        t.Fatalf("set-acl error = %v", err)
+    }
+
+    if content, err := bob.fetchRange("127.0.0.1:3383", data, 0, 5); err != nil || string(content) != "alice" {
+        t.Errorf("Expected bob to read the file once granted, got %q, %v", content, err)
+    }
+    if _, err := bob.requestVersions("127.0.0.1:3383", data); !denied(err) {
+        t.Errorf("Expected bob's listing to be denied, got %v", err)
+    }
+    if err := bob.requestBucketChange("127.0.0.1:3383", &datamgmt.Data{Command: "delete-bucket", Bucket: "private"}); !denied(err) {
+        t.Errorf("Expected bob's delete-bucket to be denied, got %v", err)
+    }
+
+    // A client cannot pass off a write as forwarded by a peer to create a bucket with
+    // settings of its choosing.
+    forged := &datamgmt.Data{ID: "1", Filename: "claim", Extension: "txt", Bucket: "shared", Forwarded: true,
+        Settings: &datamgmt.Bucket{Name: "shared", Versioned: true, ACL: datamgmt.ACL{Owner: "client:alice"}}}
+    file.Seek(0, 0)
+    if err := bob.syncData("127.0.0.1:3383", forged, file); err == nil || !strings.Contains(err.Error(), errNoSuchBucket.Error()) {
+        t.Errorf("Expected bob's forwarded write to a missing bucket to be refused, got %v", err)
+    }
+    if _, err := node.storage.Bucket("shared"); !errors.Is(err, errNoSuchBucket) {
+        t.Errorf("Expected no bucket to be created from bob's settings, got %v", err)
+    }
+}
+
+func TestServer_DeletedFileKeepsACL(t *testing.T) {
+    node := startTestServer(t, "127.0.0.1:3393", nil, func(node *Server) {
+        node.credentials = &Credentials{Clients: map[string]string{"alice": "alice-token", "bob": "bob-token"}}
+    })
+    alice, bob := testClient(t, "alice-token"), testClient(t, "bob-token")
+    denied := func(err error) bool {
+        var rejected *peerError
+        return errors.As(err, &rejected) && strings.Contains(err.Error(), errAccessDenied.Error())
+    }
+
+    path := filepath.Join(t.TempDir(), "diary.txt")
+    os.WriteFile(path, []byte("alice's diary"), 0600)
+    file, err := os.Open(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+    data := &datamgmt.Data{ID: "1", Filename: "diary", Extension: "txt"}
+    if err := alice.syncData("127.0.0.1:3393", data, file); err != nil {
+        t.Fatalf("syncData() error = %v", err)
+    }
+    versions, err := alice.requestVersions("127.0.0.1:3393", data)
+    if err != nil || len(versions) != 1 {
+        t.Fatalf("requestVersions() = %+v, %v", versions, err)
+    }
+    deleted := *data
+    deleted.OriginID = "client:alice"
+    if err := node.storage.DeleteData(&deleted); err != nil {
+        t.Fatalf("DeleteData() error = %v", err)
+    }
+
+    // The tombstone keeps alice's ACL, so the older version and the name stay hers.
+    archived := *data
+    archived.Version = versions[0].VersionID
+    if _, err := bob.fetchRange("127.0.0.1:3393", &archived, 0, 5); !denied(err) {
+        t.Errorf("Expected bob's read of the deleted file's older version to be denied, got %v", err)
+    }
+    if _, err := bob.requestVersions("127.0.0.1:3393", data); !denied(err) {
+        t.Errorf("Expected bob's listing of the deleted file to be denied, got %v", err)
+    }
+    write := *data
+    write.Command = "send"
+    if response, err := bob.request("127.0.0.1:3393", &write); !denied(err) {
+        if err == nil {
+            response.Close()
+        }
+        t.Errorf("Expected bob's write to the deleted file's name to be denied, got %v", err)
+    }
+    latest, _ := node.storage.generateFilePath(data)
+    if manifest, err := node.storage.loadManifest(latest); err != nil || !manifest.Deleted || manifest.ACL.Owner != "client:alice" {
+        t.Errorf("Expected alice's tombstone to remain, got %+v, %v", manifest, err)
+    }
+    if content, err := alice.fetchRange("127.0.0.1:3393", &archived, 0, 5); err != nil || string(content) != "alice" {
+        t.Errorf("Expected alice to read the older version, got %q, %v", content, err)
+    }
+}
+
+func TestServer_ListGrantCannotClaimChunks(t *testing.T) {
+    node := startTestServer(t, "127.0.0.1:3394", nil, func(node *Server) {
+        node.credentials = &Credentials{Clients: map[string]string{"alice": "alice-token", "bob": "bob-token"}}
+    })
+    alice, bob := testClient(t, "alice-token"), testClient(t, "bob-token")
+
+    path := filepath.Join(t.TempDir(), "pin.txt")
+    os.WriteFile(path, []byte("alice's pin"), 0600)
+    file, err := os.Open(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+    data := &datamgmt.Data{ID: "1", Filename: "pin", Extension: "txt"}
+    if err := alice.syncData("127.0.0.1:3394", data, file); err != nil {
+        t.Fatalf("syncData() error = %v", err)
+    }
+    grant := *data
+    grant.ACL = &datamgmt.ACL{Grants: map[string][]datamgmt.Permission{"client:bob": {datamgmt.PermList}}}
+    if err := alice.requestSetACL("127.0.0.1:3394", &grant); err != nil {
+        t.Fatalf("set-acl error = %v", err)
+    }
+
+    // The checksum of a file of one chunk is the chunk's hash, so only readers are told it.
+    if versions, err := bob.requestVersions("127.0.0.1:3394", data); err != nil || len(versions) != 1 || versions[0].Checksum != "" {
+        t.Errorf("Expected bob to list the version without its checksum, got %+v, %v", versions, err)
+    }
+    versions, err := alice.requestVersions("127.0.0.1:3394", data)
+    if err != nil || len(versions) != 1 || versions[0].Checksum == "" {
+        t.Fatalf("Expected alice to be told the checksum, got %+v, %v", versions, err)
+    }
+
+    // A chunk of alice's file counts as stored for her file alone, or for a trusted peer.
+    refs := []datamgmt.ChunkRef{{Hash: versions[0].Checksum, Size: versions[0].Size}}
+    claim := &datamgmt.Data{ID: "1", Filename: "claim", Extension: "txt", OriginID: "client:bob"}
+    if missing, err := node.storage.MissingChunks(claim, refs, false); err != nil || len(missing) != 1 {
+        t.Errorf("Expected bob to have to send the chunk, got %v, %v", missing, err)
+    }
+    if missing, err := node.storage.MissingChunks(data, refs, false); err != nil || len(missing) != 0 {
+        t.Errorf("Expected alice's own file to reuse its chunk, got %v, %v", missing, err)
+    }
+    if missing, err := node.storage.MissingChunks(claim, refs, true); err != nil || len(missing) != 0 {
+        t.Errorf("Expected a trusted peer to reuse the chunk, got %v, %v", missing, err)
+    }
+}
+
+func TestServer_RejectsPathTraversal(t *testing.T) {
+    node := startTestServer(t, "127.0.0.1:3389", nil, func(node *Server) {
+        node.credentials = &Credentials{Clients: map[string]string{"alice": "alice-token", "bob": "bob-token"}}
+    })
+    alice, bob := testClient(t, "alice-token"), testClient(t, "bob-token")
+    for _, request := range []struct {
+        owner  *Server
+        bucket string
+    }{{alice, "private"}, {bob, "bobs"}} {
+        bucket := &datamgmt.Data{Command: "create-bucket", Bucket: request.bucket, Settings: &datamgmt.Bucket{Versioned: true}}
+        if err := request.owner.requestBucketChange("127.0.0.1:3389", bucket); err != nil {
+            t.Fatalf("create-bucket error = %v", err)
+        }
+    }
+    path := filepath.Join(t.TempDir(), "secret.txt")
+    os.WriteFile(path, []byte("alice's secret"), 0600)
+    file, err := os.Open(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+    secret := &datamgmt.Data{ID: "1", Filename: "secret", Extension: "txt", Bucket: "private"}
+    if err := alice.syncData("127.0.0.1:3389", secret, file); err != nil {
+        t.Fatalf("syncData() error = %v", err)
+    }
+
+    // Access to bob's own bucket does not reach alice's through it.
+    for _, command := range []string{"fetch", "send", "delete"} {
+        traversal := &datamgmt.Data{Command: command, ID: "1", Filename: "../private/secret", Extension: "txt", Bucket: "bobs"}
+        response, err := bob.request("127.0.0.1:3389", traversal)
+        if err == nil {
+            response.Close()
+        }
+        if err == nil || !strings.Contains(err.Error(), errInvalidFileName.Error()) {
+            t.Errorf("%s: expected the traversal to be refused, got %v", command, err)
+        }
+    }
+    if content := readStored(t, node.storage, secret); string(content) != "alice's secret" {
+        t.Errorf("Expected alice's file to be untouched, got %q", content)
+    }
+}
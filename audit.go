@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/logger"
+)
+
+// A node can keep an audit log of who ran every command it handled, apart from its
+// operational log. The log is only ever appended to, one JSON entry per line, and each
+// entry carries the hash of the entry before it and a hash of its own content, so changing,
+// inserting or removing an entry breaks the chain from that entry on. Removing entries from
+// the end cannot be told from the log alone, so verification reports the hash of the last
+// entry, to be compared with one noted down earlier.
+
+const auditLineLimit = 1 << 20
+
+var errAuditChain = errors.New("audit log chain broken")
+
+// AuditEntry records one command a node handled.
+type AuditEntry struct {
+    Sequence uint64 // Position in the log, starting at 1
+    Time     time.Time
+    Identity string // Authenticated caller, empty if it failed to authenticate
+    Command  string
+    Object   string // File or bucket the command acted on, if any
+    BytesIn  int64  // Bytes read from the caller for the command, as sent on the wire
+    BytesOut int64  // Bytes written to the caller for the command, as sent on the wire
+    Result   string // "ok", or the error the command failed with
+    Remote   string // Address the command came from
+    Previous string // Hash of the entry before, empty for the first
+    Hash     string
+}
+
+// digest returns the hash of the entry's content, leaving out its own hash.
+func (e *AuditEntry) digest() (string, error) {
+    entry := *e
+    entry.Hash = ""
+    content, err := json.Marshal(&entry)
+    if err != nil {
+        return "", err
+    }
+    sum := sha256.Sum256(content)
+    return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditLog appends entries to an audit log file.
+type AuditLog struct {
+    mutex    sync.Mutex
+    path     string
+    file     *os.File
+    sequence uint64 // Sequence of the last entry
+    last     string // Hash of the last entry
+}
+
+// OpenAuditLog opens the audit log at path, creating it if it does not exist, to append
+// entries after the last one in it.
+func OpenAuditLog(path string) (*AuditLog, error) {
+    log := &AuditLog{path: path}
+    last, err := lastAuditEntry(path)
+    if err != nil && !errors.Is(err, fs.ErrNotExist) {
+        return nil, err
+    }
+    if last != nil {
+        log.sequence, log.last = last.Sequence, last.Hash
+    }
+    if log.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+        return nil, err
+    }
+    return log, nil
+}
+
+// Record completes entry with its place in the chain and appends it to the log.
+func (a *AuditLog) Record(entry *AuditEntry) error {
+    a.mutex.Lock()
+    defer a.mutex.Unlock()
+
+    entry.Sequence, entry.Previous = a.sequence+1, a.last
+    entry.Time = time.Now().UTC()
+    hash, err := entry.digest()
+    if err != nil {
+        return err
+    }
+    entry.Hash = hash
+    line, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+    if _, err := a.file.Write(append(line, '\n')); err != nil {
+        return err
+    }
+    if err := a.file.Sync(); err != nil {
+        return err
+    }
+    a.sequence, a.last = entry.Sequence, entry.Hash
+    return nil
+}
+
+// Verify checks the chain of the log, returning how many entries it holds and the hash of
+// the last one.
+func (a *AuditLog) Verify() (uint64, string, error) {
+    a.mutex.Lock()
+    defer a.mutex.Unlock()
+    return VerifyAuditLog(a.path)
+}
+
+func (a *AuditLog) Close() error {
+    a.mutex.Lock()
+    defer a.mutex.Unlock()
+    return a.file.Close()
+}
+
+// VerifyAuditLog checks that every entry of the audit log at path follows the one before
+// it and is unchanged, returning how many entries it holds and the hash of the last one.
+func VerifyAuditLog(path string) (uint64, string, error) {
+    var sequence uint64
+    var last string
+    err := scanAuditLog(path, func(entry *AuditEntry, err error) error {
+        sequence++
+        if err != nil {
+            return fmt.Errorf("%w: entry %d cannot be read: %v", errAuditChain, sequence, err)
+        }
+        if entry.Sequence != sequence {
+            return fmt.Errorf("%w: entry %d has sequence %d", errAuditChain, sequence, entry.Sequence)
+        }
+        if entry.Previous != last {
+            return fmt.Errorf("%w: entry %d does not follow the entry before it", errAuditChain, sequence)
+        }
+        if hash, err := entry.digest(); err != nil || hash != entry.Hash {
+            return fmt.Errorf("%w: entry %d was altered", errAuditChain, sequence)
+        }
+        last = entry.Hash
+        return nil
+    })
+    if err != nil {
+        return 0, "", err
+    }
+    return sequence, last, nil
+}
+
+// lastAuditEntry returns the last entry of the audit log at path, or nil if it is empty.
+func lastAuditEntry(path string) (*AuditEntry, error) {
+    var last *AuditEntry
+    err := scanAuditLog(path, func(entry *AuditEntry, err error) error {
+        last = entry
+        return err
+    })
+    return last, err
+}
+
+// scanAuditLog calls visit with each entry of the audit log at path, or the error decoding
+// it, stopping at the first error visit returns.
+func scanAuditLog(path string, visit func(*AuditEntry, error) error) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    scanner := bufio.NewScanner(file)
+    scanner.Buffer(nil, auditLineLimit)
+    for scanner.Scan() {
+        var entry AuditEntry
+        err := json.Unmarshal(scanner.Bytes(), &entry)
+        if err := visit(&entry, err); err != nil {
+            return err
+        }
+    }
+    return scanner.Err()
+}
+
+// auditObject names the file or bucket a command acted on, if any.
+func auditObject(data *datamgmt.Data) string {
+    if data.Filename == "" && data.Bucket == "" {
+        return ""
+    }
+    return aclTarget(data)
+}
+
+// countingConn counts the bytes read from and written to a connection, so the audit log
+// can record how much each command transferred.
+type countingConn struct {
+    net.Conn
+    read    atomic.Int64
+    written atomic.Int64
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+    n, err := c.Conn.Read(p)
+    c.read.Add(int64(n))
+    return n, err
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+    n, err := c.Conn.Write(p)
+    c.written.Add(int64(n))
+    return n, err
+}
+
+// auditCommand records a command in the audit log, if the node keeps one, as received and
+// with the error its handler returned. Handlers may reuse data for their replies, so the
+// command is passed as it was read. The bytes it transferred are those counted on conn
+// since read and written were taken.
+func (s *Server) auditCommand(identity, command string, data *datamgmt.Data, cause error, conn *countingConn, read, written int64) {
+    if s.audit == nil {
+        return
+    }
+    entry := &AuditEntry{
+        Identity: identity,
+        Command:  command,
+        Object:   auditObject(data),
+        BytesIn:  conn.read.Load() - read,
+        BytesOut: conn.written.Load() - written,
+        Result:   "ok",
+        Remote:   conn.RemoteAddr().String(),
+    }
+    if cause != nil {
+        entry.Result = cause.Error()
+    }
+    if err := s.audit.Record(entry); err != nil {
+        logger.Log.WithError(err).Error("Failed to record command in audit log")
+    }
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+)
+
+func TestAuditLog_Verify(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "audit.log")
+    audit, err := OpenAuditLog(path)
+    if err != nil {
+        t.Fatalf("OpenAuditLog() error = %v", err)
+    }
+    for _, command := range []string{"send", "fetch"} {
+        if err := audit.Record(&AuditEntry{Identity: "client:alice", Command: command, Result: "ok"}); err != nil {
+            t.Fatalf("Record() error = %v", err)
+        }
+    }
+    audit.Close()
+
+    // A reopened log continues the chain.
+    if audit, err = OpenAuditLog(path); err != nil {
+        t.Fatalf("OpenAuditLog() error = %v", err)
+    }
+    if err := audit.Record(&AuditEntry{Identity: "client:bob", Command: "delete", Result: "ok"}); err != nil {
+        t.Fatalf("Record() error = %v", err)
+    }
+    audit.Close()
+    entries, last, err := VerifyAuditLog(path)
+    if err != nil || entries != 3 || last == "" {
+        t.Fatalf("VerifyAuditLog() = %d, %q, %v, expected 3 intact entries", entries, last, err)
+    }
+
+    content, _ := os.ReadFile(path)
+    lines := strings.SplitAfter(string(content), "\n")
+    for name, tampered := range map[string]string{
+        "altered":   lines[0] + strings.Replace(lines[1], "client:alice", "client:bob", 1) + lines[2],
+        "removed":   lines[0] + lines[2],
+        "reordered": lines[1] + lines[0] + lines[2],
+    } {
+        os.WriteFile(path, []byte(tampered), 0600)
+        if _, _, err := VerifyAuditLog(path); !errors.Is(err, errAuditChain) {
+            t.Errorf("%s: expected a broken chain, got %v", name, err)
+        }
+    }
+}
+
+func TestServer_Audit(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "audit.log")
+    audit, err := OpenAuditLog(path)
+    if err != nil {
+        t.Fatalf("OpenAuditLog() error = %v", err)
+    }
+    // The node closes the audit log when it shuts down.
+    startTestServer(t, "127.0.0.1:3385", nil, func(node *Server) {
+        node.credentials = &Credentials{Clients: map[string]string{"alice": "alice-token"}}
+        node.audit = audit
+    })
+    alice, stranger := testClient(t, "alice-token"), testClient(t, "")
+
+    source := filepath.Join(t.TempDir(), "notes.txt")
+    os.WriteFile(source, []byte("meeting notes"), 0600)
+    file, err := os.Open(source)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+    data := &datamgmt.Data{ID: "1", Filename: "notes", Extension: "txt"}
+    if err := alice.syncData("127.0.0.1:3385", data, file); err != nil {
+        t.Fatalf("syncData() error = %v", err)
+    }
+    var fetched bytes.Buffer
+    if _, err := alice.fetchInto("127.0.0.1:3385", data, 0, &fetched); err != nil || fetched.String() != "meeting notes" {
+        t.Fatalf("fetchInto() = %q, %v", fetched.String(), err)
+    }
+    // A delete gets no reply, so its failure only shows in the audit log.
+    purge := *data
+    purge.Command, purge.Version = "delete", "no-such-version"
+    conn, err := alice.sendCommand("127.0.0.1:3385", &purge)
+    if err != nil {
+        t.Fatalf("sendCommand() error = %v", err)
+    }
+    conn.Close()
+    if _, err := stranger.requestUsage("127.0.0.1:3385"); err == nil {
+        t.Fatalf("Expected a caller without credentials to be refused")
+    }
+
+    // Entries are recorded once the reply is sent, so wait for them.
+    find := func(match func(*AuditEntry) bool) *AuditEntry {
+        for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+            var found *AuditEntry
+            audit.mutex.Lock()
+            scanAuditLog(path, func(entry *AuditEntry, err error) error {
+                if err == nil && match(entry) {
+                    found = entry
+                }
+                return err
+            })
+            audit.mutex.Unlock()
+            if found != nil {
+                return found
+            }
+        }
+        return nil
+    }
+    synced := find(func(entry *AuditEntry) bool { return entry.Command == "sync" })
+    if synced == nil || synced.Identity != "client:alice" || synced.Object != data.Key() || synced.Result != "ok" || synced.BytesIn == 0 || synced.Remote == "" {
+        t.Errorf("Expected alice's sync to be recorded, got %+v", synced)
+    }
+    // The fetch is recorded as received, not as the download it is answered with.
+    download := find(func(entry *AuditEntry) bool { return entry.Command == "fetch" })
+    if download == nil || download.Identity != "client:alice" || download.Object != data.Key() || download.Result != "ok" || download.BytesOut == 0 {
+        t.Errorf("Expected alice's fetch to be recorded, got %+v", download)
+    }
+    failed := find(func(entry *AuditEntry) bool { return entry.Command == "delete" })
+    if failed == nil || failed.Identity != "client:alice" || !strings.Contains(failed.Result, "invalid version ID") {
+        t.Errorf("Expected alice's failed delete to be recorded with its error, got %+v", failed)
+    }
+    refused := find(func(entry *AuditEntry) bool { return entry.Command == "authenticate" })
+    if refused == nil || refused.Identity != "" || refused.Result != errUnauthenticated.Error() {
+        t.Errorf("Expected the refused connection to be recorded, got %+v", refused)
+    }
+    if _, _, err := audit.Verify(); err != nil {
+        t.Errorf("Verify() error = %v", err)
+    }
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/encryption"
+	"github.com/tejasprabhu/GopherStore/logger"
+	"github.com/tejasprabhu/GopherStore/p2p"
+)
+
+// Every connection opens with a handshake before any command is sent. The node sends a
+// challenge, and if it requires authentication the caller challenges it back, so the node
+// proves its node key first and the caller knows whom it is about to present credentials
+// to. Every proof covers the handshake transcript, both sides' nonces, ephemeral keys and
+// node keys, so it is only valid in the handshake it was made in. Both sides then derive
+// session keys from their ephemeral keys and the transcript, and the rest of the handshake
+// and every command after it are encrypted and authenticated with them. Someone relaying a
+// handshake between two nodes therefore cannot read or inject anything on the connection it
+// authenticated, and no one on the path can take it over. A node only proves its own node
+// key to the nodes it trusts and never sends its API token to another node; a client
+// answers with its token. The node replies with the identity it authenticated the caller as,
+// or refuses it and closes the connection. Clients are identified by the name their token
+// is registered under, and peers by their node ID, which the node must trust. A client that
+// trusts no node key cannot tell the node from someone in the middle, and a node that does
+// not require authentication sets up no session keys at all.
+
+const (
+	authTimeout    = 10 * time.Second
+	authFrameLimit = 4 << 10 // Largest handshake message read, so nothing large is buffered before authentication
+)
+
+// tokenEnv is the environment variable holding the API token the node authenticates to
+// peers with.
+const tokenEnv = "GOPHERSTORE_TOKEN"
+
+var (
+	errUnauthenticated = errors.New("authentication failed")
+	errUntrustedNode   = errors.New("node is not trusted, not presenting credentials")
+)
+
+// Credentials are the API tokens of the clients a node serves, by client name, and the
+// IDs of the peer nodes it trusts.
+type Credentials struct {
+    Clients map[string]string
+    Peers   []string
+}
+
+// LoadCredentials reads a credentials file.
+func LoadCredentials(path string) (*Credentials, error) {
+    content, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var credentials Credentials
+    if err := json.Unmarshal(content, &credentials); err != nil {
+        return nil, fmt.Errorf("invalid credentials: %w", err)
+    }
+    for name, token := range credentials.Clients {
+        if token == "" {
+            return nil, fmt.Errorf("client %q has no token", name)
+        }
+    }
+    for _, peer := range credentials.Peers {
+        if _, err := p2p.ParseNodeID(peer); err != nil {
+            return nil, fmt.Errorf("invalid peer node ID %q: %w", peer, err)
+        }
+    }
+    return &credentials, nil
+}
+
+// client returns the name a token is registered under. Every token is compared, in
+// constant time, so the time taken reveals nothing about them.
+func (c *Credentials) client(token string) (string, bool) {
+    presented := sha256.Sum256([]byte(token))
+    var found string
+    for name, registered := range c.Clients {
+        expected := sha256.Sum256([]byte(registered))
+        if subtle.ConstantTimeCompare(presented[:], expected[:]) == 1 {
+            found = name
+        }
+    }
+    return found, found != ""
+}
+
+func (c *Credentials) trusts(id p2p.NodeID) bool {
+    for _, peer := range c.Peers {
+        if parsed, err := p2p.ParseNodeID(peer); err == nil && parsed == id {
+            return true
+        }
+    }
+    return false
+}
+
+// Clients authenticate as "client:<name>" and peers as "node:<node ID>".
+const (
+	clientPrefix = "client:"
+	peerPrefix   = "node:"
+)
+
+func clientIdentity(name string) string { return clientPrefix + name }
+func peerIdentity(id p2p.NodeID) string { return peerPrefix + id.String() }
+
+// anonymous is the identity of callers of a node that does not require authentication.
+const anonymous = "anonymous"
+
+// authChallenge opens every connection. Callers only answer it if Required is set, first
+// with a challenge of their own, which carries their public node key if they have one.
+type authChallenge struct {
+    Required  bool
+    Ephemeral []byte
+    Nonce     []byte
+    PublicKey []byte
+}
+
+// nodeProof answers a caller's challenge with the node's public node key and the proof that
+// it holds the private one, or with neither if the node has no node key.
+type nodeProof struct {
+    PublicKey []byte
+    Proof     []byte
+}
+
+// authResponse holds a caller's credentials: an API token, its public node key with the
+// proof that it holds the private one, or a capability token.
+type authResponse struct {
+    Token      string
+    PublicKey  []byte
+    Proof      []byte
+    Capability string
+}
+
+// caller is who a connection was authenticated as, and the capability it presented if it
+// is only allowed what the capability grants.
+type caller struct {
+    identity   string
+    capability *Capability
+}
+
+// authResult tells the caller who it was authenticated as, or why it was refused.
+type authResult struct {
+    Identity string
+    Error    string
+}
+
+// Handshake transcripts are computed for each use, so a proof made for one cannot stand in
+// for another.
+const (
+	nodeProofRole   = "node proof"
+	callerProofRole = "caller proof"
+	sessionRole     = "session"
+)
+
+// handshakeTranscript hashes what both sides of a handshake sent for the use named by role:
+// the node's challenge, the caller's, and the public node key the node proved, if any.
+func handshakeTranscript(role string, challenge, counter *authChallenge, nodePublic []byte) []byte {
+    return encryption.Transcript([]byte(role), challenge.Ephemeral, challenge.Nonce, counter.Ephemeral, counter.Nonce, counter.PublicKey, nodePublic)
+}
+
+// secureChannel wraps conn in a channel keyed by the session keys of a handshake, on the
+// node's side of it if node is set and the caller's otherwise.
+func secureChannel(conn net.Conn, challenge *encryption.Challenge, peerEphemeral, transcript []byte, node bool) (net.Conn, error) {
+    keys, err := challenge.SessionKeys(peerEphemeral, transcript, "caller to node", "node to caller")
+    if err != nil {
+        return nil, err
+    }
+    if node {
+        return encryption.NewSecureConn(conn, keys[1], keys[0])
+    }
+    return encryption.NewSecureConn(conn, keys[0], keys[1])
+}
+
+// authenticate runs the node's side of the handshake on a new connection and returns who
+// the caller is, along with the connection to serve it on.
+func (s *Server) authenticate(conn net.Conn) (*caller, net.Conn, error) {
+    if err := conn.SetDeadline(time.Now().Add(authTimeout)); err != nil {
+        return nil, nil, err
+    }
+    defer conn.SetDeadline(time.Time{})
+
+    if s.credentials == nil {
+        return &caller{identity: anonymous}, conn, datamgmt.SendEncodedData(conn, &authChallenge{})
+    }
+    challenge, err := encryption.NewChallenge()
+    if err != nil {
+        return nil, nil, err
+    }
+    sent := &authChallenge{Required: true, Ephemeral: challenge.Ephemeral, Nonce: challenge.Nonce}
+    if err := datamgmt.SendEncodedData(conn, sent); err != nil {
+        return nil, nil, err
+    }
+    var counter authChallenge
+    if err := datamgmt.ReadLimitedEncodedData(conn, &counter, authFrameLimit); err != nil {
+        return nil, nil, err
+    }
+    var proof nodeProof
+    if s.nodeKey != nil {
+        public, mac, err := encryption.Prove(s.nodeKey, counter.Ephemeral, handshakeTranscript(nodeProofRole, sent, &counter, s.publicKey))
+        if err != nil {
+            return nil, nil, err
+        }
+        proof = nodeProof{PublicKey: public, Proof: mac}
+    }
+    if err := datamgmt.SendEncodedData(conn, &proof); err != nil {
+        return nil, nil, err
+    }
+    secured, err := secureChannel(conn, challenge, counter.Ephemeral, handshakeTranscript(sessionRole, sent, &counter, s.publicKey), true)
+    if err != nil {
+        return nil, nil, err
+    }
+    var response authResponse
+    if err := datamgmt.ReadLimitedEncodedData(secured, &response, authFrameLimit); err != nil {
+        return nil, nil, err
+    }
+
+    authenticated, err := s.verifyCredentials(challenge, &counter, handshakeTranscript(callerProofRole, sent, &counter, s.publicKey), &response)
+    var result authResult
+    if err != nil {
+        result.Error = err.Error()
+    } else {
+        result.Identity = authenticated.identity
+    }
+    if sendErr := datamgmt.SendEncodedData(secured, &result); sendErr != nil && err == nil {
+        return nil, nil, sendErr
+    }
+    return authenticated, secured, err
+}
+
+// verifyCredentials returns who a caller's credentials prove it is, preferring its node
+// key to its token, and its token to a capability. A node key proof must be for the key the
+// caller announced in its challenge, and made over this handshake's transcript.
+func (s *Server) verifyCredentials(challenge *encryption.Challenge, counter *authChallenge, transcript []byte, response *authResponse) (*caller, error) {
+    if response.PublicKey != nil && bytes.Equal(response.PublicKey, counter.PublicKey) && challenge.Verify(response.PublicKey, response.Proof, transcript) {
+        if id := nodeIDFor(response.PublicKey); s.credentials.trusts(id) {
+            return &caller{identity: peerIdentity(id)}, nil
+        }
+    }
+    if response.Token != "" {
+        if name, ok := s.credentials.client(response.Token); ok {
+            return &caller{identity: clientIdentity(name)}, nil
+        }
+    }
+    if response.Capability != "" {
+        capability, err := s.verifyCapability(response.Capability)
+        if err != nil {
+            return nil, fmt.Errorf("%w: %v", errUnauthenticated, err)
+        }
+        return &caller{identity: capabilityIdentity(capability), capability: capability}, nil
+    }
+    return nil, errUnauthenticated
+}
+
+// dial connects to a peer and authenticates to it with the node's credentials.
+func (s *Server) dial(address string) (net.Conn, error) {
+    return s.dialWith(address, "")
+}
+
+// dialWith connects to a peer and authenticates to it, with a capability token in place of
+// the node's credentials if one is given.
+func (s *Server) dialWith(address, capability string) (net.Conn, error) {
+    conn, err := s.transport.Dial(address)
+    if err != nil {
+        return nil, err
+    }
+    conn = s.limiter.throttle(conn, s.quit)
+    secured, err := s.answerChallenge(conn, capability)
+    if err != nil {
+        conn.Close()
+        logger.Log.WithError(err).WithField("address", address).Error("Failed to authenticate")
+        return nil, err
+    }
+    return secured, nil
+}
+
+// answerChallenge runs the caller's side of the handshake and returns the connection to
+// send commands on. Once the node has proved its node key, if it has one, the caller answers
+// with the capability if one is given, and otherwise with the credentials it presents to
+// that node.
+func (s *Server) answerChallenge(conn net.Conn, capability string) (net.Conn, error) {
+    if err := conn.SetDeadline(time.Now().Add(authTimeout)); err != nil {
+        return nil, err
+    }
+    defer conn.SetDeadline(time.Time{})
+
+    var challenge authChallenge
+    if err := datamgmt.ReadLimitedEncodedData(conn, &challenge, authFrameLimit); err != nil {
+        return nil, err
+    }
+    if !challenge.Required {
+        return conn, nil
+    }
+    counter, err := encryption.NewChallenge()
+    if err != nil {
+        return nil, err
+    }
+    sent := &authChallenge{Ephemeral: counter.Ephemeral, Nonce: counter.Nonce, PublicKey: s.publicKey}
+    if err := datamgmt.SendEncodedData(conn, sent); err != nil {
+        return nil, err
+    }
+    var proof nodeProof
+    if err := datamgmt.ReadLimitedEncodedData(conn, &proof, authFrameLimit); err != nil {
+        return nil, err
+    }
+    if proof.PublicKey != nil && !counter.Verify(proof.PublicKey, proof.Proof, handshakeTranscript(nodeProofRole, &challenge, sent, proof.PublicKey)) {
+        return nil, fmt.Errorf("%w: node failed to prove its node key", errUnauthenticated)
+    }
+    secured, err := secureChannel(conn, counter, challenge.Ephemeral, handshakeTranscript(sessionRole, &challenge, sent, proof.PublicKey), false)
+    if err != nil {
+        return nil, err
+    }
+
+    if capability != "" {
+        return secured, exchangeCredentials(secured, &authResponse{Capability: capability})
+    }
+    response, err := s.credentialsFor(&challenge, sent, proof.PublicKey)
+    if err != nil {
+        return nil, err
+    }
+    return secured, exchangeCredentials(secured, response)
+}
+
+// credentialsFor returns what the node presents to the node that proved it holds the node
+// key behind public, nil if it holds none. A node with a node key only proves it to the
+// nodes it trusts, and never sends them its API token. A client sends its token, but only to
+// the nodes it trusts if it has credentials naming any.
+func (s *Server) credentialsFor(challenge, counter *authChallenge, public []byte) (*authResponse, error) {
+    trusted := public != nil && s.credentials != nil && s.credentials.trusts(nodeIDFor(public))
+    if s.nodeKey != nil {
+        if !trusted {
+            return nil, errUntrustedNode
+        }
+        proven, proof, err := encryption.Prove(s.nodeKey, challenge.Ephemeral, handshakeTranscript(callerProofRole, challenge, counter, public))
+        if err != nil {
+            return nil, err
+        }
+        return &authResponse{PublicKey: proven, Proof: proof}, nil
+    }
+    if s.credentials != nil && len(s.credentials.Peers) > 0 && !trusted {
+        return nil, errUntrustedNode
+    }
+    return &authResponse{Token: s.token}, nil
+}
+
+// exchangeCredentials sends a caller's credentials and reads whether they were accepted.
+func exchangeCredentials(conn net.Conn, response *authResponse) error {
+    if err := datamgmt.SendEncodedData(conn, response); err != nil {
+        return err
+    }
+    var result authResult
+    if err := datamgmt.ReadLimitedEncodedData(conn, &result, authFrameLimit); err != nil {
+        return err
+    }
+    if result.Error != "" {
+        return &peerError{message: result.Error}
+    }
+    return nil
+}
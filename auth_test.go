@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/encryption"
+)
+
+func TestLoadCredentials(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "auth.json")
+    os.WriteFile(path, []byte(`{"Clients": {"alice": "secret"}, "Peers": ["not a node ID"]}`), 0600)
+    if _, err := LoadCredentials(path); err == nil {
+        t.Errorf("Expected an invalid peer node ID to be rejected")
+    }
+
+    os.WriteFile(path, []byte(`{"Clients": {"alice": "secret", "bob": "other"}}`), 0600)
+    credentials, err := LoadCredentials(path)
+    if err != nil {
+        t.Fatalf("LoadCredentials() error = %v", err)
+    }
+    if name, ok := credentials.client("other"); !ok || name != "bob" {
+        t.Errorf("Expected the token of bob, got %q", name)
+    }
+    if _, ok := credentials.client("guess"); ok {
+        t.Errorf("Expected an unknown token to be rejected")
+    }
+}
+
+func TestServer_Authentication(t *testing.T) {
+    nodeKey, _ := encryption.GenerateKey()
+    nodePublic, _ := encryption.PublicKey(nodeKey)
+    caller := func(token string, nodeKey []byte, trusted ...string) *Server {
+        server := testClient(t, token)
+        if nodeKey != nil {
+            if err := server.useNodeKey(nodeKey); err != nil {
+                t.Fatalf("useNodeKey() error = %v", err)
+            }
+        }
+        if trusted != nil {
+            server.credentials = &Credentials{Peers: trusted}
+        }
+        return server
+    }
+    nodeID := nodeIDFor(nodePublic).String()
+    trustedKey, _ := encryption.GenerateKey()
+    untrustedKey, _ := encryption.GenerateKey()
+    trusted := caller("", trustedKey, nodeID)
+    startTestServer(t, "127.0.0.1:3382", nil, func(node *Server) {
+        if err := node.useNodeKey(nodeKey); err != nil {
+            t.Fatalf("useNodeKey() error = %v", err)
+        }
+        node.credentials = &Credentials{
+            Clients: map[string]string{"alice": "secret"},
+            Peers:   []string{trusted.dht.Self().ID.String()},
+        }
+    })
+
+    for _, test := range []struct {
+        name   string
+        caller *Server
+        err    error
+    }{
+        {"no credentials", caller("", nil), errUnauthenticated},
+        {"wrong token", caller("guess", nil), errUnauthenticated},
+        {"client token", caller("secret", nil), nil},
+        {"client trusting the node", caller("secret", nil, nodeID), nil},
+        {"trusted peer", trusted, nil},
+        {"untrusted peer", caller("", untrustedKey, nodeID), errUnauthenticated},
+        // A node authenticates with its node key alone, never its token.
+        {"untrusted peer with a token", caller("secret", untrustedKey, nodeID), errUnauthenticated},
+        // Credentials are only presented to a node the caller trusts.
+        {"peer not trusting the node", caller("", trustedKey), errUntrustedNode},
+        {"client not trusting the node", caller("secret", nil, trusted.dht.Self().ID.String()), errUntrustedNode},
+    } {
+        _, err := test.caller.requestUsage("127.0.0.1:3382")
+        var rejected *peerError
+        switch {
+        case test.err == nil && err != nil:
+            t.Errorf("%s: expected to be served, got %v", test.name, err)
+        case test.err == errUnauthenticated && (!errors.As(err, &rejected) || rejected.message != errUnauthenticated.Error()):
+            t.Errorf("%s: expected to be refused, got %v", test.name, err)
+        case test.err == errUntrustedNode && !errors.Is(err, errUntrustedNode):
+            t.Errorf("%s: expected not to authenticate, got %v", test.name, err)
+        }
+    }
+}
+
+func TestServer_VerifyCredentialsBindsProofToNode(t *testing.T) {
+    node := NewServer("127.0.0.1:0")
+    t.Cleanup(func() { os.RemoveAll(node.storage.rootPath) })
+    nodeKey, _ := encryption.GenerateKey()
+    otherKey, _ := encryption.GenerateKey()
+    peerKey, _ := encryption.GenerateKey()
+    node.useNodeKey(nodeKey)
+    otherPublic, _ := encryption.PublicKey(otherKey)
+    peerPublic, _ := encryption.PublicKey(peerKey)
+    node.credentials = &Credentials{Peers: []string{nodeIDFor(peerPublic).String()}}
+
+    challenge, err := encryption.NewChallenge()
+    if err != nil {
+        t.Fatalf("NewChallenge() error = %v", err)
+    }
+    counterChallenge, _ := encryption.NewChallenge()
+    sent := &authChallenge{Required: true, Ephemeral: challenge.Ephemeral, Nonce: challenge.Nonce}
+    counter := &authChallenge{Ephemeral: counterChallenge.Ephemeral, Nonce: counterChallenge.Nonce, PublicKey: peerPublic}
+    transcript := handshakeTranscript(callerProofRole, sent, counter, node.publicKey)
+
+    // A proof the peer made for another node, or in another role, cannot be passed on to
+    // this one.
+    for _, other := range [][]byte{
+        handshakeTranscript(callerProofRole, sent, counter, otherPublic),
+        handshakeTranscript(nodeProofRole, sent, counter, node.publicKey),
+    } {
+        public, proof, _ := encryption.Prove(peerKey, challenge.Ephemeral, other)
+        if _, err := node.verifyCredentials(challenge, counter, transcript, &authResponse{PublicKey: public, Proof: proof}); !errors.Is(err, errUnauthenticated) {
+            t.Errorf("Expected a proof made for another handshake to be refused, got %v", err)
+        }
+    }
+    public, proof, _ := encryption.Prove(peerKey, challenge.Ephemeral, transcript)
+    if authenticated, err := node.verifyCredentials(challenge, counter, transcript, &authResponse{PublicKey: public, Proof: proof}); err != nil || authenticated.identity != peerIdentity(nodeIDFor(peerPublic)) {
+        t.Errorf("Expected the peer to be authenticated, got %+v, %v", authenticated, err)
+    }
+    // Only the key the caller announced in its challenge may be proved.
+    unannounced := *counter
+    unannounced.PublicKey = otherPublic
+    if _, err := node.verifyCredentials(challenge, &unannounced, transcript, &authResponse{PublicKey: public, Proof: proof}); !errors.Is(err, errUnauthenticated) {
+        t.Errorf("Expected a proof for a key the caller did not announce to be refused, got %v", err)
+    }
+}
+
+func TestServer_AuthenticateRefusesLargeFrames(t *testing.T) {
+    node := NewServer("127.0.0.1:0")
+    t.Cleanup(func() { os.RemoveAll(node.storage.rootPath) })
+    node.credentials = &Credentials{Clients: map[string]string{"alice": "secret"}}
+    local, remote := net.Pipe()
+    defer local.Close()
+    defer remote.Close()
+
+    done := make(chan error, 1)
+    go func() {
+        _, _, err := node.authenticate(local)
+        done <- err
+    }()
+    var challenge authChallenge
+    if err := datamgmt.ReadEncodedData(remote, &challenge); err != nil {
+        t.Fatalf("ReadEncodedData() error = %v", err)
+    }
+    // Only the length prefix is sent: the node must refuse it without waiting for the rest.
+    binary.Write(remote, binary.LittleEndian, uint32(1<<30))
+    if err := <-done; !errors.Is(err, datamgmt.ErrFrameTooLarge) {
+        t.Errorf("Expected an oversized handshake message to be refused, got %v", err)
+    }
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/logger"
+)
+
+// Buckets are named namespaces of files with settings of their own. The settings of a
+// bucket are kept in buckets/<name>.json and its files in a directory of their own, so files
+// in different buckets never collide. A node only accepts writes to buckets created on it,
+// except for copies forwarded by the node replicating a file, which carry the bucket's
+// settings and create the bucket where it is missing.
+
+const bucketDirName = "buckets"
+
+var (
+    errNoSuchBucket   = fmt.Errorf("bucket does not exist: %w", fs.ErrNotExist)
+    errBucketExists   = errors.New("bucket already exists")
+    errBucketNotEmpty = errors.New("bucket is not empty, delete its files first")
+)
+
+func (s *StorageService) bucketPath(name string) string {
+    return filepath.Join(s.rootPath, bucketDirName, name+".json")
+}
+
+// CreateBucket creates a bucket with the given settings.
+func (s *StorageService) CreateBucket(bucket *datamgmt.Bucket) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return s.createBucket(bucket)
+}
+
+// createBucket creates a bucket. The caller must hold the mutex.
+func (s *StorageService) createBucket(bucket *datamgmt.Bucket) error {
+    if err := datamgmt.ValidateBucketName(bucket.Name); err != nil {
+        return err
+    }
+    if _, err := s.loadBucket(bucket.Name); err == nil {
+        return errBucketExists
+    }
+    if bucket.Replicas < 0 || bucket.QuotaBytes < 0 || bucket.QuotaObjects < 0 {
+        return errors.New("bucket settings cannot be negative")
+    }
+    if bucket.Encrypted && s.keys == nil {
+        return errors.New("encrypted buckets need encryption at rest, start the node with a master key")
+    }
+    if bucket.CreatedAt.IsZero() {
+        bucket.CreatedAt = time.Now()
+    }
+    content, err := json.Marshal(bucket)
+    if err != nil {
+        return err
+    }
+    if err := writeFileAtomic(s.bucketPath(bucket.Name), content); err != nil {
+        return err
+    }
+    logger.Log.WithField("bucket", bucket.Name).Info("Bucket created")
+    return nil
+}
+
+// loadBucket reads the settings of a bucket. The caller must hold the mutex.
+func (s *StorageService) loadBucket(name string) (*datamgmt.Bucket, error) {
+    if err := datamgmt.ValidateBucketName(name); err != nil {
+        return nil, err
+    }
+    content, err := os.ReadFile(s.bucketPath(name))
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil, fmt.Errorf("%w: %s", errNoSuchBucket, name)
+    }
+    if err != nil {
+        return nil, err
+    }
+    var bucket datamgmt.Bucket
+    if err := json.Unmarshal(content, &bucket); err != nil {
+        return nil, fmt.Errorf("invalid settings of bucket %s: %w", name, err)
+    }
+    return &bucket, nil
+}
+
+// Bucket returns the settings of a bucket.
+func (s *StorageService) Bucket(name string) (*datamgmt.Bucket, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return s.loadBucket(name)
+}
+
+// Buckets returns every bucket on this node, sorted by name.
+func (s *StorageService) Buckets() ([]datamgmt.Bucket, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    entries, err := os.ReadDir(filepath.Join(s.rootPath, bucketDirName))
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var buckets []datamgmt.Bucket
+    for _, entry := range entries {
+        name, ok := strings.CutSuffix(entry.Name(), ".json")
+        if !ok || strings.Contains(name, tempFileMarker) {
+            continue
+        }
+        bucket, err := s.loadBucket(name)
+        if err != nil {
+            logger.Log.WithError(err).WithField("bucket", name).Warn("Skipping unreadable bucket")
+            continue
+        }
+        buckets = append(buckets, *bucket)
+    }
+    sort.Slice(buckets, func(i, j int) bool { return buckets[i].Name < buckets[j].Name })
+    return buckets, nil
+}
+
+// DeleteBucket removes an empty bucket, erasing the deleted files it still holds with
+// their history.
+func (s *StorageService) DeleteBucket(name string) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if _, err := s.loadBucket(name); err != nil {
+        return err
+    }
+    var files []string
+    err := s.walkManifests(func(path string, manifest *Manifest) error {
+        if manifest.Bucket != name {
+            return nil
+        }
+        if !manifest.Deleted {
+            return errBucketNotEmpty
+        }
+        files = append(files, path)
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    for _, path := range files {
+        if err := s.eraseFile(path); err != nil {
+            return err
+        }
+    }
+    if err := os.Remove(s.bucketPath(name)); err != nil {
+        return err
+    }
+    logger.Log.WithField("bucket", name).Info("Bucket deleted")
+    return nil
+}
+
+// versioned reports whether files in a bucket keep their older versions, which files
+// outside buckets, or in buckets this node has no settings for, always do. The caller must
+// hold the mutex.
+func (s *StorageService) versioned(name string) bool {
+    if name == "" {
+        return true
+    }
+    bucket, err := s.loadBucket(name)
+    return err != nil || bucket.Versioned
+}
+
+// CheckBucket checks that the bucket of the file data describes, if any, accepts writes. It
+// must exist, unless the write was forwarded with the bucket's settings, which then create
+// it, and an encrypted bucket needs encryption at rest.
+func (s *StorageService) CheckBucket(data *datamgmt.Data) error {
+    if data.Bucket == "" {
+        return nil
+    }
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    bucket, err := s.loadBucket(data.Bucket)
+    if errors.Is(err, errNoSuchBucket) && data.Forwarded && data.Settings != nil && data.Settings.Name == data.Bucket {
+        settings := *data.Settings
+        if err := s.createBucket(&settings); err != nil {
+            return err
+        }
+        bucket, err = &settings, nil
+    }
+    if err != nil {
+        return err
+    }
+    if bucket.Encrypted && s.keys == nil {
+        return fmt.Errorf("bucket %s is encrypted but this node does not encrypt data at rest", bucket.Name)
+    }
+    return nil
+}
+
+// handleCreateBucketCommand creates the bucket described by data.Settings, owned by the
+// origin that asked for it.
+func (s *Server) handleCreateBucketCommand(data *datamgmt.Data, conn net.Conn) error {
+    if data.Settings == nil {
+        return s.respond(conn, data, errors.New("no bucket settings given"))
+    }
+    settings := *data.Settings
+    settings.Name, settings.ACL.Owner = data.Bucket, data.OriginID
+    return s.respond(conn, data, s.storage.CreateBucket(&settings))
+}
+
+// handleDeleteBucketCommand deletes an empty bucket.
+func (s *Server) handleDeleteBucketCommand(data *datamgmt.Data, conn net.Conn) error {
+    return s.respond(conn, data, s.storage.DeleteBucket(data.Bucket))
+}
+
+// handleListBucketsCommand replies with the buckets on this node the caller may list.
+func (s *Server) handleListBucketsCommand(identity string, data *datamgmt.Data, conn net.Conn) error {
+    writer, err := datamgmt.NewWriteStreamAdapter(conn)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to create write stream adapter")
+        return err
+    }
+    defer writer.Close()
+
+    buckets, err := s.storage.Buckets()
+    if err := s.reply(writer, data, err); err != nil {
+        return err
+    }
+    if !unchecked(identity) {
+        visible := buckets[:0]
+        for _, bucket := range buckets {
+            request := datamgmt.Data{Bucket: bucket.Name}
+            if s.storage.Authorize(data.OriginID, &request, datamgmt.PermList) == nil {
+                visible = append(visible, bucket)
+            }
+        }
+        buckets = visible
+    }
+    if err := datamgmt.SendEncodedData(writer.GzipWriter, buckets); err != nil {
+        logger.Log.WithError(err).Error("Failed to send buckets")
+        return err
+    }
+    if err := writer.GzipWriter.Flush(); err != nil {
+        logger.Log.WithError(err).Error("Failed to flush data")
+        return err
+    }
+    return nil
+}
+
+// requestBuckets asks a peer for its buckets.
+func (s *Server) requestBuckets(address string) ([]datamgmt.Bucket, error) {
+    response, err := s.request(address, &datamgmt.Data{Command: "list-buckets"})
+    if err != nil {
+        return nil, err
+    }
+    defer response.Close()
+
+    var buckets []datamgmt.Bucket
+    if err := datamgmt.ReadEncodedData(response.reader.GzipReader, &buckets); err != nil {
+        return nil, err
+    }
+    return buckets, nil
+}
+
+// requestBucketChange sends a peer a create-bucket or delete-bucket command and waits for
+// its reply.
+func (s *Server) requestBucketChange(address string, data *datamgmt.Data) error {
+    response, err := s.request(address, data)
+    if err != nil {
+        return err
+    }
+    response.Close()
+    return nil
+}
+
+// replicate copies a file a client wrote to a bucket that keeps several replicas to the
+// peers closest to its key, until the bucket has as many replicas as it asks for, and
+// returns how many copies it made.
+func (s *Server) replicate(data *datamgmt.Data) int {
+    if data.Bucket == "" || data.Forwarded {
+        return 0
+    }
+    bucket, err := s.storage.Bucket(data.Bucket)
+    if err != nil || bucket.Replicas <= 1 {
+        return 0
+    }
+
+    request := datamgmt.Data{ID: data.ID, Filename: data.Filename, Extension: data.Extension, OriginID: data.OriginID, Bucket: data.Bucket}
+    var info datamgmt.ObjectInfo
+    if err := s.storage.DescribeVersions(&request, &info); err != nil {
+        logger.Log.WithError(err).WithField("key", data.Key()).Warn("Failed to replicate file")
+        return 0
+    }
+    request.Clock, request.ModifiedAt, request.ExpiresAt, request.Tags = info.Clock, info.ModifiedAt, info.ExpiresAt, info.Tags
+    request.Forwarded, request.Settings = true, bucket
+
+    temp, err := os.CreateTemp("", "gopherstore-replica-*")
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to create temporary file")
+        return 0
+    }
+    defer os.Remove(temp.Name())
+    defer temp.Close()
+    reader, err := s.storage.ReadData(&request)
+    if err != nil {
+        logger.Log.WithError(err).WithField("key", data.Key()).Warn("Failed to replicate file")
+        return 0
+    }
+    _, err = io.Copy(temp, reader)
+    reader.Close()
+    if err != nil {
+        logger.Log.WithError(err).WithField("key", data.Key()).Warn("Failed to replicate file")
+        return 0
+    }
+
+    wanted, placed := bucket.Replicas-1, 0
+    for _, address := range s.shardCandidates(data, nil) {
+        if placed == wanted {
+            break
+        }
+        if err := s.syncData(address, &request, temp); err != nil {
+            logger.Log.WithError(err).WithField("address", address).Warn("Failed to copy file to replica")
+            continue
+        }
+        placed++
+    }
+    fields := map[string]interface{}{"key": data.Key(), "replicas": placed + 1, "wanted": bucket.Replicas}
+    if placed < wanted {
+        logger.Log.WithFields(fields).Warn("Too few peers to replicate file to")
+    } else {
+        logger.Log.WithFields(fields).Info("File replicated")
+    }
+    return placed
+}
+
+// parseBucketOption reads a "replicas=<n>", "versioning=on|off", "encryption=on|off",
+// "quota=<size>" or "quota-files=<n>" argument of the create-bucket command into bucket.
+func parseBucketOption(arg string, bucket *datamgmt.Bucket) error {
+    name, value, found := strings.Cut(arg, "=")
+    if !found {
+        return fmt.Errorf("expected <setting>=<value>, got %q", arg)
+    }
+    var err error
+    switch name {
+    case "replicas":
+        bucket.Replicas, err = strconv.Atoi(value)
+    case "versioning":
+        bucket.Versioned, err = parseSwitch(value)
+    case "encryption":
+        bucket.Encrypted, err = parseSwitch(value)
+    case "quota":
+        bucket.QuotaBytes, err = parseSize(value)
+    case "quota-files":
+        bucket.QuotaObjects, err = strconv.Atoi(value)
+    default:
+        return fmt.Errorf("unknown bucket setting %q", name)
+    }
+    if err != nil {
+        return fmt.Errorf("invalid %s %q", name, value)
+    }
+    return nil
+}
+
+// parseSwitch reads "on" or "off".
+func parseSwitch(value string) (bool, error) {
+    switch value {
+    case "on":
+        return true, nil
+    case "off":
+        return false, nil
+    }
+    return false, fmt.Errorf("expected on or off, got %q", value)
+}
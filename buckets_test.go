@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+)
+
+func TestStorageService_Buckets(t *testing.T) {
+    service := NewStorageService("test_address")
+    defer os.RemoveAll(service.rootPath) // Clean up after test
+    for _, bucket := range []*datamgmt.Bucket{{Name: "photos", Versioned: true}, {Name: "scratch", QuotaObjects: 1}} {
+        if err := service.CreateBucket(bucket); err != nil {
+            t.Fatalf("CreateBucket() error = %v", err)
+        }
+    }
+    if err := service.CreateBucket(&datamgmt.Bucket{Name: "photos"}); !errors.Is(err, errBucketExists) {
+        t.Errorf("Expected errBucketExists, got %v", err)
+    }
+    if err := service.CreateBucket(&datamgmt.Bucket{Name: "secret", Encrypted: true}); err == nil {
+        t.Errorf("Expected an encrypted bucket to need encryption at rest")
+    }
+    if err := service.CheckBucket(&datamgmt.Data{Bucket: "missing"}); !errors.Is(err, errNoSuchBucket) {
+        t.Errorf("Expected errNoSuchBucket, got %v", err)
+    }
+
+    // The same name in two buckets, and outside them, addresses three different files.
+    photo := &datamgmt.Data{ID: "1", Filename: "cat", Extension: "txt", Bucket: "photos"}
+    scratch := &datamgmt.Data{ID: "1", Filename: "cat", Extension: "txt", Bucket: "scratch"}
+    plain := &datamgmt.Data{ID: "1", Filename: "cat", Extension: "txt"}
+    for _, data := range []*datamgmt.Data{photo, scratch, plain} {
+        if err := service.StoreData(data, bytes.NewReader([]byte("first "+data.Bucket))); err != nil {
+            t.Fatalf("StoreData() error = %v", err)
+        }
+    }
+    for _, data := range []*datamgmt.Data{photo, scratch, plain} {
+        if content := readStored(t, service, data); string(content) != "first "+data.Bucket {
+            t.Errorf("Expected %q in bucket %q, got %q", "first "+data.Bucket, data.Bucket, content)
+        }
+    }
+
+    // Only versioned buckets keep older versions.
+    for _, data := range []*datamgmt.Data{photo, scratch} {
+        if err := service.StoreData(data, bytes.NewReader([]byte("second"))); err != nil {
+            t.Fatalf("StoreData() error = %v", err)
+        }
+    }
+    if versions, _ := service.Versions(photo); len(versions) != 2 {
+        t.Errorf("Expected a versioned bucket to keep 2 versions, got %d", len(versions))
+    }
+    if versions, _ := service.Versions(scratch); len(versions) != 1 {
+        t.Errorf("Expected an unversioned bucket to keep 1 version, got %d", len(versions))
+    }
+
+    other := &datamgmt.Data{ID: "1", Filename: "dog", Extension: "txt", Bucket: "scratch"}
+    if err := service.CheckQuota(other, 1); !errors.Is(err, errQuotaExceeded) {
+        t.Errorf("Expected the bucket quota to be exceeded, got %v", err)
+    }
+    report, err := service.Usage()
+    if err != nil {
+        t.Fatalf("Usage() error = %v", err)
+    }
+    if usage := report.Buckets["scratch"]; usage.Objects != 1 || usage.Quota.Objects != 1 {
+        t.Errorf("Unexpected bucket usage %+v", usage)
+    }
+
+    if err := service.DeleteBucket("scratch"); !errors.Is(err, errBucketNotEmpty) {
+        t.Errorf("Expected errBucketNotEmpty, got %v", err)
+    }
+    if err := service.DeleteData(scratch); err != nil {
+        t.Fatalf("DeleteData() error = %v", err)
+    }
+    if err := service.DeleteBucket("scratch"); err != nil {
+        t.Fatalf("DeleteBucket() error = %v", err)
+    }
+    if buckets, _ := service.Buckets(); len(buckets) != 1 || buckets[0].Name != "photos" {
+        t.Errorf("Expected only the photos bucket to remain, got %+v", buckets)
+    }
+}
+
+func TestServer_ReplicateBucket(t *testing.T) {
+    origin := startTestServer(t, "127.0.0.1:3379", nil)
+    peers := []*Server{startTestServer(t, "127.0.0.1:3380", nil), startTestServer(t, "127.0.0.1:3381", nil)}
+    origin.dht.Bootstrap([]string{"127.0.0.1:3380", "127.0.0.1:3381"})
+
+    if err := origin.storage.CreateBucket(&datamgmt.Bucket{Name: "shared", Replicas: 2}); err != nil {
+        t.Fatalf("CreateBucket() error = %v", err)
+    }
+    data := &datamgmt.Data{ID: "1", Filename: "report", Extension: "txt", OriginID: "client", Bucket: "shared"}
+    if err := origin.storage.StoreData(data, bytes.NewReader([]byte("replicated content"))); err != nil {
+        t.Fatalf("StoreData() error = %v", err)
+    }
+    if placed := origin.replicate(data); placed != 1 {
+        t.Fatalf("Expected 1 copy, got %d", placed)
+    }
+
+    holders := 0
+    for _, peer := range peers {
+        if !peer.storage.HasData(data) {
+            continue
+        }
+        holders++
+        if content := readStored(t, peer.storage, data); string(content) != "replicated content" {
+            t.Errorf("Unexpected replica content %q", content)
+        }
+        if bucket, err := peer.storage.Bucket("shared"); err != nil || bucket.Replicas != 2 {
+            t.Errorf("Expected the replica to create the bucket, got %+v, %v", bucket, err)
+        }
+    }
+    if holders != 1 {
+        t.Errorf("Expected exactly one peer to hold a replica, got %d", holders)
+    }
+}
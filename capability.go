@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/encryption"
+	"github.com/tejasprabhu/GopherStore/logger"
+)
+
+// A capability token lets whoever holds it run some operations on one file until it
+// expires, without credentials of their own, so a link to a file can be handed out safely.
+// The token carries what it grants, signed with an HMAC keyed by the capability key of the
+// node that issued it, so it cannot be altered or forged. Nodes that share a capability
+// key accept each other's tokens. A holder acts as the identity that issued the token, and
+// can do no more than the issuer still may, so revoking the issuer's access revokes the
+// token's too. A token is for the latest version of its file, or for the one version it
+// names.
+
+const (
+	capabilityKeyFileName = "capability.key"
+	capabilityPrefix      = "capability:"
+)
+
+var errInvalidCapability = errors.New("invalid capability token")
+
+// Capability is what a capability token grants.
+type Capability struct {
+    ID         string // Identifies the token in logs
+    Issuer     string // Identity the holder acts as
+    Bucket     string
+    FileID     string
+    Filename   string
+    Extension  string
+    Version    string // Only version the token is for, empty for the latest
+    Operations []datamgmt.Permission
+    ExpiresAt  time.Time
+}
+
+// target returns the metadata addressing the file the capability is for.
+func (c *Capability) target() *datamgmt.Data {
+    return &datamgmt.Data{ID: c.FileID, Filename: c.Filename, Extension: c.Extension, Bucket: c.Bucket, Version: c.Version, OriginID: c.Issuer}
+}
+
+// allows reports whether the capability grants permission on the file, and version, data
+// describes.
+func (c *Capability) allows(data *datamgmt.Data, permission datamgmt.Permission) bool {
+    return time.Now().Before(c.ExpiresAt) &&
+        data.ID == c.FileID && data.Filename == c.Filename && data.Extension == c.Extension && data.Bucket == c.Bucket &&
+        data.Version == c.Version && slices.Contains(c.Operations, permission)
+}
+
+func capabilityIdentity(c *Capability) string { return capabilityPrefix + c.ID }
+
+// CapabilityKey returns the key the node signs capabilities with, generating one kept
+// under the storage root the first time.
+func (s *StorageService) CapabilityKey() ([]byte, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    path := filepath.Join(s.rootPath, keyDirName, capabilityKeyFileName)
+    key, err := encryption.LoadKey(path)
+    if !errors.Is(err, fs.ErrNotExist) {
+        return key, err
+    }
+    if key, err = encryption.GenerateKey(); err != nil {
+        return nil, err
+    }
+    if err := writeFileAtomic(path, []byte(hex.EncodeToString(key))); err != nil {
+        return nil, err
+    }
+    return key, nil
+}
+
+// signingKey returns the configured capability key, or the node's own.
+func (s *Server) signingKey() ([]byte, error) {
+    if s.capabilityKey != nil {
+        return s.capabilityKey, nil
+    }
+    return s.storage.CapabilityKey()
+}
+
+// IssueCapability returns a token granting operations on the file data describes, as its
+// origin, for ttl.
+func (s *Server) IssueCapability(data *datamgmt.Data, operations []datamgmt.Permission, ttl time.Duration) (string, error) {
+    if len(operations) == 0 || ttl <= 0 {
+        return "", errors.New("a capability needs operations and a positive lifetime")
+    }
+    key, err := s.signingKey()
+    if err != nil {
+        return "", err
+    }
+    id := make([]byte, 8)
+    if _, err := rand.Read(id); err != nil {
+        return "", err
+    }
+    capability := Capability{
+        ID:         hex.EncodeToString(id),
+        Issuer:     data.OriginID,
+        Bucket:     data.Bucket,
+        FileID:     data.ID,
+        Filename:   data.Filename,
+        Extension:  data.Extension,
+        Version:    data.Version,
+        Operations: operations,
+        ExpiresAt:  time.Now().Add(ttl),
+    }
+    var payload bytes.Buffer
+    if err := gob.NewEncoder(&payload).Encode(&capability); err != nil {
+        return "", err
+    }
+    encoding := base64.RawURLEncoding
+    return encoding.EncodeToString(payload.Bytes()) + "." + encoding.EncodeToString(capabilityMAC(key, payload.Bytes())), nil
+}
+
+// verifyCapability checks a token's signature and expiry and returns what it grants.
+func (s *Server) verifyCapability(token string) (*Capability, error) {
+    key, err := s.signingKey()
+    if err != nil {
+        return nil, err
+    }
+    payload, signature, err := splitCapability(token)
+    if err != nil {
+        return nil, err
+    }
+    if !hmac.Equal(signature, capabilityMAC(key, payload)) {
+        return nil, errInvalidCapability
+    }
+    capability, err := decodeCapability(payload)
+    if err != nil {
+        return nil, err
+    }
+    if !time.Now().Before(capability.ExpiresAt) {
+        return nil, fmt.Errorf("capability expired at %s", capability.ExpiresAt.Format(time.RFC3339))
+    }
+    return capability, nil
+}
+
+// readCapability returns what a token grants without checking its signature, which only
+// the issuing node can do.
+func readCapability(token string) (*Capability, error) {
+    payload, _, err := splitCapability(token)
+    if err != nil {
+        return nil, err
+    }
+    return decodeCapability(payload)
+}
+
+func splitCapability(token string) ([]byte, []byte, error) {
+    encodedPayload, encodedSignature, found := strings.Cut(token, ".")
+    if !found {
+        return nil, nil, errInvalidCapability
+    }
+    payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+    if err != nil {
+        return nil, nil, errInvalidCapability
+    }
+    signature, err := base64.RawURLEncoding.DecodeString(encodedSignature)
+    if err != nil {
+        return nil, nil, errInvalidCapability
+    }
+    return payload, signature, nil
+}
+
+func decodeCapability(payload []byte) (*Capability, error) {
+    var capability Capability
+    if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&capability); err != nil {
+        return nil, errInvalidCapability
+    }
+    return &capability, nil
+}
+
+func capabilityMAC(key, payload []byte) []byte {
+    mac := hmac.New(sha256.New, key)
+    mac.Write([]byte("gopherstore capability"))
+    mac.Write(payload)
+    return mac.Sum(nil)
+}
+
+// handleCapabilityCommand issues a capability for data.Operations on a file, lasting
+// data.TTL, to a caller that holds each of the operations itself.
+func (s *Server) handleCapabilityCommand(identity string, data *datamgmt.Data, conn net.Conn) error {
+    writer, err := datamgmt.NewWriteStreamAdapter(conn)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to create write stream adapter")
+        return err
+    }
+    defer writer.Close()
+
+    var token string
+    for _, operation := range data.Operations {
+        if unchecked(identity) {
+            break
+        }
+        if err = s.storage.Authorize(data.OriginID, data, operation); err != nil {
+            break
+        }
+    }
+    if err == nil {
+        token, err = s.IssueCapability(data, data.Operations, data.TTL)
+    }
+    if err := s.reply(writer, data, err); err != nil {
+        return err
+    }
+    if err := datamgmt.SendEncodedData(writer.GzipWriter, token); err != nil {
+        logger.Log.WithError(err).Error("Failed to send capability")
+        return err
+    }
+    if err := writer.GzipWriter.Flush(); err != nil {
+        logger.Log.WithError(err).Error("Failed to flush data")
+        return err
+    }
+    return nil
+}
+
+// requestCapability asks a peer to issue a capability for operations on a file.
+func (s *Server) requestCapability(address string, data *datamgmt.Data, operations []datamgmt.Permission, ttl time.Duration) (string, error) {
+    request := *data
+    request.Command, request.Operations, request.TTL = "capability", operations, ttl
+    response, err := s.request(address, &request)
+    if err != nil {
+        return "", err
+    }
+    defer response.Close()
+
+    var token string
+    if err := datamgmt.ReadEncodedData(response.reader.GzipReader, &token); err != nil {
+        return "", err
+    }
+    return token, nil
+}
+
+// fetchWithCapability downloads the file a capability token is for from the node that
+// accepts it, authenticating with the token alone.
+func (s *Server) fetchWithCapability(address, token string, writer io.Writer) (int64, error) {
+    capability, err := readCapability(token)
+    if err != nil {
+        return 0, err
+    }
+    request := capability.target()
+    request.Command = "fetch"
+
+    conn, err := s.dialWith(address, token)
+    if err != nil {
+        return 0, err
+    }
+    if err := s.writeCommand(conn, request); err != nil {
+        conn.Close()
+        return 0, err
+    }
+    response, err := s.readResponse(conn)
+    if err != nil {
+        return 0, err
+    }
+    defer response.Close()
+    return datamgmt.ReadStreamWithSizePrefix(response.reader.GzipReader, writer)
+}
+
+// parseOperations reads a comma-separated list of permissions.
+func parseOperations(list string) ([]datamgmt.Permission, error) {
+    var operations []datamgmt.Permission
+    for _, name := range strings.Split(list, ",") {
+        operation, err := datamgmt.ParsePermission(name)
+        if err != nil {
+            return nil, err
+        }
+        operations = append(operations, operation)
+    }
+    return operations, nil
+}
+
+// saveDownload writes a download into a new file at path.
+func saveDownload(path string, download func(io.Writer) (int64, error)) (int64, error) {
+    file, err := os.Create(path)
+    if err != nil {
+        return 0, err
+    }
+    written, err := download(file)
+    if closeErr := file.Close(); err == nil {
+        err = closeErr
+    }
+    if err != nil {
+        os.Remove(path)
+    }
+    return written, err
+}
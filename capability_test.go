@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+)
+
+func TestServer_Capability(t *testing.T) {
+    node := startTestServer(t, "127.0.0.1:3384", nil, func(node *Server) {
+        node.credentials = &Credentials{Clients: map[string]string{"alice": "alice-token", "bob": "bob-token"}}
+    })
+    alice, bob, stranger := testClient(t, "alice-token"), testClient(t, "bob-token"), testClient(t, "")
+
+    path := filepath.Join(t.TempDir(), "report.txt")
+    os.WriteFile(path, []byte("quarterly report"), 0600)
+    file, err := os.Open(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+    data := &datamgmt.Data{ID: "1", Filename: "report", Extension: "txt"}
+    if err := alice.syncData("127.0.0.1:3384", data, file); err != nil {
+        t.Fatalf("syncData() error = %v", err)
+    }
+    read := []datamgmt.Permission{datamgmt.PermRead}
+    if _, err := bob.requestCapability("127.0.0.1:3384", data, read, time.Minute); err == nil || !strings.Contains(err.Error(), errAccessDenied.Error()) {
+        t.Errorf("Expected bob to be unable to delegate alice's file, got %v", err)
+    }
+    token, err := alice.requestCapability("127.0.0.1:3384", data, read, time.Minute)
+    if err != nil {
+        t.Fatalf("requestCapability() error = %v", err)
+    }
+
+    var content bytes.Buffer
+    if _, err := stranger.fetchWithCapability("127.0.0.1:3384", token, &content); err != nil || content.String() != "quarterly report" {
+        t.Fatalf("Expected the capability to fetch the file, got %q, %v", content.String(), err)
+    }
+    if _, err := stranger.fetchWithCapability("127.0.0.1:3384", "x"+token, &bytes.Buffer{}); err == nil {
+        t.Errorf("Expected a tampered token to be rejected")
+    }
+
+    // The capability allows nothing beyond reading its own file.
+    request := func(token string, data *datamgmt.Data) error {
+        conn, err := stranger.dialWith("127.0.0.1:3384", token)
+        if err != nil {
+            return err
+        }
+        if err := stranger.writeCommand(conn, data); err != nil {
+            conn.Close()
+            return err
+        }
+        response, err := stranger.readResponse(conn)
+        if err == nil {
+            response.Close()
+        }
+        return err
+    }
+    if err := request(token, &datamgmt.Data{Command: "versions", ID: "1", Filename: "report", Extension: "txt"}); err == nil || !strings.Contains(err.Error(), errAccessDenied.Error()) {
+        t.Errorf("Expected listing versions to be denied, got %v", err)
+    }
+    if err := request(token, &datamgmt.Data{Command: "stat", ID: "1", Filename: "other", Extension: "txt"}); err == nil || !strings.Contains(err.Error(), errAccessDenied.Error()) {
+        t.Errorf("Expected reading another file to be denied, got %v", err)
+    }
+    versions, err := alice.requestVersions("127.0.0.1:3384", data)
+    if err != nil || len(versions) == 0 {
+        t.Fatalf("requestVersions() = %v, %v", versions, err)
+    }
+    version := &datamgmt.Data{Command: "fetch", ID: "1", Filename: "report", Extension: "txt", Version: versions[0].VersionID}
+    if err := request(token, version); err == nil || !strings.Contains(err.Error(), errAccessDenied.Error()) {
+        t.Errorf("Expected reading a version by name to be denied, got %v", err)
+    }
+
+    // A token stops working once its issuer loses the access it grants.
+    grant := &datamgmt.Data{ID: "1", Filename: "report", Extension: "txt", ACL: &datamgmt.ACL{Grants: map[string][]datamgmt.Permission{"client:bob": read}}}
+    if err := alice.requestSetACL("127.0.0.1:3384", grant); err != nil {
+        t.Fatalf("requestSetACL() error = %v", err)
+    }
+    delegated, err := bob.requestCapability("127.0.0.1:3384", data, read, time.Minute)
+    if err != nil {
+        t.Fatalf("requestCapability() error = %v", err)
+    }
+    if _, err := stranger.fetchWithCapability("127.0.0.1:3384", delegated, &bytes.Buffer{}); err != nil {
+        t.Fatalf("Expected bob's capability to fetch the file, got %v", err)
+    }
+    grant.ACL.Grants = map[string][]datamgmt.Permission{}
+    if err := alice.requestSetACL("127.0.0.1:3384", grant); err != nil {
+        t.Fatalf("requestSetACL() error = %v", err)
+    }
+    if _, err := stranger.fetchWithCapability("127.0.0.1:3384", delegated, &bytes.Buffer{}); err == nil || !strings.Contains(err.Error(), errAccessDenied.Error()) {
+        t.Errorf("Expected bob's capability to stop working once bob's grant was revoked, got %v", err)
+    }
+
+    expired, err := node.IssueCapability(&datamgmt.Data{ID: "1", Filename: "report", Extension: "txt"}, read, time.Millisecond)
+    if err != nil {
+        t.Fatalf("IssueCapability() error = %v", err)
+    }
+    time.Sleep(5 * time.Millisecond)
+    if _, err := node.verifyCapability(expired); err == nil {
+        t.Errorf("Expected an expired capability to be rejected")
+    }
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/encryption"
+	"github.com/tejasprabhu/GopherStore/logger"
+)
+
+const chunkDirName = "chunks"
+
+// chunkPath returns where the chunk with the given hash is stored, in the hot tier unless
+// the cold tier holds it.
+func (s *StorageService) chunkPath(hash string) string {
+    if tier := s.locateChunk(hash); tier != nil {
+        return tier.chunkPath(hash)
+    }
+    return s.chunkTiers()[0].chunkPath(hash)
+}
+
+// isHexDigest reports whether hash is a well-formed SHA-256 hex digest, which also keeps
+// peer-supplied names from escaping the storage directories.
+func isHexDigest(hash string) bool {
+    decoded, err := hex.DecodeString(hash)
+    return err == nil && len(decoded) == 32
+}
+
+func (s *StorageService) hasChunk(hash string) bool {
+    return s.locateChunk(hash) != nil
+}
+
+// writeChunk stores a chunk unless an identical one already exists, reporting whether it
+// was newly written. The caller must hold the mutex.
+func (s *StorageService) writeChunk(hash string, chunk []byte) (bool, error) {
+    if s.hasChunk(hash) {
+        return false, nil
+    }
+    if s.keys != nil {
+        sealed, err := s.keys.Seal(chunk, []byte(hash))
+        if err != nil {
+            logger.Log.WithError(err).WithField("chunk", hash).Error("Error encrypting chunk")
+            return false, err
+        }
+        chunk = sealed
+    }
+    tier, err := s.placeChunk(int64(len(chunk)))
+    if err != nil {
+        logger.Log.WithField("chunk", hash).Error("No storage tier has room for chunk")
+        return false, err
+    }
+    if err := writeFileAtomic(tier.chunkPath(hash), chunk); err != nil {
+        logger.Log.WithError(err).WithField("chunk", hash).Error("Error writing chunk")
+        return false, err
+    }
+    tier.used += int64(len(chunk))
+    return true, nil
+}
+
+// readChunk returns the content of a stored chunk, decrypting it if it is encrypted at rest.
+// Readers do not hold the mutex, so a chunk may move between tiers while it is looked up:
+// checking the hot tier again after the cold one finds a chunk just promoted.
+func (s *StorageService) readChunk(hash string) ([]byte, error) {
+    hot, cold := s.tierPaths(hash)
+    content, err := os.ReadFile(hot)
+    if os.IsNotExist(err) && cold != "" {
+        content, err = os.ReadFile(cold)
+        if os.IsNotExist(err) {
+            content, err = os.ReadFile(hot)
+        }
+    }
+    if err != nil || !encryption.IsSealed(content) {
+        return content, err
+    }
+    // A chunk written before encryption was enabled may happen to start like a sealed one.
+    if datamgmt.HashChunk(content) == hash {
+        return content, nil
+    }
+    if s.keys == nil {
+        return nil, errMissingMasterKey
+    }
+    return s.keys.Open(content, []byte(hash))
+}
+
+// MissingChunks returns the hashes from refs that the sender of the file data describes
+// must transmit. Unless shared is set, a stored chunk only counts if a version of the same
+// file refers to it or the sender already transmitted it in its upload session, so a sender
+// can neither learn which chunks other files hold nor commit them without their content.
+func (s *StorageService) MissingChunks(data *datamgmt.Data, refs []datamgmt.ChunkRef, shared bool) ([]string, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    var known map[string]bool
+    if !shared {
+        var err error
+        if known, err = s.fileChunks(data); err != nil {
+            return nil, err
+        }
+    }
+    var missing []string
+    requested := make(map[string]bool)
+    for _, ref := range refs {
+        if !isHexDigest(ref.Hash) {
+            return nil, fmt.Errorf("invalid chunk hash %q", ref.Hash)
+        }
+        if !requested[ref.Hash] && (!shared && !known[ref.Hash] || !s.hasChunk(ref.Hash)) {
+            missing = append(missing, ref.Hash)
+        }
+        requested[ref.Hash] = true
+    }
+    return missing, nil
+}
+
+// fileChunks returns the chunks the versions of the file data describes refer to, along with
+// those its sender transmitted in its upload session. The caller must hold the mutex.
+func (s *StorageService) fileChunks(data *datamgmt.Data) (map[string]bool, error) {
+    path, err := s.generateFilePath(data)
+    if err != nil {
+        return nil, err
+    }
+    versions, err := s.archivedVersions(path)
+    if err != nil {
+        return nil, err
+    }
+    if latest, err := s.loadManifest(path); err == nil {
+        versions = append(versions, latest)
+    } else if !errors.Is(err, fs.ErrNotExist) {
+        return nil, err
+    }
+    chunks := make(map[string]bool)
+    for _, manifest := range versions {
+        for _, ref := range manifest.Chunks {
+            chunks[ref.Hash] = true
+        }
+    }
+    if data.SessionID != "" {
+        if session, err := s.loadUploadSession(data.SessionID); err == nil && session.Key == data.Key() {
+            for _, hash := range session.Received {
+                chunks[hash] = true
+            }
+        }
+    }
+    return chunks, nil
+}
+
+// checkChunkRefs rejects a chunk list naming a chunk by anything but a SHA-256 digest, with a
+// size the chunker cannot produce, or with two sizes for the same chunk, so that what a
+// sender claims about its chunks can be held against the chunks it sends.
+func checkChunkRefs(refs []datamgmt.ChunkRef) error {
+    sizes := make(map[string]int64, len(refs))
+    for _, ref := range refs {
+        if !isHexDigest(ref.Hash) {
+            return fmt.Errorf("invalid chunk hash %q", ref.Hash)
+        }
+        if ref.Size <= 0 || ref.Size > datamgmt.MaxChunkSize {
+            return fmt.Errorf("chunk %s has invalid size %d", ref.Hash, ref.Size)
+        }
+        if size, ok := sizes[ref.Hash]; ok && size != ref.Size {
+            return fmt.Errorf("chunk %s is listed with sizes %d and %d", ref.Hash, size, ref.Size)
+        }
+        sizes[ref.Hash] = ref.Size
+    }
+    return nil
+}
+
+// PutChunk verifies a chunk against its expected hash and size and adds it to the chunk
+// store.
+func (s *StorageService) PutChunk(ref datamgmt.ChunkRef, chunk []byte) error {
+    if int64(len(chunk)) != ref.Size || len(chunk) > datamgmt.MaxChunkSize {
+        return fmt.Errorf("chunk size mismatch: expected %d bytes, got %d", ref.Size, len(chunk))
+    }
+    if actual := datamgmt.HashChunk(chunk); actual != ref.Hash {
+        return fmt.Errorf("chunk hash mismatch: expected %s, got %s", ref.Hash, actual)
+    }
+
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    _, err := s.writeChunk(ref.Hash, chunk)
+    return err
+}
+
+// collectChunks removes the candidate chunks that no version of a file, pending upload
+// session or open reader refers to any more. The caller must hold the mutex.
+func (s *StorageService) collectChunks(candidates []datamgmt.ChunkRef) {
+    unused := make(map[string]bool)
+    for _, ref := range candidates {
+        unused[ref.Hash] = true
+    }
+    if len(unused) == 0 {
+        return
+    }
+
+    err := s.walkManifests(func(path string, manifest *Manifest) error {
+        for _, ref := range manifest.Chunks {
+            delete(unused, ref.Hash)
+        }
+        return nil
+    })
+    if err == nil {
+        err = s.walkVersions(func(path string, manifest *Manifest) error {
+            for _, ref := range manifest.Chunks {
+                delete(unused, ref.Hash)
+            }
+            return nil
+        })
+    }
+    if err != nil {
+        logger.Log.WithError(err).Error("Error scanning manifests, keeping chunks")
+        return
+    }
+    s.walkUploadSessions(func(session *UploadSession) {
+        for _, ref := range session.Chunks {
+            delete(unused, ref.Hash)
+        }
+    })
+    for hash := range s.pinned {
+        if unused[hash] {
+            if s.deferred == nil {
+                s.deferred = make(map[string]bool)
+            }
+            s.deferred[hash] = true
+            delete(unused, hash)
+        }
+    }
+
+    for hash := range unused {
+        if err := s.removeChunk(hash); err != nil && !os.IsNotExist(err) {
+            logger.Log.WithError(err).WithField("chunk", hash).Warn("Error removing unused chunk")
+        }
+    }
+    logger.Log.WithField("chunks_removed", len(unused)).Debug("Unused chunks collected")
+}
+
+// chunkReader streams a byte range of a file by reading its chunks in order. Its chunks are
+// pinned until it is closed, so a file deleted or purged while it is read is not collected
+// from under it.
+type chunkReader struct {
+    service   *StorageService
+    chunks    []datamgmt.ChunkRef
+    pinned    []datamgmt.ChunkRef // Chunks to unpin on Close
+    skip      int64 // Bytes to skip at the start of the first chunk
+    remaining int64 // Bytes left to return, negative meaning until the end
+    current   []byte
+}
+
+// newChunkReader returns a reader over length bytes of the chunks starting at offset. A
+// length of zero reads until the end. The caller must hold the mutex.
+func (s *StorageService) newChunkReader(chunks []datamgmt.ChunkRef, offset, length int64) *chunkReader {
+    for len(chunks) > 0 && offset >= chunks[0].Size {
+        offset -= chunks[0].Size
+        chunks = chunks[1:]
+    }
+    remaining := int64(-1)
+    if length > 0 {
+        remaining = length
+    }
+    s.pinChunks(chunks, 1)
+    return &chunkReader{service: s, chunks: chunks, pinned: chunks, skip: offset, remaining: remaining}
+}
+
+// pinChunks adds delta to the open readers of each chunk. Chunks a collection passed over
+// because they were being read are collected once their last reader closes. The caller must
+// hold the mutex.
+func (s *StorageService) pinChunks(chunks []datamgmt.ChunkRef, delta int) {
+    if s.pinned == nil {
+        s.pinned = make(map[string]int)
+    }
+    var released []datamgmt.ChunkRef
+    for _, ref := range chunks {
+        if s.pinned[ref.Hash] += delta; s.pinned[ref.Hash] > 0 {
+            continue
+        }
+        delete(s.pinned, ref.Hash)
+        if s.deferred[ref.Hash] {
+            delete(s.deferred, ref.Hash)
+            released = append(released, ref)
+        }
+    }
+    s.collectChunks(released)
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+    for {
+        if r.remaining == 0 {
+            return 0, io.EOF
+        }
+        if len(r.current) == 0 {
+            if len(r.chunks) == 0 {
+                return 0, io.EOF
+            }
+            chunk, err := r.service.readChunk(r.chunks[0].Hash)
+            if err != nil {
+                return 0, fmt.Errorf("chunk %s: %w", r.chunks[0].Hash, err)
+            }
+            if r.skip > int64(len(chunk)) {
+                return 0, fmt.Errorf("chunk %s is shorter than recorded", r.chunks[0].Hash)
+            }
+            r.current, r.skip = chunk[r.skip:], 0
+            r.chunks = r.chunks[1:]
+            continue
+        }
+
+        if r.remaining > 0 && int64(len(p)) > r.remaining {
+            p = p[:r.remaining]
+        }
+        n := copy(p, r.current)
+        r.current = r.current[n:]
+        if r.remaining > 0 {
+            r.remaining -= int64(n)
+        }
+        return n, nil
+    }
+}
+
+func (r *chunkReader) Close() error {
+    r.service.mutex.Lock()
+    r.service.pinChunks(r.pinned, -1)
+    r.service.mutex.Unlock()
+    r.current, r.chunks, r.pinned = nil, nil, nil
+    return nil
+}
+
+// multiRangeReader returns several byte ranges of a file one after another.
+type multiRangeReader struct {
+    io.Reader
+    readers []io.ReadCloser
+}
+
+func newMultiRangeReader(readers []io.ReadCloser) *multiRangeReader {
+    plain := make([]io.Reader, len(readers))
+    for i, reader := range readers {
+        plain[i] = reader
+    }
+    return &multiRangeReader{Reader: io.MultiReader(plain...), readers: readers}
+}
+
+func (r *multiRangeReader) Close() error {
+    var first error
+    for _, reader := range r.readers {
+        if err := reader.Close(); err != nil && first == nil {
+            first = err
+        }
+    }
+    return first
+}
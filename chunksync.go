@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/logger"
+)
+
+const (
+	maxTransferAttempts = 5
+	transferRetryDelay  = 2 * time.Second
+)
+
+// handleSyncCommand receives a file as a list of chunks: it replies with the chunks it does
+// not have yet, stores the ones the sender then transmits, and commits the file's manifest.
+// Only trusted peers may reuse chunks of other files; anyone else must send every chunk
+// the file does not already have.
+func (s *Server) handleSyncCommand(identity string, data *datamgmt.Data, adapter *datamgmt.StreamAdapter, conn net.Conn) error {
+    writer, err := datamgmt.NewWriteStreamAdapter(conn)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to create write stream adapter")
+        return err
+    }
+    defer writer.Close()
+
+    if err := s.receiveChunks(data, unchecked(identity), adapter, writer); err != nil {
+        logger.Log.WithError(err).WithField("key", data.Key()).Error("Failed to sync data")
+        return s.reply(writer, data, err)
+    }
+    if err := s.reply(writer, data, nil); err != nil {
+        return err
+    }
+    go s.announce(data)
+    go s.replicate(data)
+    return nil
+}
+
+func (s *Server) receiveChunks(data *datamgmt.Data, shared bool, reader, writer *datamgmt.StreamAdapter) error {
+    var refs []datamgmt.ChunkRef
+    if err := datamgmt.ReadEncodedData(reader.GzipReader, &refs); err != nil {
+        return err
+    }
+    // A rejected write requests no chunks, so the sender goes on to read the error reply.
+    reject := func(cause error) error {
+        if err := datamgmt.SendEncodedData(writer.GzipWriter, []string{}); err != nil {
+            return err
+        }
+        return cause
+    }
+    if err := checkChunkRefs(refs); err != nil {
+        return reject(err)
+    }
+    var size int64
+    sizes := make(map[string]int64, len(refs))
+    for _, ref := range refs {
+        size += ref.Size
+        sizes[ref.Hash] = ref.Size
+    }
+    if err := s.storage.CheckBucket(data); err != nil {
+        return reject(err)
+    }
+    release, err := s.storage.ReserveQuota(data, size)
+    if err != nil {
+        return reject(err)
+    }
+    defer release()
+
+    if data.SessionID != "" {
+        if _, err := s.storage.OpenUploadSession(data.SessionID, data, refs); err != nil {
+            return err
+        }
+    }
+
+    missing, err := s.storage.MissingChunks(data, refs, shared)
+    if err != nil {
+        return err
+    }
+    wanted := make(map[string]bool, len(missing))
+    for _, hash := range missing {
+        wanted[hash] = true
+    }
+    var needed int64
+    for _, ref := range refs {
+        if wanted[ref.Hash] {
+            needed += ref.Size
+            delete(wanted, ref.Hash)
+        }
+    }
+    if err := s.storage.CheckSpace(needed); err != nil {
+        return reject(err)
+    }
+    if err := datamgmt.SendEncodedData(writer.GzipWriter, missing); err != nil {
+        return err
+    }
+    if err := writer.GzipWriter.Flush(); err != nil {
+        return err
+    }
+
+    for _, hash := range missing {
+        chunk, err := datamgmt.ReadLimitedData(reader.GzipReader, datamgmt.MaxChunkSize)
+        if err != nil {
+            return err
+        }
+        if err := s.storage.PutChunk(datamgmt.ChunkRef{Hash: hash, Size: sizes[hash]}, chunk); err != nil {
+            return err
+        }
+        if data.SessionID != "" {
+            if err := s.storage.ReceivedChunk(data.SessionID, hash); err != nil {
+                return err
+            }
+        }
+    }
+
+    logger.Log.WithFields(map[string]interface{}{
+        "key":         data.Key(),
+        "chunks":      len(refs),
+        "transferred": len(missing),
+    }).Info("Chunks received")
+    if err := s.storage.CommitManifest(data, refs); err != nil {
+        return err
+    }
+    if data.SessionID != "" {
+        return s.storage.CloseUploadSession(data.SessionID)
+    }
+    return nil
+}
+
+// handleStatusCommand reports how many leading bytes of a resumable upload are committed.
+func (s *Server) handleStatusCommand(data *datamgmt.Data, conn net.Conn) error {
+    writer, err := datamgmt.NewWriteStreamAdapter(conn)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to create write stream adapter")
+        return err
+    }
+    defer writer.Close()
+
+    offset, err := s.storage.CommittedOffset(data.SessionID)
+    response := *data
+    response.Offset = offset
+    return s.reply(writer, &response, err)
+}
+
+// reply sends the outcome of a command to the requester as an "ok" or "error" response.
+// It returns cause, or the error sending the response if the command succeeded, so the
+// handler can return the command's outcome.
+func (s *Server) reply(writer *datamgmt.StreamAdapter, data *datamgmt.Data, cause error) error {
+    response := *data
+    response.Command = "ok"
+    if cause != nil {
+        response.Command = "error"
+        response.Error = cause.Error()
+    }
+    err := datamgmt.SendEncodedData(writer.GzipWriter, &response)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to send response")
+    } else if err = writer.GzipWriter.Flush(); err != nil {
+        logger.Log.WithError(err).Error("Failed to flush data")
+    }
+    if cause != nil {
+        return cause
+    }
+    return err
+}
+
+// syncData sends a file to a peer by chunking it locally and transmitting only the chunks
+// the peer does not already store. The upload is identified by a session ID derived from
+// its content, under which the peer keeps the chunks it has committed. A retry, here or by
+// sending the same file again later, therefore transmits only the chunks the peer still
+// asks for.
+func (s *Server) syncData(address string, metadata *datamgmt.Data, file *os.File) error {
+    refs, offsets, checksum, err := chunkFile(file)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to chunk file")
+        return err
+    }
+
+    request := *metadata
+    request.Command = "sync"
+    request.SessionID = uploadSessionID(metadata, refs)
+    request.Checksum = checksum
+
+    for attempt := 1; ; attempt++ {
+        err = s.syncChunks(address, &request, refs, offsets, file)
+        var rejected *peerError
+        if err == nil || errors.As(err, &rejected) || attempt == maxTransferAttempts {
+            return err
+        }
+
+        logger.Log.WithError(err).WithField("attempt", attempt).Warn("Upload interrupted, retrying")
+        time.Sleep(transferRetryDelay)
+    }
+}
+
+// syncChunks performs a single attempt of the chunk exchange described by syncData.
+func (s *Server) syncChunks(address string, request *datamgmt.Data, refs []datamgmt.ChunkRef, offsets []int64, file *os.File) error {
+    conn, err := s.dial(address)
+    if err != nil {
+        logger.Log.WithError(err).WithField("address", address).Error("Failed to connect")
+        return err
+    }
+    conn = &idleTimeoutConn{Conn: conn, timeout: requestTimeout}
+    defer conn.Close()
+
+    writer, err := datamgmt.NewWriteStreamAdapter(conn)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to create stream adapter")
+        return err
+    }
+    defer writer.Close()
+
+    if err := datamgmt.SendEncodedData(writer.GzipWriter, request); err != nil {
+        return err
+    }
+    if err := datamgmt.SendEncodedData(writer.GzipWriter, refs); err != nil {
+        return err
+    }
+    if err := writer.GzipWriter.Flush(); err != nil {
+        return err
+    }
+
+    reader, err := datamgmt.NewReadStreamAdapter(conn)
+    if err != nil {
+        return err
+    }
+    defer reader.Close()
+
+    var missing []string
+    if err := datamgmt.ReadEncodedData(reader.GzipReader, &missing); err != nil {
+        return err
+    }
+
+    index := make(map[string]int, len(refs))
+    for i, ref := range refs {
+        index[ref.Hash] = i
+    }
+    for _, hash := range missing {
+        i, ok := index[hash]
+        if !ok {
+            return errors.New("peer requested an unknown chunk")
+        }
+        chunk := make([]byte, refs[i].Size)
+        if _, err := file.ReadAt(chunk, offsets[i]); err != nil {
+            return err
+        }
+        if err := datamgmt.SendLengthPrefixedData(writer.GzipWriter, chunk); err != nil {
+            return err
+        }
+        // Flush each chunk so the peer commits it even if the connection drops later.
+        if err := writer.GzipWriter.Flush(); err != nil {
+            return err
+        }
+    }
+
+    var response datamgmt.Data
+    if err := datamgmt.ReadEncodedData(reader.GzipReader, &response); err != nil {
+        return err
+    }
+    if response.Command == "error" {
+        return &peerError{message: response.Error}
+    }
+
+    logger.Log.WithFields(map[string]interface{}{
+        "address":     address,
+        "chunks":      len(refs),
+        "transferred": len(missing),
+    }).Info("Data sent successfully")
+    return nil
+}
+
+// queryUploadOffset asks a peer how many leading bytes of an upload session it holds. The
+// upload itself does not need it, since the peer lists the chunks it is missing.
+func (s *Server) queryUploadOffset(address string, upload *datamgmt.Data) (int64, error) {
+    request := *upload
+    request.Command = "status"
+
+    response, err := s.request(address, &request)
+    if err != nil {
+        return 0, err
+    }
+    defer response.Close()
+    return response.Data.Offset, nil
+}
+
+// uploadSessionID derives a session ID from the object key and its chunks, so the same
+// upload always maps to the same session.
+func uploadSessionID(data *datamgmt.Data, refs []datamgmt.ChunkRef) string {
+    var buffer bytes.Buffer
+    buffer.WriteString(data.Key())
+    for _, ref := range refs {
+        buffer.WriteString(ref.Hash)
+    }
+    return datamgmt.HashChunk(buffer.Bytes())
+}
+
+// resumableFetch downloads an object from a peer into a partial file and stores it once
+// complete. Interrupted transfers continue with a range request from the last verified
+// piece, including across restarts since the partial file is kept on disk.
+func (s *Server) resumableFetch(address string, data *datamgmt.Data) error {
+    info, err := s.statObject(address, data)
+    if err != nil {
+        return err
+    }
+
+    file, offset, err := s.storage.OpenPartialDownload(data)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to open partial download")
+        return err
+    }
+    defer file.Close()
+
+    for attempt := 1; ; attempt++ {
+        offset, err = verifiedPrefix(file, info, offset)
+        if err != nil {
+            return err
+        }
+        if offset == info.Size {
+            break
+        }
+        if attempt > maxTransferAttempts {
+            return fmt.Errorf("download incomplete after %d attempts", maxTransferAttempts)
+        }
+        if attempt > 1 || offset > 0 {
+            logger.Log.WithField("key", data.Key()).WithField("offset", offset).Info("Resuming download")
+        }
+
+        received, err := s.fetchInto(address, data, offset, file)
+        offset += received
+        var rejected *peerError
+        if errors.As(err, &rejected) {
+            return err
+        }
+        if err != nil {
+            logger.Log.WithError(err).WithField("attempt", attempt).Warn("Download interrupted, retrying")
+            time.Sleep(transferRetryDelay)
+        }
+    }
+
+    data.Checksum = info.Checksum
+    data.Clock, data.ModifiedAt = info.Clock, info.ModifiedAt
+    data.ExpiresAt, data.Tags = info.ExpiresAt, info.Tags
+    warnSiblings(data, info)
+    if err := s.storage.CompleteDownload(data, file); err != nil {
+        logger.Log.WithError(err).Error("Failed to store data")
+        return err
+    }
+    logger.Log.WithField("key", data.Key()).WithField("bytes", info.Size).Info("Download complete")
+    go s.announce(data)
+    return nil
+}
+
+// fetchInto streams an object from offset to its end into writer, returning how many bytes
+// were written even if the transfer fails part way.
+func (s *Server) fetchInto(address string, data *datamgmt.Data, offset int64, writer io.Writer) (int64, error) {
+    request := *data
+    request.Command = "fetch"
+    request.Offset, request.Length = offset, 0
+
+    response, err := s.request(address, &request)
+    if err != nil {
+        return 0, err
+    }
+    defer response.Close()
+    return datamgmt.ReadStreamWithSizePrefix(response.reader.GzipReader, writer)
+}
+
+// verifiedPrefix checks the first received bytes of a partial download against the piece
+// hashes, truncates the file after the last intact piece and returns its new length.
+func verifiedPrefix(file *os.File, info *datamgmt.ObjectInfo, received int64) (int64, error) {
+    var verified int64
+    for index := 0; index < info.PieceCount(); index++ {
+        offset, length := info.PieceRange(index)
+        if offset+length > received {
+            break
+        }
+        piece := make([]byte, length)
+        if _, err := file.ReadAt(piece, offset); err != nil {
+            return 0, err
+        }
+        if !info.VerifyPiece(index, piece) {
+            break
+        }
+        verified = offset + length
+    }
+    if err := file.Truncate(verified); err != nil {
+        return 0, err
+    }
+    _, err := file.Seek(verified, io.SeekStart)
+    return verified, err
+}
+
+// chunkFile splits a file into content-defined chunks, returning each chunk's reference and
+// offset within the file along with the checksum of the whole file.
+func chunkFile(file *os.File) ([]datamgmt.ChunkRef, []int64, string, error) {
+    if _, err := file.Seek(0, io.SeekStart); err != nil {
+        return nil, nil, "", err
+    }
+    var refs []datamgmt.ChunkRef
+    var offsets []int64
+    var offset int64
+    hasher := datamgmt.NewChecksum()
+    chunker := datamgmt.NewChunker(io.TeeReader(file, hasher))
+    for {
+        chunk, err := chunker.Next()
+        if err == io.EOF {
+            return refs, offsets, hex.EncodeToString(hasher.Sum(nil)), nil
+        }
+        if err != nil {
+            return nil, nil, "", err
+        }
+        refs = append(refs, datamgmt.ChunkRef{Hash: datamgmt.HashChunk(chunk), Size: int64(len(chunk))})
+        offsets = append(offsets, offset)
+        offset += int64(len(chunk))
+    }
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+)
+
+func readStored(t *testing.T, service *StorageService, data *datamgmt.Data) []byte {
+    reader, err := service.ReadData(data)
+    if err != nil {
+        t.Fatalf("ReadData() error = %v", err)
+    }
+    defer reader.Close()
+    content, _ := io.ReadAll(reader)
+    return content
+}
+
+func TestServer_ResumesInterruptedUpload(t *testing.T) {
+    content := make([]byte, 2<<20)
+    if _, err := rand.Read(content); err != nil {
+        t.Fatal(err)
+    }
+    path := filepath.Join(t.TempDir(), "upload.bin")
+    if err := os.WriteFile(path, content, 0600); err != nil {
+        t.Fatal(err)
+    }
+    file, err := os.Open(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+
+    receiver := startTestServer(t, "127.0.0.1:3321", nil)
+    sender := NewServer("127.0.0.1:3320")
+    defer os.RemoveAll(sender.storage.rootPath)
+
+    // Simulate a transfer that dropped after half of the chunks were committed
+    data := &datamgmt.Data{ID: "1", Filename: "upload", Extension: "bin", Command: "sync"}
+    refs, offsets, _, err := chunkFile(file)
+    if err != nil {
+        t.Fatalf("chunkFile() error = %v", err)
+    }
+    data.SessionID = uploadSessionID(data, refs)
+    if _, err := receiver.storage.OpenUploadSession(data.SessionID, data, refs); err != nil {
+        t.Fatalf("OpenUploadSession() error = %v", err)
+    }
+    half := len(refs) / 2
+    for i := 0; i < half; i++ {
+        chunk := content[offsets[i] : offsets[i]+refs[i].Size]
+        if err := receiver.storage.PutChunk(refs[i], chunk); err != nil {
+            t.Fatalf("PutChunk() error = %v", err)
+        }
+        if err := receiver.storage.ReceivedChunk(data.SessionID, refs[i].Hash); err != nil {
+            t.Fatalf("ReceivedChunk() error = %v", err)
+        }
+    }
+
+    offset, err := sender.queryUploadOffset("127.0.0.1:3321", data)
+    if err != nil {
+        t.Fatalf("queryUploadOffset() error = %v", err)
+    }
+    if offset != offsets[half] {
+        t.Errorf("Expected committed offset %d, got %d", offsets[half], offset)
+    }
+
+    if err := sender.syncData("127.0.0.1:3321", data, file); err != nil {
+        t.Fatalf("syncData() error = %v", err)
+    }
+    if !bytes.Equal(readStored(t, receiver.storage, data), content) {
+        t.Errorf("Stored content does not match the uploaded file")
+    }
+    if _, err := os.Stat(receiver.storage.sessionPath(data.SessionID)); !os.IsNotExist(err) {
+        t.Errorf("Upload session was not removed after completion")
+    }
+}
+
+func TestServer_ResumesInterruptedDownload(t *testing.T) {
+    content := make([]byte, 2*datamgmt.DefaultPieceSize+4321)
+    if _, err := rand.Read(content); err != nil {
+        t.Fatal(err)
+    }
+    startTestServer(t, "127.0.0.1:3331", content)
+    client := NewServer("127.0.0.1:3330")
+    defer os.RemoveAll(client.storage.rootPath)
+
+    // Leave a partial download with one intact piece followed by corrupted bytes
+    data := &datamgmt.Data{ID: "1", Filename: "swarm", Extension: "bin", Command: "fetch"}
+    partial, _, err := client.storage.OpenPartialDownload(data)
+    if err != nil {
+        t.Fatalf("OpenPartialDownload() error = %v", err)
+    }
+    partial.Write(content[:datamgmt.DefaultPieceSize])
+    partial.Write(make([]byte, 1000))
+    partial.Close()
+
+    if err := client.resumableFetch("127.0.0.1:3331", data); err != nil {
+        t.Fatalf("resumableFetch() error = %v", err)
+    }
+    if !bytes.Equal(readStored(t, client.storage, data), content) {
+        t.Errorf("Downloaded content does not match the original")
+    }
+    if _, err := os.Stat(partial.Name()); !os.IsNotExist(err) {
+        t.Errorf("Partial download was not removed after completion")
+    }
+}
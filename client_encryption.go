@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/encryption"
+	"github.com/tejasprabhu/GopherStore/logger"
+)
+
+// encryptedExtension replaces the extension of files whose names are encrypted.
+const encryptedExtension = "enc"
+
+// sharedPrefix marks a file another node shared with us, such as "shared:report.pdf", so a
+// grant can never stand in for a file of our own with the same name.
+const sharedPrefix = "shared:"
+
+var (
+    encryptionKey []byte // Key files are encrypted with before they are sent, nil to send plaintext
+    encryptNames  bool   // Whether file names are encrypted as well
+    currentBucket string // Bucket files are addressed in, empty for none
+)
+
+// fileMetadata builds the metadata addressing a local file on the network. With name
+// encryption enabled, peers only ever see the encrypted name; a file another node shared
+// with us, named with sharedPrefix, is addressed by the name recorded in its grant and can
+// only be read, and any other file lives in the current bucket.
+func fileMetadata(command, filePath string) (*datamgmt.Data, error) {
+    fileName, fileExt := getFileName(filePath)
+    metadata := &datamgmt.Data{
+        ID:        "001",
+        Filename:  fileName,
+        Command:   command,
+        OriginID:  "clientID",
+        Extension: fileExt,
+    }
+    if name, ok := strings.CutPrefix(filePath, sharedPrefix); ok {
+        grant := sharedGrant(filePath)
+        if grant == nil {
+            return nil, fmt.Errorf("no file named %q was shared with this node", name)
+        }
+        if command != "fetch" && command != "stat" && command != "versions" {
+            return nil, fmt.Errorf("a shared file can only be read, not used for %s", command)
+        }
+        metadata.Filename, metadata.Extension = grant.Filename, grant.Extension
+        return metadata, nil
+    }
+    if encryptNames {
+        encrypted, err := encryption.EncryptName(encryptionKey, metadata.Key())
+        if err != nil {
+            return nil, err
+        }
+        metadata.Filename, metadata.Extension = encrypted, encryptedExtension
+    }
+    metadata.Bucket = currentBucket
+    return metadata, nil
+}
+
+// encryptFile writes an encrypted copy of file to a temporary file, which the caller must
+// close and remove.
+func encryptFile(file *os.File) (*os.File, error) {
+    temp, err := os.CreateTemp("", "gopherstore-encrypted-*")
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to create temporary file")
+        return nil, err
+    }
+    if err := encryption.Encrypt(encryptionKey, temp, file); err != nil {
+        logger.Log.WithError(err).Error("Failed to encrypt file")
+        temp.Close()
+        os.Remove(temp.Name())
+        return nil, err
+    }
+    return temp, nil
+}
+
+// sharedGrant returns the grant another node gave us for a file named with sharedPrefix, if
+// any.
+func sharedGrant(filePath string) *encryption.Grant {
+    name, ok := strings.CutPrefix(filePath, sharedPrefix)
+    if keystore == nil || !ok {
+        return nil
+    }
+    grant, _ := keystore.Grant(name)
+    return grant
+}
+
+// decryptsOnFetch reports whether a fetched file is encrypted for us and must be decrypted.
+func decryptsOnFetch(filePath string) bool {
+    return encryptionKey != nil || sharedGrant(filePath) != nil
+}
+
+// fileKey recovers the key of an encrypted file, either with one of our user keys or
+// through a grant from the node that shared the file with us.
+func fileKey(header *encryption.Header, filePath string) ([]byte, error) {
+    key, err := header.FileKey(userKeys()...)
+    if err == nil {
+        return key, nil
+    }
+    if grant := sharedGrant(filePath); grant != nil {
+        nodeKeys, err := keystore.All(encryption.NodeKey)
+        if err != nil {
+            return nil, err
+        }
+        return grant.FileKey(nodeKeys...)
+    }
+    return nil, err
+}
+
+// saveDecrypted decrypts a fetched file from local storage and writes the plaintext to the
+// working directory under its original name.
+func saveDecrypted(metadata *datamgmt.Data, filePath string) error {
+    reader, err := server.storage.ReadData(metadata)
+    if err != nil {
+        return err
+    }
+    defer reader.Close()
+
+    header, err := encryption.ReadHeader(reader)
+    if err != nil {
+        logger.Log.WithError(err).WithField("key", metadata.Key()).Error("Failed to read encrypted file")
+        return err
+    }
+    key, err := fileKey(header, filePath)
+    if err != nil {
+        logger.Log.WithError(err).WithField("key", metadata.Key()).Error("No key can decrypt the file")
+        return err
+    }
+
+    output := filepath.Base(strings.TrimPrefix(filePath, sharedPrefix))
+    temp, err := os.CreateTemp(".", output+tempFileMarker+"*")
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to create output file")
+        return err
+    }
+    defer os.Remove(temp.Name())
+
+    if err := encryption.DecryptBody(key, header, temp, reader); err != nil {
+        logger.Log.WithError(err).WithField("key", metadata.Key()).Error("Failed to decrypt file")
+        temp.Close()
+        return err
+    }
+    if err := temp.Close(); err != nil {
+        return err
+    }
+    if err := os.Rename(temp.Name(), output); err != nil {
+        return err
+    }
+    logger.Log.WithField("path", output).Info("Decrypted file saved")
+    return nil
+}
+
+// openForSending opens a file to be sent, encrypting it first when a key is configured.
+// The returned function releases the file and any temporary copy.
+func openForSending(filePath string) (*os.File, func(), error) {
+    file, err := os.Open(filepath.Clean(filePath))
+    if err != nil {
+        return nil, nil, err
+    }
+    if encryptionKey == nil {
+        return file, func() { file.Close() }, nil
+    }
+
+    defer file.Close()
+    encrypted, err := encryptFile(file)
+    if err != nil {
+        return nil, nil, err
+    }
+    if _, err := encrypted.Seek(0, io.SeekStart); err != nil {
+        encrypted.Close()
+        os.Remove(encrypted.Name())
+        return nil, nil, err
+    }
+    return encrypted, func() {
+        encrypted.Close()
+        os.Remove(encrypted.Name())
+    }, nil
+}
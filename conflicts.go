@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/logger"
+)
+
+// Every write carries a vector clock: the writer's own counter incremented on top of the
+// clocks of the versions it has seen. A write whose clock descends from the current version
+// replaces it, one that precedes it is rejected as stale, and one concurrent with it becomes
+// a sibling. The node's ConflictResolver decides which siblings stay current; the others are
+// kept as older versions, so no write is lost silently either way.
+
+// clockDirName holds the clocks of the writes this node sent to other nodes, so its next
+// write of the same file descends from them even though it keeps no copy of the file.
+const clockDirName = "clocks"
+
+const defaultConflictResolution = "lww"
+
+var errStaleWrite = errors.New("write is older than the stored version, fetch the file and retry")
+
+// ConflictResolver decides between concurrent versions of a file.
+type ConflictResolver interface {
+    // Resolve returns the versions that stay current out of siblings, which are pairwise
+    // concurrent and include the version being written.
+    Resolve(siblings []*Manifest) []*Manifest
+}
+
+// ConflictResolverFunc adapts a function to a ConflictResolver.
+type ConflictResolverFunc func(siblings []*Manifest) []*Manifest
+
+func (f ConflictResolverFunc) Resolve(siblings []*Manifest) []*Manifest {
+    return f(siblings)
+}
+
+// LastWriterWins keeps the sibling its writer modified last.
+type LastWriterWins struct{}
+
+func (LastWriterWins) Resolve(siblings []*Manifest) []*Manifest {
+    sortVersions(siblings)
+    return siblings[len(siblings)-1:]
+}
+
+// KeepBoth keeps every sibling current until a client writes a version that descends from
+// all of them.
+type KeepBoth struct{}
+
+func (KeepBoth) Resolve(siblings []*Manifest) []*Manifest {
+    return siblings
+}
+
+var conflictResolvers = map[string]ConflictResolver{
+    "lww":       LastWriterWins{},
+    "keep-both": KeepBoth{},
+}
+
+// RegisterConflictResolver makes a custom resolver available to -conflict-resolution under
+// name.
+func RegisterConflictResolver(name string, resolver ConflictResolver) {
+    conflictResolvers[name] = resolver
+}
+
+// conflictResolver looks up a resolver by name.
+func conflictResolver(name string) (ConflictResolver, error) {
+    resolver, ok := conflictResolvers[name]
+    if !ok {
+        names := make([]string, 0, len(conflictResolvers))
+        for name := range conflictResolvers {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        return nil, fmt.Errorf("unknown conflict resolution %q, expected one of %s", name, strings.Join(names, ", "))
+    }
+    return resolver, nil
+}
+
+// sortVersions orders versions by when their writers made them, oldest first.
+func sortVersions(versions []*Manifest) {
+    sort.Slice(versions, func(i, j int) bool {
+        if !versions[i].ModifiedAt.Equal(versions[j].ModifiedAt) {
+            return versions[i].ModifiedAt.Before(versions[j].ModifiedAt)
+        }
+        return versions[i].VersionID < versions[j].VersionID
+    })
+}
+
+// mergedClock returns a clock descending from the clocks of all versions.
+func mergedClock(versions []*Manifest) datamgmt.VectorClock {
+    clock := datamgmt.VectorClock{}
+    for _, version := range versions {
+        clock = clock.Merge(version.Clock)
+    }
+    return clock
+}
+
+// resolveWrite works out which versions of a file are current once incoming is written over
+// the current ones, oldest first so the last one becomes the latest version.
+func (s *StorageService) resolveWrite(current []*Manifest, incoming *Manifest) ([]*Manifest, error) {
+    if len(incoming.Clock) == 0 {
+        // Writes without a clock replace everything they overwrite, as before clocks, except
+        // tombstones: such a write cannot tell whether it saw the delete.
+        for _, version := range current {
+            if version.Deleted && !incoming.Deleted {
+                return nil, errResurrection
+            }
+        }
+        incoming.Clock = mergedClock(current)
+        return []*Manifest{incoming}, nil
+    }
+
+    var concurrent []*Manifest
+    for _, version := range current {
+        switch incoming.Clock.Compare(version.Clock) {
+        case datamgmt.Before:
+            return nil, errStaleWrite
+        case datamgmt.Equal:
+            if version.Deleted && !incoming.Deleted {
+                return nil, errResurrection
+            }
+        case datamgmt.Concurrent:
+            concurrent = append(concurrent, version)
+        }
+    }
+    if len(concurrent) == 0 {
+        return []*Manifest{incoming}, nil
+    }
+
+    resolver := s.resolver
+    if resolver == nil {
+        resolver = LastWriterWins{}
+    }
+    siblings := append(concurrent, incoming)
+    live := resolver.Resolve(append([]*Manifest(nil), siblings...))
+    if len(live) == 0 {
+        live = []*Manifest{incoming}
+    }
+    sortVersions(live)
+
+    logger.Log.WithFields(map[string]interface{}{
+        "key":      incoming.Filename + "." + incoming.Extension,
+        "siblings": len(siblings),
+        "current":  len(live),
+    }).Warn("Concurrent writes detected")
+    return live, nil
+}
+
+// currentVersions returns latest and the siblings it lists. The caller must hold the mutex.
+func (s *StorageService) currentVersions(path string, latest *Manifest) []*Manifest {
+    if latest == nil {
+        return nil
+    }
+    var current []*Manifest
+    for _, id := range latest.Siblings {
+        sibling, err := s.loadManifest(s.versionPath(path, id))
+        if err != nil {
+            logger.Log.WithError(err).WithField("version", id).Warn("Skipping unreadable sibling")
+            continue
+        }
+        current = append(current, sibling)
+    }
+    return append(current, latest)
+}
+
+// DescribeVersions fills in the causal context of a file that readers need to write it
+// again: a clock descending from all its current versions, those other than the version
+// data selects, and when that version was written.
+func (s *StorageService) DescribeVersions(data *datamgmt.Data, info *datamgmt.ObjectInfo) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    path, err := s.generateFilePath(data)
+    if err != nil {
+        return err
+    }
+    latest, err := s.loadManifest(path)
+    if err != nil {
+        return err
+    }
+    selected := data.Version
+    if selected == "" {
+        selected = latest.VersionID
+    }
+    current := s.currentVersions(path, latest)
+    info.Clock = mergedClock(current)
+    info.Siblings = nil
+    for _, version := range current {
+        if version.VersionID == selected {
+            info.ModifiedAt, info.ExpiresAt, info.Tags = version.ModifiedAt, version.ExpiresAt, version.Tags
+        } else {
+            info.Siblings = append(info.Siblings, version.VersionID)
+        }
+    }
+    return nil
+}
+
+// clockPath returns where the clock of this node's last write of a file is kept.
+func (s *StorageService) clockPath(data *datamgmt.Data) (string, error) {
+    path, err := s.generateFilePath(data)
+    if err != nil {
+        return "", err
+    }
+    relative, err := filepath.Rel(s.rootPath, path)
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(s.rootPath, clockDirName, relative), nil
+}
+
+// LoadClock returns the clock of this node's last write of a file, if any.
+func (s *StorageService) LoadClock(data *datamgmt.Data) datamgmt.VectorClock {
+    path, err := s.clockPath(data)
+    if err != nil {
+        return nil
+    }
+    content, err := os.ReadFile(path)
+    if err != nil {
+        if !errors.Is(err, fs.ErrNotExist) {
+            logger.Log.WithError(err).Warn("Failed to read write clock")
+        }
+        return nil
+    }
+    var clock datamgmt.VectorClock
+    if err := json.Unmarshal(content, &clock); err != nil {
+        logger.Log.WithError(err).Warn("Ignoring invalid write clock")
+        return nil
+    }
+    return clock
+}
+
+// SaveClock records data.Clock as the clock of this node's last write of a file.
+func (s *StorageService) SaveClock(data *datamgmt.Data) error {
+    path, err := s.clockPath(data)
+    if err != nil {
+        return err
+    }
+    content, err := json.Marshal(data.Clock)
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(path, content)
+}
+
+// writeClock returns the clock for a write of data by this node. It descends from the
+// versions stored here and from this node's earlier writes, so only writes this node has
+// not seen are concurrent with it.
+func (s *Server) writeClock(data *datamgmt.Data) datamgmt.VectorClock {
+    request := *data
+    request.Version = ""
+    var info datamgmt.ObjectInfo
+    if err := s.storage.DescribeVersions(&request, &info); err != nil && !errors.Is(err, fs.ErrNotExist) {
+        logger.Log.WithError(err).Warn("Failed to read local versions")
+    }
+    return info.Clock.Merge(s.storage.LoadClock(data)).Increment(s.dht.Self().ID.String())
+}
+
+// warnSiblings tells the user that the file being fetched has concurrent versions, which they
+// can list with the versions command and resolve by sending the file again.
+func warnSiblings(data *datamgmt.Data, info *datamgmt.ObjectInfo) {
+    if len(info.Siblings) > 0 {
+        logger.Log.WithField("key", data.Key()).WithField("siblings", info.Siblings).Warn("File has conflicting versions, sending it again resolves them")
+    }
+}
@@ -0,0 +1,47 @@
+package datamgmt
+
+import "fmt"
+
+// Permission is an operation an ACL can grant on a bucket or object.
+type Permission string
+
+const (
+    PermRead   Permission = "read"
+    PermWrite  Permission = "write"
+    PermDelete Permission = "delete"
+    PermList   Permission = "list"
+)
+
+// Everyone stands for every identity in an ACL's grants.
+const Everyone = "*"
+
+// ACL records who owns a bucket or object and the permissions granted on it to other
+// identities. The owner holds every permission.
+type ACL struct {
+    Owner  string
+    Grants map[string][]Permission
+}
+
+// Allows reports whether identity holds permission under the ACL.
+func (a *ACL) Allows(identity string, permission Permission) bool {
+    if identity == a.Owner {
+        return true
+    }
+    for _, grantee := range []string{identity, Everyone} {
+        for _, granted := range a.Grants[grantee] {
+            if granted == permission {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// ParsePermission checks that name is a known permission.
+func ParsePermission(name string) (Permission, error) {
+    switch permission := Permission(name); permission {
+    case PermRead, PermWrite, PermDelete, PermList:
+        return permission, nil
+    }
+    return "", fmt.Errorf("unknown permission %q, expected read, write, delete or list", name)
+}
@@ -0,0 +1,28 @@
+package datamgmt
+
+import "testing"
+
+func TestACL_Allows(t *testing.T) {
+    acl := ACL{
+        Owner: "client:alice",
+        Grants: map[string][]Permission{
+            "client:bob":      {PermRead, PermList},
+            Everyone: {PermList},
+        },
+    }
+    for _, test := range []struct {
+        identity   string
+        permission Permission
+        allowed    bool
+    }{
+        {"client:alice", PermDelete, true},
+        {"client:bob", PermRead, true},
+        {"client:bob", PermWrite, false},
+        {"client:carol", PermList, true},
+        {"client:carol", PermRead, false},
+    } {
+        if allowed := acl.Allows(test.identity, test.permission); allowed != test.allowed {
+            t.Errorf("Allows(%s, %s) = %v, want %v", test.identity, test.permission, allowed, test.allowed)
+        }
+    }
+}
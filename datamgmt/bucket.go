@@ -0,0 +1,35 @@
+package datamgmt
+
+import (
+	"fmt"
+	"time"
+)
+
+// Bucket is a named namespace of objects with its own settings. Objects in different
+// buckets never collide, even when their names are the same.
+type Bucket struct {
+    Name         string
+    CreatedAt    time.Time
+    Replicas     int   // Copies of each object kept on the network, counting the first
+    Versioned    bool  // Older versions are kept when objects are overwritten or deleted
+    Encrypted    bool  // Objects are only stored by nodes that encrypt data at rest
+    QuotaBytes   int64 // Bytes the bucket may hold across all versions, zero for no limit
+    QuotaObjects int   // Objects the bucket may hold, zero for no limit
+    ACL          ACL   // Owner of the bucket and permissions granted on its objects
+}
+
+// ValidateBucketName checks that name can name a bucket: 3 to 63 lowercase letters, digits
+// and hyphens, starting and ending with a letter or digit. This also keeps peer-supplied
+// names from escaping the storage directories.
+func ValidateBucketName(name string) error {
+    if len(name) < 3 || len(name) > 63 {
+        return fmt.Errorf("bucket name %q must be 3 to 63 characters long", name)
+    }
+    for i, c := range name {
+        alphanumeric := (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9')
+        if !alphanumeric && (c != '-' || i == 0 || i == len(name)-1) {
+            return fmt.Errorf("bucket name %q may only hold lowercase letters, digits and inner hyphens", name)
+        }
+    }
+    return nil
+}
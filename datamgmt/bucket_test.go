@@ -0,0 +1,16 @@
+package datamgmt
+
+import "testing"
+
+func TestValidateBucketName(t *testing.T) {
+    for _, name := range []string{"logs", "team-7", "a1b"} {
+        if err := ValidateBucketName(name); err != nil {
+            t.Errorf("ValidateBucketName(%q) error = %v", name, err)
+        }
+    }
+    for _, name := range []string{"", "ab", "-logs", "logs-", "Logs", "../etc", "my.bucket", "a/b"} {
+        if err := ValidateBucketName(name); err == nil {
+            t.Errorf("Expected ValidateBucketName(%q) to fail", name)
+        }
+    }
+}
@@ -0,0 +1,36 @@
+package datamgmt
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// ErrChecksumMismatch is returned when received or stored content does not match the
+// checksum computed by its sender.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// NewChecksum returns the hash used for content checksums.
+func NewChecksum() hash.Hash {
+    return sha256.New()
+}
+
+// ComputeChecksum returns the hex-encoded checksum of everything read from reader.
+func ComputeChecksum(reader io.Reader) (string, error) {
+    hasher := NewChecksum()
+    if _, err := io.Copy(hasher, reader); err != nil {
+        return "", err
+    }
+    return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// VerifyChecksum compares an expected checksum with the one actually computed.
+func VerifyChecksum(expected, actual string) error {
+    if expected != actual {
+        return fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, expected, actual)
+    }
+    return nil
+}
@@ -0,0 +1,129 @@
+package datamgmt
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/bits"
+)
+
+// Chunk size bounds used for content-defined chunking.
+const (
+    MinChunkSize = 16 << 10
+    AvgChunkSize = 64 << 10
+    MaxChunkSize = 256 << 10
+)
+
+// gearTable holds the random values mixed into the rolling hash, one per byte value. It is
+// generated from a fixed seed so every node cuts identical content at identical boundaries.
+var gearTable = func() [256]uint64 {
+    var table [256]uint64
+    state := uint64(0x9e3779b97f4a7c15)
+    for i := range table {
+        // splitmix64
+        state += 0x9e3779b97f4a7c15
+        z := state
+        z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+        z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+        table[i] = z ^ (z >> 31)
+    }
+    return table
+}()
+
+// ChunkRef identifies a stored chunk by the SHA-256 hash of its content.
+type ChunkRef struct {
+    Hash string
+    Size int64
+}
+
+// HashChunk returns the content address of a chunk.
+func HashChunk(chunk []byte) string {
+    sum := sha256.Sum256(chunk)
+    return hex.EncodeToString(sum[:])
+}
+
+// Chunker splits a stream into variable-size chunks using FastCDC with normalized chunking,
+// so an edit only changes the chunks around it instead of shifting every later boundary.
+type Chunker struct {
+    reader io.Reader
+    buffer []byte
+    start  int
+    end    int
+    eof    bool
+    maskS  uint64
+    maskL  uint64
+}
+
+// NewChunker creates a chunker reading from reader with the default chunk sizes.
+func NewChunker(reader io.Reader) *Chunker {
+    avgBits := bits.Len(uint(AvgChunkSize)) - 1
+    return &Chunker{
+        reader: reader,
+        buffer: make([]byte, MaxChunkSize),
+        maskS:  highBitsMask(avgBits + 2),
+        maskL:  highBitsMask(avgBits - 2),
+    }
+}
+
+// highBitsMask sets the n most significant bits; the top bits of the gear hash depend on
+// the most recent 64 bytes, giving the rolling hash a 64-byte window.
+func highBitsMask(n int) uint64 {
+    return ^uint64(0) << (64 - n)
+}
+
+// Next returns the next chunk of the stream, or io.EOF once the stream is exhausted. The
+// returned slice is only valid until the following call.
+func (c *Chunker) Next() ([]byte, error) {
+    if c.end-c.start < MaxChunkSize && !c.eof {
+        copy(c.buffer, c.buffer[c.start:c.end])
+        c.end -= c.start
+        c.start = 0
+        n, err := io.ReadFull(c.reader, c.buffer[c.end:])
+        c.end += n
+        if err == io.EOF || err == io.ErrUnexpectedEOF {
+            c.eof = true
+        } else if err != nil {
+            return nil, err
+        }
+    }
+    if c.start == c.end {
+        return nil, io.EOF
+    }
+
+    cut := c.cutPoint(c.buffer[c.start:c.end])
+    chunk := c.buffer[c.start : c.start+cut]
+    c.start += cut
+    return chunk, nil
+}
+
+// cutPoint finds the chunk boundary in data, using a stricter mask before the average size
+// and a looser one after it to keep chunk sizes close to the average.
+func (c *Chunker) cutPoint(data []byte) int {
+    n := len(data)
+    if n <= MinChunkSize {
+        return n
+    }
+    if n > MaxChunkSize {
+        n = MaxChunkSize
+    }
+    normal := AvgChunkSize
+    if n < normal {
+        normal = n
+    }
+
+    var hash uint64
+    i := MinChunkSize
+    for ; i < normal; i++ {
+        hash = (hash << 1) + gearTable[data[i]]
+        if hash&c.maskS == 0 {
+            return i
+        }
+    }
+    for ; i < n; i++ {
+        hash = (hash << 1) + gearTable[data[i]]
+        if hash&c.maskL == 0 {
+            return i
+        }
+    }
+    return n
+}
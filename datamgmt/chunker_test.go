@@ -0,0 +1,59 @@
+package datamgmt
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func chunkAll(t *testing.T, content []byte) [][]byte {
+    var chunks [][]byte
+    chunker := NewChunker(bytes.NewReader(content))
+    for {
+        chunk, err := chunker.Next()
+        if err == io.EOF {
+            return chunks
+        }
+        if err != nil {
+            t.Fatalf("Next() error = %v", err)
+        }
+        chunks = append(chunks, bytes.Clone(chunk))
+    }
+}
+
+func TestChunker_Boundaries(t *testing.T) {
+    content := make([]byte, 4<<20)
+    rand.New(rand.NewSource(1)).Read(content)
+
+    chunks := chunkAll(t, content)
+    if !bytes.Equal(bytes.Join(chunks, nil), content) {
+        t.Fatalf("Chunks do not reassemble into the original content")
+    }
+    for i, chunk := range chunks {
+        if len(chunk) > MaxChunkSize || (len(chunk) < MinChunkSize && i != len(chunks)-1) {
+            t.Errorf("Chunk %d has size %d outside [%d, %d]", i, len(chunk), MinChunkSize, MaxChunkSize)
+        }
+    }
+}
+
+func TestChunker_EditOnlyChangesNearbyChunks(t *testing.T) {
+    content := make([]byte, 4<<20)
+    rand.New(rand.NewSource(2)).Read(content)
+    edited := append([]byte("inserted"), content...)
+
+    original := make(map[string]bool)
+    for _, chunk := range chunkAll(t, content) {
+        original[HashChunk(chunk)] = true
+    }
+    changed := 0
+    editedChunks := chunkAll(t, edited)
+    for _, chunk := range editedChunks {
+        if !original[HashChunk(chunk)] {
+            changed++
+        }
+    }
+    if changed > 2 {
+        t.Errorf("Expected an insertion to change at most 2 chunks, changed %d of %d", changed, len(editedChunks))
+    }
+}
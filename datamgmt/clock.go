@@ -0,0 +1,99 @@
+package datamgmt
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// VectorClock records the causal history of an object as a counter per node ID. Every
+// write increments the writer's own counter on top of the clock of the version it read, so
+// comparing two clocks tells whether one write saw the other or they happened concurrently.
+type VectorClock map[string]uint64
+
+// Ordering is the causal relation between two vector clocks.
+type Ordering int
+
+const (
+	Equal      Ordering = iota // Both clocks record the same history
+	Before                     // The clock is an ancestor of the other one
+	After                      // The clock descends from the other one
+	Concurrent                 // Neither clock saw the other's write
+)
+
+func (o Ordering) String() string {
+    switch o {
+    case Equal:
+        return "equal"
+    case Before:
+        return "before"
+    case After:
+        return "after"
+    default:
+        return "concurrent"
+    }
+}
+
+// Compare returns how c relates to other. Missing entries count as zero, so an empty clock
+// comes before every other clock.
+func (c VectorClock) Compare(other VectorClock) Ordering {
+    behind, ahead := false, false
+    for node, counter := range c {
+        if counter > other[node] {
+            ahead = true
+        } else if counter < other[node] {
+            behind = true
+        }
+    }
+    for node, counter := range other {
+        if _, ok := c[node]; !ok && counter > 0 {
+            behind = true
+        }
+    }
+    switch {
+    case ahead && behind:
+        return Concurrent
+    case ahead:
+        return After
+    case behind:
+        return Before
+    default:
+        return Equal
+    }
+}
+
+// Merge returns a new clock holding the highest counter of each node in either clock, which
+// descends from both.
+func (c VectorClock) Merge(other VectorClock) VectorClock {
+    merged := make(VectorClock, len(c))
+    for node, counter := range c {
+        merged[node] = counter
+    }
+    for node, counter := range other {
+        if counter > merged[node] {
+            merged[node] = counter
+        }
+    }
+    return merged
+}
+
+// Increment returns a new clock that descends from c with the counter of node advanced,
+// recording a write made by that node.
+func (c VectorClock) Increment(node string) VectorClock {
+    next := c.Merge(nil)
+    next[node]++
+    return next
+}
+
+// String formats the clock as "node:counter" pairs sorted by node ID.
+func (c VectorClock) String() string {
+    nodes := make([]string, 0, len(c))
+    for node := range c {
+        nodes = append(nodes, node)
+    }
+    sort.Strings(nodes)
+    for i, node := range nodes {
+        nodes[i] = fmt.Sprintf("%s:%d", node, c[node])
+    }
+    return "{" + strings.Join(nodes, ", ") + "}"
+}
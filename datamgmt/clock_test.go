@@ -0,0 +1,32 @@
+package datamgmt
+
+import "testing"
+
+func TestVectorClockCompare(t *testing.T) {
+    base := VectorClock{}.Increment("a")
+    fromA := base.Increment("a")
+    fromB := base.Increment("b")
+
+    tests := []struct {
+        name     string
+        clock    VectorClock
+        other    VectorClock
+        expected Ordering
+    }{
+        {"empty clocks", nil, VectorClock{}, Equal},
+        {"same history", fromA, VectorClock{"a": 2}, Equal},
+        {"ancestor", base, fromA, Before},
+        {"descendant", fromA, base, After},
+        {"empty comes first", nil, base, Before},
+        {"independent writes", fromA, fromB, Concurrent},
+        {"merge resolves", fromA.Merge(fromB).Increment("b"), fromA, After},
+    }
+    for _, tt := range tests {
+        if got := tt.clock.Compare(tt.other); got != tt.expected {
+            t.Errorf("%s: %v.Compare(%v) = %v, want %v", tt.name, tt.clock, tt.other, got, tt.expected)
+        }
+    }
+    if base["a"] != 1 {
+        t.Errorf("Increment() modified the clock it was called on: %v", base)
+    }
+}
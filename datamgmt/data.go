@@ -1,5 +1,9 @@
 package datamgmt
 
+import (
+	"fmt"
+	"time"
+)
 
 type Data struct {
     ID        string
@@ -7,4 +11,42 @@ type Data struct {
     OriginID  string
     Extension string
     Command string
-}
\ No newline at end of file
+    Offset    int64       // Start of the requested byte range
+    Length    int64       // Length of the requested byte range, zero meaning until the end
+    Ranges    []ByteRange // Multiple byte ranges to fetch, taking precedence over Offset and Length
+    Error     string      // Reason a request failed, set on "error" responses
+    SessionID string      // Identifies a resumable upload
+    Checksum  string      // SHA-256 of the whole object as read by its sender, verified before it is stored
+    Version   string      // Version of the object to read or delete, empty meaning the latest
+    Clock      VectorClock // Causal context of a write, telling which versions it replaces
+    ModifiedAt time.Time   // When the writer made the change, ordering concurrent writes
+    Forwarded  bool        // Set on writes and deletes forwarded between replicas, which are not forwarded again
+    TTL        time.Duration // How long the object is kept after it is stored, zero meaning forever
+    ExpiresAt  time.Time     // When the object expires, taking precedence over TTL
+    Tags       map[string]string // Labels stored with the object, which lifecycle rules select by
+    Bucket     string  // Bucket holding the object, empty for the default namespace
+    Settings   *Bucket // Settings of the bucket created by create-bucket or a forwarded write
+    ACL        *ACL    // Grants set by set-acl
+    Operations []Permission // Operations a capability is requested for
+}
+
+// Key returns the name under which the object is addressed across the network, prefixed
+// by its bucket if it is in one.
+func (d *Data) Key() string {
+    if d.Bucket != "" {
+        return fmt.Sprintf("%s:%s.%s", d.Bucket, d.Filename, d.Extension)
+    }
+    return fmt.Sprintf("%s.%s", d.Filename, d.Extension)
+}
+
+// Expiry returns when the object expires if it is stored at now, or the zero time if it
+// never does.
+func (d *Data) Expiry(now time.Time) time.Time {
+    if !d.ExpiresAt.IsZero() {
+        return d.ExpiresAt
+    }
+    if d.TTL > 0 {
+        return now.Add(d.TTL)
+    }
+    return time.Time{}
+}
@@ -5,6 +5,9 @@ import (
 	"compress/gzip"
 	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"io"
 	"net"
 
@@ -78,10 +81,12 @@ func SendLengthPrefixedData(writer io.Writer, data []byte) error {
     return nil
 }
 
-// SendStreamWithSizePrefix sends a stream with its size prefixed to the writer.
+// SendStreamWithSizePrefix sends a stream with its size prefixed to the writer, followed by
+// a checksum trailer so the receiver can verify the content arrived intact.
 func SendStreamWithSizePrefix(writer io.Writer, stream io.Reader) error {
     buffer := new(bytes.Buffer)
-    size, err := io.Copy(buffer, stream)
+    hasher := NewChecksum()
+    size, err := io.Copy(io.MultiWriter(buffer, hasher), stream)
     if err != nil {
         logger.Log.WithError(err).Error("Failed to buffer stream")
         return err
@@ -94,16 +99,79 @@ func SendStreamWithSizePrefix(writer io.Writer, stream io.Reader) error {
         logger.Log.WithError(err).Error("Failed to write stream")
         return err
     }
+    if _, err := writer.Write(hasher.Sum(nil)); err != nil {
+        logger.Log.WithError(err).Error("Failed to write stream checksum")
+        return err
+    }
     return nil
 }
 
+// ReadStreamWithSizePrefix copies a stream written by SendStreamWithSizePrefix from the
+// reader to the writer and verifies its checksum trailer, returning ErrChecksumMismatch if
+// the content was corrupted. The number of bytes copied is returned even when the stream
+// ends early.
+func ReadStreamWithSizePrefix(reader io.Reader, writer io.Writer) (int64, error) {
+    size, err := ReadStreamSize(reader)
+    if err != nil {
+        return 0, err
+    }
+    return ReadStreamContent(reader, writer, size)
+}
+
+// ReadStreamSize reads the size prefix of a stream written by SendStreamWithSizePrefix, so
+// the receiver can decide whether to accept the stream before reading its content.
+func ReadStreamSize(reader io.Reader) (int64, error) {
+    var size uint32
+    if err := binary.Read(reader, binary.LittleEndian, &size); err != nil {
+        logger.Log.WithError(err).Error("Failed to read stream size")
+        return 0, err
+    }
+    return int64(size), nil
+}
+
+// ReadStreamContent copies the size bytes of content following a stream's size prefix from
+// the reader to the writer and verifies the checksum trailer, like ReadStreamWithSizePrefix.
+func ReadStreamContent(reader io.Reader, writer io.Writer, size int64) (int64, error) {
+    hasher := NewChecksum()
+    copied, err := io.CopyN(io.MultiWriter(writer, hasher), reader, size)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to read stream")
+        return copied, err
+    }
+
+    trailer := make([]byte, hasher.Size())
+    if _, err := io.ReadFull(reader, trailer); err != nil {
+        logger.Log.WithError(err).Error("Failed to read stream checksum")
+        return copied, err
+    }
+    actual := hex.EncodeToString(hasher.Sum(nil))
+    if err := VerifyChecksum(hex.EncodeToString(trailer), actual); err != nil {
+        logger.Log.WithError(err).Error("Stream failed checksum verification")
+        return copied, err
+    }
+    return copied, nil
+}
+
+// ErrFrameTooLarge is returned when a length prefix announces more data than the reader
+// accepts.
+var ErrFrameTooLarge = errors.New("frame too large")
+
 // ReadLengthPrefixedData reads data from the reader prefixed with its length.
 func ReadLengthPrefixedData(reader io.Reader) ([]byte, error) {
+    return ReadLimitedData(reader, -1)
+}
+
+// ReadLimitedData reads data from the reader prefixed with its length, refusing data longer
+// than limit bytes before allocating it. A negative limit accepts any length.
+func ReadLimitedData(reader io.Reader, limit int) ([]byte, error) {
     var length uint32
     if err := binary.Read(reader, binary.LittleEndian, &length); err != nil {
         logger.Log.WithError(err).Error("Failed to read length prefix")
         return nil, err
     }
+    if limit >= 0 && int64(length) > int64(limit) {
+        return nil, fmt.Errorf("%w: %d bytes, at most %d accepted", ErrFrameTooLarge, length, limit)
+    }
     data := make([]byte, length)
     if _, err := io.ReadFull(reader, data); err != nil {
         logger.Log.WithError(err).Error("Failed to read data")
@@ -111,3 +179,32 @@ func ReadLengthPrefixedData(reader io.Reader) ([]byte, error) {
     }
     return data, nil
 }
+
+// SendEncodedData gob-encodes value and writes it to the writer with a length prefix.
+func SendEncodedData(writer io.Writer, value interface{}) error {
+    var buffer bytes.Buffer
+    if err := gob.NewEncoder(&buffer).Encode(value); err != nil {
+        logger.Log.WithError(err).Error("Failed to encode value")
+        return err
+    }
+    return SendLengthPrefixedData(writer, buffer.Bytes())
+}
+
+// ReadEncodedData reads a length-prefixed gob value from the reader into value.
+func ReadEncodedData(reader io.Reader, value interface{}) error {
+    return ReadLimitedEncodedData(reader, value, -1)
+}
+
+// ReadLimitedEncodedData reads a length-prefixed gob value from the reader into value,
+// refusing one encoded in more than limit bytes. A negative limit accepts any length.
+func ReadLimitedEncodedData(reader io.Reader, value interface{}, limit int) error {
+    payload, err := ReadLimitedData(reader, limit)
+    if err != nil {
+        return err
+    }
+    if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(value); err != nil {
+        logger.Log.WithError(err).Error("Failed to decode value")
+        return err
+    }
+    return nil
+}
@@ -1,7 +1,11 @@
 package datamgmt
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"net"
+	"strings"
 	"testing"
 )
 
@@ -53,6 +57,45 @@ func TestSendReceiveLengthPrefixedData(t *testing.T) {
     }
 }
 
+func TestReadLimitedData(t *testing.T) {
+    var buffer bytes.Buffer
+    if err := SendLengthPrefixedData(&buffer, []byte("hello world")); err != nil {
+        t.Fatalf("Failed to send length-prefixed data: %v", err)
+    }
+    frame := buffer.Bytes()
+
+    if data, err := ReadLimitedData(bytes.NewReader(frame), 11); err != nil || string(data) != "hello world" {
+        t.Errorf("Expected data within the limit to be read, got %q, %v", data, err)
+    }
+    if _, err := ReadLimitedData(bytes.NewReader(frame), 10); !errors.Is(err, ErrFrameTooLarge) {
+        t.Errorf("Expected data over the limit to be refused, got %v", err)
+    }
+}
+
+
+func TestReadStreamWithSizePrefix_DetectsCorruption(t *testing.T) {
+    var wire bytes.Buffer
+    if err := SendStreamWithSizePrefix(&wire, strings.NewReader("hello world")); err != nil {
+        t.Fatalf("SendStreamWithSizePrefix() error = %v", err)
+    }
+    encoded := wire.Bytes()
+
+    var received bytes.Buffer
+    if _, err := ReadStreamWithSizePrefix(bytes.NewReader(encoded), &received); err != nil {
+        t.Fatalf("ReadStreamWithSizePrefix() error = %v", err)
+    }
+    if received.String() != "hello world" {
+        t.Errorf("Expected 'hello world', got '%s'", received.String())
+    }
+
+    // Flip a bit in the content, after the four byte size prefix
+    corrupted := append([]byte(nil), encoded...)
+    corrupted[4] ^= 1
+    _, err := ReadStreamWithSizePrefix(bytes.NewReader(corrupted), io.Discard)
+    if !errors.Is(err, ErrChecksumMismatch) {
+        t.Errorf("Expected ErrChecksumMismatch, got %v", err)
+    }
+}
 
 // TestStreamAdapterIntegrity tests the integrity of data transmission using StreamAdapter.
 // func TestStreamAdapterIntegrity(t *testing.T) {
@@ -0,0 +1,70 @@
+package datamgmt
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"time"
+)
+
+// DefaultPieceSize is the size of the pieces an object is split into for multi-source downloads.
+const DefaultPieceSize = 1 << 20
+
+// ObjectInfo describes an object as a sequence of fixed-size pieces with their hashes.
+type ObjectInfo struct {
+    Size        int64
+    PieceSize   int64
+    PieceHashes []string
+    Checksum    string // Checksum of the whole object
+    Clock       VectorClock // Causal context covering every current version of the object
+    Siblings    []string    // Versions concurrent with the one described, left by conflicting writes
+    ModifiedAt  time.Time   // When the version described was written
+    ExpiresAt   time.Time   // When the version described expires, zero if it never does
+    Tags        map[string]string // Labels the version described was stored with
+}
+
+// ComputeObjectInfo reads the stream and hashes it in pieces of pieceSize bytes.
+func ComputeObjectInfo(reader io.Reader, pieceSize int64) (*ObjectInfo, error) {
+    info := &ObjectInfo{PieceSize: pieceSize}
+    checksum := NewChecksum()
+    reader = io.TeeReader(reader, checksum)
+    for {
+        hasher := sha256.New()
+        n, err := io.CopyN(hasher, reader, pieceSize)
+        if n > 0 {
+            info.Size += n
+            info.PieceHashes = append(info.PieceHashes, hex.EncodeToString(hasher.Sum(nil)))
+        }
+        if err == io.EOF {
+            info.Checksum = hex.EncodeToString(checksum.Sum(nil))
+            return info, nil
+        }
+        if err != nil {
+            return nil, err
+        }
+    }
+}
+
+// PieceCount returns the number of pieces in the object.
+func (info *ObjectInfo) PieceCount() int {
+    return len(info.PieceHashes)
+}
+
+// PieceRange returns the byte offset and length of the piece at index.
+func (info *ObjectInfo) PieceRange(index int) (int64, int64) {
+    offset := int64(index) * info.PieceSize
+    length := info.PieceSize
+    if offset+length > info.Size {
+        length = info.Size - offset
+    }
+    return offset, length
+}
+
+// VerifyPiece reports whether piece matches the recorded hash for index.
+func (info *ObjectInfo) VerifyPiece(index int, piece []byte) bool {
+    if index < 0 || index >= len(info.PieceHashes) {
+        return false
+    }
+    sum := sha256.Sum256(piece)
+    return hex.EncodeToString(sum[:]) == info.PieceHashes[index]
+}
@@ -0,0 +1,90 @@
+package datamgmt
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MaxRanges bounds how many byte ranges a single fetch may request.
+const MaxRanges = 64
+
+// ErrRangeNotSatisfiable is returned when a requested range lies outside the object.
+var ErrRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// ByteRange is a span of an object. A negative Offset selects the last -Offset bytes, and a
+// Length of zero extends the range to the end of the object.
+type ByteRange struct {
+    Offset int64
+    Length int64
+}
+
+// ParseRanges parses a comma-separated range specification in the style of HTTP byte
+// ranges, with inclusive ends: "0-99" (first 100 bytes), "500-" (from byte 500 to the end)
+// and "-200" (last 200 bytes).
+func ParseRanges(spec string) ([]ByteRange, error) {
+    var ranges []ByteRange
+    for _, part := range strings.Split(spec, ",") {
+        start, end, found := strings.Cut(strings.TrimSpace(part), "-")
+        if !found {
+            return nil, fmt.Errorf("invalid range %q", part)
+        }
+
+        var r ByteRange
+        switch {
+        case start == "":
+            suffix, err := strconv.ParseInt(end, 10, 64)
+            if err != nil || suffix <= 0 {
+                return nil, fmt.Errorf("invalid suffix range %q", part)
+            }
+            r.Offset = -suffix
+        default:
+            first, err := strconv.ParseInt(start, 10, 64)
+            if err != nil || first < 0 {
+                return nil, fmt.Errorf("invalid range start %q", part)
+            }
+            r.Offset = first
+            if end != "" {
+                last, err := strconv.ParseInt(end, 10, 64)
+                if err != nil || last < first {
+                    return nil, fmt.Errorf("invalid range end %q", part)
+                }
+                r.Length = last - first + 1
+            }
+        }
+        ranges = append(ranges, r)
+    }
+    if len(ranges) > MaxRanges {
+        return nil, fmt.Errorf("at most %d ranges may be requested", MaxRanges)
+    }
+    return ranges, nil
+}
+
+// ResolveRanges converts ranges into absolute spans of an object of the given size,
+// clamping them to its end.
+func ResolveRanges(ranges []ByteRange, size int64) ([]ByteRange, error) {
+    if len(ranges) > MaxRanges {
+        return nil, fmt.Errorf("at most %d ranges may be requested", MaxRanges)
+    }
+    resolved := make([]ByteRange, 0, len(ranges))
+    for _, r := range ranges {
+        if r.Length < 0 {
+            return nil, fmt.Errorf("invalid range length %d", r.Length)
+        }
+        if r.Offset < 0 {
+            r.Offset += size
+            if r.Offset < 0 {
+                r.Offset = 0
+            }
+        }
+        if r.Offset >= size && !(r.Offset == 0 && size == 0) {
+            return nil, fmt.Errorf("%w: offset %d of %d bytes", ErrRangeNotSatisfiable, r.Offset, size)
+        }
+        if r.Length == 0 || r.Offset+r.Length > size {
+            r.Length = size - r.Offset
+        }
+        resolved = append(resolved, r)
+    }
+    return resolved, nil
+}
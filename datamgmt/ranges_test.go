@@ -0,0 +1,46 @@
+package datamgmt
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseAndResolveRanges(t *testing.T) {
+    tests := []struct {
+        spec     string
+        size     int64
+        expected []ByteRange
+    }{
+        {"0-99", 1000, []ByteRange{{Offset: 0, Length: 100}}},
+        {"900-", 1000, []ByteRange{{Offset: 900, Length: 100}}},
+        {"-200", 1000, []ByteRange{{Offset: 800, Length: 200}}},
+        {"-5000", 1000, []ByteRange{{Offset: 0, Length: 1000}}},
+        {"990-2000", 1000, []ByteRange{{Offset: 990, Length: 10}}},
+        {"0-9, 500-509,-1", 1000, []ByteRange{{0, 10}, {500, 10}, {999, 1}}},
+    }
+    for _, test := range tests {
+        ranges, err := ParseRanges(test.spec)
+        if err != nil {
+            t.Errorf("ParseRanges(%q) error = %v", test.spec, err)
+            continue
+        }
+        resolved, err := ResolveRanges(ranges, test.size)
+        if err != nil {
+            t.Errorf("ResolveRanges(%q) error = %v", test.spec, err)
+            continue
+        }
+        if !reflect.DeepEqual(resolved, test.expected) {
+            t.Errorf("Range %q resolved to %v, expected %v", test.spec, resolved, test.expected)
+        }
+    }
+
+    for _, spec := range []string{"", "abc", "10-5", "-0", "5"} {
+        if _, err := ParseRanges(spec); err == nil {
+            t.Errorf("ParseRanges(%q) should fail", spec)
+        }
+    }
+    if _, err := ResolveRanges([]ByteRange{{Offset: 1000}}, 1000); !errors.Is(err, ErrRangeNotSatisfiable) {
+        t.Errorf("Expected ErrRangeNotSatisfiable, got %v", err)
+    }
+}
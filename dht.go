@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/logger"
+	"github.com/tejasprabhu/GopherStore/p2p"
+)
+
+const dhtTimeout = 10 * time.Second
+
+// handleDHTCommand answers a DHT RPC received on the connection. A peer that authenticated
+// with its node key may only send messages as that node.
+func (s *Server) handleDHTCommand(identity string, adapter *datamgmt.StreamAdapter, conn net.Conn) error {
+    var msg p2p.Message
+    if err := datamgmt.ReadEncodedData(adapter.GzipReader, &msg); err != nil {
+        logger.Log.WithError(err).Error("Failed to read DHT message")
+        return err
+    }
+    if strings.HasPrefix(identity, peerPrefix) && identity != peerIdentity(msg.Sender.ID) {
+        logger.Log.WithField("identity", identity).WithField("sender", msg.Sender.ID.String()).Warn("Refusing DHT message sent as another node")
+        return fmt.Errorf("%w: %s may not send DHT messages as %s", errAccessDenied, identity, msg.Sender.ID)
+    }
+
+    // Peers listening on 0.0.0.0 advertise an unusable host; use the one they came from.
+    msg.Sender.Address = p2p.ResolveAddress(msg.Sender.Address, conn.RemoteAddr())
+    reply := s.dht.HandleRPC(&msg)
+
+    writer, err := datamgmt.NewWriteStreamAdapter(conn)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to create write stream adapter")
+        return err
+    }
+    defer writer.Close()
+
+    if err := datamgmt.SendEncodedData(writer.GzipWriter, reply); err != nil {
+        logger.Log.WithError(err).Error("Failed to send DHT reply")
+        return err
+    }
+    if err := writer.GzipWriter.Flush(); err != nil {
+        logger.Log.WithError(err).Error("Failed to flush DHT reply")
+        return err
+    }
+    return nil
+}
+
+// dhtRPC delivers a DHT message to address over a dedicated connection and waits for the reply.
+func (s *Server) dhtRPC(address string, msg *p2p.Message) (*p2p.Message, error) {
+    conn, err := s.dial(address)
+    if err != nil {
+        return nil, err
+    }
+    defer conn.Close()
+
+    if err := conn.SetDeadline(time.Now().Add(dhtTimeout)); err != nil {
+        return nil, err
+    }
+
+    writer, err := datamgmt.NewWriteStreamAdapter(conn)
+    if err != nil {
+        return nil, err
+    }
+    defer writer.Close()
+
+    if err := datamgmt.SendEncodedData(writer.GzipWriter, &datamgmt.Data{Command: "dht"}); err != nil {
+        return nil, err
+    }
+    if err := datamgmt.SendEncodedData(writer.GzipWriter, msg); err != nil {
+        return nil, err
+    }
+    // Flush rather than close so the peer can answer before the stream ends.
+    if err := writer.GzipWriter.Flush(); err != nil {
+        return nil, err
+    }
+
+    reader, err := datamgmt.NewReadStreamAdapter(conn)
+    if err != nil {
+        return nil, err
+    }
+    defer reader.Close()
+
+    var reply p2p.Message
+    if err := datamgmt.ReadEncodedData(reader.GzipReader, &reply); err != nil {
+        return nil, err
+    }
+    return &reply, nil
+}
+
+// announce publishes this node as a provider of the object to the DHT.
+func (s *Server) announce(data *datamgmt.Data) {
+    if err := s.dht.Provide(data.Key()); err != nil {
+        logger.Log.WithError(err).WithField("key", data.Key()).Warn("Failed to announce object")
+    }
+}
+
+// republishLoop announces every stored file when the node starts, and again well within the
+// lifetime of provider records, so that the records of files it holds never expire.
+func (s *Server) republishLoop() {
+    defer s.wg.Done()
+    s.republish()
+    ticker := time.NewTicker(p2p.RepublishInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-s.quit:
+            return
+        case <-ticker.C:
+            s.republish()
+        }
+    }
+}
+
+// republish announces every stored file to the DHT and returns how many announcements
+// reached a peer.
+func (s *Server) republish() int {
+    files, err := s.storage.StoredFiles()
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to list stored files to republish")
+        return 0
+    }
+    announced := 0
+    for _, manifest := range files {
+        if err := s.dht.Provide(manifestData(manifest).Key()); err == nil {
+            announced++
+        }
+    }
+    if len(files) > 0 {
+        logger.Log.WithFields(map[string]interface{}{"files": len(files), "announced": announced}).Info("Provider records republished")
+    }
+    return announced
+}
+
+// locateProviders returns the addresses of remote peers that hold the object.
+func (s *Server) locateProviders(data *datamgmt.Data) ([]string, error) {
+    providers, err := s.dht.FindProviders(data.Key())
+    if err != nil {
+        return nil, err
+    }
+    addresses := make([]string, 0, len(providers))
+    for _, provider := range providers {
+        if provider.ID != s.dht.Self().ID {
+            addresses = append(addresses, provider.Address)
+        }
+    }
+    return addresses, nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+)
+
+func TestServer_Republish(t *testing.T) {
+    holder := startTestServer(t, "127.0.0.1:3387", []byte("stored before joining"))
+    peer := startTestServer(t, "127.0.0.1:3388", nil)
+    if err := peer.dht.Bootstrap([]string{"127.0.0.1:3387"}); err != nil {
+        t.Fatalf("Bootstrap() error = %v", err)
+    }
+
+    if announced := holder.republish(); announced != 1 {
+        t.Fatalf("Expected the stored file to be announced, %d were", announced)
+    }
+    data := &datamgmt.Data{ID: "1", Filename: "swarm", Extension: "bin"}
+    providers, err := peer.dht.FindProviders(data.Key())
+    if err != nil {
+        t.Fatalf("FindProviders() error = %v", err)
+    }
+    if len(providers) != 1 || providers[0].ID != holder.dht.Self().ID {
+        t.Errorf("Expected %s to provide the file, got %v", holder.dht.Self().Address, providers)
+    }
+}
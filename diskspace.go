@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/logger"
+)
+
+// Every storage tier can keep a reserve of free disk space that writes never use, so the
+// disk does not fill up halfway through a file. Tiers on the same file system share its free
+// space, which is only counted once. New chunks go to a tier with room to spare, and
+// writes the tiers cannot take are refused before any data is accepted. The node advertises
+// the space it has left to its peers with every DHT message, and tells them at once when it
+// becomes full, so shard placement can pass over full nodes.
+
+const (
+	defaultDiskReserve = 0
+	diskCheckInterval  = time.Minute
+)
+
+// diskWarnings are the fractions of the storage space left at which the node warns that it
+// is running low, from the first warning to the last.
+var diskWarnings = []float64{0.20, 0.10, 0.05}
+
+// SetDiskReserve sets the bytes of free disk space every tier leaves unused.
+func (s *StorageService) SetDiskReserve(reserve int64) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.reserve = reserve
+}
+
+// tierSpace returns how many more bytes a tier can store: what its capacity and the free
+// space of its disk beyond the reserve both allow. The caller must hold the mutex.
+func (s *StorageService) tierSpace(tier *storageTier) int64 {
+    space := int64(math.MaxInt64)
+    if tier.capacity > 0 {
+        space = tier.capacity - tier.used
+    }
+    if free, _, err := diskSpace(tier.root); err == nil {
+        space = min(space, free-s.reserve)
+    }
+    return max(space, 0)
+}
+
+// tierSize returns the most a tier can store, zero if it is unknown. The caller must hold
+// the mutex.
+func (s *StorageService) tierSize(tier *storageTier) int64 {
+    if tier.capacity > 0 {
+        return tier.capacity
+    }
+    if _, total, err := diskSpace(tier.root); err == nil {
+        return max(total-s.reserve, 0)
+    }
+    return 0
+}
+
+// Space returns how many more bytes the storage can take across its tiers, and the most it
+// can store, math.MaxInt64 and zero respectively if neither is limited. Tiers on the same
+// file system add up their capacities, but together take no more than its free space.
+func (s *StorageService) Space() (int64, int64) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    type disk struct {
+        space, size int64 // What the tiers on the disk allow together
+        free, total int64 // What the disk allows beyond the reserve
+    }
+    disks := make(map[uint64]*disk)
+    var space, size int64
+    for _, tier := range s.chunkTiers() {
+        free, total, err := diskSpace(tier.root)
+        device, deviceErr := diskDevice(tier.root)
+        if err != nil || deviceErr != nil {
+            if tier.capacity <= 0 {
+                return math.MaxInt64, 0
+            }
+            space += max(tier.capacity-tier.used, 0)
+            size += tier.capacity
+            continue
+        }
+        d := disks[device]
+        if d == nil {
+            d = &disk{free: max(free-s.reserve, 0), total: max(total-s.reserve, 0)}
+            disks[device] = d
+        }
+        if tier.capacity > 0 {
+            d.space += min(max(tier.capacity-tier.used, 0), d.free)
+            d.size += min(tier.capacity, d.total)
+        } else {
+            d.space += d.free
+            d.size += d.total
+        }
+    }
+    for _, d := range disks {
+        space += min(d.space, d.free)
+        size += min(d.size, d.total)
+    }
+    return space, size
+}
+
+// CheckSpace returns errStorageFull unless the storage can take size more bytes.
+func (s *StorageService) CheckSpace(size int64) error {
+    if space, _ := s.Space(); space < size {
+        return fmt.Errorf("%w: %d bytes requested, %d available", errStorageFull, size, space)
+    }
+    return nil
+}
+
+// diskLoop periodically checks the space left until the server shuts down.
+func (s *Server) diskLoop() {
+    defer s.wg.Done()
+    s.checkDiskSpace()
+    ticker := time.NewTicker(diskCheckInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-s.quit:
+            return
+        case <-ticker.C:
+            s.checkDiskSpace()
+        }
+    }
+}
+
+// checkDiskSpace advertises the space left to peers and warns each time it falls below
+// another of the diskWarnings levels.
+func (s *Server) checkDiskSpace() {
+    space, size := s.storage.Space()
+    full := space < datamgmt.MaxChunkSize
+    if size == 0 {
+        s.dht.Advertise(0, full)
+        return
+    }
+    s.dht.Advertise(space, full)
+
+    left := float64(space) / float64(size)
+    level := 0
+    for level < len(diskWarnings) && left < diskWarnings[level] {
+        level++
+    }
+    if full {
+        level = len(diskWarnings) + 1
+    }
+    fields := map[string]interface{}{
+        "available": space,
+        "size":      size,
+        "percent":   math.Round(left * 100),
+    }
+    switch {
+    case level > s.spaceLevel && full:
+        logger.Log.WithFields(fields).Error("Storage is full, refusing new data")
+    case level > s.spaceLevel:
+        logger.Log.WithFields(fields).Warn("Storage space is running low")
+    case level == 0 && s.spaceLevel > 0:
+        logger.Log.WithFields(fields).Info("Storage space recovered")
+    }
+    s.spaceLevel = level
+}
+
+// admitWrite checks that the bucket of the file data describes accepts writes, and that
+// size more bytes of it fit in its quotas and in the storage. The bytes are held against
+// the quotas until release is called.
+func (s *Server) admitWrite(data *datamgmt.Data, size int64) (release func(), err error) {
+    if err := s.storage.CheckBucket(data); err != nil {
+        logger.Log.WithError(err).WithField("key", data.Key()).Warn("Rejecting write to bucket")
+        return nil, err
+    }
+    if err := s.storage.CheckSpace(size); err != nil {
+        logger.Log.WithError(err).WithField("key", data.Key()).Warn("Rejecting write, storage is full")
+        return nil, err
+    }
+    release, err = s.storage.ReserveQuota(data, size)
+    if err != nil {
+        logger.Log.WithError(err).WithField("key", data.Key()).Warn("Rejecting write over quota")
+        return nil, err
+    }
+    return release, nil
+}
@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import "errors"
+
+// diskSpace is not supported here, so only tier capacities limit what is stored.
+func diskSpace(path string) (int64, int64, error) {
+    return 0, 0, errors.New("disk space is not available on this platform")
+}
+
+// diskDevice is not supported here either.
+func diskDevice(path string) (uint64, error) {
+    return 0, errors.New("device ID is not available on this platform")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+)
+
+func TestStorageService_DiskReserve(t *testing.T) {
+    service := NewStorageService("test_address")
+    defer os.RemoveAll(service.rootPath) // Clean up after test
+    free, _, err := diskSpace(service.rootPath)
+    if err != nil {
+        t.Skipf("Disk space unavailable: %v", err)
+    }
+    if err := service.CheckSpace(1 << 20); err != nil {
+        t.Fatalf("CheckSpace() error = %v", err)
+    }
+
+    // Reserve all but a few bytes of the disk.
+    service.SetDiskReserve(free - 8)
+    if err := service.CheckSpace(1 << 20); !errors.Is(err, errStorageFull) {
+        t.Errorf("Expected errStorageFull, got %v", err)
+    }
+    data := &datamgmt.Data{ID: "1", Filename: "large", Extension: "txt"}
+    if err := service.StoreData(data, bytes.NewReader(bytes.Repeat([]byte("large"), 1000))); !errors.Is(err, errStorageFull) {
+        t.Errorf("Expected StoreData() to fail with errStorageFull, got %v", err)
+    }
+    if countChunks(service.rootPath) != 0 {
+        t.Errorf("Expected no chunks of the refused file to remain")
+    }
+}
+
+func TestStorageService_SpaceSharedDisk(t *testing.T) {
+    service := NewStorageService("test_address")
+    defer os.RemoveAll(service.rootPath) // Clean up after test
+    hot, cold := filepath.Join(service.rootPath, "hot"), filepath.Join(service.rootPath, "cold")
+    if err := service.ConfigureTiers(hot, cold, 0, 0); err != nil {
+        t.Fatalf("ConfigureTiers() error = %v", err)
+    }
+    _, total, err := diskSpace(service.rootPath)
+    if err != nil {
+        t.Skipf("Disk space unavailable: %v", err)
+    }
+
+    // Both tiers are on one disk, so its space is only counted once.
+    if space, size := service.Space(); size != total || space > total {
+        t.Errorf("Expected a disk of %d bytes to be counted once, got %d of %d", total, space, size)
+    }
+    if err := service.ConfigureTiers(hot, cold, 4<<20, 2<<20); err != nil {
+        t.Fatalf("ConfigureTiers() error = %v", err)
+    }
+    if space, size := service.Space(); size != 6<<20 || space != 6<<20 {
+        t.Errorf("Expected the capacities of both tiers to add up, got %d of %d", space, size)
+    }
+}
+
+func TestServer_CheckDiskSpace(t *testing.T) {
+    server := NewServer("127.0.0.1:3378")
+    defer os.RemoveAll(server.storage.rootPath)
+    if err := server.storage.ConfigureTiers("", "", 4<<20, 0); err != nil {
+        t.Fatalf("ConfigureTiers() error = %v", err)
+    }
+    store := func(name string, size int) {
+        content := make([]byte, size)
+        rand.Read(content)
+        data := &datamgmt.Data{ID: "1", Filename: name, Extension: "bin"}
+        if err := server.storage.StoreData(data, bytes.NewReader(content)); err != nil {
+            t.Fatalf("StoreData() error = %v", err)
+        }
+    }
+
+    server.checkDiskSpace()
+    if self := server.dht.Self(); server.spaceLevel != 0 || self.Full || self.Space != 4<<20 {
+        t.Fatalf("Expected an empty tier to be advertised, got level %d, %+v", server.spaceLevel, self)
+    }
+
+    store("most", 3584<<10)
+    server.checkDiskSpace()
+    if self := server.dht.Self(); server.spaceLevel != 1 || self.Full || self.Space != 512<<10 {
+        t.Errorf("Expected the first low space warning, got level %d, %+v", server.spaceLevel, self)
+    }
+
+    store("rest", 300<<10)
+    server.checkDiskSpace()
+    if self := server.dht.Self(); server.spaceLevel != len(diskWarnings)+1 || !self.Full {
+        t.Errorf("Expected the node to advertise it is full, got level %d, %+v", server.spaceLevel, self)
+    }
+}
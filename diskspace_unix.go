@@ -0,0 +1,33 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// diskSpace returns the bytes available to unprivileged users and the total size of the
+// file system holding path.
+func diskSpace(path string) (int64, int64, error) {
+    var stat syscall.Statfs_t
+    if err := syscall.Statfs(path, &stat); err != nil {
+        return 0, 0, err
+    }
+    return int64(stat.Bavail) * int64(stat.Bsize), int64(stat.Blocks) * int64(stat.Bsize), nil
+}
+
+// diskDevice returns the ID of the device holding path, which paths on the same file system
+// share.
+func diskDevice(path string) (uint64, error) {
+    info, err := os.Stat(path)
+    if err != nil {
+        return 0, err
+    }
+    stat, ok := info.Sys().(*syscall.Stat_t)
+    if !ok {
+        return 0, errors.New("device ID is not available")
+    }
+    return uint64(stat.Dev), nil
+}
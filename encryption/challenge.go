@@ -0,0 +1,108 @@
+package encryption
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// Challenge asks a node to prove it holds the node key behind a public key. Node keys are
+// X25519 keys, which cannot sign, so the node answers with a MAC of the handshake transcript
+// keyed by the secret its node key shares with the challenge's ephemeral key. Only the
+// holder of the node key, and the challenger, can compute it. The transcript covers both
+// sides' nonces, ephemeral keys and node keys, so a proof is only valid in the handshake it
+// was made in, and the session key both sides derive from their ephemeral keys is bound to
+// the same handshake.
+type Challenge struct {
+	Ephemeral []byte // Public half of the ephemeral key the proof is computed against
+	Nonce     []byte
+	private   *ecdh.PrivateKey
+}
+
+// NewChallenge creates a challenge with a fresh ephemeral key and nonce.
+func NewChallenge() (*Challenge, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return &Challenge{Ephemeral: private.PublicKey().Bytes(), Nonce: nonce, private: private}, nil
+}
+
+// Transcript hashes the fields of a handshake, each prefixed with its length so no two
+// different lists of fields hash alike.
+func Transcript(fields ...[]byte) []byte {
+	hash := sha256.New()
+	hash.Write([]byte("gopherstore handshake"))
+	for _, field := range fields {
+		hash.Write(binary.BigEndian.AppendUint32(nil, uint32(len(field))))
+		hash.Write(field)
+	}
+	return hash.Sum(nil)
+}
+
+// Prove answers a challenge's ephemeral key with the proof that the node holds nodeKey over
+// the handshake transcript, returning the node's public key with it.
+func Prove(nodeKey, ephemeral, transcript []byte) (public, proof []byte, err error) {
+	private, err := ecdh.X25519().NewPrivateKey(nodeKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	peer, err := ecdh.X25519().NewPublicKey(ephemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+	shared, err := private.ECDH(peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return private.PublicKey().Bytes(), challengeMAC(shared, transcript), nil
+}
+
+// Verify reports whether proof shows that its sender holds the node key behind public, and
+// that it was made over transcript.
+func (c *Challenge) Verify(public, proof, transcript []byte) bool {
+	peer, err := ecdh.X25519().NewPublicKey(public)
+	if err != nil {
+		return false
+	}
+	shared, err := c.private.ECDH(peer)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(proof, challengeMAC(shared, transcript))
+}
+
+// SessionKeys derives the keys of a session from the secret the challenge's ephemeral key
+// shares with the other side's, one for each direction, named by the labels. Both sides
+// derive the same keys from the same transcript.
+func (c *Challenge) SessionKeys(peerEphemeral, transcript []byte, labels ...string) ([][]byte, error) {
+	peer, err := ecdh.X25519().NewPublicKey(peerEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := c.private.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([][]byte, len(labels))
+	for i, label := range labels {
+		mac := hmac.New(sha256.New, shared)
+		mac.Write([]byte("gopherstore session " + label))
+		mac.Write(transcript)
+		keys[i] = mac.Sum(nil)
+	}
+	return keys, nil
+}
+
+func challengeMAC(shared, transcript []byte) []byte {
+	mac := hmac.New(sha256.New, shared)
+	mac.Write([]byte("gopherstore challenge"))
+	mac.Write(transcript)
+	return mac.Sum(nil)
+}
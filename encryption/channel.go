@@ -0,0 +1,103 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// channelFrameSize is the most plaintext a secure channel seals in one frame.
+const channelFrameSize = 32 << 10
+
+// ErrChannelFrame is returned when a frame read from a secure channel fails to open.
+var ErrChannelFrame = errors.New("secure channel frame failed authentication")
+
+// SecureConn encrypts and authenticates everything sent over a connection with the session
+// keys a handshake agreed on. Writes are sealed with AES-256-GCM in frames of at most
+// channelFrameSize bytes, each prefixed with its length and sealed under a nonce counting the
+// frames sent in that direction, so a frame that is altered, replayed, reordered or dropped
+// fails to open and the connection is broken off.
+type SecureConn struct {
+	net.Conn
+	send, receive  cipher.AEAD
+	readMu         sync.Mutex
+	writeMu        sync.Mutex
+	sent, received uint64
+	pending        []byte // Opened plaintext not read yet
+}
+
+// NewSecureConn wraps conn in a secure channel that seals what it sends with sendKey and
+// opens what it receives with receiveKey.
+func NewSecureConn(conn net.Conn, sendKey, receiveKey []byte) (*SecureConn, error) {
+	send, err := newGCM(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	receive, err := newGCM(receiveKey)
+	if err != nil {
+		return nil, err
+	}
+	return &SecureConn{Conn: conn, send: send, receive: receive}, nil
+}
+
+func (c *SecureConn) Write(p []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), channelFrameSize)
+		frame := make([]byte, 4, 4+n+c.send.Overhead())
+		frame = c.send.Seal(frame, frameNonce(c.send.NonceSize(), c.sent), p[:n], nil)
+		binary.BigEndian.PutUint32(frame, uint32(len(frame)-4))
+		if _, err := c.Conn.Write(frame); err != nil {
+			return written, err
+		}
+		c.sent++
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (c *SecureConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+
+	for len(c.pending) == 0 {
+		var header [4]byte
+		if _, err := io.ReadFull(c.Conn, header[:]); err != nil {
+			return 0, err
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if size > uint32(channelFrameSize+c.receive.Overhead()) {
+			return 0, ErrChannelFrame
+		}
+		frame := make([]byte, size)
+		if _, err := io.ReadFull(c.Conn, frame); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		plaintext, err := c.receive.Open(frame[:0], frameNonce(c.receive.NonceSize(), c.received), frame, nil)
+		if err != nil {
+			return 0, ErrChannelFrame
+		}
+		c.received++
+		c.pending = plaintext
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// frameNonce returns the nonce of the frame with the given sequence number.
+func frameNonce(size int, sequence uint64) []byte {
+	nonce := make([]byte, size)
+	binary.BigEndian.PutUint64(nonce[size-8:], sequence)
+	return nonce
+}
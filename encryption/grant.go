@@ -0,0 +1,158 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+)
+
+// Grant gives another node access to one encrypted file by wrapping the file's key to the
+// node's X25519 public key. Only the holder of the matching node key can unwrap it. The
+// grant is signed by the node that sent it: node keys cannot sign, so the signature is a MAC
+// of every field keyed by the secret the sender's and recipient's node keys share, which
+// only those two nodes can compute.
+type Grant struct {
+	Name       string // Original name of the shared file
+	Filename   string // Name the encrypted file is stored under on the network
+	Extension  string
+	Recipient  []byte // Public key of the node the grant is for
+	Ephemeral  []byte // Ephemeral public key the file key was wrapped with
+	WrappedKey []byte
+	Sender     []byte // Public key of the node that sent the grant
+	Signature  []byte
+}
+
+// PublicKey returns the X25519 public key of a node private key.
+func PublicKey(nodeKey []byte) ([]byte, error) {
+	private, err := ecdh.X25519().NewPrivateKey(nodeKey)
+	if err != nil {
+		return nil, err
+	}
+	return private.PublicKey().Bytes(), nil
+}
+
+// NewGrant wraps fileKey to recipient, binding it to the file's network name, and signs the
+// grant with the sender's node key.
+func NewGrant(senderKey, recipient, fileKey []byte, name, filename, extension string) (*Grant, error) {
+	sender, err := ecdh.X25519().NewPrivateKey(senderKey)
+	if err != nil {
+		return nil, err
+	}
+	public, err := ecdh.X25519().NewPublicKey(recipient)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := ephemeral.ECDH(public)
+	if err != nil {
+		return nil, err
+	}
+
+	grant := &Grant{
+		Name:      name,
+		Filename:  filename,
+		Extension: extension,
+		Recipient: recipient,
+		Ephemeral: ephemeral.PublicKey().Bytes(),
+		Sender:    sender.PublicKey().Bytes(),
+	}
+	aead, err := newGCM(grant.wrappingKey(shared))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	grant.WrappedKey = aead.Seal(nonce, nonce, fileKey, grant.additionalData())
+	static, err := sender.ECDH(public)
+	if err != nil {
+		return nil, err
+	}
+	grant.Signature = grant.signature(static)
+	return grant, nil
+}
+
+// Verify reports whether the grant was signed by the holder of the node key behind Sender,
+// checking it with whichever of the node keys the grant was made for.
+func (g *Grant) Verify(nodeKeys ...[]byte) bool {
+	sender, err := ecdh.X25519().NewPublicKey(g.Sender)
+	if err != nil {
+		return false
+	}
+	for _, nodeKey := range nodeKeys {
+		private, err := ecdh.X25519().NewPrivateKey(nodeKey)
+		if err != nil || !bytes.Equal(private.PublicKey().Bytes(), g.Recipient) {
+			continue
+		}
+		static, err := private.ECDH(sender)
+		if err != nil {
+			return false
+		}
+		return hmac.Equal(g.Signature, g.signature(static))
+	}
+	return false
+}
+
+// FileKey unwraps the file key with whichever of the node keys the grant was made for.
+func (g *Grant) FileKey(nodeKeys ...[]byte) ([]byte, error) {
+	ephemeral, err := ecdh.X25519().NewPublicKey(g.Ephemeral)
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	for _, nodeKey := range nodeKeys {
+		private, err := ecdh.X25519().NewPrivateKey(nodeKey)
+		if err != nil || !bytes.Equal(private.PublicKey().Bytes(), g.Recipient) {
+			continue
+		}
+		shared, err := private.ECDH(ephemeral)
+		if err != nil {
+			return nil, ErrAuthFailed
+		}
+		aead, err := newGCM(g.wrappingKey(shared))
+		if err != nil {
+			return nil, err
+		}
+		if len(g.WrappedKey) < aead.NonceSize() {
+			return nil, ErrAuthFailed
+		}
+		fileKey, err := aead.Open(nil, g.WrappedKey[:aead.NonceSize()], g.WrappedKey[aead.NonceSize():], g.additionalData())
+		if err != nil {
+			return nil, ErrAuthFailed
+		}
+		return fileKey, nil
+	}
+	return nil, ErrNoKey
+}
+
+// wrappingKey derives the key wrapping key from the shared secret and both public keys.
+func (g *Grant) wrappingKey(shared []byte) []byte {
+	mac := hmac.New(sha256.New, shared)
+	mac.Write([]byte("gopherstore grant"))
+	mac.Write(g.Ephemeral)
+	mac.Write(g.Recipient)
+	return mac.Sum(nil)
+}
+
+// signature computes the grant's signature from the secret its sender's and recipient's
+// node keys share.
+func (g *Grant) signature(static []byte) []byte {
+	mac := hmac.New(sha256.New, static)
+	mac.Write([]byte("gopherstore grant signature"))
+	fields := [][]byte{[]byte(g.Name), []byte(g.Filename), []byte(g.Extension), g.Recipient, g.Ephemeral, g.WrappedKey, g.Sender}
+	for _, field := range fields {
+		mac.Write(binary.BigEndian.AppendUint32(nil, uint32(len(field))))
+		mac.Write(field)
+	}
+	return mac.Sum(nil)
+}
+
+func (g *Grant) additionalData() []byte {
+	return []byte(g.Name + "\x00" + g.Filename + "." + g.Extension)
+}
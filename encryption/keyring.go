@@ -0,0 +1,199 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// MasterKeyEnv is the environment variable a hex-encoded master key can be supplied in.
+const MasterKeyEnv = "GOPHERSTORE_MASTER_KEY"
+
+// sealedMagic marks a blob sealed by a Keyring; it is followed by the data key ID.
+const sealedMagic = "GSR\x01"
+
+// ErrUnknownKey is returned when a blob was sealed with a data key the keyring lacks.
+var ErrUnknownKey = errors.New("sealed with an unknown data key")
+
+// KeyringState is the persisted form of a keyring: its data keys, wrapped under the master
+// key, and which of them seals new data.
+type KeyringState struct {
+	Active uint32
+	Keys   map[uint32][]byte
+}
+
+// Keyring seals data at rest with node data keys. Data keys never leave the node in plain
+// form; they are stored wrapped under a master key, so rotating the master key only
+// re-wraps the data keys, and rotating the data key only affects newly sealed data.
+type Keyring struct {
+	mu     sync.RWMutex
+	master []byte
+	state  KeyringState
+	keys   map[uint32][]byte
+}
+
+// LoadMasterKey reads the master key from a key file, or from MasterKeyEnv when path is
+// empty. It returns nil without error when neither is configured.
+func LoadMasterKey(path string) ([]byte, error) {
+	if path != "" {
+		return LoadKey(path)
+	}
+	value := os.Getenv(MasterKeyEnv)
+	if value == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(value))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", MasterKeyEnv, err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("%s: %w", MasterKeyEnv, ErrInvalidKey)
+	}
+	return key, nil
+}
+
+// NewKeyring unwraps the data keys in state with master. A nil state starts a new keyring
+// with a freshly generated data key.
+func NewKeyring(master []byte, state *KeyringState) (*Keyring, error) {
+	k := &Keyring{master: master, keys: make(map[uint32][]byte)}
+	if state == nil {
+		k.state.Keys = make(map[uint32][]byte)
+		if err := k.addDataKey(); err != nil {
+			return nil, err
+		}
+		return k, nil
+	}
+
+	k.state = KeyringState{Active: state.Active, Keys: make(map[uint32][]byte, len(state.Keys))}
+	for id, wrapped := range state.Keys {
+		key, err := UnwrapKey(master, wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("data key %d: %w", id, err)
+		}
+		k.keys[id] = key
+		k.state.Keys[id] = wrapped
+	}
+	if _, ok := k.keys[state.Active]; !ok {
+		return nil, fmt.Errorf("active data key %d: %w", state.Active, ErrUnknownKey)
+	}
+	return k, nil
+}
+
+// State returns the keyring in its persisted form.
+func (k *Keyring) State() *KeyringState {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	state := &KeyringState{Active: k.state.Active, Keys: make(map[uint32][]byte, len(k.state.Keys))}
+	for id, wrapped := range k.state.Keys {
+		state.Keys[id] = wrapped
+	}
+	return state
+}
+
+// RotateDataKey generates a new data key for sealing from now on. Older keys are kept so
+// existing data stays readable without being rewritten.
+func (k *Keyring) RotateDataKey() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.addDataKey()
+}
+
+// Rewrap wraps every data key under a new master key.
+func (k *Keyring) Rewrap(master []byte) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	rewrapped := make(map[uint32][]byte, len(k.keys))
+	for id, key := range k.keys {
+		wrapped, err := WrapKey(master, key)
+		if err != nil {
+			return err
+		}
+		rewrapped[id] = wrapped
+	}
+	k.master, k.state.Keys = master, rewrapped
+	return nil
+}
+
+// Seal encrypts a blob with the active data key. The additional data, such as the blob's
+// name, is authenticated but not stored, so a sealed blob cannot be swapped for another.
+func (k *Keyring) Seal(plaintext, additional []byte) ([]byte, error) {
+	k.mu.RLock()
+	id := k.state.Active
+	key := k.keys[id]
+	k.mu.RUnlock()
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, 0, len(sealedMagic)+4+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	sealed = append(sealed, sealedMagic...)
+	sealed = binary.BigEndian.AppendUint32(sealed, id)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed = append(sealed, nonce...)
+	return aead.Seal(sealed, nonce, plaintext, additional), nil
+}
+
+// Open decrypts a blob sealed by Seal with the same additional data.
+func (k *Keyring) Open(sealed, additional []byte) ([]byte, error) {
+	if !IsSealed(sealed) {
+		return nil, ErrNotEncrypted
+	}
+	id := binary.BigEndian.Uint32(sealed[len(sealedMagic):])
+	k.mu.RLock()
+	key, ok := k.keys[id]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("data key %d: %w", id, ErrUnknownKey)
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	body := sealed[len(sealedMagic)+4:]
+	if len(body) < aead.NonceSize() {
+		return nil, ErrAuthFailed
+	}
+	plaintext, err := aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], additional)
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	return plaintext, nil
+}
+
+// IsSealed reports whether a blob looks like it was sealed by a Keyring.
+func IsSealed(blob []byte) bool {
+	return len(blob) >= len(sealedMagic)+4 && bytes.HasPrefix(blob, []byte(sealedMagic))
+}
+
+// addDataKey generates, wraps and activates a new data key. The caller must hold the lock.
+func (k *Keyring) addDataKey() error {
+	key, err := GenerateKey()
+	if err != nil {
+		return err
+	}
+	wrapped, err := WrapKey(k.master, key)
+	if err != nil {
+		return err
+	}
+	var id uint32
+	for existing := range k.keys {
+		if existing >= id {
+			id = existing + 1
+		}
+	}
+	k.keys[id] = key
+	k.state.Keys[id] = wrapped
+	k.state.Active = id
+	return nil
+}
@@ -0,0 +1,279 @@
+package encryption
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// KeyType names the kind of key held in a keystore.
+type KeyType string
+
+const (
+	// UserKey is the symmetric key files are encrypted under before they are sent.
+	UserKey KeyType = "user"
+	// NodeKey is the node's X25519 private key, which identifies it and receives grants.
+	NodeKey KeyType = "node"
+)
+
+// Argon2id parameters used to derive the keystore key from the passphrase.
+const (
+	argonTime    = 1
+	argonMemory  = 64 << 10
+	argonThreads = 4
+	saltSize     = 16
+)
+
+var (
+	// ErrWrongPassphrase is returned when a keystore cannot be unlocked.
+	ErrWrongPassphrase = errors.New("wrong keystore passphrase")
+	// ErrNoKey is returned when the keystore holds no key of the requested type.
+	ErrNoKey = errors.New("no such key in keystore")
+	// ErrKeyExists is returned when generating a key of a type the keystore already holds.
+	ErrKeyExists = errors.New("key already exists, rotate it instead")
+	// ErrGrantExists is returned when a grant is received for a file name that already has one.
+	ErrGrantExists = errors.New("a grant for this file name already exists")
+)
+
+// storedKey is a key sealed under the keystore key.
+type storedKey struct {
+	Sealed    []byte
+	CreatedAt time.Time
+}
+
+// keystoreFile is the on-disk form of a keystore. Only the KDF parameters and grants are
+// stored in the clear; grants are already wrapped to this node's public key.
+type keystoreFile struct {
+	Salt    []byte
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	Check   []byte
+	Keys    map[KeyType][]storedKey // Oldest first, the last one is active
+	Grants  map[string]*Grant
+}
+
+// Keystore keeps user and node keys on disk, encrypted under a key derived from a
+// passphrase with Argon2id. Rotated keys are retained so data protected by them stays
+// accessible.
+type Keystore struct {
+	mu   sync.Mutex
+	path string
+	key  []byte
+	file keystoreFile
+}
+
+// OpenKeystore unlocks the keystore at path with passphrase, creating an empty one if the
+// file does not exist yet.
+func OpenKeystore(path, passphrase string) (*Keystore, error) {
+	ks := &Keystore{path: path}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		salt := make([]byte, saltSize)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		ks.file = keystoreFile{
+			Salt:    salt,
+			Time:    argonTime,
+			Memory:  argonMemory,
+			Threads: argonThreads,
+			Keys:    make(map[KeyType][]storedKey),
+			Grants:  make(map[string]*Grant),
+		}
+		ks.deriveKey(passphrase)
+		if ks.file.Check, err = ks.seal(nil, "check"); err != nil {
+			return nil, err
+		}
+		return ks, ks.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, &ks.file); err != nil {
+		return nil, fmt.Errorf("invalid keystore %s: %w", path, err)
+	}
+	if ks.file.Keys == nil {
+		ks.file.Keys = make(map[KeyType][]storedKey)
+	}
+	if ks.file.Grants == nil {
+		ks.file.Grants = make(map[string]*Grant)
+	}
+	ks.deriveKey(passphrase)
+	if _, err := ks.open(ks.file.Check, "check"); err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return ks, nil
+}
+
+// Active returns the current key of the given type.
+func (ks *Keystore) Active(keyType KeyType) ([]byte, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	stored := ks.file.Keys[keyType]
+	if len(stored) == 0 {
+		return nil, ErrNoKey
+	}
+	return ks.open(stored[len(stored)-1].Sealed, string(keyType))
+}
+
+// All returns every key of the given type, newest first.
+func (ks *Keystore) All(keyType KeyType) ([][]byte, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	stored := ks.file.Keys[keyType]
+	keys := make([][]byte, 0, len(stored))
+	for i := len(stored) - 1; i >= 0; i-- {
+		key, err := ks.open(stored[i].Sealed, string(keyType))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Generate creates the first key of the given type.
+func (ks *Keystore) Generate(keyType KeyType) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if len(ks.file.Keys[keyType]) > 0 {
+		return ErrKeyExists
+	}
+	return ks.addGenerated(keyType)
+}
+
+// Rotate makes a newly generated key of the given type active, keeping the previous ones.
+func (ks *Keystore) Rotate(keyType KeyType) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if len(ks.file.Keys[keyType]) == 0 {
+		return ErrNoKey
+	}
+	return ks.addGenerated(keyType)
+}
+
+// Import adds an existing key of the given type and makes it active.
+func (ks *Keystore) Import(keyType KeyType, key []byte) error {
+	if len(key) != KeySize {
+		return ErrInvalidKey
+	}
+	if keyType == NodeKey {
+		if _, err := ecdh.X25519().NewPrivateKey(key); err != nil {
+			return err
+		}
+	}
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return ks.add(keyType, key)
+}
+
+// AddGrant records a grant received from another node. A grant never replaces an earlier
+// one for the same file name, so no node can redirect a name to a file of its choosing.
+func (ks *Keystore) AddGrant(grant *Grant) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if _, ok := ks.file.Grants[grant.Name]; ok {
+		return ErrGrantExists
+	}
+	ks.file.Grants[grant.Name] = grant
+	return ks.save()
+}
+
+// Grant returns the grant received for a file name, if any.
+func (ks *Keystore) Grant(name string) (*Grant, bool) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	grant, ok := ks.file.Grants[name]
+	return grant, ok
+}
+
+// KeyCount returns how many keys of the given type the keystore holds.
+func (ks *Keystore) KeyCount(keyType KeyType) int {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	return len(ks.file.Keys[keyType])
+}
+
+func (ks *Keystore) addGenerated(keyType KeyType) error {
+	key, err := GenerateKey()
+	if err != nil {
+		return err
+	}
+	return ks.add(keyType, key)
+}
+
+// add seals and appends a key, then saves the keystore. The caller must hold the lock.
+func (ks *Keystore) add(keyType KeyType, key []byte) error {
+	sealed, err := ks.seal(key, string(keyType))
+	if err != nil {
+		return err
+	}
+	ks.file.Keys[keyType] = append(ks.file.Keys[keyType], storedKey{Sealed: sealed, CreatedAt: time.Now()})
+	return ks.save()
+}
+
+func (ks *Keystore) deriveKey(passphrase string) {
+	ks.key = argon2.IDKey([]byte(passphrase), ks.file.Salt, ks.file.Time, ks.file.Memory, ks.file.Threads, KeySize)
+}
+
+func (ks *Keystore) seal(plaintext []byte, label string) ([]byte, error) {
+	aead, err := newGCM(ks.key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(label)), nil
+}
+
+func (ks *Keystore) open(sealed []byte, label string) ([]byte, error) {
+	aead, err := newGCM(ks.key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, ErrAuthFailed
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(label))
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	return plaintext, nil
+}
+
+// save writes the keystore atomically, readable by its owner only.
+func (ks *Keystore) save() error {
+	content, err := json.MarshalIndent(&ks.file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(ks.path), 0700); err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(ks.path), filepath.Base(ks.path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(content); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), ks.path)
+}
@@ -0,0 +1,189 @@
+package encryption
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeystoreRotateAndReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keystore.json")
+	ks, err := OpenKeystore(path, "secret")
+	if err != nil {
+		t.Fatalf("OpenKeystore() error = %v", err)
+	}
+	if _, err := ks.Active(UserKey); !errors.Is(err, ErrNoKey) {
+		t.Fatalf("Active() on empty keystore error = %v, want ErrNoKey", err)
+	}
+	if err := ks.Generate(UserKey); err != nil {
+		t.Fatalf("Generate() error = %v", err)
+	}
+	if err := ks.Generate(UserKey); !errors.Is(err, ErrKeyExists) {
+		t.Fatalf("second Generate() error = %v, want ErrKeyExists", err)
+	}
+	first, _ := ks.Active(UserKey)
+	if err := ks.Rotate(UserKey); err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+
+	reopened, err := OpenKeystore(path, "secret")
+	if err != nil {
+		t.Fatalf("reopening keystore error = %v", err)
+	}
+	keys, err := reopened.All(UserKey)
+	if err != nil || len(keys) != 2 {
+		t.Fatalf("All() = %d keys, %v, want 2 keys", len(keys), err)
+	}
+	active, _ := reopened.Active(UserKey)
+	if !bytes.Equal(keys[0], active) || !bytes.Equal(keys[1], first) {
+		t.Errorf("All() is not ordered newest first")
+	}
+
+	if _, err := OpenKeystore(path, "wrong"); !errors.Is(err, ErrWrongPassphrase) {
+		t.Errorf("OpenKeystore() with wrong passphrase error = %v, want ErrWrongPassphrase", err)
+	}
+}
+
+func TestGrantUnwrapsOnlyForRecipient(t *testing.T) {
+	nodeKey, _ := GenerateKey()
+	otherKey, _ := GenerateKey()
+	senderKey, _ := GenerateKey()
+	public, err := PublicKey(nodeKey)
+	if err != nil {
+		t.Fatalf("PublicKey() error = %v", err)
+	}
+	fileKey, _ := GenerateKey()
+
+	grant, err := NewGrant(senderKey, public, fileKey, "report.pdf", "abc", "enc")
+	if err != nil {
+		t.Fatalf("NewGrant() error = %v", err)
+	}
+	if !grant.Verify(otherKey, nodeKey) {
+		t.Fatalf("Verify() rejected the sender's signature")
+	}
+	if grant.Verify(otherKey) {
+		t.Errorf("Verify() accepted a grant made for another node")
+	}
+	forged := *grant
+	forged.Sender, _ = PublicKey(otherKey)
+	if forged.Verify(nodeKey) {
+		t.Errorf("Verify() accepted a grant claiming another sender")
+	}
+	unwrapped, err := grant.FileKey(otherKey, nodeKey)
+	if err != nil || !bytes.Equal(unwrapped, fileKey) {
+		t.Fatalf("FileKey() = %x, %v, want the file key", unwrapped, err)
+	}
+	if _, err := grant.FileKey(otherKey); !errors.Is(err, ErrNoKey) {
+		t.Errorf("FileKey() with another node key error = %v, want ErrNoKey", err)
+	}
+
+	grant.Filename = "other"
+	if _, err := grant.FileKey(nodeKey); !errors.Is(err, ErrAuthFailed) {
+		t.Errorf("FileKey() after renaming error = %v, want ErrAuthFailed", err)
+	}
+	if grant.Verify(nodeKey) {
+		t.Errorf("Verify() accepted a renamed grant")
+	}
+}
+
+func TestKeystoreKeepsFirstGrant(t *testing.T) {
+	ks, err := OpenKeystore(filepath.Join(t.TempDir(), "keystore.json"), "secret")
+	if err != nil {
+		t.Fatalf("OpenKeystore() error = %v", err)
+	}
+	if err := ks.AddGrant(&Grant{Name: "report.pdf", Filename: "abc", Extension: "enc"}); err != nil {
+		t.Fatalf("AddGrant() error = %v", err)
+	}
+	if err := ks.AddGrant(&Grant{Name: "report.pdf", Filename: "other", Extension: "enc"}); !errors.Is(err, ErrGrantExists) {
+		t.Errorf("second AddGrant() error = %v, want ErrGrantExists", err)
+	}
+	if grant, ok := ks.Grant("report.pdf"); !ok || grant.Filename != "abc" {
+		t.Errorf("Grant() = %+v, want the first grant", grant)
+	}
+}
+
+func TestChallengeProvesNodeKey(t *testing.T) {
+	nodeKey, _ := GenerateKey()
+	otherKey, _ := GenerateKey()
+	challengerKey, _ := GenerateKey()
+	challenge, err := NewChallenge()
+	if err != nil {
+		t.Fatalf("NewChallenge() error = %v", err)
+	}
+
+	otherPublic, _ := PublicKey(otherKey)
+	challenger, _ := PublicKey(challengerKey)
+	transcript := Transcript(challenge.Ephemeral, challenge.Nonce, challenger)
+	public, proof, err := Prove(nodeKey, challenge.Ephemeral, transcript)
+	if err != nil {
+		t.Fatalf("Prove() error = %v", err)
+	}
+	if !challenge.Verify(public, proof, transcript) {
+		t.Fatalf("Verify() rejected a valid proof")
+	}
+	if challenge.Verify(otherPublic, proof, transcript) {
+		t.Errorf("Verify() accepted a proof for another node key")
+	}
+	other, _ := NewChallenge()
+	if other.Verify(public, proof, Transcript(other.Ephemeral, other.Nonce, challenger)) {
+		t.Errorf("Verify() accepted a proof for another challenge")
+	}
+	if challenge.Verify(public, proof, Transcript(challenge.Ephemeral, challenge.Nonce, otherPublic)) {
+		t.Errorf("Verify() accepted a proof made for another handshake")
+	}
+}
+
+// bufferConn is a connection whose writes are kept in a buffer for reads to return.
+type bufferConn struct {
+	net.Conn
+	buffer bytes.Buffer
+}
+
+func (c *bufferConn) Read(p []byte) (int, error)  { return c.buffer.Read(p) }
+func (c *bufferConn) Write(p []byte) (int, error) { return c.buffer.Write(p) }
+
+func TestSecureConnDetectsTampering(t *testing.T) {
+	caller, err := NewChallenge()
+	if err != nil {
+		t.Fatalf("NewChallenge() error = %v", err)
+	}
+	node, _ := NewChallenge()
+	transcript := Transcript(caller.Ephemeral, node.Ephemeral)
+	callerKeys, err := caller.SessionKeys(node.Ephemeral, transcript, "caller", "node")
+	if err != nil {
+		t.Fatalf("SessionKeys() error = %v", err)
+	}
+	nodeKeys, _ := node.SessionKeys(caller.Ephemeral, transcript, "caller", "node")
+	if !bytes.Equal(callerKeys[0], nodeKeys[0]) || bytes.Equal(callerKeys[0], callerKeys[1]) {
+		t.Fatalf("Expected both sides to derive the same key for each direction")
+	}
+
+	message := bytes.Repeat([]byte("secure channel "), 5000)
+	for _, tamper := range []func([]byte) []byte{
+		nil,
+		func(frames []byte) []byte { frames[100] ^= 1; return frames },
+		func(frames []byte) []byte { return frames[4+channelFrameSize+16:] },
+	} {
+		wire := &bufferConn{}
+		sender, _ := NewSecureConn(wire, callerKeys[0], callerKeys[1])
+		if _, err := sender.Write(message); err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+		if tamper != nil {
+			frames := tamper(wire.buffer.Bytes())
+			wire.buffer.Reset()
+			wire.buffer.Write(frames)
+		}
+		receiver, _ := NewSecureConn(wire, nodeKeys[1], nodeKeys[0])
+		received, err := io.ReadAll(receiver)
+		if tamper == nil && (err != nil || !bytes.Equal(received, message)) {
+			t.Errorf("Expected the message to arrive intact, got %d bytes, %v", len(received), err)
+		}
+		if tamper != nil && !errors.Is(err, ErrChannelFrame) {
+			t.Errorf("Expected an altered or dropped frame to be refused, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package encryption
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// nameEncoding keeps encrypted names safe for case-insensitive file systems.
+var nameEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// EncryptName encrypts a file name deterministically, so the same name always maps to the
+// same ciphertext and a file can still be fetched by name without peers learning it. The
+// nonce is derived from the name itself (as in SIV), which only reveals whether two
+// names are equal.
+func EncryptName(key []byte, name string) (string, error) {
+	if len(key) != KeySize {
+		return "", ErrInvalidKey
+	}
+	aead, err := newGCM(deriveKey(key, "name encryption"))
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, deriveKey(key, "name nonce"))
+	mac.Write([]byte(name))
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+	sealed := aead.Seal(nonce, nonce, []byte(name), nil)
+	return strings.ToLower(nameEncoding.EncodeToString(sealed)), nil
+}
+
+// DecryptName recovers a file name encrypted by EncryptName.
+func DecryptName(key []byte, encrypted string) (string, error) {
+	if len(key) != KeySize {
+		return "", ErrInvalidKey
+	}
+	aead, err := newGCM(deriveKey(key, "name encryption"))
+	if err != nil {
+		return "", err
+	}
+	sealed, err := nameEncoding.DecodeString(strings.ToUpper(encrypted))
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", ErrNotEncrypted
+	}
+	name, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", ErrAuthFailed
+	}
+	return string(name), nil
+}
+
+// LoadKey reads a hex-encoded key from a file, such as one created with
+// `openssl rand -hex 32`.
+func LoadKey(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("key file %s: %w", path, err)
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key file %s: %w", path, ErrInvalidKey)
+	}
+	return key, nil
+}
@@ -0,0 +1,255 @@
+// Package encryption implements client-side encryption of files before they leave the
+// node, so that peers storing them only ever see ciphertext.
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// KeySize is the length of user and file keys in bytes (AES-256).
+	KeySize = 32
+	// SegmentSize is the amount of plaintext sealed as one AEAD segment, so files of any
+	// size are processed in constant memory.
+	SegmentSize = 64 << 10
+
+	noncePrefixSize = 7
+	tagSize         = 16
+	wrappedKeySize  = 12 + KeySize + tagSize
+
+	// HeaderSize is the length of the header preceding an encrypted stream's segments.
+	HeaderSize = len(magic) + wrappedKeySize + noncePrefixSize
+)
+
+// magic identifies an encrypted stream and its format version.
+const magic = "GSE\x01"
+
+var (
+	// ErrNotEncrypted is returned when decrypting data that was not produced by Encrypt.
+	ErrNotEncrypted = errors.New("data is not encrypted")
+	// ErrAuthFailed is returned when ciphertext was modified, truncated, or encrypted
+	// under a different key.
+	ErrAuthFailed = errors.New("decryption failed: wrong key or corrupted data")
+	// ErrInvalidKey is returned for keys that are not KeySize bytes long.
+	ErrInvalidKey = fmt.Errorf("key must be %d bytes", KeySize)
+)
+
+// Encrypt reads plaintext from src and writes it to dst encrypted with AES-256-GCM. Every
+// file gets a fresh random file key, stored in the header wrapped under key, and the
+// content is sealed in segments following the STREAM construction: each segment's nonce
+// carries its index and a final-segment flag, so reordering, dropping or truncating
+// segments is detected on decryption.
+func Encrypt(key []byte, dst io.Writer, src io.Reader) error {
+	fileKey, err := GenerateKey()
+	if err != nil {
+		return err
+	}
+	wrapped, err := WrapKey(key, fileKey)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 0, HeaderSize)
+	header = append(header, magic...)
+	header = append(header, wrapped...)
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+	header = append(header, prefix...)
+	if _, err := dst.Write(header); err != nil {
+		return err
+	}
+
+	aead, err := newGCM(fileKey)
+	if err != nil {
+		return err
+	}
+	plaintext := make([]byte, SegmentSize)
+	sealed := make([]byte, 0, SegmentSize+tagSize)
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(src, plaintext)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// A short segment is the final one; a file that is an exact multiple of the
+		// segment size ends with an empty segment.
+		last := n < SegmentSize
+		sealed = aead.Seal(sealed[:0], segmentNonce(prefix, counter, last), plaintext[:n], header)
+		if _, err := dst.Write(sealed); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		if counter == ^uint32(0) {
+			return errors.New("file too large to encrypt")
+		}
+	}
+}
+
+// Decrypt reads a stream produced by Encrypt from src and writes the plaintext to dst. The
+// plaintext is written segment by segment as it is authenticated, so when an error is
+// returned dst may hold a prefix of the file and must be discarded.
+func Decrypt(key []byte, dst io.Writer, src io.Reader) error {
+	header, err := ReadHeader(src)
+	if err != nil {
+		return err
+	}
+	fileKey, err := header.FileKey(key)
+	if err != nil {
+		return err
+	}
+	return DecryptBody(fileKey, header, dst, src)
+}
+
+// Header is the plaintext header at the start of an encrypted stream, holding the wrapped
+// file key.
+type Header struct {
+	raw []byte
+}
+
+// ReadHeader reads the header of an encrypted stream, leaving src positioned at its body.
+func ReadHeader(src io.Reader) (*Header, error) {
+	raw := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(src, raw); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotEncrypted
+		}
+		return nil, err
+	}
+	if !bytes.HasPrefix(raw, []byte(magic)) {
+		return nil, ErrNotEncrypted
+	}
+	return &Header{raw: raw}, nil
+}
+
+// FileKey unwraps the file key with the first of keys that fits, so files encrypted under
+// a user key that has since been rotated remain readable.
+func (h *Header) FileKey(keys ...[]byte) ([]byte, error) {
+	wrapped := h.raw[len(magic) : len(magic)+wrappedKeySize]
+	for _, key := range keys {
+		if fileKey, err := UnwrapKey(key, wrapped); err == nil {
+			return fileKey, nil
+		}
+	}
+	return nil, ErrAuthFailed
+}
+
+// DecryptBody decrypts the body of a stream whose header has been read with ReadHeader,
+// using its file key directly.
+func DecryptBody(fileKey []byte, header *Header, dst io.Writer, src io.Reader) error {
+	aead, err := newGCM(fileKey)
+	if err != nil {
+		return err
+	}
+	prefix := header.raw[len(magic)+wrappedKeySize:]
+
+	segment := make([]byte, SegmentSize+tagSize)
+	plaintext := make([]byte, 0, SegmentSize)
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(src, segment)
+		if err == io.EOF {
+			// The final segment is missing.
+			return ErrAuthFailed
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n < len(segment)
+		plaintext, err = aead.Open(plaintext[:0], segmentNonce(prefix, counter, last), segment[:n], header.raw)
+		if err != nil {
+			return ErrAuthFailed
+		}
+		if _, err := dst.Write(plaintext); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// WrapKey encrypts a file key under a user key.
+func WrapKey(key, fileKey []byte) ([]byte, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	aead, err := newGCM(deriveKey(key, "file key wrap"))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, fileKey, []byte(magic)), nil
+}
+
+// UnwrapKey recovers a file key wrapped by WrapKey.
+func UnwrapKey(key, wrapped []byte) ([]byte, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	aead, err := newGCM(deriveKey(key, "file key wrap"))
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) != wrappedKeySize {
+		return nil, ErrAuthFailed
+	}
+	fileKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(magic))
+	if err != nil {
+		return nil, ErrAuthFailed
+	}
+	return fileKey, nil
+}
+
+// GenerateKey returns a new random key.
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// segmentNonce builds the GCM nonce for a segment from the per-file random prefix, the
+// segment index and whether it is the final segment.
+func segmentNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, noncePrefixSize+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// deriveKey derives an independent subkey of key for the given purpose, so the same user
+// key can safely be used for wrapping file keys and for encrypting names.
+func deriveKey(key []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("gopherstore " + purpose))
+	return mac.Sum(nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
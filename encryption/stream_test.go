@@ -0,0 +1,91 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func encrypt(t *testing.T, key, plaintext []byte) []byte {
+	var ciphertext bytes.Buffer
+	if err := Encrypt(key, &ciphertext, bytes.NewReader(plaintext)); err != nil {
+		t.Fatalf("Encrypt() error = %v", err)
+	}
+	return ciphertext.Bytes()
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key, _ := GenerateKey()
+	for _, size := range []int{0, 1, SegmentSize - 1, SegmentSize, 3*SegmentSize + 17} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+		ciphertext := encrypt(t, key, plaintext)
+		if size >= 16 && bytes.Contains(ciphertext, plaintext) {
+			t.Fatalf("size %d: ciphertext contains the plaintext", size)
+		}
+
+		var decrypted bytes.Buffer
+		if err := Decrypt(key, &decrypted, bytes.NewReader(ciphertext)); err != nil {
+			t.Fatalf("size %d: Decrypt() error = %v", size, err)
+		}
+		if !bytes.Equal(decrypted.Bytes(), plaintext) {
+			t.Errorf("size %d: decrypted content does not match", size)
+		}
+	}
+}
+
+func TestDecryptRejectsTampering(t *testing.T) {
+	key, _ := GenerateKey()
+	plaintext := make([]byte, 2*SegmentSize+100)
+	rand.Read(plaintext)
+	ciphertext := encrypt(t, key, plaintext)
+	otherKey, _ := GenerateKey()
+
+	flipped := bytes.Clone(ciphertext)
+	flipped[HeaderSize+SegmentSize+5] ^= 1
+	segment := SegmentSize + tagSize
+	cases := map[string]struct {
+		key        []byte
+		ciphertext []byte
+	}{
+		"modified":  {key, flipped},
+		"truncated": {key, ciphertext[:HeaderSize+2*segment]},
+		"reordered": {key, append(append(bytes.Clone(ciphertext[:HeaderSize]), ciphertext[HeaderSize+segment:HeaderSize+2*segment]...), ciphertext[HeaderSize:HeaderSize+segment]...)},
+		"wrong key": {otherKey, ciphertext},
+	}
+	for name, c := range cases {
+		err := Decrypt(c.key, io.Discard, bytes.NewReader(c.ciphertext))
+		if !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("%s: expected ErrAuthFailed, got %v", name, err)
+		}
+	}
+
+	if err := Decrypt(key, io.Discard, bytes.NewReader(plaintext)); !errors.Is(err, ErrNotEncrypted) {
+		t.Errorf("Expected ErrNotEncrypted for plaintext, got %v", err)
+	}
+}
+
+func TestEncryptName(t *testing.T) {
+	key, _ := GenerateKey()
+	first, err := EncryptName(key, "report.pdf")
+	if err != nil {
+		t.Fatalf("EncryptName() error = %v", err)
+	}
+	second, _ := EncryptName(key, "report.pdf")
+	if first != second {
+		t.Errorf("Encrypted names differ: %s and %s", first, second)
+	}
+	if other, _ := EncryptName(key, "report.txt"); other == first {
+		t.Errorf("Different names encrypted to the same value")
+	}
+
+	name, err := DecryptName(key, first)
+	if err != nil {
+		t.Fatalf("DecryptName() error = %v", err)
+	}
+	if name != "report.pdf" {
+		t.Errorf("Expected report.pdf, got %s", name)
+	}
+}
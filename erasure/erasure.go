@@ -0,0 +1,149 @@
+// Package erasure implements systematic Reed-Solomon erasure coding over GF(2^8). An object
+// is split into data shards and extended with parity shards, and any combination of as
+// many shards as there are data shards is enough to rebuild all the others.
+package erasure
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MaxShards is the largest number of data and parity shards a codec supports.
+const MaxShards = 256
+
+var (
+	// ErrTooFewShards is returned when fewer shards are present than are needed to
+	// reconstruct the missing ones.
+	ErrTooFewShards = errors.New("too few shards to reconstruct")
+	// ErrShardSize is returned when shards differ in size.
+	ErrShardSize = errors.New("shards differ in size")
+
+	errSingular = errors.New("matrix is singular")
+)
+
+// Codec encodes and reconstructs shards for a fixed number of data and parity shards.
+type Codec struct {
+    dataShards   int
+    parityShards int
+    matrix       matrix // Rows produce every shard from the data shards, the top ones being the identity
+}
+
+// New returns a codec that extends dataShards data shards with parityShards parity shards.
+func New(dataShards, parityShards int) (*Codec, error) {
+    if dataShards <= 0 || parityShards < 0 || dataShards+parityShards > MaxShards {
+        return nil, fmt.Errorf("invalid shard counts %d+%d", dataShards, parityShards)
+    }
+    // Multiplying a Vandermonde matrix by the inverse of its top square keeps every square
+    // subset of rows invertible while turning the top rows into the identity, so the data
+    // shards are stored as they are.
+    total := dataShards + parityShards
+    v := vandermonde(total, dataShards)
+    top, err := v[:dataShards].invert()
+    if err != nil {
+        return nil, err
+    }
+    return &Codec{
+        dataShards:   dataShards,
+        parityShards: parityShards,
+        matrix:       v.multiply(top),
+    }, nil
+}
+
+// DataShards returns the number of data shards.
+func (c *Codec) DataShards() int {
+    return c.dataShards
+}
+
+// ParityShards returns the number of parity shards.
+func (c *Codec) ParityShards() int {
+    return c.parityShards
+}
+
+// Shards returns the total number of shards.
+func (c *Codec) Shards() int {
+    return c.dataShards + c.parityShards
+}
+
+// Encode computes the parity shards from the data shards. shards must hold every shard,
+// data shards first, all of the same size; the parity shards are overwritten.
+func (c *Codec) Encode(shards [][]byte) error {
+    if len(shards) != c.Shards() {
+        return fmt.Errorf("expected %d shards, got %d", c.Shards(), len(shards))
+    }
+    size := len(shards[0])
+    for _, shard := range shards {
+        if len(shard) != size {
+            return ErrShardSize
+        }
+    }
+    for p := c.dataShards; p < c.Shards(); p++ {
+        c.combine(c.matrix[p], shards[:c.dataShards], shards[p])
+    }
+    return nil
+}
+
+// Reconstruct rebuilds the missing shards, marked by nil entries, from the present ones.
+// At least DataShards shards must be present.
+func (c *Codec) Reconstruct(shards [][]byte) error {
+    if len(shards) != c.Shards() {
+        return fmt.Errorf("expected %d shards, got %d", c.Shards(), len(shards))
+    }
+    size := -1
+    var present []int
+    for i, shard := range shards {
+        if shard == nil {
+            continue
+        }
+        if size >= 0 && len(shard) != size {
+            return ErrShardSize
+        }
+        size = len(shard)
+        present = append(present, i)
+    }
+    if len(present) == c.Shards() {
+        return nil
+    }
+    if len(present) < c.dataShards {
+        return ErrTooFewShards
+    }
+
+    // The rows of the present shards map the data shards to them, so their inverse maps
+    // the present shards back to the data shards.
+    present = present[:c.dataShards]
+    rows := make(matrix, c.dataShards)
+    inputs := make([][]byte, c.dataShards)
+    for i, index := range present {
+        rows[i] = c.matrix[index]
+        inputs[i] = shards[index]
+    }
+    decode, err := rows.invert()
+    if err != nil {
+        return err
+    }
+    for d := 0; d < c.dataShards; d++ {
+        if shards[d] == nil {
+            shards[d] = make([]byte, size)
+            c.combine(decode[d], inputs, shards[d])
+        }
+    }
+    for p := c.dataShards; p < c.Shards(); p++ {
+        if shards[p] == nil {
+            shards[p] = make([]byte, size)
+            c.combine(c.matrix[p], shards[:c.dataShards], shards[p])
+        }
+    }
+    return nil
+}
+
+// combine writes the linear combination of inputs with the given coefficients to out.
+func (c *Codec) combine(coefficients []byte, inputs [][]byte, out []byte) {
+    for i := range out {
+        out[i] = 0
+    }
+    for i, input := range inputs {
+        table := &mulTable[coefficients[i]]
+        for j, b := range input {
+            out[j] ^= table[b]
+        }
+    }
+}
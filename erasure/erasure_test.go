@@ -0,0 +1,104 @@
+package erasure
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestReconstructFromAnyDataShards(t *testing.T) {
+    codec, err := New(4, 2)
+    if err != nil {
+        t.Fatalf("New() error = %v", err)
+    }
+    shards := make([][]byte, codec.Shards())
+    for i := range shards {
+        shards[i] = make([]byte, 100)
+        if i < codec.DataShards() {
+            rand.Read(shards[i])
+        }
+    }
+    if err := codec.Encode(shards); err != nil {
+        t.Fatalf("Encode() error = %v", err)
+    }
+
+    for a := 0; a < codec.Shards(); a++ {
+        for b := a + 1; b < codec.Shards(); b++ {
+            damaged := make([][]byte, len(shards))
+            copy(damaged, shards)
+            damaged[a], damaged[b] = nil, nil
+            if err := codec.Reconstruct(damaged); err != nil {
+                t.Fatalf("Reconstruct() without shards %d and %d error = %v", a, b, err)
+            }
+            for i := range shards {
+                if !bytes.Equal(damaged[i], shards[i]) {
+                    t.Fatalf("shard %d differs after losing shards %d and %d", i, a, b)
+                }
+            }
+        }
+    }
+
+    damaged := make([][]byte, len(shards))
+    copy(damaged, shards)
+    damaged[0], damaged[1], damaged[2] = nil, nil, nil
+    if err := codec.Reconstruct(damaged); !errors.Is(err, ErrTooFewShards) {
+        t.Errorf("Reconstruct() with 3 missing shards error = %v, want ErrTooFewShards", err)
+    }
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+    const unitSize = 1024
+    codec, _ := New(3, 2)
+    for _, size := range []int{0, 1, unitSize, 3 * unitSize, 10*unitSize + 7} {
+        object := make([]byte, size)
+        rand.Read(object)
+
+        buffers := make([]*bytes.Buffer, codec.Shards())
+        writers := make([]io.Writer, codec.Shards())
+        for i := range buffers {
+            buffers[i] = new(bytes.Buffer)
+            writers[i] = buffers[i]
+        }
+        read, err := codec.EncodeStream(bytes.NewReader(object), writers, unitSize)
+        if err != nil || read != int64(size) {
+            t.Fatalf("size %d: EncodeStream() = %d, %v", size, read, err)
+        }
+        for i, buffer := range buffers {
+            if int64(buffer.Len()) != codec.ShardSize(int64(size), unitSize) {
+                t.Fatalf("size %d: shard %d holds %d bytes, want %d", size, i, buffer.Len(), codec.ShardSize(int64(size), unitSize))
+            }
+        }
+
+        // Lose one data and one parity shard, rebuild them and decode the object.
+        readers := make([]io.Reader, codec.Shards())
+        for i, buffer := range buffers {
+            if i != 1 && i != 4 {
+                readers[i] = bytes.NewReader(buffer.Bytes())
+            }
+        }
+        var rebuiltData, rebuiltParity bytes.Buffer
+        rebuilt := make([]io.Writer, codec.Shards())
+        rebuilt[1], rebuilt[4] = &rebuiltData, &rebuiltParity
+        if err := codec.ReconstructStream(readers, rebuilt, unitSize); err != nil {
+            t.Fatalf("size %d: ReconstructStream() error = %v", size, err)
+        }
+        if !bytes.Equal(rebuiltData.Bytes(), buffers[1].Bytes()) || !bytes.Equal(rebuiltParity.Bytes(), buffers[4].Bytes()) {
+            t.Fatalf("size %d: rebuilt shards differ", size)
+        }
+
+        for i, buffer := range buffers {
+            if readers[i] != nil {
+                readers[i] = bytes.NewReader(buffer.Bytes())
+            }
+        }
+        var decoded bytes.Buffer
+        if err := codec.DecodeStream(readers, &decoded, int64(size), unitSize); err != nil {
+            t.Fatalf("size %d: DecodeStream() error = %v", size, err)
+        }
+        if !bytes.Equal(decoded.Bytes(), object) {
+            t.Errorf("size %d: decoded object differs", size)
+        }
+    }
+}
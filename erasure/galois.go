@@ -0,0 +1,128 @@
+package erasure
+
+// Arithmetic in GF(2^8) with the reducing polynomial x^8 + x^4 + x^3 + x^2 + 1 (0x11d).
+
+var (
+	expTable [510]byte // Doubled so the sum of two logarithms needs no reduction
+	logTable [256]byte
+	mulTable [256][256]byte
+)
+
+func init() {
+    x := 1
+    for i := 0; i < 255; i++ {
+        expTable[i] = byte(x)
+        logTable[x] = byte(i)
+        x <<= 1
+        if x&0x100 != 0 {
+            x ^= 0x11d
+        }
+    }
+    for i := 255; i < len(expTable); i++ {
+        expTable[i] = expTable[i-255]
+    }
+    for a := 1; a < 256; a++ {
+        for b := 1; b < 256; b++ {
+            mulTable[a][b] = expTable[int(logTable[a])+int(logTable[b])]
+        }
+    }
+}
+
+func gfMul(a, b byte) byte {
+    return mulTable[a][b]
+}
+
+// gfInv returns the multiplicative inverse of a, which must not be zero.
+func gfInv(a byte) byte {
+    return expTable[255-int(logTable[a])]
+}
+
+// gfPow returns a raised to the power n.
+func gfPow(a byte, n int) byte {
+    if n == 0 {
+        return 1
+    }
+    if a == 0 {
+        return 0
+    }
+    return expTable[(int(logTable[a])*n)%255]
+}
+
+// matrix is a row-major matrix over GF(2^8).
+type matrix [][]byte
+
+func newMatrix(rows, cols int) matrix {
+    m := make(matrix, rows)
+    for i := range m {
+        m[i] = make([]byte, cols)
+    }
+    return m
+}
+
+// vandermonde returns the rows x cols matrix whose element (r, c) is r^c. Any cols of its
+// rows are linearly independent as long as rows does not exceed 256.
+func vandermonde(rows, cols int) matrix {
+    m := newMatrix(rows, cols)
+    for r := range m {
+        for c := range m[r] {
+            m[r][c] = gfPow(byte(r), c)
+        }
+    }
+    return m
+}
+
+func (m matrix) multiply(other matrix) matrix {
+    result := newMatrix(len(m), len(other[0]))
+    for r := range result {
+        for c := range result[r] {
+            var value byte
+            for i := range other {
+                value ^= gfMul(m[r][i], other[i][c])
+            }
+            result[r][c] = value
+        }
+    }
+    return result
+}
+
+// invert returns the inverse of a square matrix using Gauss-Jordan elimination, or
+// errSingular if it has none.
+func (m matrix) invert() (matrix, error) {
+    size := len(m)
+    work := newMatrix(size, 2*size)
+    for r := range m {
+        copy(work[r], m[r])
+        work[r][size+r] = 1
+    }
+
+    for col := 0; col < size; col++ {
+        pivot := col
+        for pivot < size && work[pivot][col] == 0 {
+            pivot++
+        }
+        if pivot == size {
+            return nil, errSingular
+        }
+        work[col], work[pivot] = work[pivot], work[col]
+
+        scale := gfInv(work[col][col])
+        for c := range work[col] {
+            work[col][c] = gfMul(work[col][c], scale)
+        }
+        for r := range work {
+            if r == col || work[r][col] == 0 {
+                continue
+            }
+            factor := work[r][col]
+            for c := range work[r] {
+                work[r][c] ^= gfMul(factor, work[col][c])
+            }
+        }
+    }
+
+    inverse := newMatrix(size, size)
+    for r := range inverse {
+        copy(inverse[r], work[r][size:])
+    }
+    return inverse, nil
+}
@@ -0,0 +1,158 @@
+package erasure
+
+import (
+	"errors"
+	"io"
+)
+
+// Streams are coded in stripes: every stripe takes unitSize bytes from each data shard, so
+// an object of any size is coded with a fixed amount of memory. The last stripe is padded
+// with zeros, and every shard of an object of n bytes holds ShardSize(n, unitSize) bytes.
+
+// ShardSize returns the size of each shard of an object of size bytes.
+func (c *Codec) ShardSize(size int64, unitSize int) int64 {
+    stripe := int64(c.dataShards * unitSize)
+    return (size + stripe - 1) / stripe * int64(unitSize)
+}
+
+// EncodeStream reads r to its end and writes every shard to the matching writer in shards,
+// returning the number of bytes read.
+func (c *Codec) EncodeStream(r io.Reader, shards []io.Writer, unitSize int) (int64, error) {
+    if len(shards) != c.Shards() {
+        return 0, ErrShardSize
+    }
+    stripe := make([][]byte, c.Shards())
+    for i := range stripe {
+        stripe[i] = make([]byte, unitSize)
+    }
+    var total int64
+    for {
+        eof := false
+        for d := 0; d < c.dataShards; d++ {
+            n, err := io.ReadFull(r, stripe[d])
+            total += int64(n)
+            if err == io.EOF || err == io.ErrUnexpectedEOF {
+                if n == 0 && d == 0 {
+                    return total, nil
+                }
+                clear(stripe[d][n:])
+                for _, rest := range stripe[d+1 : c.dataShards] {
+                    clear(rest)
+                }
+                eof = true
+                break
+            }
+            if err != nil {
+                return total, err
+            }
+        }
+        if err := c.Encode(stripe); err != nil {
+            return total, err
+        }
+        for i, w := range shards {
+            if _, err := w.Write(stripe[i]); err != nil {
+                return total, err
+            }
+        }
+        if eof {
+            return total, nil
+        }
+    }
+}
+
+// ReconstructStream reads the present shards, with nil readers marking missing ones, and
+// writes the shards that have a writer in rebuilt.
+func (c *Codec) ReconstructStream(shards []io.Reader, rebuilt []io.Writer, unitSize int) error {
+    return c.stripes(shards, unitSize, func(stripe [][]byte) error {
+        for i, w := range rebuilt {
+            if w == nil {
+                continue
+            }
+            if _, err := w.Write(stripe[i]); err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+}
+
+// DecodeStream reads the present shards, with nil readers marking missing ones, and writes
+// the first size bytes of the original object to w.
+func (c *Codec) DecodeStream(shards []io.Reader, w io.Writer, size int64, unitSize int) error {
+    remaining := size
+    err := c.stripes(shards, unitSize, func(stripe [][]byte) error {
+        for _, unit := range stripe[:c.dataShards] {
+            if remaining == 0 {
+                return nil
+            }
+            if int64(len(unit)) > remaining {
+                unit = unit[:remaining]
+            }
+            if _, err := w.Write(unit); err != nil {
+                return err
+            }
+            remaining -= int64(len(unit))
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    if remaining > 0 {
+        return io.ErrUnexpectedEOF
+    }
+    return nil
+}
+
+// stripes reads the present shards one stripe at a time, reconstructs the missing units of
+// each stripe and passes the complete stripe to fn.
+func (c *Codec) stripes(shards []io.Reader, unitSize int, fn func(stripe [][]byte) error) error {
+    if len(shards) != c.Shards() {
+        return ErrShardSize
+    }
+    buffers := make([][]byte, c.Shards())
+    for i, r := range shards {
+        if r != nil {
+            buffers[i] = make([]byte, unitSize)
+        }
+    }
+    stripe := make([][]byte, c.Shards())
+    for {
+        ended := 0
+        present := 0
+        for i, r := range shards {
+            if r == nil {
+                continue
+            }
+            present++
+            _, err := io.ReadFull(r, buffers[i])
+            if err == io.EOF {
+                ended++
+                continue
+            }
+            if errors.Is(err, io.ErrUnexpectedEOF) {
+                return ErrShardSize
+            }
+            if err != nil {
+                return err
+            }
+        }
+        if present < c.dataShards {
+            return ErrTooFewShards
+        }
+        if ended == present {
+            return nil
+        }
+        if ended > 0 {
+            return ErrShardSize
+        }
+
+        copy(stripe, buffers)
+        if err := c.Reconstruct(stripe); err != nil {
+            return err
+        }
+        if err := fn(stripe); err != nil {
+            return err
+        }
+    }
+}
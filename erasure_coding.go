@@ -0,0 +1,581 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/erasure"
+	"github.com/tejasprabhu/GopherStore/logger"
+	"github.com/tejasprabhu/GopherStore/p2p"
+)
+
+const (
+	erasureDirName        = "erasure"
+	erasureUnitSize       = 64 << 10
+	defaultDataShards     = 4
+	defaultParityShards   = 2
+	defaultRepairInterval = time.Hour
+	shardExtension        = "shard"
+	layoutExtension       = "layout"
+)
+
+// ErasureLayout describes how an erasure-coded object was split into shards. A copy is
+// stored next to every shard, so any peer holding a shard can tell how to decode it.
+type ErasureLayout struct {
+    DataShards     int
+    ParityShards   int
+    UnitSize       int
+    Size           int64    // Size of the original object
+    Checksum       string   // Checksum of the original object
+    ShardChecksums []string // Checksum of every shard, data shards first
+}
+
+// ErasureRecord remembers an erasure-coded object this node placed on the network, so it
+// can keep its shards repaired.
+type ErasureRecord struct {
+    ID        string
+    Filename  string
+    Extension string
+    OriginID  string
+    Layout    ErasureLayout
+}
+
+// shardData returns the metadata a shard of an object is stored under.
+func shardData(data *datamgmt.Data, index int) *datamgmt.Data {
+    return &datamgmt.Data{
+        ID:        data.ID,
+        Filename:  fmt.Sprintf("%s.%d", data.Key(), index),
+        OriginID:  data.OriginID,
+        Extension: shardExtension,
+    }
+}
+
+// layoutData returns the metadata the layout of an object is stored under.
+func layoutData(data *datamgmt.Data) *datamgmt.Data {
+    return &datamgmt.Data{
+        ID:        data.ID,
+        Filename:  data.Key(),
+        OriginID:  data.OriginID,
+        Extension: layoutExtension,
+    }
+}
+
+func (l *ErasureLayout) codec() (*erasure.Codec, error) {
+    codec, err := erasure.New(l.DataShards, l.ParityShards)
+    if err != nil {
+        return nil, err
+    }
+    if len(l.ShardChecksums) != codec.Shards() || l.UnitSize <= 0 {
+        return nil, errors.New("invalid erasure layout")
+    }
+    return codec, nil
+}
+
+// sendErasureCoded splits a file into dataShards data and parityShards parity shards and
+// stores each shard, along with the layout, on a different peer close to the object's key.
+func (s *Server) sendErasureCoded(data *datamgmt.Data, file *os.File, dataShards, parityShards int) error {
+    codec, err := erasure.New(dataShards, parityShards)
+    if err != nil {
+        return err
+    }
+    candidates := s.shardCandidates(data, nil)
+    if len(candidates) < codec.Shards() {
+        return fmt.Errorf("%d shards need as many peers, only %d known", codec.Shards(), len(candidates))
+    }
+
+    shards, hashers, err := createShardFiles(codec.Shards())
+    if err != nil {
+        return err
+    }
+    defer removeShardFiles(shards)
+    writers := make([]io.Writer, len(shards))
+    for i := range shards {
+        writers[i] = io.MultiWriter(shards[i], hashers[i])
+    }
+
+    if _, err := file.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+    hasher := datamgmt.NewChecksum()
+    size, err := codec.EncodeStream(io.TeeReader(file, hasher), writers, erasureUnitSize)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to encode shards")
+        return err
+    }
+    layout := ErasureLayout{
+        DataShards:   dataShards,
+        ParityShards: parityShards,
+        UnitSize:     erasureUnitSize,
+        Size:         size,
+        Checksum:     hex.EncodeToString(hasher.Sum(nil)),
+    }
+    for _, h := range hashers {
+        layout.ShardChecksums = append(layout.ShardChecksums, hex.EncodeToString(h.Sum(nil)))
+    }
+
+    placed, err := s.placeShards(data, &layout, shards, candidates)
+    if err != nil {
+        return err
+    }
+    record := &ErasureRecord{
+        ID:        data.ID,
+        Filename:  data.Filename,
+        Extension: data.Extension,
+        OriginID:  data.OriginID,
+        Layout:    layout,
+    }
+    if err := s.storage.SaveErasureRecord(record); err != nil {
+        logger.Log.WithError(err).Error("Failed to record erasure-coded object")
+        return err
+    }
+    logger.Log.WithFields(map[string]interface{}{
+        "key":    data.Key(),
+        "data":   dataShards,
+        "parity": parityShards,
+        "peers":  placed,
+    }).Info("Erasure-coded object stored")
+    return nil
+}
+
+// placeShards uploads every non-nil shard file, together with the layout, to its own peer
+// from candidates, moving on to the next candidate when a peer fails. It returns where each
+// shard was placed.
+func (s *Server) placeShards(data *datamgmt.Data, layout *ErasureLayout, shards []*os.File, candidates []string) (map[int]string, error) {
+    content, err := json.Marshal(layout)
+    if err != nil {
+        return nil, err
+    }
+    layoutFile, err := os.CreateTemp("", "gopherstore-layout-*")
+    if err != nil {
+        return nil, err
+    }
+    defer os.Remove(layoutFile.Name())
+    defer layoutFile.Close()
+    if _, err := layoutFile.Write(content); err != nil {
+        return nil, err
+    }
+
+    placed := make(map[int]string)
+    for index, shard := range shards {
+        if shard == nil {
+            continue
+        }
+        for len(candidates) > 0 && placed[index] == "" {
+            address := candidates[0]
+            candidates = candidates[1:]
+            err := s.syncData(address, shardData(data, index), shard)
+            if err == nil {
+                err = s.syncData(address, layoutData(data), layoutFile)
+            }
+            if err != nil {
+                logger.Log.WithError(err).WithField("address", address).WithField("shard", index).Warn("Failed to place shard")
+                continue
+            }
+            placed[index] = address
+        }
+        if placed[index] == "" {
+            return placed, fmt.Errorf("no peer left to place shard %d", index)
+        }
+    }
+    return placed, nil
+}
+
+// shardCandidates returns the peers closest to the object's key, leaving out this node, the
+// excluded addresses and peers that advertised they are full.
+func (s *Server) shardCandidates(data *datamgmt.Data, exclude map[string]bool) []string {
+    var candidates []string
+    for _, contact := range s.dht.FindNode(p2p.NewNodeID(data.Key())) {
+        if contact.ID != s.dht.Self().ID && !exclude[contact.Address] && !contact.Full {
+            candidates = append(candidates, contact.Address)
+        }
+    }
+    return candidates
+}
+
+// fetchErasureCoded rebuilds an erasure-coded object from any DataShards of its shards and
+// stores it locally. The result must match the checksum recorded in the layout.
+func (s *Server) fetchErasureCoded(data *datamgmt.Data) error {
+    layout, err := s.erasureLayout(data)
+    if err != nil {
+        return err
+    }
+    codec, err := layout.codec()
+    if err != nil {
+        return err
+    }
+    shards, err := s.downloadShards(data, layout, s.locateShards(data, layout), codec.DataShards())
+    if err != nil {
+        return err
+    }
+    defer removeShardFiles(shards)
+
+    temp, err := os.CreateTemp("", "gopherstore-decoded-*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(temp.Name())
+    defer temp.Close()
+    if err := codec.DecodeStream(shardReaders(shards), temp, layout.Size, layout.UnitSize); err != nil {
+        logger.Log.WithError(err).Error("Failed to decode shards")
+        return err
+    }
+    if _, err := temp.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+
+    data.Command = "send"
+    if data.Checksum == "" {
+        data.Checksum = layout.Checksum
+    }
+    if err := s.storage.StoreData(data, temp); err != nil {
+        logger.Log.WithError(err).Error("Failed to store data")
+        return err
+    }
+    logger.Log.WithField("key", data.Key()).Info("Erasure-coded object reconstructed")
+    go s.announce(data)
+    return nil
+}
+
+// repairErasureCoded regenerates the shards of an object that are no longer held by any
+// live peer and places them on new peers. It returns how many shards were regenerated.
+func (s *Server) repairErasureCoded(record *ErasureRecord) (int, error) {
+    data := record.Data()
+    layout := &record.Layout
+    codec, err := layout.codec()
+    if err != nil {
+        return 0, err
+    }
+    holders := s.locateShards(data, layout)
+    if len(holders) == codec.Shards() {
+        return 0, nil
+    }
+    shards, err := s.downloadShards(data, layout, holders, codec.DataShards())
+    if err != nil {
+        return 0, err
+    }
+    defer removeShardFiles(shards)
+
+    rebuilt, hashers, err := createShardFiles(codec.Shards())
+    if err != nil {
+        return 0, err
+    }
+    defer removeShardFiles(rebuilt)
+    writers := make([]io.Writer, codec.Shards())
+    for i := range rebuilt {
+        if _, ok := holders[i]; ok {
+            rebuilt[i].Close()
+            os.Remove(rebuilt[i].Name())
+            rebuilt[i] = nil
+            continue
+        }
+        writers[i] = io.MultiWriter(rebuilt[i], hashers[i])
+    }
+    if err := codec.ReconstructStream(shardReaders(shards), writers, layout.UnitSize); err != nil {
+        return 0, err
+    }
+    for i, shard := range rebuilt {
+        if shard == nil {
+            continue
+        }
+        if err := datamgmt.VerifyChecksum(layout.ShardChecksums[i], hex.EncodeToString(hashers[i].Sum(nil))); err != nil {
+            return 0, fmt.Errorf("shard %d: %w", i, err)
+        }
+    }
+
+    exclude := make(map[string]bool)
+    for _, address := range holders {
+        exclude[address] = true
+    }
+    placed, err := s.placeShards(data, layout, rebuilt, s.shardCandidates(data, exclude))
+    return len(placed), err
+}
+
+// repairLoop periodically repairs the erasure-coded objects this node placed until the
+// server shuts down.
+func (s *Server) repairLoop() {
+    defer s.wg.Done()
+    if s.repairInterval <= 0 {
+        return
+    }
+    ticker := time.NewTicker(s.repairInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-s.quit:
+            return
+        case <-ticker.C:
+            s.repairShards()
+        }
+    }
+}
+
+// repairShards checks every erasure-coded object this node placed and regenerates missing
+// shards, returning how many were regenerated.
+func (s *Server) repairShards() int {
+    records, err := s.storage.ErasureRecords()
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to list erasure-coded objects")
+        return 0
+    }
+    repaired := 0
+    for _, record := range records {
+        select {
+        case <-s.quit:
+            return repaired
+        default:
+        }
+        count, err := s.repairErasureCoded(record)
+        repaired += count
+        if err != nil {
+            logger.Log.WithError(err).WithField("key", record.Data().Key()).Error("Failed to repair erasure-coded object")
+            continue
+        }
+        if count > 0 {
+            logger.Log.WithField("key", record.Data().Key()).WithField("shards", count).Info("Missing shards regenerated")
+        }
+    }
+    return repaired
+}
+
+// erasureLayout returns the layout of an object, from the local record if this node placed
+// it and otherwise from the peers holding its shards, preferring the layout most of them
+// agree on.
+func (s *Server) erasureLayout(data *datamgmt.Data) (*ErasureLayout, error) {
+    if record, err := s.storage.LoadErasureRecord(data); err == nil {
+        return &record.Layout, nil
+    }
+    providers, err := s.locateProviders(layoutData(data))
+    if err != nil {
+        return nil, err
+    }
+
+    votes := make(map[string]int)
+    layouts := make(map[string]*ErasureLayout)
+    var best string
+    for _, address := range providers {
+        var content bytes.Buffer
+        if _, err := s.fetchInto(address, layoutData(data), 0, &content); err != nil {
+            logger.Log.WithError(err).WithField("address", address).Warn("Failed to fetch erasure layout")
+            continue
+        }
+        var layout ErasureLayout
+        if err := json.Unmarshal(content.Bytes(), &layout); err != nil {
+            continue
+        }
+        if _, err := layout.codec(); err != nil {
+            continue
+        }
+        fingerprint := content.String()
+        layouts[fingerprint] = &layout
+        votes[fingerprint]++
+        if votes[fingerprint] > votes[best] {
+            best = fingerprint
+        }
+    }
+    if layouts[best] == nil {
+        return nil, errors.New("no peer could provide the erasure layout")
+    }
+    return layouts[best], nil
+}
+
+// locateShards finds a live peer holding an intact copy of each shard, checking with every
+// provider that its copy matches the layout. Shards nobody holds are left out.
+func (s *Server) locateShards(data *datamgmt.Data, layout *ErasureLayout) map[int]string {
+    var mu sync.Mutex
+    var wg sync.WaitGroup
+    holders := make(map[int]string)
+    for index := range layout.ShardChecksums {
+        wg.Add(1)
+        go func(index int) {
+            defer wg.Done()
+            shard := shardData(data, index)
+            providers, err := s.locateProviders(shard)
+            if err != nil {
+                return
+            }
+            for _, address := range providers {
+                info, err := s.statObject(address, shard)
+                if err != nil || info.Checksum != layout.ShardChecksums[index] {
+                    continue
+                }
+                mu.Lock()
+                holders[index] = address
+                mu.Unlock()
+                return
+            }
+        }(index)
+    }
+    wg.Wait()
+    return holders
+}
+
+// downloadShards fetches needed shards from their holders into temporary files, verifying
+// each against the layout. The returned slice has a nil entry for every shard not fetched.
+func (s *Server) downloadShards(data *datamgmt.Data, layout *ErasureLayout, holders map[int]string, needed int) ([]*os.File, error) {
+    shards := make([]*os.File, len(layout.ShardChecksums))
+    fetched := 0
+    for index := range shards {
+        if fetched == needed {
+            break
+        }
+        address, ok := holders[index]
+        if !ok {
+            continue
+        }
+        shard, err := s.fetchShard(address, shardData(data, index), layout.ShardChecksums[index])
+        if err != nil {
+            logger.Log.WithError(err).WithField("address", address).WithField("shard", index).Warn("Failed to fetch shard")
+            continue
+        }
+        shards[index] = shard
+        fetched++
+    }
+    if fetched < needed {
+        removeShardFiles(shards)
+        return nil, fmt.Errorf("%w: %d of %d shards available", erasure.ErrTooFewShards, fetched, needed)
+    }
+    return shards, nil
+}
+
+// fetchShard downloads a shard into a temporary file and checks it against its checksum.
+func (s *Server) fetchShard(address string, shard *datamgmt.Data, checksum string) (*os.File, error) {
+    temp, err := os.CreateTemp("", "gopherstore-shard-*")
+    if err != nil {
+        return nil, err
+    }
+    hasher := datamgmt.NewChecksum()
+    _, err = s.fetchInto(address, shard, 0, io.MultiWriter(temp, hasher))
+    if err == nil {
+        err = datamgmt.VerifyChecksum(checksum, hex.EncodeToString(hasher.Sum(nil)))
+    }
+    if err == nil {
+        _, err = temp.Seek(0, io.SeekStart)
+    }
+    if err != nil {
+        temp.Close()
+        os.Remove(temp.Name())
+        return nil, err
+    }
+    return temp, nil
+}
+
+func createShardFiles(count int) ([]*os.File, []hash.Hash, error) {
+    shards := make([]*os.File, count)
+    hashers := make([]hash.Hash, count)
+    for i := range shards {
+        file, err := os.CreateTemp("", "gopherstore-shard-*")
+        if err != nil {
+            removeShardFiles(shards)
+            return nil, nil, err
+        }
+        shards[i] = file
+        hashers[i] = datamgmt.NewChecksum()
+    }
+    return shards, hashers, nil
+}
+
+func removeShardFiles(shards []*os.File) {
+    for _, shard := range shards {
+        if shard != nil {
+            shard.Close()
+            os.Remove(shard.Name())
+        }
+    }
+}
+
+// shardReaders rewinds the shard files and returns them as readers, nil for missing ones.
+func shardReaders(shards []*os.File) []io.Reader {
+    readers := make([]io.Reader, len(shards))
+    for i, shard := range shards {
+        if shard == nil {
+            continue
+        }
+        if _, err := shard.Seek(0, io.SeekStart); err == nil {
+            readers[i] = shard
+        }
+    }
+    return readers
+}
+
+// Data returns the metadata of the recorded object.
+func (r *ErasureRecord) Data() *datamgmt.Data {
+    return &datamgmt.Data{
+        ID:        r.ID,
+        Filename:  r.Filename,
+        Extension: r.Extension,
+        OriginID:  r.OriginID,
+    }
+}
+
+func (s *StorageService) erasureRecordPath(data *datamgmt.Data) string {
+    return filepath.Join(s.rootPath, erasureDirName, datamgmt.HashChunk([]byte(data.Key()))+".json")
+}
+
+// SaveErasureRecord remembers an erasure-coded object placed by this node.
+func (s *StorageService) SaveErasureRecord(record *ErasureRecord) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    content, err := json.Marshal(record)
+    if err != nil {
+        return err
+    }
+    return writeFileAtomic(s.erasureRecordPath(record.Data()), content)
+}
+
+// LoadErasureRecord returns the record of an erasure-coded object placed by this node.
+func (s *StorageService) LoadErasureRecord(data *datamgmt.Data) (*ErasureRecord, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return s.loadErasureRecord(s.erasureRecordPath(data))
+}
+
+// ErasureRecords returns every erasure-coded object placed by this node.
+func (s *StorageService) ErasureRecords() ([]*ErasureRecord, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    entries, err := os.ReadDir(filepath.Join(s.rootPath, erasureDirName))
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var records []*ErasureRecord
+    for _, entry := range entries {
+        if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+            continue
+        }
+        record, err := s.loadErasureRecord(filepath.Join(s.rootPath, erasureDirName, entry.Name()))
+        if err != nil {
+            logger.Log.WithError(err).WithField("file", entry.Name()).Warn("Skipping unreadable erasure record")
+            continue
+        }
+        records = append(records, record)
+    }
+    return records, nil
+}
+
+func (s *StorageService) loadErasureRecord(path string) (*ErasureRecord, error) {
+    content, err := os.ReadFile(filepath.Clean(path))
+    if err != nil {
+        return nil, err
+    }
+    var record ErasureRecord
+    if err := json.Unmarshal(content, &record); err != nil {
+        return nil, fmt.Errorf("invalid erasure record %s: %w", path, err)
+    }
+    return &record, nil
+}
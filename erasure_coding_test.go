@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+)
+
+func TestServer_ErasureCodingSurvivesPeerLoss(t *testing.T) {
+    content := make([]byte, 3*erasureUnitSize+999)
+    if _, err := rand.Read(content); err != nil {
+        t.Fatal(err)
+    }
+    file, err := os.CreateTemp("", "erasure-test-*")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.Remove(file.Name())
+    defer file.Close()
+    file.Write(content)
+
+    peers := make(map[string]*Server)
+    addresses := []string{"127.0.0.1:3361", "127.0.0.1:3362", "127.0.0.1:3363", "127.0.0.1:3364", "127.0.0.1:3365", "127.0.0.1:3366"}
+    for _, address := range addresses {
+        peers[address] = startTestServer(t, address, nil)
+        peers[address].dht.Bootstrap(addresses[:1])
+    }
+    client := startTestServer(t, "127.0.0.1:3360", nil)
+    client.dht.Bootstrap(addresses)
+
+    data := &datamgmt.Data{ID: "1", Filename: "cold", Extension: "bin"}
+    if err := client.sendErasureCoded(data, file, 2, 2); err != nil {
+        t.Fatalf("sendErasureCoded() error = %v", err)
+    }
+    record, err := client.storage.LoadErasureRecord(data)
+    if err != nil {
+        t.Fatalf("LoadErasureRecord() error = %v", err)
+    }
+    holders := client.locateShards(data, &record.Layout)
+    if len(holders) != 4 {
+        t.Fatalf("Expected 4 shards on the network, found %d", len(holders))
+    }
+
+    // Lose two of the peers holding shards, then regenerate their shards on the others.
+    peers[holders[0]].transport.Close()
+    peers[holders[3]].transport.Close()
+    if repaired := client.repairShards(); repaired != 2 {
+        t.Fatalf("repairShards() regenerated %d shards, want 2", repaired)
+    }
+    // Peers announce the shards they receive in the background.
+    for attempt := 1; ; attempt++ {
+        holders = client.locateShards(data, &record.Layout)
+        if len(holders) == 4 {
+            break
+        }
+        if attempt == 50 {
+            t.Fatalf("Expected 4 shards after repair, found %d", len(holders))
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+
+    fetcher := startTestServer(t, "127.0.0.1:3367", nil)
+    fetcher.dht.Bootstrap([]string{holders[1]})
+    if err := fetcher.fetchErasureCoded(&datamgmt.Data{ID: "1", Filename: "cold", Extension: "bin"}); err != nil {
+        t.Fatalf("fetchErasureCoded() error = %v", err)
+    }
+    reader, err := fetcher.storage.ReadData(data)
+    if err != nil {
+        t.Fatalf("ReadData() error = %v", err)
+    }
+    defer reader.Close()
+    result, _ := io.ReadAll(reader)
+    if !bytes.Equal(result, content) {
+        t.Errorf("Reconstructed content does not match the original")
+    }
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/logger"
+)
+
+// Files sent with a TTL or expiry time record when they expire in their manifest, and are
+// no longer served from that moment on. The expirer then replaces every expired file with a
+// tombstone, which is forwarded to the other replicas like any delete, and erases the
+// expired version so its chunks are freed without waiting for the tombstone's grace period.
+
+const expiryInterval = time.Minute
+
+var errObjectExpired = fmt.Errorf("object expired: %w", fs.ErrNotExist)
+
+// expired reports whether the version has expired by now.
+func (m *Manifest) expired(now time.Time) bool {
+    return !m.ExpiresAt.IsZero() && !now.Before(m.ExpiresAt)
+}
+
+// ExpireData replaces every file whose latest version has expired by now with a tombstone,
+// erases expired versions, and returns the tombstones it wrote.
+func (s *StorageService) ExpireData(now time.Time) ([]*Manifest, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    expired := make(map[string][]string) // Expired version IDs by file path
+    var latest []string
+    err := s.walkManifests(func(path string, manifest *Manifest) error {
+        if !manifest.Deleted && manifest.expired(now) {
+            latest = append(latest, path)
+            expired[path] = append(expired[path], manifest.VersionID)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    err = s.walkVersions(func(path string, manifest *Manifest) error {
+        if manifest.expired(now) {
+            relative, err := filepath.Rel(filepath.Join(s.rootPath, versionDirName), filepath.Dir(path))
+            if err != nil {
+                return err
+            }
+            file := filepath.Join(s.rootPath, relative)
+            expired[file] = append(expired[file], manifest.VersionID)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    var tombstones []*Manifest
+    for _, path := range latest {
+        manifest, err := s.loadManifest(path)
+        if err != nil {
+            continue
+        }
+        tombstone := &Manifest{
+            ID:         manifest.ID,
+            Filename:   manifest.Filename,
+            Extension:  manifest.Extension,
+            OriginID:   manifest.OriginID,
+            Deleted:    true,
+            ModifiedAt: manifest.ExpiresAt,
+            Bucket:     manifest.Bucket,
+        }
+        if err := s.writeVersion(path, tombstone); err != nil {
+            logger.Log.WithError(err).WithField("path", path).Error("Failed to expire file")
+            delete(expired, path)
+            continue
+        }
+        tombstones = append(tombstones, tombstone)
+    }
+    for path, ids := range expired {
+        for _, id := range ids {
+            if err := s.purgeVersion(path, id); err != nil {
+                logger.Log.WithError(err).WithField("path", path).WithField("version", id).Warn("Failed to erase expired version")
+            }
+        }
+    }
+    return tombstones, nil
+}
+
+// expiryLoop periodically expires files until the server shuts down.
+func (s *Server) expiryLoop() {
+    defer s.wg.Done()
+    ticker := time.NewTicker(expiryInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-s.quit:
+            return
+        case <-ticker.C:
+            s.expire()
+        }
+    }
+}
+
+// expire removes expired files here and on the other peers providing them.
+func (s *Server) expire() {
+    tombstones, err := s.storage.ExpireData(time.Now())
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to expire files")
+        return
+    }
+    for _, tombstone := range tombstones {
+        data := tombstoneData(tombstone)
+        s.dht.RemoveProvider(data.Key(), s.dht.Self().ID)
+        s.propagateDelete(data)
+        logger.Log.WithField("key", data.Key()).Info("File expired")
+    }
+}
+
+// parseSendOption reads a "ttl=<duration>", "expires=<RFC 3339 time>" or
+// "tag=<name>:<value>" argument of the send command into data.
+func parseSendOption(arg string, data *datamgmt.Data) error {
+    if ttl, ok := strings.CutPrefix(arg, "ttl="); ok {
+        duration, err := time.ParseDuration(ttl)
+        if err != nil || duration <= 0 {
+            return fmt.Errorf("invalid TTL %q", ttl)
+        }
+        data.TTL = duration
+        return nil
+    }
+    if expires, ok := strings.CutPrefix(arg, "expires="); ok {
+        at, err := time.Parse(time.RFC3339, expires)
+        if err != nil {
+            return fmt.Errorf("invalid expiry time %q: %w", expires, err)
+        }
+        data.ExpiresAt = at
+        return nil
+    }
+    if tag, ok := strings.CutPrefix(arg, "tag="); ok {
+        name, value, found := strings.Cut(tag, ":")
+        if !found || name == "" {
+            return fmt.Errorf("invalid tag %q, expected <name>:<value>", tag)
+        }
+        if data.Tags == nil {
+            data.Tags = make(map[string]string)
+        }
+        data.Tags[name] = value
+        return nil
+    }
+    return fmt.Errorf("expected ttl=<duration>, expires=<time> or tag=<name>:<value>, got %q", arg)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+)
+
+func TestStorageService_ExpireData(t *testing.T) {
+    service := NewStorageService("test_address")
+    defer os.RemoveAll(service.rootPath) // Clean up after test
+
+    kept := &datamgmt.Data{ID: "1", Filename: "kept", Extension: "txt", TTL: time.Hour}
+    if err := service.StoreData(kept, bytes.NewReader([]byte("kept content"))); err != nil {
+        t.Fatalf("StoreData() error = %v", err)
+    }
+    expires := time.Now().Add(50 * time.Millisecond)
+    data := &datamgmt.Data{ID: "1", Filename: "temporary", Extension: "txt", ExpiresAt: expires}
+    if err := service.StoreData(data, bytes.NewReader([]byte("temporary content"))); err != nil {
+        t.Fatalf("StoreData() error = %v", err)
+    }
+    if result := readStored(t, service, data); string(result) != "temporary content" {
+        t.Fatalf("Expected content before expiry, got '%s'", result)
+    }
+
+    time.Sleep(time.Until(expires))
+    // Expired files stop being served before the expirer gets to them.
+    if _, err := service.ReadData(data); !errors.Is(err, errObjectExpired) {
+        t.Errorf("Expected errObjectExpired, got %v", err)
+    }
+    if service.HasData(data) {
+        t.Errorf("Expected expired file to be unavailable")
+    }
+
+    tombstones, err := service.ExpireData(time.Now())
+    if err != nil || len(tombstones) != 1 || tombstones[0].Filename != "temporary" {
+        t.Fatalf("ExpireData() = %v, %v", tombstones, err)
+    }
+    versions, err := service.Versions(data)
+    if err != nil || len(versions) != 1 || !versions[0].Deleted {
+        t.Errorf("Expected only a tombstone to remain, got %+v, %v", versions, err)
+    }
+    chunks, _ := filepath.Glob(filepath.Join(service.rootPath, chunkDirName, "*", "*"))
+    if len(chunks) != 1 {
+        t.Errorf("Expected only the chunk of the unexpired file to remain, found %d", len(chunks))
+    }
+    if result := readStored(t, service, kept); string(result) != "kept content" {
+        t.Errorf("Expected unexpired file to be kept, got '%s'", result)
+    }
+}
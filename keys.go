@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+
+	"github.com/tejasprabhu/GopherStore/encryption"
+	"github.com/tejasprabhu/GopherStore/logger"
+	"github.com/tejasprabhu/GopherStore/p2p"
+)
+
+// passphraseEnv is the environment variable the keystore passphrase is read from.
+const passphraseEnv = "GOPHERSTORE_PASSPHRASE"
+
+// keystore holds the user and node keys when the node was started with -keystore.
+var keystore *encryption.Keystore
+
+// openKeystore unlocks the keystore at path with the passphrase from passphraseEnv.
+func openKeystore(path string) (*encryption.Keystore, error) {
+    passphrase := os.Getenv(passphraseEnv)
+    if passphrase == "" {
+        logger.Log.Fatalf("Set %s to unlock the keystore", passphraseEnv)
+    }
+    return encryption.OpenKeystore(filepath.Clean(path), passphrase)
+}
+
+// userKeys returns every key that may have encrypted one of our files, newest first.
+func userKeys() [][]byte {
+    if keystore != nil {
+        keys, err := keystore.All(encryption.UserKey)
+        if err != nil {
+            logger.Log.WithError(err).Error("Failed to read user keys")
+        }
+        return keys
+    }
+    if encryptionKey != nil {
+        return [][]byte{encryptionKey}
+    }
+    return nil
+}
+
+// handleKeysCommand manages the keys in the keystore:
+//
+//	keys list
+//	keys generate|rotate <user|node>
+//	keys import|export <user|node> <key file>
+func handleKeysCommand(args []string) {
+    if keystore == nil {
+        logger.Log.Error("No keystore configured, start the node with -keystore")
+        return
+    }
+    if len(args) == 1 && args[0] == "list" {
+        listKeys()
+        return
+    }
+    if len(args) < 2 || (args[1] != string(encryption.UserKey) && args[1] != string(encryption.NodeKey)) {
+        logger.Log.Warn("Usage: keys list | keys generate|rotate <user|node> | keys import|export <user|node> <key file>")
+        return
+    }
+    keyType := encryption.KeyType(args[1])
+
+    var err error
+    switch args[0] {
+    case "generate":
+        err = keystore.Generate(keyType)
+    case "rotate":
+        err = keystore.Rotate(keyType)
+    case "import", "export":
+        if len(args) < 3 {
+            logger.Log.Warnf("Usage: keys %s <user|node> <key file>", args[0])
+            return
+        }
+        if args[0] == "import" {
+            err = importKey(keyType, args[2])
+        } else {
+            err = exportKey(keyType, args[2])
+        }
+    default:
+        logger.Log.Warn("Unknown keys command")
+        return
+    }
+    if err != nil {
+        logger.Log.WithError(err).Errorf("Failed to %s %s key", args[0], keyType)
+        return
+    }
+    logger.Log.WithField("type", keyType).Infof("Key %s done", args[0])
+    if args[0] != "export" {
+        activateKeys(keyType)
+    }
+}
+
+// activateKeys starts using the current key of the given type where possible.
+func activateKeys(keyType encryption.KeyType) {
+    if keyType == encryption.NodeKey {
+        logger.Log.Warn("Restart the node for peers to see its new node key")
+        return
+    }
+    key, err := keystore.Active(encryption.UserKey)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to load user key")
+        return
+    }
+    encryptionKey = key
+}
+
+func importKey(keyType encryption.KeyType, path string) error {
+    key, err := encryption.LoadKey(filepath.Clean(path))
+    if err != nil {
+        return err
+    }
+    return keystore.Import(keyType, key)
+}
+
+// exportKey writes the active key of the given type to a hex key file only its owner can
+// read, e.g. to move it to another machine.
+func exportKey(keyType encryption.KeyType, path string) error {
+    key, err := keystore.Active(keyType)
+    if err != nil {
+        return err
+    }
+    return os.WriteFile(filepath.Clean(path), []byte(hex.EncodeToString(key)+"\n"), 0600)
+}
+
+// listKeys logs how many keys of each type the keystore holds and identifies the active
+// ones without revealing them.
+func listKeys() {
+    if key, err := keystore.Active(encryption.UserKey); err == nil {
+        fingerprint := sha256.Sum256(key)
+        logger.Log.WithFields(map[string]interface{}{
+            "keys":        keystore.KeyCount(encryption.UserKey),
+            "fingerprint": hex.EncodeToString(fingerprint[:8]),
+        }).Info("User key")
+    } else {
+        logger.Log.Info("No user key, create one with: keys generate user")
+    }
+
+    if key, err := keystore.Active(encryption.NodeKey); err == nil {
+        public, err := encryption.PublicKey(key)
+        if err != nil {
+            logger.Log.WithError(err).Error("Invalid node key")
+            return
+        }
+        logger.Log.WithFields(map[string]interface{}{
+            "keys":       keystore.KeyCount(encryption.NodeKey),
+            "public_key": hex.EncodeToString(public),
+            "node_id":    nodeIDFor(public).String(),
+        }).Info("Node key")
+    } else {
+        logger.Log.Info("No node key, create one with: keys generate node")
+    }
+}
+
+// handleShare lets the node with the given ID decrypt one of our encrypted files.
+func handleShare(filePath, nodeID string) {
+    if server == nil {
+        logger.Log.Error("Server is not running.")
+        return
+    }
+    recipient, err := p2p.ParseNodeID(nodeID)
+    if err != nil {
+        logger.Log.WithError(err).Error("Invalid node ID")
+        return
+    }
+    metadata, err := fileMetadata("fetch", filePath)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to build file metadata")
+        return
+    }
+    if err := server.shareFile(metadata, filepath.Base(filePath), recipient, userKeys()); err != nil {
+        logger.Log.WithError(err).Error("Failed to share file")
+        return
+    }
+    logger.Log.WithField("node_id", nodeID).WithField("path", filePath).Info("File shared")
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/logger"
+	"github.com/tejasprabhu/GopherStore/p2p"
+)
+
+// A lifecycle policy is a list of rules read from a JSON file. The server evaluates them
+// against every stored file at each lifecycle pass, and every rule a file matches applies
+// its action:
+//
+//	delete              deletes the file, on every replica
+//	cold                moves the file to the cold tier, if the node has one
+//	drop-versions       erases older versions beyond the newest KeepVersions
+//	reduce-replication  drops this node's replica while Replicas closer ones hold the file
+
+const defaultLifecycleInterval = time.Hour
+
+const (
+	actionDelete            = "delete"
+	actionCold              = "cold"
+	actionDropVersions      = "drop-versions"
+	actionReduceReplication = "reduce-replication"
+)
+
+// LifecyclePolicy is the set of lifecycle rules a node applies.
+type LifecyclePolicy struct {
+    Rules []LifecycleRule
+}
+
+// LifecycleRule selects files by key prefix, tags, size and age, and names what to do with
+// them. Conditions left empty match every file.
+type LifecycleRule struct {
+    Name         string
+    Prefix       string            // Matches keys that start with it
+    Tags         map[string]string // Matches files carrying all of these tags
+    MinSize      int64
+    MaxSize      int64
+    Age          Duration // Matches files last written at least this long ago
+    Idle         Duration // Matches files last read at least this long ago
+    Action       string
+    KeepVersions int // Older versions kept by drop-versions
+    Replicas     int // Replicas left by reduce-replication, this one included
+}
+
+// Duration is a time.Duration written in JSON as a string such as "36h" or "30d".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+    var text string
+    if err := json.Unmarshal(b, &text); err != nil {
+        return fmt.Errorf("duration must be a string: %w", err)
+    }
+    if days, ok := strings.CutSuffix(text, "d"); ok {
+        n, err := strconv.Atoi(days)
+        if err != nil {
+            return fmt.Errorf("invalid duration %q", text)
+        }
+        *d = Duration(time.Duration(n) * 24 * time.Hour)
+        return nil
+    }
+    parsed, err := time.ParseDuration(text)
+    if err != nil {
+        return err
+    }
+    *d = Duration(parsed)
+    return nil
+}
+
+// LoadLifecyclePolicy reads and validates a lifecycle policy file.
+func LoadLifecyclePolicy(path string) (*LifecyclePolicy, error) {
+    content, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var policy LifecyclePolicy
+    if err := json.Unmarshal(content, &policy); err != nil {
+        return nil, fmt.Errorf("invalid lifecycle policy: %w", err)
+    }
+    for i, rule := range policy.Rules {
+        if err := rule.validate(); err != nil {
+            return nil, fmt.Errorf("lifecycle rule %d (%s): %w", i+1, rule.Name, err)
+        }
+    }
+    return &policy, nil
+}
+
+func (r *LifecycleRule) validate() error {
+    switch r.Action {
+    case actionDelete, actionCold:
+    case actionDropVersions:
+        if r.KeepVersions < 0 {
+            return errors.New("KeepVersions cannot be negative")
+        }
+    case actionReduceReplication:
+        if r.Replicas < 1 {
+            return errors.New("Replicas must be at least 1")
+        }
+    default:
+        return fmt.Errorf("unknown action %q", r.Action)
+    }
+    return nil
+}
+
+// matches reports whether the rule selects the file, which was last read at accessed.
+func (r *LifecycleRule) matches(manifest *Manifest, accessed, now time.Time) bool {
+    key := manifest.Filename + "." + manifest.Extension
+    if !strings.HasPrefix(key, r.Prefix) {
+        return false
+    }
+    for name, value := range r.Tags {
+        if tag, ok := manifest.Tags[name]; !ok || tag != value {
+            return false
+        }
+    }
+    if manifest.Size < r.MinSize || (r.MaxSize > 0 && manifest.Size > r.MaxSize) {
+        return false
+    }
+    if now.Sub(manifest.ModifiedAt) < time.Duration(r.Age) {
+        return false
+    }
+    return now.Sub(accessed) >= time.Duration(r.Idle)
+}
+
+// StoredFiles returns the latest versions of the files this node holds that are neither
+// deleted nor expired.
+func (s *StorageService) StoredFiles() ([]*Manifest, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    now := time.Now()
+    var files []*Manifest
+    err := s.walkManifests(func(path string, manifest *Manifest) error {
+        if !manifest.Deleted && !manifest.expired(now) {
+            files = append(files, manifest)
+        }
+        return nil
+    })
+    return files, err
+}
+
+// fileAccess records how a file has been read since the node started.
+type fileAccess struct {
+    last  time.Time
+    reads int // Reads since the last tiering pass
+}
+
+// recordAccess notes that the file at path was read. The caller must hold the mutex.
+func (s *StorageService) recordAccess(path string) {
+    if s.accessed == nil {
+        s.accessed = make(map[string]*fileAccess)
+    }
+    access, ok := s.accessed[path]
+    if !ok {
+        access = &fileAccess{}
+        s.accessed[path] = access
+    }
+    access.last = time.Now()
+    access.reads++
+}
+
+// LastAccess returns when a file was last read. Reads are only tracked while the node runs,
+// so files not read since it started count as read when it started, or when they were
+// written if that was later.
+func (s *StorageService) LastAccess(data *datamgmt.Data, manifest *Manifest) time.Time {
+    accessed, _ := s.AccessStats(data, manifest)
+    return accessed
+}
+
+// AccessStats returns when a file was last read, as LastAccess does, and how many times it
+// was read since the last tiering pass.
+func (s *StorageService) AccessStats(data *datamgmt.Data, manifest *Manifest) (time.Time, int) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    path, err := s.generateFilePath(data)
+    if err == nil {
+        if access, ok := s.accessed[path]; ok {
+            return access.last, access.reads
+        }
+    }
+    if manifest.ModifiedAt.After(s.started) {
+        return manifest.ModifiedAt, 0
+    }
+    return s.started, 0
+}
+
+// resetReads starts counting reads afresh for the next tiering pass.
+func (s *StorageService) resetReads() {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    for _, access := range s.accessed {
+        access.reads = 0
+    }
+}
+
+// PruneVersions erases the older versions of a file beyond the newest keep, leaving its
+// current versions alone, and returns how many it erased.
+func (s *StorageService) PruneVersions(data *datamgmt.Data, keep int) (int, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    path, err := s.generateFilePath(data)
+    if err != nil {
+        return 0, err
+    }
+    return s.pruneVersions(path, keep)
+}
+
+// pruneVersions erases the older versions of the file at path beyond the newest keep. The
+// caller must hold the mutex.
+func (s *StorageService) pruneVersions(path string, keep int) (int, error) {
+    latest, err := s.loadManifest(path)
+    if err != nil {
+        return 0, err
+    }
+    older, err := s.archivedVersions(path)
+    if err != nil {
+        return 0, err
+    }
+    var prunable []*Manifest
+    for _, version := range older {
+        if version.VersionID != latest.VersionID && !slices.Contains(latest.Siblings, version.VersionID) {
+            prunable = append(prunable, version)
+        }
+    }
+    if len(prunable) <= keep {
+        return 0, nil
+    }
+    pruned := 0
+    for _, version := range prunable[:len(prunable)-keep] {
+        if err := s.purgeVersion(path, version.VersionID); err != nil {
+            return pruned, err
+        }
+        pruned++
+    }
+    return pruned, nil
+}
+
+// DropReplica erases this node's copy of a file with all its versions. Unlike a delete it
+// leaves no tombstone, as the file lives on at other replicas.
+func (s *StorageService) DropReplica(data *datamgmt.Data) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    path, err := s.generateFilePath(data)
+    if err != nil {
+        return err
+    }
+    return s.eraseFile(path)
+}
+
+// lifecycleLoop periodically applies the lifecycle policy until the server shuts down.
+func (s *Server) lifecycleLoop() {
+    defer s.wg.Done()
+    if s.lifecycle == nil || s.lifecycleInterval <= 0 {
+        return
+    }
+    ticker := time.NewTicker(s.lifecycleInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-s.quit:
+            return
+        case <-ticker.C:
+            s.applyLifecycle()
+        }
+    }
+}
+
+// applyLifecycle applies the lifecycle policy to every stored file and returns how many
+// actions changed something.
+func (s *Server) applyLifecycle() int {
+    files, err := s.storage.StoredFiles()
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to list stored files for lifecycle rules")
+        return 0
+    }
+    now := time.Now()
+    applied := 0
+    for _, manifest := range files {
+        data := manifestData(manifest)
+        accessed := s.storage.LastAccess(data, manifest)
+        for _, rule := range s.lifecycle.Rules {
+            if !rule.matches(manifest, accessed, now) {
+                continue
+            }
+            changed, err := s.applyRule(&rule, manifest, data)
+            if err != nil {
+                logger.Log.WithError(err).WithField("key", data.Key()).WithField("rule", rule.Name).Warn("Failed to apply lifecycle rule")
+                continue
+            }
+            if !changed {
+                continue
+            }
+            applied++
+            logger.Log.WithField("key", data.Key()).WithField("rule", rule.Name).WithField("action", rule.Action).Info("Lifecycle rule applied")
+            if rule.Action == actionDelete || rule.Action == actionReduceReplication {
+                break // The file is gone from this node
+            }
+        }
+    }
+    return applied
+}
+
+// applyRule carries out the rule's action on a file, reporting whether anything changed.
+func (s *Server) applyRule(rule *LifecycleRule, manifest *Manifest, data *datamgmt.Data) (bool, error) {
+    switch rule.Action {
+    case actionDelete:
+        s.deleteData(data)
+        return !s.storage.HasData(data), nil
+    case actionCold:
+        if manifest.Tier == coldTier {
+            return false, nil
+        }
+        manifest.Tier = coldTier
+        return true, s.storage.Demote(data)
+    case actionDropVersions:
+        pruned, err := s.storage.PruneVersions(data, rule.KeepVersions)
+        return pruned > 0, err
+    case actionReduceReplication:
+        return s.reduceReplication(data, rule.Replicas)
+    }
+    return false, fmt.Errorf("unknown action %q", rule.Action)
+}
+
+// reduceReplication drops this node's replica of a file if it is not among the replicas
+// replicas closest to the file's key, so every node holding the file reaches the same
+// decision, and only once those closer replicas are confirmed to hold the same content.
+func (s *Server) reduceReplication(data *datamgmt.Data, replicas int) (bool, error) {
+    providers, err := s.dht.FindProviders(data.Key())
+    if err != nil {
+        return false, err
+    }
+    self := s.dht.Self()
+    holders := []p2p.Contact{self}
+    for _, provider := range providers {
+        if provider.ID != self.ID {
+            holders = append(holders, provider)
+        }
+    }
+    if len(holders) <= replicas {
+        return false, nil
+    }
+    target := p2p.NewNodeID(data.Key())
+    sort.Slice(holders, func(i, j int) bool {
+        return holders[i].ID.Distance(target).Less(holders[j].ID.Distance(target))
+    })
+    for _, holder := range holders[:replicas] {
+        if holder.ID == self.ID {
+            return false, nil
+        }
+    }
+    for _, holder := range holders[:replicas] {
+        info, err := s.statObject(holder.Address, data)
+        if err != nil {
+            return false, fmt.Errorf("replica %s unavailable: %w", holder.Address, err)
+        }
+        if info.Checksum != data.Checksum {
+            return false, fmt.Errorf("replica %s holds different content", holder.Address)
+        }
+    }
+
+    if err := s.storage.DropReplica(data); err != nil {
+        return false, err
+    }
+    s.dht.RemoveProvider(data.Key(), self.ID)
+    return true, nil
+}
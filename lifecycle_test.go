@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+)
+
+func TestLoadLifecyclePolicy(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "lifecycle.json")
+    policy := `{"Rules": [
+        {"Name": "logs", "Prefix": "log-", "Age": "30d", "Action": "delete"},
+        {"Name": "history", "Action": "drop-versions", "KeepVersions": 2},
+        {"Name": "idle", "Tags": {"class": "archive"}, "Idle": "36h", "Action": "reduce-replication", "Replicas": 1}
+    ]}`
+    os.WriteFile(path, []byte(policy), 0600)
+
+    loaded, err := LoadLifecyclePolicy(path)
+    if err != nil {
+        t.Fatalf("LoadLifecyclePolicy() error = %v", err)
+    }
+    if len(loaded.Rules) != 3 || time.Duration(loaded.Rules[0].Age) != 30*24*time.Hour || time.Duration(loaded.Rules[2].Idle) != 36*time.Hour {
+        t.Errorf("Unexpected policy %+v", loaded)
+    }
+
+    os.WriteFile(path, []byte(`{"Rules": [{"Name": "bad", "Action": "reduce-replication"}]}`), 0600)
+    if _, err := LoadLifecyclePolicy(path); err == nil {
+        t.Errorf("Expected a reduce-replication rule without Replicas to be rejected")
+    }
+}
+
+func TestServer_ApplyLifecycle(t *testing.T) {
+    server := NewServer("127.0.0.1:3372")
+    defer os.RemoveAll(server.storage.rootPath)
+    server.lifecycle = &LifecyclePolicy{Rules: []LifecycleRule{
+        {Name: "logs", Prefix: "log-", Action: actionDelete},
+        {Name: "archive", Tags: map[string]string{"class": "archive"}, MinSize: 5, Action: actionCold},
+        {Name: "history", Action: actionDropVersions, KeepVersions: 1},
+    }}
+
+    store := func(data *datamgmt.Data, content string) {
+        if err := server.storage.StoreData(data, bytes.NewReader([]byte(content))); err != nil {
+            t.Fatalf("StoreData() error = %v", err)
+        }
+    }
+    logFile := &datamgmt.Data{ID: "1", Filename: "log-today", Extension: "txt"}
+    store(logFile, "log line")
+    archived := &datamgmt.Data{ID: "1", Filename: "report", Extension: "pdf", Tags: map[string]string{"class": "archive"}}
+    small := &datamgmt.Data{ID: "1", Filename: "note", Extension: "txt", Tags: map[string]string{"class": "archive"}}
+    store(small, "tiny")
+    for _, content := range []string{"first", "second", "third"} {
+        store(archived, content)
+    }
+
+    if applied := server.applyLifecycle(); applied != 3 {
+        t.Errorf("applyLifecycle() applied %d actions, want 3", applied)
+    }
+    if server.storage.HasData(logFile) {
+        t.Errorf("Expected the log file to be deleted")
+    }
+    versions, _ := server.storage.Versions(archived)
+    if len(versions) != 2 || versions[0].Tier != coldTier {
+        t.Errorf("Expected 2 versions with the latest in the cold tier, got %+v", versions)
+    }
+    if versions, _ := server.storage.Versions(small); versions[0].Tier != "" {
+        t.Errorf("Expected files below MinSize to stay in the default tier")
+    }
+    // Rules already applied change nothing on the next pass.
+    if applied := server.applyLifecycle(); applied != 0 {
+        t.Errorf("Second applyLifecycle() applied %d actions, want 0", applied)
+    }
+}
+
+func TestServer_ReduceReplication(t *testing.T) {
+    content := []byte("widely replicated content")
+    rule := LifecycleRule{Name: "idle", Action: actionReduceReplication, Replicas: 1}
+    policy := func(server *Server) { server.lifecycle = &LifecyclePolicy{Rules: []LifecycleRule{rule}} }
+    first := startTestServer(t, "127.0.0.1:3373", content, policy)
+    second := startTestServer(t, "127.0.0.1:3374", content, policy)
+    first.dht.Bootstrap([]string{"127.0.0.1:3374"})
+    second.dht.Bootstrap([]string{"127.0.0.1:3373"})
+
+    data := &datamgmt.Data{ID: "1", Filename: "swarm", Extension: "bin"}
+    first.announce(data)
+    second.announce(data)
+
+    for _, server := range []*Server{first, second} {
+        server.applyLifecycle()
+    }
+    if first.storage.HasData(data) == second.storage.HasData(data) {
+        t.Errorf("Expected exactly one replica to remain, first %v, second %v", first.storage.HasData(data), second.storage.HasData(data))
+    }
+}
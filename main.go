@@ -2,19 +2,22 @@ package main
 
 import (
 	"bufio"
-	"bytes"
-	"encoding/gob"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"net"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/encryption"
 	"github.com/tejasprabhu/GopherStore/logger"
+	"github.com/tejasprabhu/GopherStore/p2p"
 )
 
 var (
@@ -22,21 +25,234 @@ var (
     serverMutex sync.Mutex
 )
 
+// serverOptions configures a server before it starts.
+type serverOptions struct {
+    scrubInterval     time.Duration
+    repairInterval    time.Duration
+    tombstoneGrace    time.Duration
+    masterKey         []byte // Enables encryption at rest when set
+    keystore          *encryption.Keystore
+    resolver          ConflictResolver
+    lifecycle         *LifecyclePolicy
+    lifecycleInterval time.Duration
+    hotDir            string
+    coldDir           string
+    hotCapacity       int64
+    coldCapacity      int64
+    demoteAfter       time.Duration
+    quotas            *QuotaPolicy
+    diskReserve       int64
+    credentials       *Credentials // Requires callers to authenticate when set
+    token             string
+    capabilityKey     []byte // Signs capability tokens, shared by the nodes that accept them
+    audit             *AuditLog
+    rateLimits        RateLimits
+}
+
 func main() {
     port := flag.String("port", "3000", "Port to start the server on")
+    bootstrap := flag.String("bootstrap", "", "Comma-separated list of peer addresses to join the DHT through")
+    scrubInterval := flag.Duration("scrub-interval", defaultScrubInterval, "Time between background integrity scrubs, 0 to disable")
+    repairInterval := flag.Duration("repair-interval", defaultRepairInterval, "Time between checks that regenerate missing shards of erasure-coded files, 0 to disable")
+    tombstoneGrace := flag.Duration("tombstone-grace", defaultTombstoneGrace, "Time deleted files keep their tombstones and older versions before they are erased, 0 to keep them forever")
+    lifecyclePath := flag.String("lifecycle", "", "JSON file of lifecycle rules to apply to stored files")
+    lifecycleInterval := flag.Duration("lifecycle-interval", defaultLifecycleInterval, "Time between lifecycle rule passes")
+    hotDir := flag.String("hot-dir", "", "Directory of the fast storage tier (default the node's storage directory)")
+    coldDir := flag.String("cold-dir", "", "Directory of the capacity storage tier that idle files move to")
+    hotCapacity := flag.String("hot-capacity", "0", "Bytes the fast tier may hold, with an optional K, M, G or T suffix, 0 for no limit")
+    coldCapacity := flag.String("cold-capacity", "0", "Bytes the capacity tier may hold, with an optional K, M, G or T suffix, 0 for no limit")
+    demoteAfter := flag.Duration("demote-after", defaultDemoteAfter, "Time a file goes unread before it moves to the capacity tier, 0 to disable")
+    diskReserve := flag.String("disk-reserve", "0", "Free disk space each storage tier leaves unused, with an optional K, M, G or T suffix")
+    quotaPath := flag.String("quotas", "", "JSON file of the byte and file quotas of origins and namespaces")
+    keyFile := flag.String("key-file", "", "File holding a hex-encoded 256-bit key to encrypt sent files with")
+    hideNames := flag.Bool("encrypt-names", false, "Encrypt file names as well as contents (requires -key-file or -keystore)")
+    keystorePath := flag.String("keystore", "", "Passphrase-protected keystore holding the user and node keys (passphrase from $"+passphraseEnv+")")
+    resolution := flag.String("conflict-resolution", defaultConflictResolution, "How concurrent writes of a file are resolved: lww keeps the last one written, keep-both keeps all as siblings")
+    authPath := flag.String("auth", "", "JSON file of the client API tokens and trusted peer node IDs allowed to connect; without it anyone may connect")
+    capabilityKeyFile := flag.String("capability-key-file", "", "File holding a hex-encoded 256-bit key to sign capability tokens with, shared by every node that should accept them (default a key of this node's own)")
+    auditPath := flag.String("audit-log", "", "File to append a hash-chained audit entry to for every command the node handles")
+    requestRate := flag.Float64("request-rate", 0, "Commands per second each identity, or each host for unauthenticated callers, may send before being made to wait, 0 for no limit")
+    requestBurst := flag.Int("request-burst", 10, "Commands an idle identity may send at once before -request-rate applies")
+    bandwidth := flag.String("bandwidth", "0", "Bytes per second the node reads, and writes, across all connections, with an optional K, M, G or T suffix, 0 for no limit")
+    peerBandwidth := flag.String("peer-bandwidth", "0", "Bytes per second the node reads from, and writes to, each remote host, with an optional K, M, G or T suffix, 0 for no limit")
+    peerConnections := flag.Int("peer-connections", 0, "Connections the node accepts at once from each remote host, refusing any more, 0 for no limit")
+    masterKeyFile := flag.String("master-key-file", "", "File holding a hex-encoded 256-bit master key to encrypt stored data with (default $"+encryption.MasterKeyEnv+")")
     flag.Parse()
 
-    startServer(*port)
+    masterKey, err := encryption.LoadMasterKey(*masterKeyFile)
+    if err != nil {
+        logger.Log.WithError(err).Fatal("Failed to load master key")
+    }
+
+    if *keyFile != "" && *keystorePath != "" {
+        logger.Log.Fatal("Use either -key-file or -keystore")
+    }
+    if *keyFile != "" {
+        key, err := encryption.LoadKey(*keyFile)
+        if err != nil {
+            logger.Log.WithError(err).Fatal("Failed to load encryption key")
+        }
+        encryptionKey = key
+    }
+    if *keystorePath != "" {
+        keystore, err = openKeystore(*keystorePath)
+        if err != nil {
+            logger.Log.WithError(err).Fatal("Failed to open keystore")
+        }
+        if key, err := keystore.Active(encryption.UserKey); err == nil {
+            encryptionKey = key
+        }
+    }
+    if *hideNames && *keyFile == "" && *keystorePath == "" {
+        logger.Log.Fatal("-encrypt-names requires -key-file or -keystore")
+    }
+    encryptNames = *hideNames
+
+    resolver, err := conflictResolver(*resolution)
+    if err != nil {
+        logger.Log.WithError(err).Fatal("Invalid -conflict-resolution")
+    }
+
+    var lifecycle *LifecyclePolicy
+    if *lifecyclePath != "" {
+        lifecycle, err = LoadLifecyclePolicy(*lifecyclePath)
+        if err != nil {
+            logger.Log.WithError(err).Fatal("Failed to load lifecycle policy")
+        }
+    }
+
+    var quotas *QuotaPolicy
+    if *quotaPath != "" {
+        quotas, err = LoadQuotaPolicy(*quotaPath)
+        if err != nil {
+            logger.Log.WithError(err).Fatal("Failed to load quota policy")
+        }
+    }
+
+    var credentials *Credentials
+    if *authPath != "" {
+        credentials, err = LoadCredentials(*authPath)
+        if err != nil {
+            logger.Log.WithError(err).Fatal("Failed to load credentials")
+        }
+    }
+
+    var capabilityKey []byte
+    if *capabilityKeyFile != "" {
+        capabilityKey, err = encryption.LoadKey(*capabilityKeyFile)
+        if err != nil {
+            logger.Log.WithError(err).Fatal("Failed to load capability key")
+        }
+    }
+
+    var audit *AuditLog
+    if *auditPath != "" {
+        audit, err = OpenAuditLog(*auditPath)
+        if err != nil {
+            logger.Log.WithError(err).Fatal("Failed to open audit log")
+        }
+    }
+
+    reserveBytes, err := parseSize(*diskReserve)
+    if err != nil {
+        logger.Log.WithError(err).Fatal("Invalid -disk-reserve")
+    }
+    hotBytes, err := parseSize(*hotCapacity)
+    if err != nil {
+        logger.Log.WithError(err).Fatal("Invalid -hot-capacity")
+    }
+    coldBytes, err := parseSize(*coldCapacity)
+    if err != nil {
+        logger.Log.WithError(err).Fatal("Invalid -cold-capacity")
+    }
+    bandwidthBytes, err := parseSize(*bandwidth)
+    if err != nil {
+        logger.Log.WithError(err).Fatal("Invalid -bandwidth")
+    }
+    peerBandwidthBytes, err := parseSize(*peerBandwidth)
+    if err != nil {
+        logger.Log.WithError(err).Fatal("Invalid -peer-bandwidth")
+    }
+    if *requestRate < 0 {
+        logger.Log.Fatal("Invalid -request-rate")
+    }
+    if *peerConnections < 0 {
+        logger.Log.Fatal("Invalid -peer-connections")
+    }
+
+    startServer(*port, serverOptions{
+        scrubInterval:     *scrubInterval,
+        repairInterval:    *repairInterval,
+        tombstoneGrace:    *tombstoneGrace,
+        masterKey:         masterKey,
+        keystore:          keystore,
+        resolver:          resolver,
+        lifecycle:         lifecycle,
+        lifecycleInterval: *lifecycleInterval,
+        hotDir:            *hotDir,
+        coldDir:           *coldDir,
+        hotCapacity:       hotBytes,
+        coldCapacity:      coldBytes,
+        demoteAfter:       *demoteAfter,
+        quotas:            quotas,
+        diskReserve:       reserveBytes,
+        credentials:       credentials,
+        token:             os.Getenv(tokenEnv),
+        capabilityKey:     capabilityKey,
+        audit:             audit,
+        rateLimits: RateLimits{
+            RequestRate:     *requestRate,
+            RequestBurst:    *requestBurst,
+            Bandwidth:       bandwidthBytes,
+            PeerBandwidth:   peerBandwidthBytes,
+            PeerConnections: *peerConnections,
+        },
+    })
+    if *bootstrap != "" {
+        go joinNetwork(strings.Split(*bootstrap, ","))
+    }
     go handleCommands()
     select {}
 }
 
-func startServer(port string) {
+func startServer(port string, options serverOptions) {
     serverMutex.Lock()
     defer serverMutex.Unlock()
 
     if server == nil {
         server = NewServer(fmt.Sprintf("0.0.0.0:%s", port))
+        server.scrubInterval = options.scrubInterval
+        server.repairInterval = options.repairInterval
+        server.tombstoneGrace = options.tombstoneGrace
+        server.lifecycle = options.lifecycle
+        server.lifecycleInterval = options.lifecycleInterval
+        server.demoteAfter = options.demoteAfter
+        server.storage.SetQuotas(options.quotas)
+        server.storage.SetDiskReserve(options.diskReserve)
+        server.credentials, server.token = options.credentials, options.token
+        server.capabilityKey = options.capabilityKey
+        server.audit = options.audit
+        server.SetRateLimits(options.rateLimits)
+        if err := server.storage.ConfigureTiers(options.hotDir, options.coldDir, options.hotCapacity, options.coldCapacity); err != nil {
+            logger.Log.WithError(err).Fatal("Failed to set up storage tiers")
+        }
+        if options.resolver != nil {
+            server.storage.resolver = options.resolver
+        }
+        if options.masterKey != nil {
+            if err := server.storage.EnableEncryption(options.masterKey); err != nil {
+                logger.Log.WithError(err).Fatal("Failed to enable encryption at rest")
+            }
+        }
+        if options.keystore != nil {
+            server.keystore = options.keystore
+            if nodeKey, err := options.keystore.Active(encryption.NodeKey); err == nil {
+                if err := server.useNodeKey(nodeKey); err != nil {
+                    logger.Log.WithError(err).Fatal("Invalid node key")
+                }
+                logger.Log.WithField("node_id", server.dht.Self().ID.String()).Info("Using node key")
+            }
+        }
         go func() {
             if err := server.Start(); err != nil {
                 logger.Log.WithError(err).Error("Error starting server")
@@ -64,12 +280,153 @@ func handleCommand(input string) {
     }
 
     switch command := parts[0]; command {
-    case "send", "fetch", "delete":
+    case "fetch":
+        parts, version := splitVersion(parts)
+        if len(parts) == 2 && version == "" {
+            handleLocatedFetch(parts[1])
+            return
+        }
+        if len(parts) < 3 {
+            logger.Log.Warn("Usage: fetch [destination IP:port] <file path> [ranges] [@version]")
+            return
+        }
+        if len(parts) > 3 {
+            handleRangeFetch(parts[1], parts[2], parts[3], version)
+            return
+        }
+        handleFileOperation(command, parts[1], parts[2], version)
+    case "delete":
+        parts, version := splitVersion(parts)
+        if len(parts) < 3 {
+            logger.Log.Warn("Usage: delete <destination IP:port> <file path> [@version]")
+            return
+        }
+        handleFileOperation(command, parts[1], parts[2], version)
+    case "send":
         if len(parts) < 3 {
-            logger.Log.Warnf("Usage: %s <destination IP:port> <file path>", command)
+            logger.Log.Warn("Usage: send <destination IP:port> <file path> [ttl=<duration>|expires=<RFC 3339 time>] [tag=<name>:<value>]...")
             return
         }
-        handleFileOperation(command, parts[1], parts[2])
+        handleSend(parts[1], parts[2], parts[3:])
+    case "versions":
+        if len(parts) == 2 {
+            handleVersions("", parts[1])
+            return
+        }
+        if len(parts) < 3 {
+            logger.Log.Warn("Usage: versions [destination IP:port] <file path>")
+            return
+        }
+        handleVersions(parts[1], parts[2])
+    case "send-ec":
+        if len(parts) != 2 && len(parts) != 4 {
+            logger.Log.Warn("Usage: send-ec <file path> [data shards] [parity shards]")
+            return
+        }
+        dataShards, parityShards := defaultDataShards, defaultParityShards
+        if len(parts) == 4 {
+            var err error
+            if dataShards, err = strconv.Atoi(parts[2]); err == nil {
+                parityShards, err = strconv.Atoi(parts[3])
+            }
+            if err != nil {
+                logger.Log.WithError(err).Warn("Shard counts must be numbers")
+                return
+            }
+        }
+        handleErasureSend(parts[1], dataShards, parityShards)
+    case "repair":
+        repairShards()
+    case "join":
+        if len(parts) < 2 {
+            logger.Log.Warn("Usage: join <peer IP:port>...")
+            return
+        }
+        joinNetwork(parts[1:])
+    case "scrub":
+        scrubStorage()
+    case "rotate-keys":
+        rotateKeys(parts[1:])
+    case "keys":
+        handleKeysCommand(parts[1:])
+    case "share":
+        if len(parts) < 3 {
+            logger.Log.Warn("Usage: share <file path> <node ID>")
+            return
+        }
+        handleShare(parts[1], parts[2])
+    case "usage":
+        if len(parts) > 2 {
+            logger.Log.Warn("Usage: usage [destination IP:port]")
+            return
+        }
+        handleUsage(parts[1:])
+    case "create-bucket":
+        args := parts[1:]
+        dest := ""
+        if len(args) > 0 && strings.Contains(args[0], ":") {
+            dest, args = args[0], args[1:]
+        }
+        if len(args) < 1 {
+            logger.Log.Warn("Usage: create-bucket [destination IP:port] <name> [replicas=<n>] [versioning=on|off] [encryption=on|off] [quota=<size>] [quota-files=<n>]")
+            return
+        }
+        handleCreateBucket(dest, args[0], args[1:])
+    case "list-buckets":
+        if len(parts) > 2 {
+            logger.Log.Warn("Usage: list-buckets [destination IP:port]")
+            return
+        }
+        handleListBuckets(parts[1:])
+    case "delete-bucket":
+        if len(parts) != 2 && len(parts) != 3 {
+            logger.Log.Warn("Usage: delete-bucket [destination IP:port] <name>")
+            return
+        }
+        handleDeleteBucket(parts[1 : len(parts)-1], parts[len(parts)-1])
+    case "set-acl":
+        args := parts[1:]
+        dest := ""
+        if len(args) > 0 && strings.Contains(args[0], ":") && !strings.HasPrefix(args[0], bucketTargetPrefix) {
+            dest, args = args[0], args[1:]
+        }
+        if len(args) < 1 {
+            logger.Log.Warn("Usage: set-acl [destination IP:port] <file path>|bucket:<name> [<identity>=<permission>[,<permission>]...]...")
+            return
+        }
+        handleSetACL(dest, args[0], args[1:])
+    case "capability":
+        if len(parts) != 4 && len(parts) != 5 {
+            logger.Log.Warn("Usage: capability [destination IP:port] <file path> <operation>[,<operation>]... <lifetime>")
+            return
+        }
+        handleCapability(parts[1:len(parts)-3], parts[len(parts)-3], parts[len(parts)-2], parts[len(parts)-1])
+    case "fetch-capability":
+        if len(parts) != 4 {
+            logger.Log.Warn("Usage: fetch-capability <destination IP:port> <token> <output path>")
+            return
+        }
+        handleCapabilityFetch(parts[1], parts[2], parts[3])
+    case "verify-audit":
+        if len(parts) > 2 {
+            logger.Log.Warn("Usage: verify-audit [audit log path]")
+            return
+        }
+        handleVerifyAudit(parts[1:])
+    case "bucket":
+        if len(parts) > 2 {
+            logger.Log.Warn("Usage: bucket [name]")
+            return
+        }
+        currentBucket = ""
+        if len(parts) == 2 {
+            if err := datamgmt.ValidateBucketName(parts[1]); err != nil {
+                logger.Log.WithError(err).Warn("Invalid bucket name")
+                return
+            }
+            currentBucket = parts[1]
+        }
+        logger.Log.WithField("bucket", currentBucket).Info("Using bucket")
     case "stop":
         stopServer()
     default:
@@ -77,90 +434,563 @@ func handleCommand(input string) {
     }
 }
 
-func handleFileOperation(operation, destAddr, filePath string) {
+// splitVersion removes a trailing "@<version ID>" argument, which selects a version of the
+// file instead of the latest one.
+func splitVersion(parts []string) ([]string, string) {
+    last := parts[len(parts)-1]
+    if len(parts) > 2 && strings.HasPrefix(last, "@") {
+        return parts[:len(parts)-1], last[1:]
+    }
+    return parts, ""
+}
+
+func handleFileOperation(operation, destAddr, filePath, version string) {
     if server == nil {
         logger.Log.Error("Server is not running.")
         return
     }
 
-    fileName, fileExt := getFileName(filePath)
-    metadata := &datamgmt.Data{
-        ID:        "001",
-        Filename:  fileName,
-        Command:   operation,
-        OriginID:  "clientID",
-        Extension: fileExt,
+    metadata, err := fileMetadata(operation, filePath)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to build file metadata")
+        return
+    }
+    metadata.Version = version
+
+    if operation == "delete" && version == "" {
+        metadata.Clock, metadata.ModifiedAt = server.writeClock(metadata), time.Now()
     }
 
     switch operation {
-    case "send":
-        err := sendFile(destAddr, metadata, filePath)
+    case "fetch":
+        if err := server.resumableFetch(destAddr, metadata); err != nil {
+            logger.Log.WithError(err).Errorf("Failed to fetch File")
+            return
+        }
+        // Whichever version was fetched is now the latest one stored here.
+        metadata.Version = ""
+        if decryptsOnFetch(filePath) {
+            saveDecrypted(metadata, filePath)
+        }
+    case "delete":
+        conn, err := server.sendCommand(destAddr, metadata)
         if err != nil {
-            logger.Log.WithError(err).Errorf("Failed to send File")
-        } 
-    case "fetch", "delete":
-        conn, err := server.sendCommand(destAddr, metadata); 
-		if err != nil {
             logger.Log.WithError(err).Errorf("Failed to send %s command", operation)
-        } 
-		if operation == "fetch" {
-            processReceivedData(conn)
+            return
+        }
+        conn.Close()
+        if metadata.Clock != nil {
+            if err := server.storage.SaveClock(metadata); err != nil {
+                logger.Log.WithError(err).Warn("Failed to record write clock")
+            }
         }
     }
 }
 
-func sendFile(destAddr string, metadata *datamgmt.Data, filePath string) error {
-    file, err := os.Open(filepath.Clean(filePath))
-    if err != nil {
-        logger.Log.WithError(err).Error("Failed to open file")
-        return err
+// handleSend sends a file to a peer. Options can make it expire after a TTL or at a given
+// time, and tag it.
+func handleSend(destAddr, filePath string, options []string) {
+    if server == nil {
+        logger.Log.Error("Server is not running.")
+        return
     }
-    defer file.Close()
 
-    if err := server.sendData(destAddr, metadata, file); err != nil {
-        logger.Log.WithError(err).Error("Failed to send data")
-        return err  
+    metadata, err := fileMetadata("send", filePath)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to build file metadata")
+        return
+    }
+    for _, option := range options {
+        if err := parseSendOption(option, metadata); err != nil {
+            logger.Log.WithError(err).Error("Invalid send option")
+            return
+        }
+    }
+    metadata.Clock, metadata.ModifiedAt = server.writeClock(metadata), time.Now()
+    if err := sendFile(destAddr, metadata, filePath); err != nil {
+        logger.Log.WithError(err).Errorf("Failed to send File")
+        return
+    }
+    if err := server.storage.SaveClock(metadata); err != nil {
+        logger.Log.WithError(err).Warn("Failed to record write clock")
     }
-    return nil
 }
 
-func processReceivedData(conn net.Conn) {
-    adapter, err := datamgmt.NewReadStreamAdapter(conn)
+// handleLocatedFetch finds the peers holding a file through the DHT and downloads it from
+// all of them in parallel.
+func handleLocatedFetch(filePath string) {
+    if server == nil {
+        logger.Log.Error("Server is not running.")
+        return
+    }
+
+    metadata, err := fileMetadata("fetch", filePath)
     if err != nil {
-        logger.Log.WithError(err).Error("Failed to create stream adapter")
+        logger.Log.WithError(err).Error("Failed to build file metadata")
         return
     }
-    defer adapter.Close() // Ensure this is deferred right after successful creation
 
-    logger.Log.Info("Waiting to read data on client...") // Using Info level for initial waiting message
-    for {
-        metadata, err := datamgmt.ReadLengthPrefixedData(adapter.GzipReader)
+    providers, err := server.locateProviders(metadata)
+    if errors.Is(err, p2p.ErrNoProviders) {
+        // Nobody holds a full replica, but the file may be erasure coded.
+        err = server.fetchErasureCoded(metadata)
         if err != nil {
-            if err == io.EOF {
-                logger.Log.Info("EOF reached, closing connection")
-                break
-            } else {
-                logger.Log.WithError(err).Error("Error reading metadata")
-                continue
-            }
+            logger.Log.WithError(err).WithField("key", metadata.Key()).Error("Failed to fetch file")
+            return
+        }
+    } else if err != nil {
+        logger.Log.WithError(err).WithField("key", metadata.Key()).Error("Failed to locate file")
+        return
+    } else if len(providers) == 0 {
+        logger.Log.WithField("key", metadata.Key()).Info("File is already stored locally")
+    } else if err := server.swarmFetch(metadata, providers); err != nil {
+        logger.Log.WithError(err).WithField("key", metadata.Key()).Error("Failed to fetch file")
+        return
+    }
+    if decryptsOnFetch(filePath) {
+        saveDecrypted(metadata, filePath)
+    }
+}
+
+// handleRangeFetch reads byte ranges such as "0-99,-500" of a file from a peer and writes
+// them one after another to "<file name>.range" in the working directory.
+func handleRangeFetch(destAddr, filePath, spec, version string) {
+    if server == nil {
+        logger.Log.Error("Server is not running.")
+        return
+    }
+
+    if encryptionKey != nil {
+        logger.Log.Warn("Byte ranges of encrypted files cannot be decrypted, fetch the whole file instead")
+        return
+    }
+
+    ranges, err := datamgmt.ParseRanges(spec)
+    if err != nil {
+        logger.Log.WithError(err).Error("Invalid range specification")
+        return
+    }
+
+    metadata, err := fileMetadata("fetch", filePath)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to build file metadata")
+        return
+    }
+
+    metadata.Version = version
+    resolved, contents, err := server.fetchRanges(destAddr, metadata, ranges)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to fetch ranges")
+        return
+    }
+
+    output := metadata.Key() + ".range"
+    file, err := os.Create(filepath.Clean(output))
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to create output file")
+        return
+    }
+    defer file.Close()
+    for i, content := range contents {
+        if _, err := file.Write(content); err != nil {
+            logger.Log.WithError(err).Error("Failed to write output file")
+            return
+        }
+        logger.Log.WithFields(map[string]interface{}{
+            "offset": resolved[i].Offset,
+            "length": resolved[i].Length,
+        }).Info("Range received")
+    }
+    logger.Log.WithField("path", output).Info("Ranges saved")
+}
+
+// handleVersions lists the versions of a file held by a peer, or by this node when no
+// destination is given.
+func handleVersions(destAddr, filePath string) {
+    if server == nil {
+        logger.Log.Error("Server is not running.")
+        return
+    }
+
+    metadata, err := fileMetadata("versions", filePath)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to build file metadata")
+        return
+    }
+    var versions []ObjectVersion
+    if destAddr == "" {
+        versions, err = server.storage.Versions(metadata)
+    } else {
+        versions, err = server.requestVersions(destAddr, metadata)
+    }
+    if err != nil {
+        logger.Log.WithError(err).WithField("key", metadata.Key()).Error("Failed to list versions")
+        return
+    }
+    for _, version := range versions {
+        fields := map[string]interface{}{
+            "version":  version.VersionID,
+            "created":  version.CreatedAt.Format(time.RFC3339),
+            "size":     version.Size,
+            "checksum": version.Checksum,
+            "deleted":  version.Deleted,
+            "latest":   version.Latest,
+            "conflict": version.Conflict,
+            "clock":    version.Clock.String(),
+        }
+        if version.Tier != "" {
+            fields["tier"] = version.Tier
+        }
+        if !version.ExpiresAt.IsZero() {
+            fields["expires"] = version.ExpiresAt.Format(time.RFC3339)
+        }
+        logger.Log.WithFields(fields).Info("Version")
+    }
+}
+
+// handleUsage logs how much each origin, namespace and bucket stores on this node, or on the peer
+// given in args, and its quota, followed by what scrubbing its storage has found.
+func handleUsage(args []string) {
+    if server == nil {
+        logger.Log.Error("Server is not running.")
+        return
+    }
+
+    var report *UsageReport
+    var err error
+    if len(args) == 0 {
+        if report, err = server.storage.Usage(); err == nil {
+            report.Scrub = server.ScrubTotals()
+        }
+    } else {
+        report, err = server.requestUsage(args[0])
+    }
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to get usage")
+        return
+    }
+    for _, group := range []struct {
+        kind  string
+        usage map[string]Usage
+    }{{"origin", report.Origins}, {"namespace", report.Namespaces}, {"bucket", report.Buckets}} {
+        names := make([]string, 0, len(group.usage))
+        for name := range group.usage {
+            names = append(names, name)
+        }
+        sort.Strings(names)
+        for _, name := range names {
+            usage := group.usage[name]
+            logger.Log.WithFields(map[string]interface{}{
+                group.kind:    name,
+                "bytes":       usage.Bytes,
+                "files":       usage.Objects,
+                "quota_bytes": usage.Quota.Bytes,
+                "quota_files": usage.Quota.Objects,
+            }).Info("Usage")
         }
+    }
+    logger.Log.WithFields(map[string]interface{}{
+        "passes":         report.Scrub.Passes,
+        "chunks":         report.Scrub.Chunks,
+        "corrupt_chunks": report.Scrub.CorruptChunks,
+        "corrupt":        report.Scrub.Corrupt,
+        "repaired":       report.Scrub.Repaired,
+    }).Info("Scrub totals")
+}
 
-        var data datamgmt.Data
-        if err := gob.NewDecoder(bytes.NewReader(metadata)).Decode(&data); err != nil {
-            logger.Log.WithError(err).Error("Error decoding metadata")
-            continue
+// handleCreateBucket creates a bucket on this node, or on dest if it is set, with the
+// settings in args. Versioning is on unless turned off.
+func handleCreateBucket(dest, name string, args []string) {
+    if server == nil {
+        logger.Log.Error("Server is not running.")
+        return
+    }
+
+    bucket := &datamgmt.Bucket{Name: name, Versioned: true}
+    for _, arg := range args {
+        if err := parseBucketOption(arg, bucket); err != nil {
+            logger.Log.WithError(err).Warn("Invalid bucket setting")
+            return
         }
+    }
+    var err error
+    if dest == "" {
+        err = server.storage.CreateBucket(bucket)
+    } else {
+        err = server.requestBucketChange(dest, &datamgmt.Data{Command: "create-bucket", Bucket: name, Settings: bucket})
+    }
+    if err != nil {
+        logger.Log.WithError(err).WithField("bucket", name).Error("Failed to create bucket")
+    }
+}
+
+// handleListBuckets logs the buckets on this node, or on the peer given in args.
+func handleListBuckets(args []string) {
+    if server == nil {
+        logger.Log.Error("Server is not running.")
+        return
+    }
 
+    var buckets []datamgmt.Bucket
+    var err error
+    if len(args) == 0 {
+        buckets, err = server.storage.Buckets()
+    } else {
+        buckets, err = server.requestBuckets(args[0])
+    }
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to list buckets")
+        return
+    }
+    for _, bucket := range buckets {
         logger.Log.WithFields(map[string]interface{}{
-            "command": data.Command, 
-            "filename": data.Filename,
-        }).Info("Received command")
+            "bucket":      bucket.Name,
+            "owner":       bucket.ACL.Owner,
+            "created":     bucket.CreatedAt.Format(time.RFC3339),
+            "replicas":    bucket.Replicas,
+            "versioning":  bucket.Versioned,
+            "encryption":  bucket.Encrypted,
+            "quota_bytes": bucket.QuotaBytes,
+            "quota_files": bucket.QuotaObjects,
+        }).Info("Bucket")
+    }
+}
+
+// handleDeleteBucket deletes an empty bucket on this node, or on the peer given in args.
+func handleDeleteBucket(args []string, name string) {
+    if server == nil {
+        logger.Log.Error("Server is not running.")
+        return
+    }
+
+    var err error
+    if len(args) == 0 {
+        err = server.storage.DeleteBucket(name)
+    } else {
+        err = server.requestBucketChange(args[0], &datamgmt.Data{Command: "delete-bucket", Bucket: name})
+    }
+    if err != nil {
+        logger.Log.WithError(err).WithField("bucket", name).Error("Failed to delete bucket")
+    }
+}
+
+// bucketTargetPrefix marks a set-acl target naming a bucket rather than a file.
+const bucketTargetPrefix = "bucket:"
 
-        // Assuming `handleStoreCommand` is implemented elsewhere and logs its actions
-        server.handleStoreCommand(&data, adapter)
+// handleSetACL replaces the grants on a file, or on a bucket given as "bucket:<name>", on
+// this node or on dest if it is set. No grants leave only the owner with access.
+func handleSetACL(dest, target string, args []string) {
+    if server == nil {
+        logger.Log.Error("Server is not running.")
+        return
+    }
+
+    grants := make(map[string][]datamgmt.Permission)
+    for _, arg := range args {
+        if err := parseGrant(arg, grants); err != nil {
+            logger.Log.WithError(err).Warn("Invalid grant")
+            return
+        }
+    }
+    metadata := &datamgmt.Data{Bucket: strings.TrimPrefix(target, bucketTargetPrefix)}
+    if !strings.HasPrefix(target, bucketTargetPrefix) {
+        var err error
+        if metadata, err = fileMetadata("set-acl", target); err != nil {
+            logger.Log.WithError(err).Error("Failed to build file metadata")
+            return
+        }
+    }
+    metadata.ACL = &datamgmt.ACL{Grants: grants}
+
+    var err error
+    if dest == "" {
+        err = server.storage.SetGrants(metadata, grants)
+    } else {
+        err = server.requestSetACL(dest, metadata)
+    }
+    if err != nil {
+        logger.Log.WithError(err).WithField("target", target).Error("Failed to set grants")
     }
 }
 
+// handleCapability issues a capability token for operations on a file lasting lifetime,
+// signed by this node or by the peer given in args, and logs it to be handed out.
+func handleCapability(args []string, filePath, operationList, lifetime string) {
+    if server == nil {
+        logger.Log.Error("Server is not running.")
+        return
+    }
+
+    operations, err := parseOperations(operationList)
+    if err != nil {
+        logger.Log.WithError(err).Warn("Invalid operations")
+        return
+    }
+    ttl, err := time.ParseDuration(lifetime)
+    if err != nil || ttl <= 0 {
+        logger.Log.WithField("lifetime", lifetime).Warn("Invalid lifetime")
+        return
+    }
+    metadata, err := fileMetadata("capability", filePath)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to build file metadata")
+        return
+    }
+
+    var token string
+    if len(args) == 0 {
+        token, err = server.IssueCapability(metadata, operations, ttl)
+    } else {
+        token, err = server.requestCapability(args[0], metadata, operations, ttl)
+    }
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to issue capability")
+        return
+    }
+    // The token is a bearer credential, so it goes to the terminal alone and not the log.
+    logger.Log.WithFields(map[string]interface{}{
+        "file":       filePath,
+        "operations": operationList,
+        "expires":    time.Now().Add(ttl).Format(time.RFC3339),
+    }).Info("Capability issued")
+    fmt.Println(token)
+}
+
+// handleCapabilityFetch downloads the file a capability token is for into outputPath.
+func handleCapabilityFetch(destAddr, token, outputPath string) {
+    if server == nil {
+        logger.Log.Error("Server is not running.")
+        return
+    }
+
+    written, err := saveDownload(outputPath, func(writer io.Writer) (int64, error) {
+        return server.fetchWithCapability(destAddr, token, writer)
+    })
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to fetch with capability")
+        return
+    }
+    logger.Log.WithField("path", outputPath).WithField("bytes", written).Info("Download complete")
+}
+
+// handleVerifyAudit checks the chain of the audit log at the path in args, or of the one
+// the node keeps.
+func handleVerifyAudit(args []string) {
+    var entries uint64
+    var last string
+    var err error
+    if len(args) == 1 {
+        entries, last, err = VerifyAuditLog(args[0])
+    } else if server != nil && server.audit != nil {
+        entries, last, err = server.audit.Verify()
+    } else {
+        logger.Log.Error("The node keeps no audit log; give the path of one to verify.")
+        return
+    }
+    if err != nil {
+        logger.Log.WithError(err).Error("Audit log verification failed")
+        return
+    }
+    logger.Log.WithFields(map[string]interface{}{"entries": entries, "last_hash": last}).Info("Audit log intact")
+}
+
+func joinNetwork(addresses []string) {
+    if server == nil {
+        logger.Log.Error("Server is not running.")
+        return
+    }
+    if err := server.dht.Bootstrap(addresses); err != nil {
+        logger.Log.WithError(err).Error("Failed to join network")
+        return
+    }
+    // Files stored before joining could not be announced to anyone.
+    server.republish()
+}
+
+// handleErasureSend erasure codes a file into data and parity shards stored on distinct
+// peers, so it survives the loss of up to parityShards of them.
+func handleErasureSend(filePath string, dataShards, parityShards int) {
+    if server == nil {
+        logger.Log.Error("Server is not running.")
+        return
+    }
+
+    metadata, err := fileMetadata("send", filePath)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to build file metadata")
+        return
+    }
+    file, release, err := openForSending(filePath)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to open file")
+        return
+    }
+    defer release()
+
+    if err := server.sendErasureCoded(metadata, file, dataShards, parityShards); err != nil {
+        logger.Log.WithError(err).Error("Failed to send erasure-coded file")
+    }
+}
+
+// repairShards regenerates missing shards of the erasure-coded files this node sent
+// without waiting for the next scheduled check.
+func repairShards() {
+    if server == nil {
+        logger.Log.Error("Server is not running.")
+        return
+    }
+    repaired := server.repairShards()
+    logger.Log.WithField("shards", repaired).Info("Shard repair complete")
+}
+
+// scrubStorage runs a scrub pass immediately instead of waiting for the next scheduled one.
+func scrubStorage() {
+    if server == nil {
+        logger.Log.Error("Server is not running.")
+        return
+    }
+    server.scrub()
+}
+
+// rotateKeys starts using a new data key for encryption at rest and, when a new master key
+// file is given, re-wraps all data keys under it.
+func rotateKeys(args []string) {
+    if server == nil {
+        logger.Log.Error("Server is not running.")
+        return
+    }
+    var newMaster []byte
+    if len(args) > 0 {
+        key, err := encryption.LoadKey(args[0])
+        if err != nil {
+            logger.Log.WithError(err).Error("Failed to load new master key")
+            return
+        }
+        newMaster = key
+    }
+    if err := server.storage.RotateKeys(newMaster); err != nil {
+        logger.Log.WithError(err).Error("Failed to rotate keys")
+        return
+    }
+    if newMaster != nil {
+        logger.Log.WithField("path", args[0]).Warn("Master key replaced, start the node with the new master key from now on")
+    }
+}
+
+func sendFile(destAddr string, metadata *datamgmt.Data, filePath string) error {
+    file, release, err := openForSending(filePath)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to open file")
+        return err
+    }
+    defer release()
+
+    if err := server.syncData(destAddr, metadata, file); err != nil {
+        logger.Log.WithError(err).Error("Failed to send data")
+        return err  
+    }
+    return nil
+}
 
 func stopServer() {
     if server != nil {
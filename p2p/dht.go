@@ -0,0 +1,375 @@
+package p2p
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/logger"
+)
+
+const (
+	// Alpha is the number of concurrent RPCs issued during an iterative lookup.
+	Alpha = 3
+	// ProviderTTL is how long a provider record is kept before it must be re-announced.
+	ProviderTTL = 24 * time.Hour
+	// RepublishInterval is how often a node re-announces the keys it holds, well within
+	// ProviderTTL so that its records never lapse.
+	RepublishInterval = ProviderTTL / 4
+)
+
+// MessageType names a DHT RPC.
+type MessageType string
+
+const (
+	Ping      MessageType = "PING"
+	FindNode  MessageType = "FIND_NODE"
+	FindValue MessageType = "FIND_VALUE"
+	Store     MessageType = "STORE"
+)
+
+// Message is the request and response envelope for all DHT RPCs.
+type Message struct {
+	Type      MessageType
+	Sender    Contact
+	Target    NodeID    // Node ID or hashed key being looked up
+	Key       string    // Object key for FIND_VALUE and STORE
+	Provider  Contact   // Provider being announced by STORE
+	Contacts  []Contact // Closest known contacts to Target
+	Providers []Contact // Provider records found by FIND_VALUE
+}
+
+// RPCFunc delivers a message to the node at address and returns its reply.
+type RPCFunc func(address string, msg *Message) (*Message, error)
+
+// ErrNoProviders is returned when no provider record exists for a key.
+var ErrNoProviders = errors.New("no providers found")
+
+// ErrNotProvided is returned when no peer accepted a provider record.
+var ErrNotProvided = errors.New("no peer accepted the provider record")
+
+type providerRecord struct {
+	contact Contact
+	expires time.Time
+}
+
+// DHT is a Kademlia distributed hash table that maps object keys to the peers holding them.
+type DHT struct {
+	self      Contact
+	table     *RoutingTable
+	rpc       RPCFunc
+	providers map[string]map[NodeID]providerRecord
+	space     int64 // Space advertised to peers
+	full      bool
+	mu        sync.Mutex
+}
+
+// NewDHT creates a DHT node identified by self that uses rpc to reach other nodes.
+func NewDHT(self Contact, rpc RPCFunc) *DHT {
+	return &DHT{
+		self:      self,
+		table:     NewRoutingTable(self.ID),
+		rpc:       rpc,
+		providers: make(map[string]map[NodeID]providerRecord),
+	}
+}
+
+// Self returns the contact information of the local node, including the space it advertises.
+func (d *DHT) Self() Contact {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	self := d.self
+	self.Space, self.Full = d.space, d.full
+	return self
+}
+
+// Advertise sets the space the local node tells peers it has left. When the node becomes
+// full or stops being full, the peers in its routing table are told right away.
+func (d *DHT) Advertise(space int64, full bool) {
+	d.mu.Lock()
+	changed := d.full != full
+	d.space, d.full = space, full
+	d.mu.Unlock()
+	if !changed {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, contact := range d.table.Closest(d.self.ID, d.table.Len()) {
+		wg.Add(1)
+		go func(contact Contact) {
+			defer wg.Done()
+			d.call(contact, &Message{Type: Ping})
+		}(contact)
+	}
+	wg.Wait()
+}
+
+// Table returns the routing table of the local node.
+func (d *DHT) Table() *RoutingTable {
+	return d.table
+}
+
+// HandleRPC answers an incoming DHT request.
+func (d *DHT) HandleRPC(msg *Message) *Message {
+	d.updateContact(msg.Sender)
+
+	reply := &Message{Type: msg.Type, Sender: d.Self(), Target: msg.Target, Key: msg.Key}
+	switch msg.Type {
+	case Ping:
+	case FindNode:
+		reply.Contacts = d.closestExcept(msg.Target, msg.Sender.ID)
+	case FindValue:
+		reply.Providers = d.localProviders(msg.Key)
+		if len(reply.Providers) == 0 {
+			reply.Contacts = d.closestExcept(msg.Target, msg.Sender.ID)
+		}
+	case Store:
+		// A node only announces itself, so the record is made for the sender, whose address
+		// the transport resolved, and never for a contact the message names.
+		if msg.Provider.ID != msg.Sender.ID {
+			logger.Log.WithField("key", msg.Key).WithField("sender", msg.Sender.ID.String()).Warn("Ignoring provider record for another node")
+			break
+		}
+		d.addProvider(msg.Key, msg.Sender)
+	default:
+		logger.Log.WithField("type", msg.Type).Warn("Unknown DHT message type")
+	}
+	return reply
+}
+
+// Bootstrap joins the network through the given addresses and populates the routing table.
+func (d *DHT) Bootstrap(addresses []string) error {
+	joined := 0
+	for _, address := range addresses {
+		if _, err := d.call(Contact{Address: address}, &Message{Type: Ping}); err != nil {
+			logger.Log.WithError(err).WithField("address", address).Warn("Failed to reach bootstrap node")
+			continue
+		}
+		joined++
+	}
+	if joined == 0 && len(addresses) > 0 {
+		return errors.New("unable to reach any bootstrap node")
+	}
+	d.FindNode(d.self.ID)
+	logger.Log.WithField("contacts", d.table.Len()).Info("DHT bootstrap complete")
+	return nil
+}
+
+// FindNode returns the closest contacts to target known to the network.
+func (d *DHT) FindNode(target NodeID) []Contact {
+	contacts, _ := d.lookup(target, "")
+	return contacts
+}
+
+// Provide announces the local node as a provider of key to the nodes closest to it. It
+// returns ErrNotProvided if none of them stored the record.
+func (d *DHT) Provide(key string) error {
+	d.addProvider(key, d.self)
+
+	closest, _ := d.lookup(NewNodeID(key), "")
+	stored := 0
+	for _, contact := range closest {
+		msg := &Message{Type: Store, Target: NewNodeID(key), Key: key, Provider: d.self}
+		if _, err := d.call(contact, msg); err != nil {
+			logger.Log.WithError(err).WithField("address", contact.Address).Warn("Failed to store provider record")
+			continue
+		}
+		stored++
+	}
+	if stored == 0 {
+		return ErrNotProvided
+	}
+	logger.Log.WithField("key", key).WithField("replicas", stored).Info("Provider record announced")
+	return nil
+}
+
+// FindProviders returns the peers that have announced they hold key.
+func (d *DHT) FindProviders(key string) ([]Contact, error) {
+	if providers := d.localProviders(key); len(providers) > 0 {
+		return providers, nil
+	}
+	_, providers := d.lookup(NewNodeID(key), key)
+	if len(providers) == 0 {
+		return nil, ErrNoProviders
+	}
+	return providers, nil
+}
+
+// lookup performs an iterative Kademlia lookup for target. When key is set, FIND_VALUE is
+// used and the lookup stops as soon as a node returns provider records.
+func (d *DHT) lookup(target NodeID, key string) ([]Contact, []Contact) {
+	msgType := FindNode
+	if key != "" {
+		msgType = FindValue
+	}
+
+	shortlist := d.table.Closest(target, BucketSize)
+	seen := map[NodeID]bool{d.self.ID: true}
+	queried := map[NodeID]bool{d.self.ID: true}
+	for _, contact := range shortlist {
+		seen[contact.ID] = true
+	}
+
+	type result struct {
+		contact Contact
+		reply   *Message
+		err     error
+	}
+
+	for {
+		var batch []Contact
+		for _, contact := range shortlist {
+			if !queried[contact.ID] {
+				batch = append(batch, contact)
+				queried[contact.ID] = true
+			}
+			if len(batch) == Alpha {
+				break
+			}
+		}
+		if len(batch) == 0 {
+			return shortlist, nil
+		}
+
+		results := make(chan result, len(batch))
+		for _, contact := range batch {
+			go func(contact Contact) {
+				reply, err := d.call(contact, &Message{Type: msgType, Target: target, Key: key})
+				results <- result{contact: contact, reply: reply, err: err}
+			}(contact)
+		}
+
+		var providers []Contact
+		failed := make(map[NodeID]bool)
+		for range batch {
+			res := <-results
+			if res.err != nil {
+				failed[res.contact.ID] = true
+				continue
+			}
+			providers = append(providers, res.reply.Providers...)
+			for _, contact := range res.reply.Contacts {
+				if !seen[contact.ID] {
+					seen[contact.ID] = true
+					shortlist = append(shortlist, contact)
+				}
+			}
+		}
+		if len(providers) > 0 {
+			return shortlist, providers
+		}
+
+		alive := shortlist[:0]
+		for _, contact := range shortlist {
+			if !failed[contact.ID] {
+				alive = append(alive, contact)
+			}
+		}
+		shortlist = alive
+		sortByDistance(shortlist, target)
+		if len(shortlist) > BucketSize {
+			shortlist = shortlist[:BucketSize]
+		}
+	}
+}
+
+// call sends msg to contact and records the responder in the routing table.
+func (d *DHT) call(contact Contact, msg *Message) (*Message, error) {
+	msg.Sender = d.Self()
+	reply, err := d.rpc(contact.Address, msg)
+	if err != nil {
+		if contact.ID != (NodeID{}) {
+			d.table.Remove(contact.ID)
+		}
+		return nil, err
+	}
+	responder := reply.Sender
+	responder.Address = contact.Address
+	d.updateContact(responder)
+	return reply, nil
+}
+
+// updateContact adds a contact to the routing table, evicting the least recently seen
+// contact of a full bucket only if it no longer answers a ping.
+func (d *DHT) updateContact(contact Contact) {
+	if contact.Address == "" {
+		return
+	}
+	oldest, added := d.table.Update(contact)
+	if added || oldest == nil {
+		return
+	}
+	go func() {
+		msg := &Message{Type: Ping, Sender: d.Self()}
+		if _, err := d.rpc(oldest.Address, msg); err == nil {
+			d.table.Update(*oldest)
+			return
+		}
+		d.table.Remove(oldest.ID)
+		d.table.Update(contact)
+	}()
+}
+
+func (d *DHT) closestExcept(target NodeID, exclude NodeID) []Contact {
+	var contacts []Contact
+	for _, contact := range d.table.Closest(target, BucketSize+1) {
+		if contact.ID != exclude {
+			contacts = append(contacts, contact)
+		}
+	}
+	if len(contacts) > BucketSize {
+		contacts = contacts[:BucketSize]
+	}
+	return contacts
+}
+
+func (d *DHT) addProvider(key string, provider Contact) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.providers[key] == nil {
+		d.providers[key] = make(map[NodeID]providerRecord)
+	}
+	d.providers[key][provider.ID] = providerRecord{contact: provider, expires: time.Now().Add(ProviderTTL)}
+}
+
+// RemoveProvider withdraws a provider record for key from the local node.
+func (d *DHT) RemoveProvider(key string, id NodeID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.providers[key], id)
+	if len(d.providers[key]) == 0 {
+		delete(d.providers, key)
+	}
+}
+
+func (d *DHT) localProviders(key string) []Contact {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var providers []Contact
+	for id, record := range d.providers[key] {
+		if time.Now().After(record.expires) {
+			delete(d.providers[key], id)
+			continue
+		}
+		providers = append(providers, record.contact)
+	}
+	return providers
+}
+
+// ResolveAddress replaces an unspecified host in an advertised address with the host the
+// connection actually came from, so peers listening on 0.0.0.0 remain reachable.
+func ResolveAddress(advertised string, remote net.Addr) string {
+	host, port, err := net.SplitHostPort(advertised)
+	if err != nil {
+		return advertised
+	}
+	if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+		return advertised
+	}
+	remoteHost, _, err := net.SplitHostPort(remote.String())
+	if err != nil {
+		return advertised
+	}
+	return net.JoinHostPort(remoteHost, port)
+}
@@ -0,0 +1,189 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// IDLength is the size of a node ID in bytes.
+	IDLength = sha256.Size
+	// IDBits is the number of bits in a node ID and therefore the number of k-buckets.
+	IDBits = IDLength * 8
+	// BucketSize is the maximum number of contacts held by a single k-bucket.
+	BucketSize = 20
+)
+
+// NodeID identifies a node (or a key) in the XOR keyspace.
+type NodeID [IDLength]byte
+
+// NewNodeID hashes an arbitrary key into the keyspace.
+func NewNodeID(key string) NodeID {
+	return NodeID(sha256.Sum256([]byte(key)))
+}
+
+// NewRandomNodeID returns a random node ID.
+func NewRandomNodeID() NodeID {
+	var id NodeID
+	if _, err := rand.Read(id[:]); err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// ParseNodeID parses the hex representation of an ID produced by String.
+func ParseNodeID(s string) (NodeID, error) {
+	var id NodeID
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return id, err
+	}
+	if len(decoded) != IDLength {
+		return id, fmt.Errorf("node ID must be %d bytes, got %d", IDLength, len(decoded))
+	}
+	copy(id[:], decoded)
+	return id, nil
+}
+
+// String returns the hex representation of the ID.
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Distance returns the XOR distance between two IDs.
+func (id NodeID) Distance(other NodeID) NodeID {
+	var d NodeID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// Less reports whether id is numerically smaller than other.
+func (id NodeID) Less(other NodeID) bool {
+	return bytes.Compare(id[:], other[:]) < 0
+}
+
+// prefixLen returns the number of leading zero bits of the ID.
+func (id NodeID) prefixLen() int {
+	for i, b := range id {
+		if b != 0 {
+			return i*8 + bits.LeadingZeros8(b)
+		}
+	}
+	return IDBits
+}
+
+// Contact is the routing information for a remote node.
+type Contact struct {
+	ID       NodeID
+	Address  string
+	LastSeen time.Time
+	Space    int64 // Bytes the node can still store as it last advertised, zero if unknown
+	Full     bool  // The node advertised it has no space left for new data
+}
+
+// RoutingTable stores contacts in k-buckets ordered by XOR distance from the local node.
+type RoutingTable struct {
+	self    NodeID
+	buckets [IDBits][]Contact
+	mu      sync.RWMutex
+}
+
+// NewRoutingTable creates an empty routing table for the given local node ID.
+func NewRoutingTable(self NodeID) *RoutingTable {
+	return &RoutingTable{self: self}
+}
+
+// bucketIndex returns the index of the k-bucket responsible for id.
+func (rt *RoutingTable) bucketIndex(id NodeID) int {
+	index := rt.self.Distance(id).prefixLen()
+	if index == IDBits {
+		index = IDBits - 1
+	}
+	return index
+}
+
+// Update records that a contact has been seen. Known contacts are moved to the tail of
+// their bucket; new contacts are appended unless the bucket is full, in which case the
+// least recently seen contact is returned so the caller can decide whether to evict it.
+func (rt *RoutingTable) Update(contact Contact) (oldest *Contact, added bool) {
+	if contact.ID == rt.self {
+		return nil, false
+	}
+	contact.LastSeen = time.Now()
+
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	index := rt.bucketIndex(contact.ID)
+	bucket := rt.buckets[index]
+	for i, existing := range bucket {
+		if existing.ID == contact.ID {
+			bucket = append(bucket[:i], bucket[i+1:]...)
+			rt.buckets[index] = append(bucket, contact)
+			return nil, true
+		}
+	}
+	if len(bucket) < BucketSize {
+		rt.buckets[index] = append(bucket, contact)
+		return nil, true
+	}
+	head := bucket[0]
+	return &head, false
+}
+
+// Remove drops a contact from the routing table.
+func (rt *RoutingTable) Remove(id NodeID) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	index := rt.bucketIndex(id)
+	bucket := rt.buckets[index]
+	for i, existing := range bucket {
+		if existing.ID == id {
+			rt.buckets[index] = append(bucket[:i], bucket[i+1:]...)
+			return
+		}
+	}
+}
+
+// Closest returns up to count contacts ordered by XOR distance to target.
+func (rt *RoutingTable) Closest(target NodeID, count int) []Contact {
+	rt.mu.RLock()
+	var contacts []Contact
+	for _, bucket := range rt.buckets {
+		contacts = append(contacts, bucket...)
+	}
+	rt.mu.RUnlock()
+
+	sortByDistance(contacts, target)
+	if len(contacts) > count {
+		contacts = contacts[:count]
+	}
+	return contacts
+}
+
+// Len returns the total number of contacts in the table.
+func (rt *RoutingTable) Len() int {
+	rt.mu.RLock()
+	defer rt.mu.RUnlock()
+	total := 0
+	for _, bucket := range rt.buckets {
+		total += len(bucket)
+	}
+	return total
+}
+
+func sortByDistance(contacts []Contact, target NodeID) {
+	sort.Slice(contacts, func(i, j int) bool {
+		return contacts[i].ID.Distance(target).Less(contacts[j].ID.Distance(target))
+	})
+}
@@ -0,0 +1,123 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// newTestNetwork creates count DHT nodes that deliver RPCs to each other in memory.
+func newTestNetwork(count int) []*DHT {
+	nodes := make(map[string]*DHT)
+	rpc := func(address string, msg *Message) (*Message, error) {
+		node, ok := nodes[address]
+		if !ok {
+			return nil, errors.New("unreachable")
+		}
+		return node.HandleRPC(msg), nil
+	}
+
+	var dhts []*DHT
+	for i := 0; i < count; i++ {
+		address := fmt.Sprintf("node-%d", i)
+		dht := NewDHT(Contact{ID: NewNodeID(address), Address: address}, rpc)
+		nodes[address] = dht
+		dhts = append(dhts, dht)
+	}
+	return dhts
+}
+
+func TestNodeID_Distance(t *testing.T) {
+	a := NewNodeID("a")
+	b := NewNodeID("b")
+	if a.Distance(a) != (NodeID{}) {
+		t.Errorf("Distance to self should be zero")
+	}
+	if a.Distance(b) != b.Distance(a) {
+		t.Errorf("Distance should be symmetric")
+	}
+}
+
+func TestRoutingTable_Closest(t *testing.T) {
+	self := NewNodeID("self")
+	table := NewRoutingTable(self)
+	for i := 0; i < 50; i++ {
+		table.Update(Contact{ID: NewNodeID(fmt.Sprintf("peer-%d", i)), Address: fmt.Sprintf("peer-%d", i)})
+	}
+
+	target := NewNodeID("target")
+	closest := table.Closest(target, 5)
+	if len(closest) != 5 {
+		t.Fatalf("Expected 5 contacts, got %d", len(closest))
+	}
+	for i := 1; i < len(closest); i++ {
+		if closest[i].ID.Distance(target).Less(closest[i-1].ID.Distance(target)) {
+			t.Errorf("Contacts are not ordered by distance")
+		}
+	}
+}
+
+func TestDHT_FindProviders(t *testing.T) {
+	nodes := newTestNetwork(30)
+	for _, node := range nodes[1:] {
+		if err := node.Bootstrap([]string{nodes[0].Self().Address}); err != nil {
+			t.Fatalf("Bootstrap() error = %v", err)
+		}
+	}
+
+	if err := nodes[7].Provide("report.pdf"); err != nil {
+		t.Fatalf("Provide() error = %v", err)
+	}
+
+	providers, err := nodes[21].FindProviders("report.pdf")
+	if err != nil {
+		t.Fatalf("FindProviders() error = %v", err)
+	}
+	if len(providers) != 1 || providers[0].ID != nodes[7].Self().ID {
+		t.Errorf("Expected provider %s, got %v", nodes[7].Self().Address, providers)
+	}
+
+	if _, err := nodes[21].FindProviders("missing.txt"); !errors.Is(err, ErrNoProviders) {
+		t.Errorf("Expected ErrNoProviders, got %v", err)
+	}
+
+	// A node can only announce itself: a record naming another node is ignored, and the
+	// address it is kept under is the sender's.
+	sender := Contact{ID: NewNodeID("mallory"), Address: "mallory"}
+	victim := Contact{ID: NewNodeID("victim"), Address: "victim"}
+	nodes[3].HandleRPC(&Message{Type: Store, Sender: sender, Key: "forged.txt", Provider: victim})
+	if providers := nodes[3].localProviders("forged.txt"); len(providers) != 0 {
+		t.Errorf("Expected a record for another node to be ignored, got %v", providers)
+	}
+	nodes[3].HandleRPC(&Message{Type: Store, Sender: sender, Key: "forged.txt", Provider: Contact{ID: sender.ID, Address: "victim"}})
+	if providers := nodes[3].localProviders("forged.txt"); len(providers) != 1 || providers[0].Address != "mallory" {
+		t.Errorf("Expected the record to name the sender, got %v", providers)
+	}
+
+	// A node that reaches no peer is told its record was not stored.
+	if err := newTestNetwork(1)[0].Provide("report.pdf"); !errors.Is(err, ErrNotProvided) {
+		t.Errorf("Expected ErrNotProvided, got %v", err)
+	}
+}
+
+func TestDHT_Advertise(t *testing.T) {
+	nodes := newTestNetwork(5)
+	for _, node := range nodes[1:] {
+		if err := node.Bootstrap([]string{nodes[0].Self().Address}); err != nil {
+			t.Fatalf("Bootstrap() error = %v", err)
+		}
+	}
+
+	nodes[3].Advertise(0, true)
+	for _, contact := range nodes[0].Table().Closest(nodes[3].Self().ID, 1) {
+		if contact.ID != nodes[3].Self().ID || !contact.Full {
+			t.Errorf("Expected %s to be known as full, got %+v", nodes[3].Self().Address, contact)
+		}
+	}
+
+	nodes[3].Advertise(1<<30, false)
+	contacts := nodes[0].Table().Closest(nodes[3].Self().ID, 1)
+	if len(contacts) != 1 || contacts[0].Full || contacts[0].Space != 1<<30 {
+		t.Errorf("Expected %s to advertise free space, got %+v", nodes[3].Self().Address, contacts)
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/logger"
+)
+
+// Quotas limit the bytes and files each origin, the OriginID of the sender, and each
+// namespace, the ID files are stored under, may keep on a node, and buckets can set quotas
+// of their own in their settings. Usage counts the size of
+// every version kept, as older versions take up space until they are erased, and the
+// number of files that are neither deleted nor expired. It is added up from every manifest
+// once, then kept current as manifests are written and removed, so checking a quota does not
+// read the whole store; a file that expires stops counting once the expiry pass deletes it.
+// A write holds the bytes and file it adds against its quotas while it runs, so writes
+// running at once cannot overshoot a quota together. Clients only see their own usage.
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits the bytes and files an origin, namespace or bucket may keep, zero meaning no
+// limit.
+type Quota struct {
+    Bytes   Size
+    Objects int
+}
+
+// Size is a byte count written in JSON as a number or a string such as "512M" or "10G".
+type Size int64
+
+func (s *Size) UnmarshalJSON(b []byte) error {
+    var bytes int64
+    if err := json.Unmarshal(b, &bytes); err == nil {
+        *s = Size(bytes)
+        return nil
+    }
+    var text string
+    if err := json.Unmarshal(b, &text); err != nil {
+        return fmt.Errorf("size must be a number or a string: %w", err)
+    }
+    parsed, err := parseSize(text)
+    if err != nil {
+        return err
+    }
+    *s = Size(parsed)
+    return nil
+}
+
+// QuotaPolicy holds the default quotas of origins and namespaces, and the quotas of those
+// that get different limits.
+type QuotaPolicy struct {
+    Origin     Quota
+    Namespace  Quota
+    Origins    map[string]Quota
+    Namespaces map[string]Quota
+}
+
+// LoadQuotaPolicy reads a quota policy file.
+func LoadQuotaPolicy(path string) (*QuotaPolicy, error) {
+    content, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var policy QuotaPolicy
+    if err := json.Unmarshal(content, &policy); err != nil {
+        return nil, fmt.Errorf("invalid quota policy: %w", err)
+    }
+    return &policy, nil
+}
+
+func (p *QuotaPolicy) originQuota(origin string) Quota {
+    if quota, ok := p.Origins[origin]; ok {
+        return quota
+    }
+    return p.Origin
+}
+
+func (p *QuotaPolicy) namespaceQuota(namespace string) Quota {
+    if quota, ok := p.Namespaces[namespace]; ok {
+        return quota
+    }
+    return p.Namespace
+}
+
+// Usage is what an origin, namespace or bucket keeps on a node, and the quota it is held to.
+type Usage struct {
+    Bytes   int64
+    Objects int
+    Quota   Quota
+}
+
+// UsageReport is the usage of every origin, namespace and bucket with files on a node, and
+// what scrubbing its storage has found.
+type UsageReport struct {
+    Origins    map[string]Usage
+    Namespaces map[string]Usage
+    Buckets    map[string]Usage
+    Scrub      ScrubReport // Totals of the scrub passes since the node started
+}
+
+// of returns the part of the report that is origin's own usage.
+func (r *UsageReport) of(origin string) *UsageReport {
+    own := &UsageReport{Origins: map[string]Usage{}}
+    if usage, ok := r.Origins[origin]; ok {
+        own.Origins[origin] = usage
+    }
+    return own
+}
+
+// Usage reports what each origin, namespace and bucket keeps on this node.
+func (s *StorageService) Usage() (*UsageReport, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return s.usage()
+}
+
+// usage reports the usage counters of each origin, namespace and bucket. The caller must
+// hold the mutex.
+func (s *StorageService) usage() (*UsageReport, error) {
+    counters, err := s.loadUsage()
+    if err != nil {
+        return nil, err
+    }
+    report := &UsageReport{Origins: maps.Clone(counters.origins), Namespaces: maps.Clone(counters.namespaces), Buckets: maps.Clone(counters.buckets)}
+    if s.quotas != nil {
+        for origin, usage := range report.Origins {
+            usage.Quota = s.quotas.originQuota(origin)
+            report.Origins[origin] = usage
+        }
+        for namespace, usage := range report.Namespaces {
+            usage.Quota = s.quotas.namespaceQuota(namespace)
+            report.Namespaces[namespace] = usage
+        }
+    }
+    for name, usage := range report.Buckets {
+        usage.Quota = s.bucketQuota(name)
+        report.Buckets[name] = usage
+    }
+    return report, nil
+}
+
+// usageEntry is what one manifest adds to the usage of its origin, namespace and bucket.
+type usageEntry struct {
+    origin, namespace, bucket string
+    bytes                     int64
+    object                    bool // The manifest is the latest version of a live file
+}
+
+// usageCounters keeps the usage of every origin, namespace and bucket, and what each
+// manifest adds to it so the manifest can be taken out again when it changes.
+type usageCounters struct {
+    entries    map[string]usageEntry // By manifest path
+    origins    map[string]Usage
+    namespaces map[string]Usage
+    buckets    map[string]Usage
+}
+
+// add adds entry to the usage it counts towards, or takes it out when sign is negative.
+func (c *usageCounters) add(entry usageEntry, sign int) {
+    count := func(usage map[string]Usage, key string) {
+        total := usage[key]
+        total.Bytes += int64(sign) * entry.bytes
+        if entry.object {
+            total.Objects += sign
+        }
+        if sign < 0 && total.Bytes == 0 && total.Objects == 0 {
+            delete(usage, key)
+            return
+        }
+        usage[key] = total
+    }
+    count(c.origins, entry.origin)
+    count(c.namespaces, entry.namespace)
+    if entry.bucket != "" {
+        count(c.buckets, entry.bucket)
+    }
+}
+
+// loadUsage returns the usage counters, adding up every manifest the first time. The caller
+// must hold the mutex.
+func (s *StorageService) loadUsage() (*usageCounters, error) {
+    if s.counters != nil {
+        return s.counters, nil
+    }
+    counters := &usageCounters{
+        entries:    make(map[string]usageEntry),
+        origins:    make(map[string]Usage),
+        namespaces: make(map[string]Usage),
+        buckets:    make(map[string]Usage),
+    }
+    record := func(path string, manifest *Manifest) error {
+        if entry, ok := s.usageEntry(path, manifest); ok {
+            counters.entries[path] = entry
+            counters.add(entry, 1)
+        }
+        return nil
+    }
+    err := s.walkManifests(record)
+    if err == nil {
+        err = s.walkVersions(record)
+    }
+    if err != nil {
+        return nil, err
+    }
+    s.counters = counters
+    return counters, nil
+}
+
+// usageEntry returns what the manifest at path adds to usage, if anything: deleted files
+// add nothing, older versions add their size, and the latest version of a file that has not
+// expired also counts as a file.
+func (s *StorageService) usageEntry(path string, manifest *Manifest) (usageEntry, bool) {
+    if manifest.Deleted {
+        return usageEntry{}, false
+    }
+    latest := !s.isVersionPath(path)
+    return usageEntry{
+        origin:    manifest.OriginID,
+        namespace: manifest.ID,
+        bucket:    manifest.Bucket,
+        bytes:     manifest.Size,
+        object:    latest && !manifest.expired(time.Now()),
+    }, true
+}
+
+// trackUsage updates the usage counters for the manifest at path now being manifest, or
+// removed when it is nil. Until the counters are first loaded there is nothing to update.
+// The caller must hold the mutex.
+func (s *StorageService) trackUsage(path string, manifest *Manifest) {
+    if s.counters == nil {
+        return
+    }
+    if entry, ok := s.counters.entries[path]; ok {
+        s.counters.add(entry, -1)
+        delete(s.counters.entries, path)
+    }
+    if manifest == nil {
+        return
+    }
+    if entry, ok := s.usageEntry(path, manifest); ok {
+        s.counters.entries[path] = entry
+        s.counters.add(entry, 1)
+    }
+}
+
+// bucketQuota returns the quota a bucket sets, none if this node has no settings for it.
+// The caller must hold the mutex.
+func (s *StorageService) bucketQuota(name string) Quota {
+    bucket, err := s.loadBucket(name)
+    if err != nil {
+        return Quota{}
+    }
+    return Quota{Bytes: Size(bucket.QuotaBytes), Objects: bucket.QuotaObjects}
+}
+
+// CheckQuota returns errQuotaExceeded if storing size more bytes of the file data describes
+// would take its origin, namespace or bucket over quota.
+func (s *StorageService) CheckQuota(data *datamgmt.Data, size int64) error {
+    release, err := s.ReserveQuota(data, size)
+    if err != nil {
+        return err
+    }
+    release()
+    return nil
+}
+
+// ReserveQuota checks the quotas like CheckQuota, and holds size bytes, and a file if the
+// write adds one, against them until release is called. The writes of other callers count
+// what is held as used, so release should be called once the write is committed or failed.
+func (s *StorageService) ReserveQuota(data *datamgmt.Data, size int64) (release func(), err error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    var bucketQuota Quota
+    if data.Bucket != "" {
+        bucketQuota = s.bucketQuota(data.Bucket)
+    }
+    if s.quotas == nil && bucketQuota == (Quota{}) {
+        return func() {}, nil
+    }
+    counters, err := s.loadUsage()
+    if err != nil {
+        return nil, err
+    }
+    // A new version of a live file does not add to the file count.
+    added := 1
+    if path, err := s.generateFilePath(data); err == nil {
+        if manifest, err := s.loadManifest(path); err == nil && !manifest.Deleted && !manifest.expired(time.Now()) {
+            added = 0
+        }
+    }
+
+    type check struct {
+        kind, name string
+        quota      Quota
+        usage      Usage
+    }
+    checks := []check{{"bucket", data.Bucket, bucketQuota, counters.buckets[data.Bucket]}}
+    if s.quotas != nil {
+        checks = append(checks,
+            check{"origin", data.OriginID, s.quotas.originQuota(data.OriginID), counters.origins[data.OriginID]},
+            check{"namespace", data.ID, s.quotas.namespaceQuota(data.ID), counters.namespaces[data.ID]},
+        )
+    }
+    keys := make([]string, len(checks))
+    for i, check := range checks {
+        keys[i] = check.kind + ":" + check.name
+        held := s.reserved[keys[i]]
+        bytes, objects := check.usage.Bytes+held.Bytes+size, check.usage.Objects+held.Objects+added
+        if check.quota.Bytes > 0 && bytes > int64(check.quota.Bytes) {
+            return nil, fmt.Errorf("%w: %s %q would store %d of %d bytes", errQuotaExceeded, check.kind, check.name, bytes, check.quota.Bytes)
+        }
+        if check.quota.Objects > 0 && objects > check.quota.Objects {
+            return nil, fmt.Errorf("%w: %s %q would keep %d of %d files", errQuotaExceeded, check.kind, check.name, objects, check.quota.Objects)
+        }
+    }
+    s.holdQuota(keys, size, added, 1)
+    released := false
+    return func() {
+        s.mutex.Lock()
+        defer s.mutex.Unlock()
+        if !released {
+            released = true
+            s.holdQuota(keys, size, added, -1)
+        }
+    }, nil
+}
+
+// holdQuota adds size bytes and objects files to what writes in progress hold against the
+// quotas keys name, or takes them off when sign is negative. The caller must hold the mutex.
+func (s *StorageService) holdQuota(keys []string, size int64, objects, sign int) {
+    if s.reserved == nil {
+        s.reserved = make(map[string]Usage)
+    }
+    for _, key := range keys {
+        held := s.reserved[key]
+        held.Bytes += int64(sign) * size
+        held.Objects += sign * objects
+        if held.Bytes == 0 && held.Objects == 0 {
+            delete(s.reserved, key)
+            continue
+        }
+        s.reserved[key] = held
+    }
+}
+
+// SetQuotas makes the storage enforce policy, or no quotas if it is nil.
+func (s *StorageService) SetQuotas(policy *QuotaPolicy) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    s.quotas = policy
+}
+
+// handleUsageCommand replies with the usage of every origin, namespace and bucket, or only
+// with that of the caller's own origin if it is a client, as the rest is other clients'.
+func (s *Server) handleUsageCommand(identity string, data *datamgmt.Data, conn net.Conn) error {
+    writer, err := datamgmt.NewWriteStreamAdapter(conn)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to create write stream adapter")
+        return err
+    }
+    defer writer.Close()
+
+    report, err := s.storage.Usage()
+    if err := s.reply(writer, data, err); err != nil {
+        return err
+    }
+    if unchecked(identity) {
+        report.Scrub = s.ScrubTotals()
+    } else {
+        report = report.of(identity)
+    }
+    if err := datamgmt.SendEncodedData(writer.GzipWriter, report); err != nil {
+        logger.Log.WithError(err).Error("Failed to send usage")
+        return err
+    }
+    if err := writer.GzipWriter.Flush(); err != nil {
+        logger.Log.WithError(err).Error("Failed to flush data")
+        return err
+    }
+    return nil
+}
+
+// requestUsage asks a peer for its usage report.
+func (s *Server) requestUsage(address string) (*UsageReport, error) {
+    response, err := s.request(address, &datamgmt.Data{Command: "usage"})
+    if err != nil {
+        return nil, err
+    }
+    defer response.Close()
+
+    var report UsageReport
+    if err := datamgmt.ReadEncodedData(response.reader.GzipReader, &report); err != nil {
+        return nil, err
+    }
+    return &report, nil
+}
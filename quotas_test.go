@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+)
+
+func TestLoadQuotaPolicy(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "quotas.json")
+    policy := `{
+        "Origin": {"Bytes": "1G", "Objects": 1000},
+        "Namespace": {"Bytes": 5000000},
+        "Origins": {"backup": {"Bytes": "2T"}}
+    }`
+    os.WriteFile(path, []byte(policy), 0600)
+
+    loaded, err := LoadQuotaPolicy(path)
+    if err != nil {
+        t.Fatalf("LoadQuotaPolicy() error = %v", err)
+    }
+    if quota := loaded.originQuota("client"); quota.Bytes != 1<<30 || quota.Objects != 1000 {
+        t.Errorf("Unexpected default origin quota %+v", quota)
+    }
+    if quota := loaded.originQuota("backup"); quota.Bytes != 2<<40 || quota.Objects != 0 {
+        t.Errorf("Unexpected backup origin quota %+v", quota)
+    }
+    if quota := loaded.namespaceQuota("1"); quota.Bytes != 5000000 {
+        t.Errorf("Unexpected namespace quota %+v", quota)
+    }
+
+    os.WriteFile(path, []byte(`{"Origin": {"Bytes": "lots"}}`), 0600)
+    if _, err := LoadQuotaPolicy(path); err == nil {
+        t.Errorf("Expected an invalid size to be rejected")
+    }
+}
+
+func TestStorageService_CheckQuota(t *testing.T) {
+    service := NewStorageService("test_address")
+    defer os.RemoveAll(service.rootPath) // Clean up after test
+    service.SetQuotas(&QuotaPolicy{
+        Origin:     Quota{Bytes: 30, Objects: 2},
+        Namespaces: map[string]Quota{"small": {Bytes: 5}},
+    })
+
+    first := &datamgmt.Data{ID: "1", Filename: "first", Extension: "txt", OriginID: "client"}
+    if err := service.StoreData(first, bytes.NewReader([]byte("ten bytes!"))); err != nil {
+        t.Fatalf("StoreData() error = %v", err)
+    }
+    // A new version of a stored file adds bytes but no file.
+    if err := service.CheckQuota(first, 10); err != nil {
+        t.Errorf("Expected a new version to fit, got %v", err)
+    }
+    if err := service.CheckQuota(first, 25); !errors.Is(err, errQuotaExceeded) {
+        t.Errorf("Expected the byte quota to be exceeded, got %v", err)
+    }
+
+    second := &datamgmt.Data{ID: "1", Filename: "second", Extension: "txt", OriginID: "client"}
+    if err := service.StoreData(second, bytes.NewReader([]byte("ten bytes!"))); err != nil {
+        t.Fatalf("StoreData() error = %v", err)
+    }
+    third := &datamgmt.Data{ID: "1", Filename: "third", Extension: "txt", OriginID: "client"}
+    if err := service.CheckQuota(third, 1); err == nil || !strings.Contains(err.Error(), "files") {
+        t.Errorf("Expected the file quota to be exceeded, got %v", err)
+    }
+    other := &datamgmt.Data{ID: "1", Filename: "third", Extension: "txt", OriginID: "other"}
+    if err := service.CheckQuota(other, 1); err != nil {
+        t.Errorf("Expected another origin to have its own quota, got %v", err)
+    }
+    small := &datamgmt.Data{ID: "small", Filename: "third", Extension: "txt", OriginID: "other"}
+    if err := service.CheckQuota(small, 6); err == nil || !strings.Contains(err.Error(), "namespace") {
+        t.Errorf("Expected the namespace quota to be exceeded, got %v", err)
+    }
+
+    report, err := service.Usage()
+    if err != nil {
+        t.Fatalf("Usage() error = %v", err)
+    }
+    if usage := report.Origins["client"]; usage.Bytes != 20 || usage.Objects != 2 || usage.Quota.Objects != 2 {
+        t.Errorf("Unexpected origin usage %+v", usage)
+    }
+
+    // Writes in progress hold their bytes against the quota until they are released.
+    release, err := service.ReserveQuota(other, 20)
+    if err != nil {
+        t.Fatalf("ReserveQuota() error = %v", err)
+    }
+    if err := service.CheckQuota(other, 20); !errors.Is(err, errQuotaExceeded) {
+        t.Errorf("Expected the bytes held by a write in progress to count, got %v", err)
+    }
+    release()
+    release()
+    if err := service.CheckQuota(other, 20); err != nil {
+        t.Errorf("Expected released bytes to be available again, got %v", err)
+    }
+}
+
+func TestStorageService_UsageFollowsChanges(t *testing.T) {
+    service := NewStorageService("test_address")
+    defer os.RemoveAll(service.rootPath) // Clean up after test
+    if _, err := service.Usage(); err != nil {
+        t.Fatalf("Usage() error = %v", err)
+    }
+
+    kept := &datamgmt.Data{ID: "1", Filename: "kept", Extension: "txt", OriginID: "client", Bucket: "photos"}
+    removed := &datamgmt.Data{ID: "1", Filename: "removed", Extension: "txt", OriginID: "client"}
+    for _, content := range []string{"first version", "second version", "third version"} {
+        for _, data := range []*datamgmt.Data{kept, removed} {
+            if err := service.StoreData(data, strings.NewReader(content)); err != nil {
+                t.Fatalf("StoreData() error = %v", err)
+            }
+        }
+    }
+    if _, err := service.PruneVersions(kept, 1); err != nil {
+        t.Fatalf("PruneVersions() error = %v", err)
+    }
+    if err := service.DeleteData(removed); err != nil {
+        t.Fatalf("DeleteData() error = %v", err)
+    }
+    counted, err := service.Usage()
+    if err != nil {
+        t.Fatalf("Usage() error = %v", err)
+    }
+    if usage := counted.Origins["client"]; usage.Objects != 1 || usage.Bytes != 13+14+13+14+13 {
+        t.Errorf("Unexpected origin usage %+v", usage)
+    }
+
+    // The counters kept while files changed match those added up from scratch.
+    check := func() {
+        t.Helper()
+        counted, err := service.Usage()
+        if err != nil {
+            t.Fatalf("Usage() error = %v", err)
+        }
+        service.counters = nil
+        walked, err := service.Usage()
+        if err != nil {
+            t.Fatalf("Usage() error = %v", err)
+        }
+        if !reflect.DeepEqual(counted, walked) {
+            t.Errorf("Usage counters %+v do not match the stored files %+v", counted, walked)
+        }
+    }
+    check()
+    if _, err := service.CollectTombstones(0); err != nil {
+        t.Fatalf("CollectTombstones() error = %v", err)
+    }
+    check()
+    if usage := counted.Buckets["photos"]; usage.Objects != 1 || usage.Bytes != 14+13 {
+        t.Errorf("Unexpected bucket usage %+v", usage)
+    }
+}
+
+func TestServer_SyncOverQuota(t *testing.T) {
+    path := filepath.Join(t.TempDir(), "large.bin")
+    if err := os.WriteFile(path, bytes.Repeat([]byte("quota"), 100), 0600); err != nil {
+        t.Fatal(err)
+    }
+    file, err := os.Open(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+
+    receiver := startTestServer(t, "127.0.0.1:3377", nil)
+    receiver.storage.SetQuotas(&QuotaPolicy{Origin: Quota{Bytes: 100}})
+    sender := startTestServer(t, "127.0.0.1:3376", nil)
+
+    data := &datamgmt.Data{ID: "1", Filename: "large", Extension: "bin", OriginID: "client"}
+    err = sender.syncData("127.0.0.1:3377", data, file)
+    var rejected *peerError
+    if !errors.As(err, &rejected) || !strings.Contains(err.Error(), errQuotaExceeded.Error()) {
+        t.Fatalf("Expected a quota exceeded error, got %v", err)
+    }
+    if receiver.storage.HasData(data) {
+        t.Errorf("Expected the file not to be stored")
+    }
+}
+
+func TestServer_StoreChecksDeclaredSize(t *testing.T) {
+    startTestServer(t, "127.0.0.1:3391", nil, func(node *Server) {
+        node.storage.SetQuotas(&QuotaPolicy{Origin: Quota{Bytes: 100}})
+    })
+    client := testClient(t, "")
+
+    // Only the size of the content is sent: the write must be refused without waiting for it.
+    data := &datamgmt.Data{Command: "send", ID: "1", Filename: "large", Extension: "bin", OriginID: "client"}
+    conn, err := client.sendCommand("127.0.0.1:3391", data)
+    if err != nil {
+        t.Fatalf("sendCommand() error = %v", err)
+    }
+    defer conn.Close()
+    writer, err := datamgmt.NewWriteStreamAdapter(conn)
+    if err != nil {
+        t.Fatal(err)
+    }
+    binary.Write(writer.GzipWriter, binary.LittleEndian, uint32(1<<30))
+    writer.GzipWriter.Flush()
+    if _, err := client.readResponse(conn); err == nil || !strings.Contains(err.Error(), errQuotaExceeded.Error()) {
+        t.Errorf("Expected the declared size to be refused, got %v", err)
+    }
+}
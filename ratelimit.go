@@ -0,0 +1,290 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// A node can cap how fast it serves requests and moves data, so that a single aggressive
+// client or peer cannot saturate it. Each limit is a token bucket: requests are limited per
+// identity, or per remote host for callers that are not authenticated, and bytes read and
+// written are limited across all connections and per remote host, on connections the node
+// accepts and those it opens. A caller over its limit is not refused or disconnected; the
+// node waits before reading its next command or moving more of its data, which TCP flow
+// control passes back to the caller. A bucket's debt is capped at its burst, so callers
+// sharing a bucket cannot push it so far into debt that the others stall behind them. The
+// connections open at once from each remote host can be capped too, and those over the
+// cap are refused.
+
+const (
+    throttleChunk   = 32 * 1024 // Most bytes a throttled connection moves at once
+    maxTrackedPeers = 1024      // Buckets kept per limit before idle ones are dropped
+)
+
+// RateLimits configures how fast a node serves requests and moves data. Zero disables a
+// limit.
+type RateLimits struct {
+    RequestRate     float64 // Commands per second per identity
+    RequestBurst    int     // Commands an idle identity may send at once
+    Bandwidth       int64   // Bytes per second read, and written, across all connections
+    PeerBandwidth   int64   // Bytes per second read, and written, per remote host
+    PeerConnections int     // Connections accepted at once per remote host
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate per second.
+type tokenBucket struct {
+    mutex  sync.Mutex
+    rate   float64
+    burst  float64
+    tokens float64
+    last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+    return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes n tokens, running into debt if there are not enough, and returns how long
+// the caller must wait for the debt to be repaid before going ahead. The debt may not grow
+// past a burst: if taking n tokens would, none are taken, and reserve returns false with
+// how long to wait before trying again.
+func (b *tokenBucket) reserve(n float64) (time.Duration, bool) {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+
+    b.refill(time.Now())
+    // A full bucket always lets the caller go ahead, however much it asks for.
+    if b.tokens-n < -b.burst && b.tokens < b.burst {
+        return time.Duration((n - b.burst - b.tokens) / b.rate * float64(time.Second)), false
+    }
+    b.tokens -= n
+    if b.tokens >= 0 {
+        return 0, true
+    }
+    return time.Duration(-b.tokens / b.rate * float64(time.Second)), true
+}
+
+// acquire takes n tokens from the bucket, waiting while its debt is at the cap, and returns
+// how long the caller must then wait. It returns false if quit is closed first.
+func (b *tokenBucket) acquire(n float64, quit <-chan struct{}) (time.Duration, bool) {
+    for {
+        delay, ok := b.reserve(n)
+        if ok {
+            return delay, true
+        }
+        if !pause(delay, quit) {
+            return 0, false
+        }
+    }
+}
+
+// idle reports whether the bucket is full, so dropping it loses nothing.
+func (b *tokenBucket) idle() bool {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+
+    b.refill(time.Now())
+    return b.tokens >= b.burst
+}
+
+// refill adds the tokens accrued since the last refill. The caller must hold the mutex.
+func (b *tokenBucket) refill(now time.Time) {
+    b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+    b.last = now
+}
+
+// limiter enforces a node's rate limits.
+type limiter struct {
+    limits RateLimits
+    read   *tokenBucket // Bytes read across all connections, nil for no limit
+    write  *tokenBucket // Bytes written across all connections, nil for no limit
+
+    mutex       sync.Mutex
+    requests    map[string]*tokenBucket // By identity or remote host
+    peerRead    map[string]*tokenBucket // By remote host
+    peerWrite   map[string]*tokenBucket // By remote host
+    connections map[string]int          // Connections open by remote host
+}
+
+func newLimiter(limits RateLimits) *limiter {
+    l := &limiter{
+        limits:      limits,
+        requests:    make(map[string]*tokenBucket),
+        peerRead:    make(map[string]*tokenBucket),
+        peerWrite:   make(map[string]*tokenBucket),
+        connections: make(map[string]int),
+    }
+    if limits.Bandwidth > 0 {
+        l.read, l.write = newBandwidthBucket(limits.Bandwidth), newBandwidthBucket(limits.Bandwidth)
+    }
+    return l
+}
+
+// newBandwidthBucket returns a bucket of bytes holding a second's worth, and at least
+// enough for the largest single read or write.
+func newBandwidthBucket(rate int64) *tokenBucket {
+    return newTokenBucket(float64(rate), float64(max(rate, throttleChunk)))
+}
+
+// bucket returns the bucket of key in buckets, creating it with create. Once too many are
+// kept, the idle ones are dropped. The caller must hold the mutex.
+func (l *limiter) bucket(buckets map[string]*tokenBucket, key string, create func() *tokenBucket) *tokenBucket {
+    if bucket, ok := buckets[key]; ok {
+        return bucket
+    }
+    if len(buckets) >= maxTrackedPeers {
+        for other, bucket := range buckets {
+            if bucket.idle() {
+                delete(buckets, other)
+            }
+        }
+    }
+    bucket := create()
+    buckets[key] = bucket
+    return bucket
+}
+
+// waitRequest waits until key may send another command, returning false if quit is closed
+// first. Identities are limited separately, and unauthenticated callers by remote host.
+func (l *limiter) waitRequest(key string, quit <-chan struct{}) bool {
+    if l.limits.RequestRate <= 0 {
+        return true
+    }
+    l.mutex.Lock()
+    bucket := l.bucket(l.requests, key, func() *tokenBucket {
+        return newTokenBucket(l.limits.RequestRate, float64(max(l.limits.RequestBurst, 1)))
+    })
+    l.mutex.Unlock()
+    delay, ok := bucket.acquire(1, quit)
+    return ok && pause(delay, quit)
+}
+
+// admit counts a connection accepted from conn's host, returning false if the host already
+// has as many open as the limit allows. An admitted connection must be released.
+func (l *limiter) admit(conn net.Conn) bool {
+    if l.limits.PeerConnections <= 0 {
+        return true
+    }
+    host := remoteHost(conn)
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    if l.connections[host] >= l.limits.PeerConnections {
+        return false
+    }
+    l.connections[host]++
+    return true
+}
+
+// release uncounts a connection admitted from conn's host.
+func (l *limiter) release(conn net.Conn) {
+    if l.limits.PeerConnections <= 0 {
+        return
+    }
+    host := remoteHost(conn)
+    l.mutex.Lock()
+    defer l.mutex.Unlock()
+    if l.connections[host]--; l.connections[host] <= 0 {
+        delete(l.connections, host)
+    }
+}
+
+// throttle returns conn limited to the node's bandwidth, if it has bandwidth limits. Its
+// reads and writes wait rather than fail when over the limit, until quit is closed.
+func (l *limiter) throttle(conn net.Conn, quit <-chan struct{}) net.Conn {
+    var read, write []*tokenBucket
+    if l.read != nil {
+        read, write = append(read, l.read), append(write, l.write)
+    }
+    if l.limits.PeerBandwidth > 0 {
+        host := remoteHost(conn)
+        create := func() *tokenBucket { return newBandwidthBucket(l.limits.PeerBandwidth) }
+        l.mutex.Lock()
+        read = append(read, l.bucket(l.peerRead, host, create))
+        write = append(write, l.bucket(l.peerWrite, host, create))
+        l.mutex.Unlock()
+    }
+    if len(read) == 0 {
+        return conn
+    }
+    return &throttledConn{Conn: conn, read: read, write: write, quit: quit}
+}
+
+// throttledConn waits after each read and write until the bytes it moved fit its buckets.
+type throttledConn struct {
+    net.Conn
+    read  []*tokenBucket
+    write []*tokenBucket
+    quit  <-chan struct{}
+}
+
+func (c *throttledConn) Read(p []byte) (int, error) {
+    n, err := c.Conn.Read(p[:min(len(p), throttleChunk)])
+    if n > 0 && !c.wait(c.read, n) && err == nil {
+        err = net.ErrClosed
+    }
+    return n, err
+}
+
+func (c *throttledConn) Write(p []byte) (int, error) {
+    written := 0
+    for written < len(p) {
+        n, err := c.Conn.Write(p[written:min(len(p), written+throttleChunk)])
+        written += n
+        if err != nil {
+            return written, err
+        }
+        if !c.wait(c.write, n) {
+            return written, net.ErrClosed
+        }
+    }
+    return written, nil
+}
+
+// wait takes n bytes from every bucket and waits for the longest of their debts, returning
+// false if the node shuts down first.
+func (c *throttledConn) wait(buckets []*tokenBucket, n int) bool {
+    var delay time.Duration
+    for _, bucket := range buckets {
+        wait, ok := bucket.acquire(float64(n), c.quit)
+        if !ok {
+            return false
+        }
+        delay = max(delay, wait)
+    }
+    return pause(delay, c.quit)
+}
+
+// pause waits for delay, returning false if quit is closed first.
+func pause(delay time.Duration, quit <-chan struct{}) bool {
+    if delay <= 0 {
+        return true
+    }
+    timer := time.NewTimer(delay)
+    defer timer.Stop()
+    select {
+    case <-timer.C:
+        return true
+    case <-quit:
+        return false
+    }
+}
+
+// remoteHost returns the host a connection is to, without its port.
+func remoteHost(conn net.Conn) string {
+    address := conn.RemoteAddr().String()
+    host, _, err := net.SplitHostPort(address)
+    if err != nil {
+        return address
+    }
+    return host
+}
+
+// requestKey returns what the requests of a caller are limited by: its identity, or the
+// host it connects from if it is not authenticated.
+func requestKey(identity string, conn net.Conn) string {
+    if identity == anonymous {
+        return "host:" + remoteHost(conn)
+    }
+    return identity
+}
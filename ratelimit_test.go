@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+)
+
+func TestTokenBucket_Reserve(t *testing.T) {
+    bucket := newTokenBucket(100, 50)
+    if delay, ok := bucket.reserve(50); !ok || delay != 0 {
+        t.Errorf("Expected a full bucket to cover its burst, got a delay of %v", delay)
+    }
+    // Going into debt makes the caller wait for the tokens to accrue.
+    if delay, ok := bucket.reserve(25); !ok || delay < 200*time.Millisecond || delay > 250*time.Millisecond {
+        t.Errorf("Expected to wait about a quarter of a second, got %v", delay)
+    }
+    if bucket.idle() {
+        t.Errorf("Expected a bucket in debt not to be idle")
+    }
+    // The debt stops at a burst, and a caller that would go past it takes nothing.
+    if delay, ok := bucket.reserve(50); ok || delay < 200*time.Millisecond || delay > 250*time.Millisecond {
+        t.Errorf("Expected to be told to retry in about a quarter of a second, got %v, %v", delay, ok)
+    }
+    if delay, ok := bucket.reserve(25); !ok || delay > 500*time.Millisecond {
+        t.Errorf("Expected the refused tokens to be left in the bucket, got a delay of %v", delay)
+    }
+}
+
+func TestServer_RateLimits(t *testing.T) {
+    node := startTestServer(t, "127.0.0.1:3386", nil, func(node *Server) {
+        node.SetRateLimits(RateLimits{RequestRate: 10, RequestBurst: 1, PeerBandwidth: 256 * 1024})
+    })
+    client := testClient(t, "")
+
+    // Requests over the rate wait their turn rather than fail.
+    start := time.Now()
+    for i := 0; i < 5; i++ {
+        if _, err := client.requestUsage("127.0.0.1:3386"); err != nil {
+            t.Fatalf("requestUsage() error = %v", err)
+        }
+    }
+    if elapsed := time.Since(start); elapsed < 350*time.Millisecond {
+        t.Errorf("Expected requests to be held to 10 per second, 5 took %v", elapsed)
+    }
+
+    // A burst of the bandwidth is sent at once, and the rest at the peer's rate.
+    content := make([]byte, 512*1024)
+    if _, err := rand.Read(content); err != nil {
+        t.Fatal(err)
+    }
+    path := filepath.Join(t.TempDir(), "large.bin")
+    os.WriteFile(path, content, 0600)
+    file, err := os.Open(path)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer file.Close()
+    data := &datamgmt.Data{ID: "1", Filename: "large", Extension: "bin"}
+    start = time.Now()
+    if err := client.syncData("127.0.0.1:3386", data, file); err != nil {
+        t.Fatalf("syncData() error = %v", err)
+    }
+    if elapsed := time.Since(start); elapsed < 700*time.Millisecond {
+        t.Errorf("Expected the upload to be throttled to 256K per second, it took %v", elapsed)
+    }
+    if stored := readStored(t, node.storage, data); !bytes.Equal(stored, content) {
+        t.Errorf("Expected the throttled upload to arrive intact")
+    }
+}
+
+func TestServer_PeerConnections(t *testing.T) {
+    startTestServer(t, "127.0.0.1:3390", nil, func(node *Server) {
+        node.SetRateLimits(RateLimits{PeerConnections: 1})
+    })
+    client := testClient(t, "")
+
+    // A connection left in the handshake holds the host's only slot.
+    held, err := net.Dial("tcp", "127.0.0.1:3390")
+    if err != nil {
+        t.Fatal(err)
+    }
+    var challenge authChallenge
+    if err := datamgmt.ReadEncodedData(held, &challenge); err != nil {
+        t.Fatalf("ReadEncodedData() error = %v", err)
+    }
+    if _, err := client.requestUsage("127.0.0.1:3390"); err == nil {
+        t.Errorf("Expected a second connection from the host to be refused")
+    }
+    held.Close()
+    for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(20 * time.Millisecond) {
+        if _, err = client.requestUsage("127.0.0.1:3390"); err == nil || time.Now().After(deadline) {
+            break
+        }
+    }
+    if err != nil {
+        t.Errorf("Expected the host to be served once its connection closed, got %v", err)
+    }
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/encryption"
+	"github.com/tejasprabhu/GopherStore/logger"
+)
+
+const (
+	quarantineDirName    = "quarantine"
+	defaultScrubInterval = 24 * time.Hour
+	scrubBytesPerSecond  = 16 << 20
+)
+
+var errScrubStopped = errors.New("scrub stopped")
+
+// ScrubReport summarises one or more scrub passes over the storage root.
+type ScrubReport struct {
+    Passes        int   // Scrub passes run
+    Objects       int   // Files verified
+    Chunks        int   // Chunks checked against their hash
+    Bytes         int64 // Bytes read while verifying
+    CorruptChunks int   // Chunks quarantined because they are missing or fail hash verification
+    Corrupt       int   // Files quarantined because their content no longer matches their manifest
+    Repaired      int   // Quarantined files restored from a replica
+}
+
+// add counts the passes of other in r.
+func (r *ScrubReport) add(other ScrubReport) {
+    r.Passes += other.Passes
+    r.Objects += other.Objects
+    r.Chunks += other.Chunks
+    r.Bytes += other.Bytes
+    r.CorruptChunks += other.CorruptChunks
+    r.Corrupt += other.Corrupt
+    r.Repaired += other.Repaired
+}
+
+// scrubResult describes what verifying a single stored file found.
+type scrubResult struct {
+    manifest    *Manifest
+    chunks      int // Chunks checked
+    bytes       int64
+    badChunks   []string // Chunks that are missing or fail hash verification
+    badChecksum bool     // The chunks are intact but do not reproduce the recorded checksum
+}
+
+func (r *scrubResult) corrupt() bool {
+    return len(r.badChunks) > 0 || r.badChecksum
+}
+
+// scrubLoop periodically scrubs the storage root until the server shuts down.
+func (s *Server) scrubLoop() {
+    defer s.wg.Done()
+    if s.scrubInterval <= 0 {
+        return
+    }
+    ticker := time.NewTicker(s.scrubInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-s.quit:
+            return
+        case <-ticker.C:
+            s.scrub()
+        }
+    }
+}
+
+// scrub re-verifies every stored file, and every older version of it, against its manifest,
+// reading at most scrubBytesPerSecond so it does not starve regular traffic. Corrupt files
+// are quarantined and, when another peer holds a replica, fetched again from it with the
+// clock, owner and grants they had. Version IDs are local to a node, so a corrupt older
+// version is quarantined but cannot be fetched again.
+func (s *Server) scrub() ScrubReport {
+    report := ScrubReport{Passes: 1}
+    defer s.recordScrub(&report)
+    paths, err := s.storage.ManifestPaths()
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to list stored files for scrubbing")
+        return report
+    }
+
+    throttle := newThrottle(scrubBytesPerSecond, s.quit)
+    for _, path := range paths {
+        result, err := s.storage.verifyObject(path, throttle)
+        if errors.Is(err, errScrubStopped) {
+            break
+        }
+        if err != nil {
+            // The file was replaced or removed while it was being scrubbed, or could not
+            // be read at all; neither says anything about its integrity.
+            logger.Log.WithError(err).WithField("path", path).Debug("Skipping file during scrub")
+            continue
+        }
+        report.Objects++
+        report.Chunks += result.chunks
+        report.Bytes += result.bytes
+        if !result.corrupt() {
+            continue
+        }
+
+        data := manifestData(result.manifest)
+        if !s.storage.quarantineObject(path, result) {
+            continue
+        }
+        report.Corrupt++
+        report.CorruptChunks += len(result.badChunks)
+        logger.Log.WithFields(map[string]interface{}{
+            "key":        data.Key(),
+            "version":    result.manifest.VersionID,
+            "bad_chunks": result.badChunks,
+        }).Error("Corrupt object quarantined")
+        if s.storage.isVersionPath(path) {
+            continue
+        }
+
+        s.dht.RemoveProvider(data.Key(), s.dht.Self().ID)
+        manifest := result.manifest
+        data.Clock, data.ModifiedAt, data.ExpiresAt, data.Tags = manifest.Clock, manifest.ModifiedAt, manifest.ExpiresAt, manifest.Tags
+        if err := s.repairObject(data); err != nil {
+            logger.Log.WithError(err).WithField("key", data.Key()).Warn("Failed to repair corrupt object")
+            continue
+        }
+        report.Repaired++
+        logger.Log.WithField("key", data.Key()).Info("Corrupt object repaired from a replica")
+    }
+
+    logger.Log.WithFields(map[string]interface{}{
+        "objects":        report.Objects,
+        "chunks":         report.Chunks,
+        "bytes":          report.Bytes,
+        "corrupt":        report.Corrupt,
+        "corrupt_chunks": report.CorruptChunks,
+        "repaired":       report.Repaired,
+    }).Info("Scrub pass complete")
+    return report
+}
+
+// recordScrub adds a scrub pass to the totals reported with the node's usage.
+func (s *Server) recordScrub(report *ScrubReport) {
+    s.scrubMutex.Lock()
+    defer s.scrubMutex.Unlock()
+    s.scrubTotals.add(*report)
+}
+
+// ScrubTotals returns what the scrub passes since the server started found.
+func (s *Server) ScrubTotals() ScrubReport {
+    s.scrubMutex.Lock()
+    defer s.scrubMutex.Unlock()
+    return s.scrubTotals
+}
+
+// repairObject fetches a good copy of a quarantined file from the peers that hold it. The
+// copy must match the checksum recorded when the file was first stored, and takes the owner
+// and grants of the quarantined manifest when it is written.
+func (s *Server) repairObject(data *datamgmt.Data) error {
+    sources, err := s.locateProviders(data)
+    if err != nil {
+        return err
+    }
+    if len(sources) == 0 {
+        return errors.New("no replica available")
+    }
+    return s.swarmFetch(data, sources)
+}
+
+// manifestData returns the metadata a file was stored with.
+func manifestData(manifest *Manifest) *datamgmt.Data {
+    return &datamgmt.Data{
+        ID:        manifest.ID,
+        Filename:  manifest.Filename,
+        Extension: manifest.Extension,
+        OriginID:  manifest.OriginID,
+        Checksum:  manifest.Checksum,
+        Bucket:    manifest.Bucket,
+    }
+}
+
+// ManifestPaths lists the manifests of all stored files that have not been deleted,
+// followed by those of their older versions.
+func (s *StorageService) ManifestPaths() ([]string, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    var paths []string
+    list := func(path string, manifest *Manifest) error {
+        if !manifest.Deleted {
+            paths = append(paths, path)
+        }
+        return nil
+    }
+    err := s.walkManifests(list)
+    if err == nil {
+        err = s.walkVersions(list)
+    }
+    return paths, err
+}
+
+// verifyObject re-reads the file recorded at path, checking every chunk against its hash
+// and the whole file against the manifest checksum. Chunks are immutable, so they are read
+// without holding the mutex; quarantineObject confirms any finding under the mutex.
+func (s *StorageService) verifyObject(path string, throttle *throttle) (*scrubResult, error) {
+    s.mutex.Lock()
+    manifest, err := s.loadManifest(path)
+    s.mutex.Unlock()
+    if err != nil {
+        return nil, err
+    }
+
+    result := &scrubResult{manifest: manifest}
+    hasher := datamgmt.NewChecksum()
+    for _, ref := range manifest.Chunks {
+        chunk, err := s.readChunk(ref.Hash)
+        if err != nil && !isChunkDamaged(err) {
+            return nil, err
+        }
+        if err := throttle.wait(len(chunk)); err != nil {
+            return nil, err
+        }
+        result.chunks++
+        result.bytes += int64(len(chunk))
+        if err != nil || datamgmt.HashChunk(chunk) != ref.Hash {
+            result.badChunks = append(result.badChunks, ref.Hash)
+            continue
+        }
+        hasher.Write(chunk)
+    }
+
+    checksum := hex.EncodeToString(hasher.Sum(nil))
+    if len(result.badChunks) == 0 && manifest.Checksum != "" && checksum != manifest.Checksum {
+        result.badChecksum = true
+    }
+    return result, nil
+}
+
+// isChunkDamaged reports whether an error reading a chunk means the chunk itself is bad,
+// rather than e.g. the master key being unavailable.
+func isChunkDamaged(err error) bool {
+    return errors.Is(err, fs.ErrNotExist) || errors.Is(err, encryption.ErrAuthFailed)
+}
+
+// quarantineObject moves a corrupt file's manifest and its bad chunks out of the store,
+// keeping them under the quarantine directory for inspection. It reports false if the
+// corruption could not be confirmed, e.g. because the file was replaced meanwhile.
+func (s *StorageService) quarantineObject(path string, result *scrubResult) bool {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    manifest, err := s.loadManifest(path)
+    if err != nil || !manifest.CreatedAt.Equal(result.manifest.CreatedAt) {
+        return false
+    }
+
+    var confirmed []string
+    for _, hash := range result.badChunks {
+        chunk, err := s.readChunk(hash)
+        if err == nil && datamgmt.HashChunk(chunk) == hash {
+            continue
+        }
+        if err != nil && !isChunkDamaged(err) {
+            return false
+        }
+        confirmed = append(confirmed, hash)
+    }
+    if len(confirmed) == 0 && !result.badChecksum {
+        return false
+    }
+    result.badChunks = confirmed
+    for _, hash := range confirmed {
+        if s.hasChunk(hash) {
+            s.moveToQuarantine(s.chunkPath(hash))
+        }
+    }
+
+    if err := s.moveToQuarantine(path); err != nil {
+        return false
+    }
+    s.trackUsage(path, nil)
+    s.collectChunks(manifest.Chunks)
+    return true
+}
+
+// quarantinePath returns where the file at path is kept once quarantined.
+func (s *StorageService) quarantinePath(path string) (string, error) {
+    relative, err := filepath.Rel(s.rootPath, path)
+    if err != nil {
+        return "", err
+    }
+    return filepath.Join(s.rootPath, quarantineDirName, relative), nil
+}
+
+// quarantinedManifest returns the manifest last quarantined from path, if any. The caller
+// must hold the mutex.
+func (s *StorageService) quarantinedManifest(path string) *Manifest {
+    target, err := s.quarantinePath(path)
+    if err != nil {
+        return nil
+    }
+    manifest, err := s.loadManifest(target)
+    if err != nil {
+        return nil
+    }
+    return manifest
+}
+
+// moveToQuarantine moves a file under the quarantine directory, keeping its path relative
+// to the storage root. The caller must hold the mutex.
+func (s *StorageService) moveToQuarantine(path string) error {
+    target, err := s.quarantinePath(path)
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(filepath.Dir(target), 0740); err != nil {
+        logger.Log.WithError(err).Error("Error creating quarantine directory")
+        return err
+    }
+    if err := os.Rename(path, target); err != nil {
+        logger.Log.WithError(err).WithField("path", path).Error("Error quarantining file")
+        return err
+    }
+    return nil
+}
+
+// throttle limits the rate at which a scrub pass reads data.
+type throttle struct {
+    rate  int64
+    start time.Time
+    total int64
+    quit  <-chan struct{}
+}
+
+func newThrottle(bytesPerSecond int64, quit <-chan struct{}) *throttle {
+    return &throttle{rate: bytesPerSecond, start: time.Now(), quit: quit}
+}
+
+// wait accounts for n more bytes read, sleeping until the average rate is back under the
+// limit. It returns errScrubStopped if the server shuts down meanwhile.
+func (t *throttle) wait(n int) error {
+    t.total += int64(n)
+    due := time.Duration(float64(t.total) / float64(t.rate) * float64(time.Second))
+    delay := due - time.Since(t.start)
+    if delay <= 0 {
+        select {
+        case <-t.quit:
+            return errScrubStopped
+        default:
+            return nil
+        }
+    }
+    select {
+    case <-t.quit:
+        return errScrubStopped
+    case <-time.After(delay):
+        return nil
+    }
+}
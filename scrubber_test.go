@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+)
+
+// corruptStoredChunk flips a byte in the first chunk of the test object stored by server.
+func corruptStoredChunk(t *testing.T, server *Server) {
+    path, _ := server.storage.generateFilePath(&datamgmt.Data{ID: "1", Filename: "swarm", Extension: "bin"})
+    manifest, err := server.storage.loadManifest(path)
+    if err != nil {
+        t.Fatalf("loadManifest() error = %v", err)
+    }
+    chunkPath := server.storage.chunkPath(manifest.Chunks[0].Hash)
+    chunk, err := os.ReadFile(chunkPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    chunk[0] ^= 0xff
+    if err := os.WriteFile(chunkPath, chunk, 0640); err != nil {
+        t.Fatal(err)
+    }
+}
+
+func TestServer_ScrubQuarantinesCorruptObject(t *testing.T) {
+    content := make([]byte, 200000)
+    if _, err := rand.Read(content); err != nil {
+        t.Fatal(err)
+    }
+    server := startTestServer(t, "127.0.0.1:3350", content)
+    corruptStoredChunk(t, server)
+
+    report := server.scrub()
+    if report.Objects != 1 || report.Chunks == 0 || report.CorruptChunks != 1 || report.Corrupt != 1 || report.Repaired != 0 {
+        t.Fatalf("Unexpected scrub report %+v", report)
+    }
+
+    data := &datamgmt.Data{ID: "1", Filename: "swarm", Extension: "bin"}
+    if _, err := server.storage.ReadData(data); err == nil {
+        t.Errorf("Corrupt object is still served")
+    }
+    path, _ := server.storage.generateFilePath(data)
+    relative, _ := filepath.Rel(server.storage.rootPath, path)
+    if _, err := os.Stat(filepath.Join(server.storage.rootPath, quarantineDirName, relative)); err != nil {
+        t.Errorf("Manifest was not quarantined: %v", err)
+    }
+
+    if report := server.scrub(); report.Objects != 0 || report.Corrupt != 0 {
+        t.Errorf("Quarantined object was scrubbed again: %+v", report)
+    }
+}
+
+func TestServer_ScrubRepairsFromReplica(t *testing.T) {
+    content := make([]byte, 200000)
+    if _, err := rand.Read(content); err != nil {
+        t.Fatal(err)
+    }
+    server := startTestServer(t, "127.0.0.1:3351", content)
+    replica := startTestServer(t, "127.0.0.1:3352", content)
+    if err := server.dht.Bootstrap([]string{"127.0.0.1:3352"}); err != nil {
+        t.Fatalf("Bootstrap() error = %v", err)
+    }
+    replica.announce(&datamgmt.Data{ID: "1", Filename: "swarm", Extension: "bin"})
+    stored := &datamgmt.Data{ID: "1", Filename: "swarm", Extension: "bin"}
+    grants := map[string][]datamgmt.Permission{"client:bob": {datamgmt.PermRead}}
+    if err := server.storage.SetGrants(stored, grants); err != nil {
+        t.Fatalf("SetGrants() error = %v", err)
+    }
+    path, _ := server.storage.generateFilePath(stored)
+    original, err := server.storage.loadManifest(path)
+    if err != nil {
+        t.Fatalf("loadManifest() error = %v", err)
+    }
+    corruptStoredChunk(t, server)
+
+    report := server.scrub()
+    if report.Corrupt != 1 || report.Repaired != 1 {
+        t.Fatalf("Unexpected scrub report %+v", report)
+    }
+    if result := readStored(t, server.storage, &datamgmt.Data{ID: "1", Filename: "swarm", Extension: "bin"}); !bytes.Equal(result, content) {
+        t.Errorf("Repaired content does not match the original")
+    }
+    // The repaired file keeps the owner, grants and clock it had before it was quarantined.
+    repaired, err := server.storage.loadManifest(path)
+    if err != nil {
+        t.Fatalf("loadManifest() error = %v", err)
+    }
+    if repaired.ACL.Owner != original.ACL.Owner || len(repaired.ACL.Grants["client:bob"]) != 1 {
+        t.Errorf("Expected the repaired file to keep its ACL %+v, got %+v", original.ACL, repaired.ACL)
+    }
+    if repaired.Clock.Compare(original.Clock) != datamgmt.Equal {
+        t.Errorf("Expected the repaired file to keep its clock %v, got %v", original.Clock, repaired.Clock)
+    }
+    second := server.scrub()
+    if second.Objects != 1 || second.Corrupt != 0 {
+        t.Errorf("Repaired object failed verification: %+v", second)
+    }
+
+    // The totals of both passes are reported with the node's usage.
+    client := NewServer("127.0.0.1:0")
+    t.Cleanup(func() { os.RemoveAll(client.storage.rootPath) })
+    usage, err := client.requestUsage("127.0.0.1:3351")
+    if err != nil {
+        t.Fatalf("requestUsage() error = %v", err)
+    }
+    totals := usage.Scrub
+    if totals.Passes != 2 || totals.Chunks != report.Chunks+second.Chunks || totals.CorruptChunks != 1 || totals.Corrupt != 1 || totals.Repaired != 1 {
+        t.Errorf("Unexpected scrub totals %+v", totals)
+    }
+}
+
+func TestServer_ScrubQuarantinesCorruptVersion(t *testing.T) {
+    server := startTestServer(t, "127.0.0.1:3392", []byte("swarm content"))
+    if err := server.storage.CreateBucket(&datamgmt.Bucket{Name: "history", Versioned: true}); err != nil {
+        t.Fatalf("CreateBucket() error = %v", err)
+    }
+    data := &datamgmt.Data{ID: "1", Filename: "notes", Extension: "txt", Bucket: "history"}
+    for _, content := range []string{"first draft", "second draft"} {
+        if err := server.storage.StoreData(data, bytes.NewReader([]byte(content))); err != nil {
+            t.Fatalf("StoreData() error = %v", err)
+        }
+    }
+    versions, err := server.storage.Versions(data)
+    if err != nil || len(versions) != 2 {
+        t.Fatalf("Versions() = %v, %v", versions, err)
+    }
+    path, _ := server.storage.generateFilePath(data)
+    archived, err := server.storage.loadVersion(path, versions[1].VersionID)
+    if err != nil {
+        t.Fatalf("loadVersion() error = %v", err)
+    }
+    chunkPath := server.storage.chunkPath(archived.Chunks[0].Hash)
+    chunk, err := os.ReadFile(chunkPath)
+    if err != nil {
+        t.Fatal(err)
+    }
+    chunk[0] ^= 0xff
+    if err := os.WriteFile(chunkPath, chunk, 0640); err != nil {
+        t.Fatal(err)
+    }
+
+    // The older version is quarantined, and the latest one is left alone.
+    report := server.scrub()
+    if report.Objects != 3 || report.Corrupt != 1 || report.Repaired != 0 {
+        t.Fatalf("Unexpected scrub report %+v", report)
+    }
+    if versions, _ := server.storage.Versions(data); len(versions) != 1 || !versions[0].Latest {
+        t.Errorf("Expected only the latest version to remain, got %+v", versions)
+    }
+    if content := readStored(t, server.storage, data); string(content) != "second draft" {
+        t.Errorf("Expected the latest version to be served, got %q", content)
+    }
+}
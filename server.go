@@ -2,31 +2,73 @@ package main
 
 import (
     "bytes"
+    "errors"
     "encoding/gob"
     "io"
     "net"
     "sync"
+    "time"
 
     "github.com/tejasprabhu/GopherStore/datamgmt"
+    "github.com/tejasprabhu/GopherStore/encryption"
     "github.com/tejasprabhu/GopherStore/logger"
     "github.com/tejasprabhu/GopherStore/p2p"
 )
 
+const requestTimeout = 30 * time.Second
+
 type Server struct {
     transport *p2p.TCPTransport
     storage   *StorageService
+    dht       *p2p.DHT
     wg        sync.WaitGroup
     quit      chan struct{}
+
+    scrubInterval  time.Duration // Time between scrub passes, zero disabling the scrubber
+    repairInterval time.Duration // Time between shard repair passes, zero disabling them
+    tombstoneGrace time.Duration // How long deleted files keep their tombstones, zero keeping them forever
+    scrubMutex     sync.Mutex
+    scrubTotals    ScrubReport // Everything the scrub passes since the server started found
+
+    lifecycle         *LifecyclePolicy // Rules applied to stored files, if any
+    lifecycleInterval time.Duration    // Time between lifecycle passes
+    demoteAfter       time.Duration    // How long files go unread before moving to the cold tier
+    spaceLevel        int              // How many low space warnings the free space is past
+    keystore      *encryption.Keystore
+    nodeKey       []byte // Private node key the node authenticates to peers with, if any
+    publicKey     []byte // Public node key the node ID is derived from, if any
+
+    credentials *Credentials // Clients and peers allowed to connect, nil to serve anyone
+    token       string       // API token the node authenticates to peers with, if any
+    capabilityKey []byte     // Key capabilities are signed with, nil to use the node's own
+    audit         *AuditLog  // Log every handled command is recorded in, if any
+    limiter       *limiter   // Request and bandwidth limits, set before the server starts
 }
 
 func NewServer(address string) *Server {
     storageService := NewStorageService(address)
     transport := p2p.NewTCPTransport(address)
-    return &Server{
+    server := &Server{
         transport: transport,
         storage:   storageService,
         quit:      make(chan struct{}),
+        limiter:   newLimiter(RateLimits{}),
+
+        scrubInterval:  defaultScrubInterval,
+        repairInterval: defaultRepairInterval,
+        tombstoneGrace: defaultTombstoneGrace,
+
+        lifecycleInterval: defaultLifecycleInterval,
+        demoteAfter:       defaultDemoteAfter,
     }
+    server.dht = p2p.NewDHT(p2p.Contact{ID: p2p.NewRandomNodeID(), Address: address}, server.dhtRPC)
+    return server
+}
+
+// SetRateLimits limits how fast the server serves requests and moves data. It must be
+// called before the server starts.
+func (s *Server) SetRateLimits(limits RateLimits) {
+    s.limiter = newLimiter(limits)
 }
 
 func (s *Server) Start() error {
@@ -35,8 +77,16 @@ func (s *Server) Start() error {
         logger.Log.WithError(err).Fatal("Failed to start server")
         return err
     }
-    s.wg.Add(1)
+    s.wg.Add(9)
     go s.handleConnections()
+    go s.scrubLoop()
+    go s.repairLoop()
+    go s.tombstoneLoop()
+    go s.expiryLoop()
+    go s.lifecycleLoop()
+    go s.tieringLoop()
+    go s.diskLoop()
+    go s.republishLoop()
     return nil
 }
 
@@ -46,10 +96,16 @@ func (s *Server) Shutdown() {
         logger.Log.WithError(err).Error("Failed to close connection")
     }
     s.wg.Wait()
+    if s.audit != nil {
+        if err := s.audit.Close(); err != nil {
+            logger.Log.WithError(err).Error("Failed to close audit log")
+        }
+    }
     logger.Log.Info("Server shut down.")
 }
 
 func (s *Server) handleConnections() {
+    defer s.wg.Done()
     for {
         select {
         case <-s.quit:
@@ -65,8 +121,37 @@ func (s *Server) handleConnections() {
 }
 
 func (s *Server) handleConnection(conn net.Conn) {
+    defer s.wg.Done()
     logger.Log.WithField("address", conn.RemoteAddr().String()).Info("Handling connection")
     defer conn.Close()
+    if !s.limiter.admit(conn) {
+        logger.Log.WithField("address", conn.RemoteAddr().String()).Warn("Refusing connection over the per-host limit")
+        return
+    }
+    defer s.limiter.release(conn)
+    conn = s.limiter.throttle(conn, s.quit)
+    counted := &countingConn{Conn: conn}
+    conn = counted
+
+    // No command is read from a caller that fails to authenticate.
+    caller, secured, err := s.authenticate(conn)
+    if err != nil {
+        logger.Log.WithError(err).WithField("address", conn.RemoteAddr().String()).Warn("Rejecting unauthenticated connection")
+        s.auditCommand("", "authenticate", &datamgmt.Data{}, err, counted, 0, 0)
+        return
+    }
+    conn = secured
+
+    // Unblock the read loop when the server shuts down.
+    done := make(chan struct{})
+    defer close(done)
+    go func() {
+        select {
+        case <-s.quit:
+            conn.Close()
+        case <-done:
+        }
+    }()
     adapter, err := datamgmt.NewReadStreamAdapter(conn)
     if err != nil {
         logger.Log.WithError(err).Error("Failed to create stream adapter")
@@ -75,15 +160,20 @@ func (s *Server) handleConnection(conn net.Conn) {
     defer adapter.Close()
 
     for {
+        // A caller over its request rate is made to wait rather than refused.
+        if !s.limiter.waitRequest(requestKey(caller.identity, conn), s.quit) {
+            break
+        }
+        read, written := counted.read.Load(), counted.written.Load()
         metadata, err := datamgmt.ReadLengthPrefixedData(adapter.GzipReader)
         if err != nil {
             if err == io.EOF {
                 logger.Log.Info("EOF reached, closing connection")
-                break
             } else {
-                logger.Log.WithError(err).Error("Error reading metadata")
-                continue
+                // The stream cannot recover from a failed read, e.g. a dropped connection.
+                logger.Log.WithError(err).Error("Error reading metadata, closing connection")
             }
+            break
         }
 
         var data datamgmt.Data
@@ -95,57 +185,193 @@ func (s *Server) handleConnection(conn net.Conn) {
         logger.Log.WithFields(map[string]interface{}{
             "command": data.Command, 
             "filename": data.Filename,
+            "identity": caller.identity,
         }).Info("Received command")
 
-        switch data.Command {
+        // Handlers may reuse data for their replies, so the command is kept as received.
+        command := data.Command
+
+        // A refused command's payload is never read, so the connection cannot go on.
+        if err := s.authorize(caller, &data); err != nil {
+            logger.Log.WithError(err).WithField("identity", caller.identity).Warn("Refusing command")
+            s.respond(conn, &data, err)
+            s.auditCommand(caller.identity, command, &data, err, counted, read, written)
+            break
+        }
+
+        switch command {
         case "send":
-            s.handleStoreCommand(&data, adapter)
+            err = s.handleStoreCommand(&data, adapter, conn)
         case "fetch":
-            s.fetchData(&data, conn)
+            err = s.fetchData(&data, conn)
+        case "stat":
+            err = s.statData(&data, conn)
+        case "sync":
+            err = s.handleSyncCommand(caller.identity, &data, adapter, conn)
+        case "status":
+            err = s.handleStatusCommand(&data, conn)
         case "delete":
-            s.deleteData(&data)
+            err = s.deleteData(&data)
+        case "versions":
+            err = s.handleVersionsCommand(caller, &data, conn)
+        case "dht":
+            err = s.handleDHTCommand(caller.identity, adapter, conn)
+        case "identity":
+            err = s.handleIdentityCommand(&data, conn)
+        case "grant":
+            err = s.handleGrantCommand(&data, adapter, conn)
+        case "usage":
+            err = s.handleUsageCommand(caller.identity, &data, conn)
+        case "create-bucket":
+            err = s.handleCreateBucketCommand(&data, conn)
+        case "list-buckets":
+            err = s.handleListBucketsCommand(caller.identity, &data, conn)
+        case "delete-bucket":
+            err = s.handleDeleteBucketCommand(&data, conn)
+        case "set-acl":
+            err = s.handleSetACLCommand(caller.identity, &data, conn)
+        case "capability":
+            err = s.handleCapabilityCommand(caller.identity, &data, conn)
         default:
-            logger.Log.WithField("command", data.Command).Warn("Invalid command received")
+            logger.Log.WithField("command", command).Warn("Invalid command received")
+            err = errors.New("invalid command")
         }
+        s.auditCommand(caller.identity, command, &data, err, counted, read, written)
     }
 }
 
-func (s *Server) handleStoreCommand(data *datamgmt.Data, adapter *datamgmt.StreamAdapter) {
-    content, err := datamgmt.ReadLengthPrefixedData(adapter.GzipReader)
+// handleStoreCommand stores an object sent as a single stream. The size the stream declares
+// is admitted before its content is read, the stream's trailer and the checksum in the
+// metadata are both verified before the object is committed, and the sender is told whether
+// it was stored.
+func (s *Server) handleStoreCommand(data *datamgmt.Data, adapter *datamgmt.StreamAdapter, conn net.Conn) error {
+    size, err := datamgmt.ReadStreamSize(adapter.GzipReader)
     if err != nil {
+        return err
+    }
+    release, err := s.admitWrite(data, size)
+    if err != nil {
+        // The content is skipped without being kept, so the next command can be read.
+        err = s.respond(conn, data, err)
+        datamgmt.ReadStreamContent(adapter.GzipReader, io.Discard, size)
+        return err
+    }
+    defer release()
+
+    var content bytes.Buffer
+    if _, err := datamgmt.ReadStreamContent(adapter.GzipReader, &content, size); err != nil {
         logger.Log.WithError(err).Error("Failed to read data content")
-        return
+        if errors.Is(err, datamgmt.ErrChecksumMismatch) {
+            return s.respond(conn, data, err)
+        }
+        return err
     }
-    byteContent := bytes.NewReader(content)
-    if err := s.storage.StoreData(data, byteContent); err != nil {
+    if err := s.storage.StoreData(data, &content); err != nil {
         logger.Log.WithError(err).Error("Failed to store data")
+        return s.respond(conn, data, err)
     }
+    if err := s.respond(conn, data, nil); err != nil {
+        return err
+    }
+    go s.announce(data)
+    go s.replicate(data)
+    return nil
 }
 
-func (s *Server) fetchData(data *datamgmt.Data, conn net.Conn) {
+func (s *Server) fetchData(data *datamgmt.Data, conn net.Conn) error {
     reader, err := s.storage.ReadData(data)
     if err != nil {
         logger.Log.WithError(err).Error("Failed to read data")
-        return
+        return s.respond(conn, data, err)
     }
     defer reader.Close()
 
     adapter, err := datamgmt.NewWriteStreamAdapter(conn)
     if err != nil {
         logger.Log.WithError(err).Error("Failed to create write stream adapter")
-        return
+        return err
     }
     defer adapter.Close()
 
     if err := s.sendDataToClient(adapter, data, reader); err != nil {
         logger.Log.WithError(err).Error("Failed to send data")
+        return err
+    }
+    return nil
+}
+
+// statData replies with the size and piece hashes of a stored object.
+func (s *Server) statData(data *datamgmt.Data, conn net.Conn) error {
+    reader, err := s.storage.ReadData(data)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to read data")
+        return s.respond(conn, data, err)
+    }
+    defer reader.Close()
+
+    info, err := datamgmt.ComputeObjectInfo(reader, datamgmt.DefaultPieceSize)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to compute object info")
+        return s.respond(conn, data, err)
+    }
+    if err := s.storage.DescribeVersions(data, info); err != nil {
+        logger.Log.WithError(err).Warn("Failed to describe versions")
+    }
+
+    adapter, err := datamgmt.NewWriteStreamAdapter(conn)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to create write stream adapter")
+        return err
+    }
+    defer adapter.Close()
+
+    response := *data
+    response.Command = "info"
+    if err := datamgmt.SendEncodedData(adapter.GzipWriter, &response); err != nil {
+        logger.Log.WithError(err).Error("Failed to send metadata")
+        return err
     }
+    if err := datamgmt.SendEncodedData(adapter.GzipWriter, info); err != nil {
+        logger.Log.WithError(err).Error("Failed to send object info")
+        return err
+    }
+    if err := adapter.GzipWriter.Flush(); err != nil {
+        logger.Log.WithError(err).Error("Failed to flush data")
+        return err
+    }
+    return nil
 }
 
-func (s *Server) deleteData(data *datamgmt.Data) {
+// respond tells the requester whether its command succeeded, reporting cause if not, and
+// returns the command's outcome like reply.
+func (s *Server) respond(conn net.Conn, data *datamgmt.Data, cause error) error {
+    adapter, err := datamgmt.NewWriteStreamAdapter(conn)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to create write stream adapter")
+        if cause != nil {
+            return cause
+        }
+        return err
+    }
+    defer adapter.Close()
+    return s.reply(adapter, data, cause)
+}
+
+// deleteData deletes a file, or one of its versions. The requester gets no reply.
+func (s *Server) deleteData(data *datamgmt.Data) error {
     if err := s.storage.DeleteData(data); err != nil {
         logger.Log.WithError(err).Error("Failed to delete data")
+        return err
     }
+    // Erasing an older version leaves the file itself in place.
+    if !s.storage.HasData(data) {
+        s.dht.RemoveProvider(data.Key(), s.dht.Self().ID)
+    }
+    // Deleting the file, rather than one of its versions, reaches every replica.
+    if data.Version == "" && !data.Forwarded {
+        go s.propagateDelete(data)
+    }
+    return nil
 }
 
 func (s *Server) sendDataToClient(adapter *datamgmt.StreamAdapter, data *datamgmt.Data, reader io.Reader) error {
@@ -176,88 +402,125 @@ func (s *Server) sendDataToClient(adapter *datamgmt.StreamAdapter, data *datamgm
     return nil
 }
 
-// sendData handles sending data along with metadata to a specified network address.
-func (s *Server) sendData(address string, metadata *datamgmt.Data, dataContent io.Reader) error {
-    // Establish a network connection to the specified address.
-    conn, err := s.transport.Dial(address)
+func (s *Server) sendCommand(address string, metadata *datamgmt.Data) (net.Conn, error) {
+    // Attempt to establish a connection to the specified address.
+    conn, err := s.dial(address)
     if err != nil {
         logger.Log.WithError(err).WithField("address", address).Error("Failed to connect")
-        return err
+        return nil, err
+    }
+    if err := s.writeCommand(conn, metadata); err != nil {
+        conn.Close()
+        return nil, err
     }
-    defer conn.Close()  // Ensure the connection is closed after the operation.
+    logger.Log.WithField("address", address).Info("Command sent successfully")
+    return conn, nil
+}
 
-    // Create a stream adapter for writing to the network connection.
+// writeCommand sends a command over an authenticated connection.
+func (s *Server) writeCommand(conn net.Conn, metadata *datamgmt.Data) error {
+    // Create a write stream adapter for the connection.
     adapter, err := datamgmt.NewWriteStreamAdapter(conn)
     if err != nil {
         logger.Log.WithError(err).Error("Failed to create stream adapter")
         return err
     }
-    defer adapter.Close()  // Ensure the adapter is closed after the operation.
+    defer adapter.Close()
 
-    // Serialize the metadata into a buffer to determine its size and send it.
+    // Encode the metadata into a buffer to calculate its size.
     var metadataBuffer bytes.Buffer
     if err := gob.NewEncoder(&metadataBuffer).Encode(metadata); err != nil {
         logger.Log.WithError(err).Error("Failed to encode metadata")
         return err
     }
 
-    // Send the serialized metadata preceded by its length.
+    // Send the metadata with a length prefix.
     if err := datamgmt.SendLengthPrefixedData(adapter.GzipWriter, metadataBuffer.Bytes()); err != nil {
         logger.Log.WithError(err).Error("Failed to send metadata")
         return err
     }
 
-    // Send the actual data content with a size prefix.
-    if err := datamgmt.SendStreamWithSizePrefix(adapter.GzipWriter, dataContent); err != nil {
-        logger.Log.WithError(err).Error("Failed to send data content")
-        return err
-    }
-
-    // Flush the writer to ensure all data is sent.
+    // Flush any buffered data to ensure all data is sent.
     if err := adapter.GzipWriter.Flush(); err != nil {
         logger.Log.WithError(err).Error("Failed to flush data")
         return err
     }
-
-    logger.Log.WithField("address", address).Info("Data sent successfully")
     return nil
 }
 
-func (s *Server) sendCommand(address string, metadata *datamgmt.Data) (net.Conn, error) {
-    // Attempt to establish a connection to the specified address.
-    conn, err := s.transport.Dial(address)
+// peerError is returned when a peer answers a request with an "error" response.
+type peerError struct {
+    message string
+}
+
+func (e *peerError) Error() string {
+    return e.message
+}
+
+// peerResponse is a reply from a peer whose metadata has been read, with the reader
+// positioned at the reply body.
+type peerResponse struct {
+    Data   datamgmt.Data
+    conn   net.Conn
+    reader *datamgmt.StreamAdapter
+}
+
+// Close releases the connection the response was read from.
+func (r *peerResponse) Close() {
+    r.reader.Close()
+    r.conn.Close()
+}
+
+// request sends a command to a peer and reads the metadata of its reply. Error replies are
+// returned as a *peerError.
+func (s *Server) request(address string, data *datamgmt.Data) (*peerResponse, error) {
+    conn, err := s.sendCommand(address, data)
     if err != nil {
-        logger.Log.WithError(err).WithField("address", address).Error("Failed to connect")
         return nil, err
     }
+    return s.readResponse(conn)
+}
 
-    // Create a write stream adapter for the connection.
-    adapter, err := datamgmt.NewWriteStreamAdapter(conn)
+// readResponse reads the metadata of a peer's reply to a command sent over conn, closing
+// the connection unless it returns the response.
+func (s *Server) readResponse(conn net.Conn) (*peerResponse, error) {
+    conn = &idleTimeoutConn{Conn: conn, timeout: requestTimeout}
+
+    reader, err := datamgmt.NewReadStreamAdapter(conn)
     if err != nil {
-        logger.Log.WithError(err).Error("Failed to create stream adapter")
+        conn.Close()
         return nil, err
     }
-    defer adapter.Close()
 
-    // Encode the metadata into a buffer to calculate its size.
-    var metadataBuffer bytes.Buffer
-    if err := gob.NewEncoder(&metadataBuffer).Encode(metadata); err != nil {
-        logger.Log.WithError(err).Error("Failed to encode metadata")
+    response := &peerResponse{conn: conn, reader: reader}
+    if err := datamgmt.ReadEncodedData(reader.GzipReader, &response.Data); err != nil {
+        response.Close()
         return nil, err
     }
-
-    // Send the metadata with a length prefix.
-    if err := datamgmt.SendLengthPrefixedData(adapter.GzipWriter, metadataBuffer.Bytes()); err != nil {
-        logger.Log.WithError(err).Error("Failed to send metadata")
-        return nil, err
+    if response.Data.Command == "error" {
+        response.Close()
+        return nil, &peerError{message: response.Data.Error}
     }
+    return response, nil
+}
 
-    // Flush any buffered data to ensure all data is sent.
-    if err := adapter.GzipWriter.Flush(); err != nil {
-        logger.Log.WithError(err).Error("Failed to flush data")
-        return nil, err
+// idleTimeoutConn pushes the connection deadline forward on every read and write, so long
+// transfers only time out when the peer stops making progress.
+type idleTimeoutConn struct {
+    net.Conn
+    timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(p []byte) (int, error) {
+    if err := c.Conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+        return 0, err
     }
+    return c.Conn.Read(p)
+}
 
-    logger.Log.WithField("address", address).Info("Command sent successfully")
-    return conn, nil
-}
\ No newline at end of file
+func (c *idleTimeoutConn) Write(p []byte) (int, error) {
+    if err := c.Conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+        return 0, err
+    }
+    return c.Conn.Write(p)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/logger"
+)
+
+const (
+	uploadDirName    = "uploads"
+	downloadDirName  = "downloads"
+	uploadSessionTTL = 24 * time.Hour
+)
+
+// UploadSession is the receiver's persisted state of an interrupted upload. It keeps the
+// chunks received so far from being collected and lets the sender resume.
+type UploadSession struct {
+    ID        string
+    Key       string
+    Chunks    []datamgmt.ChunkRef
+    Received  []string // Chunks the sender has transmitted, which it need not send again
+    UpdatedAt time.Time
+}
+
+func (s *StorageService) sessionPath(id string) string {
+    return filepath.Join(s.rootPath, uploadDirName, id+".json")
+}
+
+// OpenUploadSession loads the upload session with the given ID, creating it for refs if it
+// does not exist yet.
+func (s *StorageService) OpenUploadSession(id string, data *datamgmt.Data, refs []datamgmt.ChunkRef) (*UploadSession, error) {
+    if !isHexDigest(id) {
+        return nil, fmt.Errorf("invalid session ID %q", id)
+    }
+
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    s.pruneUploadSessions()
+    session, err := s.loadUploadSession(id)
+    if err == nil {
+        if session.Key != data.Key() || len(session.Chunks) != len(refs) {
+            return nil, fmt.Errorf("session %s belongs to a different upload", id)
+        }
+    } else if errors.Is(err, fs.ErrNotExist) {
+        session = &UploadSession{ID: id, Key: data.Key(), Chunks: refs}
+    } else {
+        return nil, err
+    }
+
+    if err := s.saveUploadSession(session); err != nil {
+        return nil, err
+    }
+    return session, nil
+}
+
+// ReceivedChunk records that the sender of an upload session transmitted a chunk.
+func (s *StorageService) ReceivedChunk(id, hash string) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    session, err := s.loadUploadSession(id)
+    if err != nil {
+        return err
+    }
+    session.Received = append(session.Received, hash)
+    return s.saveUploadSession(session)
+}
+
+// saveUploadSession writes an upload session, marking it as just used. The caller must hold
+// the mutex.
+func (s *StorageService) saveUploadSession(session *UploadSession) error {
+    session.UpdatedAt = time.Now()
+    content, err := json.Marshal(session)
+    if err != nil {
+        return err
+    }
+    if err := writeFileAtomic(s.sessionPath(session.ID), content); err != nil {
+        logger.Log.WithError(err).Error("Error writing upload session")
+        return err
+    }
+    return nil
+}
+
+// CommittedOffset returns how many leading bytes of an upload the receiver already holds
+// from its sender.
+func (s *StorageService) CommittedOffset(id string) (int64, error) {
+    if !isHexDigest(id) {
+        return 0, fmt.Errorf("invalid session ID %q", id)
+    }
+
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    session, err := s.loadUploadSession(id)
+    if errors.Is(err, fs.ErrNotExist) {
+        return 0, nil
+    }
+    if err != nil {
+        return 0, err
+    }
+    received := make(map[string]bool, len(session.Received))
+    for _, hash := range session.Received {
+        received[hash] = true
+    }
+    var offset int64
+    for _, ref := range session.Chunks {
+        if !received[ref.Hash] || !s.hasChunk(ref.Hash) {
+            break
+        }
+        offset += ref.Size
+    }
+    return offset, nil
+}
+
+// CloseUploadSession removes a finished upload session.
+func (s *StorageService) CloseUploadSession(id string) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if err := os.Remove(s.sessionPath(id)); err != nil && !os.IsNotExist(err) {
+        return err
+    }
+    return nil
+}
+
+func (s *StorageService) loadUploadSession(id string) (*UploadSession, error) {
+    content, err := os.ReadFile(s.sessionPath(id))
+    if err != nil {
+        return nil, err
+    }
+    var session UploadSession
+    if err := json.Unmarshal(content, &session); err != nil {
+        return nil, fmt.Errorf("invalid upload session %s: %w", id, err)
+    }
+    return &session, nil
+}
+
+// walkUploadSessions calls fn for every persisted upload session. The caller must hold the
+// mutex.
+func (s *StorageService) walkUploadSessions(fn func(session *UploadSession)) {
+    entries, err := os.ReadDir(filepath.Join(s.rootPath, uploadDirName))
+    if err != nil {
+        return
+    }
+    for _, entry := range entries {
+        id, ok := strings.CutSuffix(entry.Name(), ".json")
+        if !ok {
+            continue
+        }
+        session, err := s.loadUploadSession(id)
+        if err != nil {
+            logger.Log.WithError(err).Warn("Skipping unreadable upload session")
+            continue
+        }
+        fn(session)
+    }
+}
+
+// pruneUploadSessions drops sessions that have not been resumed within uploadSessionTTL
+// together with their orphaned chunks. The caller must hold the mutex.
+func (s *StorageService) pruneUploadSessions() {
+    var expired []*UploadSession
+    s.walkUploadSessions(func(session *UploadSession) {
+        if time.Since(session.UpdatedAt) > uploadSessionTTL {
+            expired = append(expired, session)
+        }
+    })
+    for _, session := range expired {
+        if err := os.Remove(s.sessionPath(session.ID)); err != nil {
+            logger.Log.WithError(err).Warn("Error removing expired upload session")
+            continue
+        }
+        s.collectChunks(session.Chunks)
+        logger.Log.WithField("session", session.ID).Info("Expired upload session removed")
+    }
+}
+
+// OpenPartialDownload opens the partial download file for an object, returning it
+// positioned at its end together with the number of bytes already received.
+func (s *StorageService) OpenPartialDownload(data *datamgmt.Data) (*os.File, int64, error) {
+    path := filepath.Join(s.rootPath, downloadDirName, data.Key()+".part")
+    if err := os.MkdirAll(filepath.Dir(path), 0740); err != nil {
+        return nil, 0, err
+    }
+    file, err := os.OpenFile(filepath.Clean(path), os.O_CREATE|os.O_RDWR, 0600)
+    if err != nil {
+        return nil, 0, err
+    }
+    offset, err := file.Seek(0, io.SeekEnd)
+    if err != nil {
+        file.Close()
+        return nil, 0, err
+    }
+    return file, offset, nil
+}
+
+// CompleteDownload stores a fully received partial download and removes the partial file.
+func (s *StorageService) CompleteDownload(data *datamgmt.Data, file *os.File) error {
+    if _, err := file.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+    if err := s.StoreData(data, file); err != nil {
+        if errors.Is(err, datamgmt.ErrChecksumMismatch) {
+            // Every piece verified, so the source itself is inconsistent; start over next time.
+            file.Close()
+            os.Remove(file.Name())
+        }
+        return err
+    }
+    file.Close()
+    return os.Remove(file.Name())
+}
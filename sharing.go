@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/encryption"
+	"github.com/tejasprabhu/GopherStore/logger"
+	"github.com/tejasprabhu/GopherStore/p2p"
+)
+
+// useNodeKey makes the node identify itself by its node key: its DHT ID becomes the hash
+// of its public key, so peers can check that a public key belongs to a node ID. It must be
+// called before Start.
+func (s *Server) useNodeKey(nodeKey []byte) error {
+    public, err := encryption.PublicKey(nodeKey)
+    if err != nil {
+        return err
+    }
+    s.nodeKey, s.publicKey = nodeKey, public
+    s.dht = p2p.NewDHT(p2p.Contact{ID: nodeIDFor(public), Address: s.dht.Self().Address}, s.dhtRPC)
+    return nil
+}
+
+// nodeIDFor returns the node ID belonging to a public key.
+func nodeIDFor(public []byte) p2p.NodeID {
+    return p2p.NewNodeID(string(public))
+}
+
+// handleIdentityCommand replies with the public key the node's ID is derived from.
+func (s *Server) handleIdentityCommand(data *datamgmt.Data, conn net.Conn) error {
+    writer, err := datamgmt.NewWriteStreamAdapter(conn)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to create write stream adapter")
+        return err
+    }
+    defer writer.Close()
+
+    if s.publicKey == nil {
+        return s.reply(writer, data, errors.New("node has no node key"))
+    }
+    if err := s.reply(writer, data, nil); err != nil {
+        return err
+    }
+    if err := datamgmt.SendEncodedData(writer.GzipWriter, s.publicKey); err != nil {
+        logger.Log.WithError(err).Error("Failed to send public key")
+        return err
+    }
+    if err := writer.GzipWriter.Flush(); err != nil {
+        logger.Log.WithError(err).Error("Failed to flush data")
+        return err
+    }
+    return nil
+}
+
+// handleGrantCommand stores a grant another node sent to share an encrypted file with us. The
+// grant must be signed by the node that sent it, and may not replace one received before.
+func (s *Server) handleGrantCommand(data *datamgmt.Data, adapter *datamgmt.StreamAdapter, conn net.Conn) error {
+    var grant encryption.Grant
+    if err := datamgmt.ReadEncodedData(adapter.GzipReader, &grant); err != nil {
+        logger.Log.WithError(err).Error("Failed to read grant")
+        return err
+    }
+    if s.keystore == nil || s.publicKey == nil || !bytes.Equal(grant.Recipient, s.publicKey) {
+        return s.respond(conn, data, errors.New("grant is not addressed to this node"))
+    }
+    if !grant.Verify(s.nodeKey) {
+        logger.Log.WithField("name", grant.Name).Warn("Refusing grant with an invalid signature")
+        return s.respond(conn, data, errors.New("grant is not signed by its sender"))
+    }
+    sender := nodeIDFor(grant.Sender)
+    if err := s.keystore.AddGrant(&grant); err != nil {
+        logger.Log.WithError(err).WithField("name", grant.Name).WithField("sender", sender.String()).Warn("Refusing grant")
+        return s.respond(conn, data, err)
+    }
+    logger.Log.WithField("name", grant.Name).WithField("sender", sender.String()).Info("Received access to a shared file")
+    return s.respond(conn, data, nil)
+}
+
+// shareFile gives the node with the given ID access to an encrypted file by sending it a
+// grant that holds the file key wrapped to the node's public key, signed with our node key.
+func (s *Server) shareFile(metadata *datamgmt.Data, name string, recipient p2p.NodeID, userKeys [][]byte) error {
+    if s.nodeKey == nil {
+        return errors.New("node has no node key to sign the grant with")
+    }
+    header, err := s.readEncryptionHeader(metadata)
+    if err != nil {
+        return err
+    }
+    fileKey, err := header.FileKey(userKeys...)
+    if err != nil {
+        return err
+    }
+
+    address, err := s.locateNode(recipient)
+    if err != nil {
+        return err
+    }
+    public, err := s.requestIdentity(address, recipient)
+    if err != nil {
+        return err
+    }
+    grant, err := encryption.NewGrant(s.nodeKey, public, fileKey, name, metadata.Filename, metadata.Extension)
+    if err != nil {
+        return err
+    }
+    return s.sendGrant(address, grant)
+}
+
+// readEncryptionHeader reads the header of an encrypted file from local storage, or from a
+// peer that holds it.
+func (s *Server) readEncryptionHeader(metadata *datamgmt.Data) (*encryption.Header, error) {
+    request := *metadata
+    request.Offset, request.Length, request.Ranges = 0, int64(encryption.HeaderSize), nil
+    if reader, err := s.storage.ReadData(&request); err == nil {
+        defer reader.Close()
+        return encryption.ReadHeader(reader)
+    }
+
+    providers, err := s.locateProviders(metadata)
+    if err != nil {
+        return nil, err
+    }
+    for _, address := range providers {
+        content, err := s.fetchRange(address, metadata, 0, int64(encryption.HeaderSize))
+        if err != nil {
+            logger.Log.WithError(err).WithField("address", address).Warn("Failed to read file header")
+            continue
+        }
+        return encryption.ReadHeader(bytes.NewReader(content))
+    }
+    return nil, errors.New("no peer could provide the file")
+}
+
+// locateNode finds the address of a node through the DHT.
+func (s *Server) locateNode(id p2p.NodeID) (string, error) {
+    for _, contact := range s.dht.FindNode(id) {
+        if contact.ID == id {
+            return contact.Address, nil
+        }
+    }
+    return "", fmt.Errorf("node %s not found", id)
+}
+
+// requestIdentity asks a peer for its public key and checks that it matches the node ID.
+func (s *Server) requestIdentity(address string, expected p2p.NodeID) ([]byte, error) {
+    response, err := s.request(address, &datamgmt.Data{Command: "identity"})
+    if err != nil {
+        return nil, err
+    }
+    defer response.Close()
+
+    var public []byte
+    if err := datamgmt.ReadEncodedData(response.reader.GzipReader, &public); err != nil {
+        return nil, err
+    }
+    if nodeIDFor(public) != expected {
+        return nil, fmt.Errorf("public key of %s does not match node %s", address, expected)
+    }
+    return public, nil
+}
+
+// sendGrant delivers a grant to the node it is addressed to.
+func (s *Server) sendGrant(address string, grant *encryption.Grant) error {
+    conn, err := s.dial(address)
+    if err != nil {
+        return err
+    }
+    conn = &idleTimeoutConn{Conn: conn, timeout: requestTimeout}
+    defer conn.Close()
+
+    writer, err := datamgmt.NewWriteStreamAdapter(conn)
+    if err != nil {
+        return err
+    }
+    defer writer.Close()
+    if err := datamgmt.SendEncodedData(writer.GzipWriter, &datamgmt.Data{Command: "grant"}); err != nil {
+        return err
+    }
+    if err := datamgmt.SendEncodedData(writer.GzipWriter, grant); err != nil {
+        return err
+    }
+    if err := writer.GzipWriter.Flush(); err != nil {
+        return err
+    }
+
+    reader, err := datamgmt.NewReadStreamAdapter(conn)
+    if err != nil {
+        return err
+    }
+    defer reader.Close()
+    var response datamgmt.Data
+    if err := datamgmt.ReadEncodedData(reader.GzipReader, &response); err != nil {
+        return err
+    }
+    if response.Command == "error" {
+        return &peerError{message: response.Error}
+    }
+    return nil
+}
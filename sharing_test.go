@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/tejasprabhu/GopherStore/encryption"
+)
+
+// withNodeKey gives a server a fresh node key.
+func withNodeKey(t *testing.T, server *Server) []byte {
+    nodeKey, err := encryption.GenerateKey()
+    if err != nil {
+        t.Fatal(err)
+    }
+    if err := server.useNodeKey(nodeKey); err != nil {
+        t.Fatalf("useNodeKey() error = %v", err)
+    }
+    return nodeKey
+}
+
+func TestServer_GrantsMustBeSignedAndNew(t *testing.T) {
+    recipient := startTestServer(t, "127.0.0.1:3395", nil, func(node *Server) {
+        withNodeKey(t, node)
+        keystore, err := encryption.OpenKeystore(filepath.Join(t.TempDir(), "keystore.json"), "secret")
+        if err != nil {
+            t.Fatalf("OpenKeystore() error = %v", err)
+        }
+        node.keystore = keystore
+    })
+    sender := NewServer("127.0.0.1:0")
+    t.Cleanup(func() { os.RemoveAll(sender.storage.rootPath) })
+    senderKey := withNodeKey(t, sender)
+    otherKey, _ := encryption.GenerateKey()
+    fileKey, _ := encryption.GenerateKey()
+
+    grant, err := encryption.NewGrant(senderKey, recipient.publicKey, fileKey, "report.pdf", "abc", "enc")
+    if err != nil {
+        t.Fatalf("NewGrant() error = %v", err)
+    }
+    if err := sender.sendGrant("127.0.0.1:3395", grant); err != nil {
+        t.Fatalf("sendGrant() error = %v", err)
+    }
+
+    // A grant claiming another sender, or for a name already granted, is refused.
+    forged, _ := encryption.NewGrant(senderKey, recipient.publicKey, fileKey, "notes.txt", "def", "enc")
+    forged.Sender, _ = encryption.PublicKey(otherKey)
+    if err := sender.sendGrant("127.0.0.1:3395", forged); err == nil || !strings.Contains(err.Error(), "not signed") {
+        t.Errorf("Expected a grant with a forged sender to be refused, got %v", err)
+    }
+    replacement, _ := encryption.NewGrant(senderKey, recipient.publicKey, fileKey, "report.pdf", "other", "enc")
+    if err := sender.sendGrant("127.0.0.1:3395", replacement); err == nil || !strings.Contains(err.Error(), encryption.ErrGrantExists.Error()) {
+        t.Errorf("Expected a second grant for the same name to be refused, got %v", err)
+    }
+    if stored, ok := recipient.keystore.Grant("report.pdf"); !ok || stored.Filename != "abc" {
+        t.Errorf("Expected the first grant to be kept, got %+v", stored)
+    }
+    if _, ok := recipient.keystore.Grant("notes.txt"); ok {
+        t.Errorf("Expected the forged grant not to be stored")
+    }
+}
@@ -3,20 +3,66 @@ package main
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/encryption"
 	"github.com/tejasprabhu/GopherStore/logger" // Assuming logger is set up correctly for structured logging
 )
 
-// StorageService handles the storage operations for data objects.
+// errInvalidFileName is returned for a file name or extension that is not a single path
+// element.
+var errInvalidFileName = errors.New("invalid file name")
+
+// StorageService handles the storage operations for data objects. File contents are split
+// into content-defined chunks stored once by hash, and each file is recorded as a manifest
+// listing its chunks, so identical data is deduplicated across files.
 type StorageService struct {
     rootPath string
     mutex    sync.Mutex
+    keys     *encryption.Keyring // Encrypts chunks at rest when set
+    resolver ConflictResolver    // Decides between concurrent versions of a file
+    accessed map[string]*fileAccess // How files were read, by path
+    started  time.Time
+    hot      *storageTier // Holds new chunks and files read often
+    cold     *storageTier // Holds idle files when configured
+    quotas   *QuotaPolicy // Limits what origins and namespaces keep, if set
+    counters *usageCounters // Usage of origins, namespaces and buckets, nil until first needed
+    reserved map[string]Usage // Quota held by writes in progress, by quota checked
+    reserve  int64        // Free disk space each tier leaves unused
+    pinned   map[string]int // Open readers of each chunk, which is kept until they close
+    deferred map[string]bool // Unused chunks to collect once their readers close
+}
+
+// Manifest lists the chunks that make up one version of a stored file.
+type Manifest struct {
+    ID        string
+    Filename  string
+    Extension string
+    OriginID  string
+    Size      int64
+    Chunks    []datamgmt.ChunkRef
+    Checksum  string // Checksum of the file content, verified when the file was stored
+    CreatedAt time.Time
+    VersionID string // Identifies this version, ordered by creation time
+    Deleted   bool   // Marks a tombstone recording that the file was deleted
+    Clock      datamgmt.VectorClock // Causal history of the version
+    ModifiedAt time.Time            // When the writer made the change
+    Siblings   []string             // Concurrent versions kept alongside the latest one
+    ExpiresAt  time.Time            // When the version stops being served, zero if never
+    Tags       map[string]string    // Labels lifecycle rules select files by
+    Tier       string               // Storage tier the version belongs to, empty for the default
+    Bucket     string               // Bucket holding the file, empty for the default namespace
+    ACL        datamgmt.ACL         // Owner of the file and permissions granted on it
 }
 
 const storageRootDir = "data_storage"
@@ -27,45 +73,110 @@ func NewStorageService(address string) *StorageService {
     if err := os.MkdirAll(root, 0740); err != nil {
         logger.Log.WithError(err).Fatal("Unable to create root storage directory")
     }
-    return &StorageService{rootPath: root}
+    return &StorageService{rootPath: root, resolver: LastWriterWins{}, started: time.Now(), reserve: defaultDiskReserve}
 }
 
-// StoreData writes data from a reader into a file determined by the datamgmt.Data object.
+// StoreData chunks data from a reader into the chunk store and records the file's manifest
+// at the path determined by the datamgmt.Data object. When data.Checksum is set the content
+// must match it, otherwise nothing is committed and ErrChecksumMismatch is returned.
 func (s *StorageService) StoreData(data *datamgmt.Data, reader io.Reader) error {
     s.mutex.Lock()
     defer s.mutex.Unlock()
 
-    path, err := s.generateFilePath(data)
-    if err != nil {
-        logger.Log.WithError(err).Error("Error generating file path")
-        return err
+    var refs []datamgmt.ChunkRef
+    var size int64
+    created := 0
+    hasher := datamgmt.NewChecksum()
+    chunker := datamgmt.NewChunker(io.TeeReader(reader, hasher))
+    for {
+        chunk, err := chunker.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            logger.Log.WithError(err).Error("Error reading data stream")
+            s.collectChunks(refs)
+            return err
+        }
+        ref := datamgmt.ChunkRef{Hash: datamgmt.HashChunk(chunk), Size: int64(len(chunk))}
+        isNew, err := s.writeChunk(ref.Hash, chunk)
+        if err != nil {
+            s.collectChunks(refs)
+            return err
+        }
+        if isNew {
+            created++
+        }
+        refs = append(refs, ref)
+        size += ref.Size
     }
 
-    if err := os.MkdirAll(filepath.Dir(path), 0740); err != nil {
-        logger.Log.WithError(err).Error("Error creating directories for file")
+    if size == 0 {
+        logger.Log.Warn("No data written to file, check input stream")
+    }
+    checksum := hex.EncodeToString(hasher.Sum(nil))
+    if err := verifyDataChecksum(data, checksum); err != nil {
+        s.collectChunks(refs)
         return err
     }
-
-    file, err := os.Create(filepath.Clean(path))
-    if err != nil {
-        logger.Log.WithError(err).Error("Error creating file")
+    if err := s.commitManifest(data, refs, checksum); err != nil {
+        s.collectChunks(refs)
         return err
     }
-    defer file.Close()
 
-    if written, err := io.Copy(file, reader); err != nil {
-        logger.Log.WithError(err).Error("Error writing data to file")
+    logger.Log.WithFields(map[string]interface{}{
+        "key":           data.Key(),
+        "bytes_written": size,
+        "chunks":        len(refs),
+        "new_chunks":    created,
+    }).Info("Data stored successfully")
+    return nil
+}
+
+// CommitManifest records a file made of chunks that are already present in the chunk store.
+// The file is read back from the stored chunks, each checked against the size it is listed
+// with, and checked against data.Checksum when set, so a file is only committed if its
+// content and size are exactly what the sender read.
+func (s *StorageService) CommitManifest(data *datamgmt.Data, refs []datamgmt.ChunkRef) error {
+    if err := checkChunkRefs(refs); err != nil {
         return err
-    } else if written == 0 {
-        logger.Log.Warn("No data written to file, check input stream")
-    } else {
-        logger.Log.WithField("path", file.Name()).WithField("bytes_written", written).Info("Data stored successfully")
     }
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
 
+    for _, ref := range refs {
+        if !s.hasChunk(ref.Hash) {
+            return fmt.Errorf("chunk %s is missing", ref.Hash)
+        }
+    }
+    hasher := datamgmt.NewChecksum()
+    for _, ref := range refs {
+        chunk, err := s.readChunk(ref.Hash)
+        if err != nil {
+            logger.Log.WithError(err).Error("Error reading stored chunks")
+            return err
+        }
+        if int64(len(chunk)) != ref.Size {
+            return fmt.Errorf("chunk %s is %d bytes, not %d", ref.Hash, len(chunk), ref.Size)
+        }
+        hasher.Write(chunk)
+    }
+    checksum := hex.EncodeToString(hasher.Sum(nil))
+    if err := verifyDataChecksum(data, checksum); err != nil {
+        return err
+    }
+    if err := s.commitManifest(data, refs, checksum); err != nil {
+        return err
+    }
+    logger.Log.WithField("key", data.Key()).WithField("chunks", len(refs)).Info("Manifest committed successfully")
     return nil
 }
 
-// ReadData opens a file for reading based on the provided datamgmt.Data object.
+// ReadData opens a file for reading based on the provided datamgmt.Data object, reading
+// data.Version if set and the latest version otherwise. When
+// data.Ranges is set the reader returns those ranges back to back and data.Ranges is
+// replaced by the resolved ranges, so callers can tell where each one ends; otherwise it
+// starts at data.Offset and is limited to data.Length bytes when a range is requested.
 func (s *StorageService) ReadData(data *datamgmt.Data) (io.ReadCloser, error) {
     s.mutex.Lock()
     defer s.mutex.Unlock()
@@ -76,17 +187,46 @@ func (s *StorageService) ReadData(data *datamgmt.Data) (io.ReadCloser, error) {
         return nil, err
     }
 
-    file, err := os.Open(filepath.Clean(path))
+    manifest, err := s.loadVersion(path, data.Version)
+    if err == nil && manifest.Deleted {
+        err = errObjectDeleted
+    } else if err == nil && manifest.expired(time.Now()) {
+        err = errObjectExpired
+    }
     if err != nil {
         logger.Log.WithError(err).Error("Error opening data file")
         return nil, err
     }
+    if data.Version == "" {
+        s.recordAccess(path)
+    }
+    ranges := data.Ranges
+    if len(ranges) == 0 {
+        ranges = []datamgmt.ByteRange{{Offset: data.Offset, Length: data.Length}}
+    }
+    resolved, err := datamgmt.ResolveRanges(ranges, manifest.Size)
+    if err != nil {
+        logger.Log.WithError(err).Error("Error resolving requested ranges")
+        return nil, err
+    }
 
     logger.Log.WithField("path", path).Info("Data file opened successfully")
-    return file, nil
+    if len(data.Ranges) == 0 {
+        return s.newChunkReader(manifest.Chunks, resolved[0].Offset, resolved[0].Length), nil
+    }
+    data.Ranges = resolved
+    readers := make([]io.ReadCloser, len(resolved))
+    for i, r := range resolved {
+        readers[i] = s.newChunkReader(manifest.Chunks, r.Offset, r.Length)
+    }
+    return newMultiRangeReader(readers), nil
 }
 
-// DeleteData removes a file based on the provided datamgmt.Data object.
+// DeleteData deletes a file based on the provided datamgmt.Data object. Deleting the file
+// records a tombstone as its latest version and keeps the older versions, setting
+// data.Clock and data.ModifiedAt to the tombstone's so the delete can be forwarded to other
+// replicas as is; deleting a specific data.Version erases that version for good, along with
+// any chunks no other version refers to.
 func (s *StorageService) DeleteData(data *datamgmt.Data) error {
     s.mutex.Lock()
     defer s.mutex.Unlock()
@@ -96,20 +236,209 @@ func (s *StorageService) DeleteData(data *datamgmt.Data) error {
         logger.Log.WithError(err).Error("Error generating file path")
         return err
     }
+    if data.Version != "" {
+        return s.purgeVersion(path, data.Version)
+    }
 
-    if err := os.Remove(path); err != nil {
+    manifest, err := s.loadManifest(path)
+    if err != nil {
+        logger.Log.WithError(err).Error("Error deleting file")
+        return err
+    }
+    if manifest.Deleted {
+        data.Clock, data.ModifiedAt = manifest.Clock, manifest.ModifiedAt
+        return nil
+    }
+    tombstone := &Manifest{
+        ID:        data.ID,
+        Filename:  data.Filename,
+        Extension: data.Extension,
+        OriginID:  data.OriginID,
+        Deleted:   true,
+        Clock:      data.Clock,
+        ModifiedAt: data.ModifiedAt,
+        Bucket:     data.Bucket,
+    }
+    if err := s.writeVersion(path, tombstone); err != nil {
         logger.Log.WithError(err).Error("Error deleting file")
         return err
     }
 
-    logger.Log.WithField("path", path).Info("Data deleted successfully")
+    data.Clock, data.ModifiedAt = tombstone.Clock, tombstone.ModifiedAt
+    logger.Log.WithField("path", path).WithField("version", tombstone.VersionID).Info("Data deleted successfully")
     return nil
 }
 
-// generateFilePath creates a filepath for storing data using a hash of the data ID.
+// generateFilePath creates a filepath for storing data using a hash of the data ID. Files
+// in a bucket are kept in a directory of their own.
 func (s *StorageService) generateFilePath(data *datamgmt.Data) (string, error) {
+    if err := validateFileName(data); err != nil {
+        return "", err
+    }
     hash := sha256.Sum256([]byte(data.ID))
     subfolder := hex.EncodeToString(hash[:3]) // Use first 3 bytes of hash for subfolder
     filename := fmt.Sprintf("%s.%s", data.Filename, data.Extension)
+    if data.Bucket != "" {
+        if err := datamgmt.ValidateBucketName(data.Bucket); err != nil {
+            return "", err
+        }
+        return filepath.Join(s.rootPath, subfolder, data.Bucket, filename), nil
+    }
     return filepath.Join(s.rootPath, subfolder, filename), nil
-}
\ No newline at end of file
+}
+
+// validateFileName checks that the file name and extension of data are each a single path
+// element, so a peer-supplied name cannot reach a file in another namespace or bucket.
+func validateFileName(data *datamgmt.Data) error {
+    for _, element := range []string{data.Filename, data.Extension} {
+        if element == "" {
+            continue
+        }
+        if !filepath.IsLocal(element) || element == "." || strings.ContainsAny(element, `/\`) {
+            return fmt.Errorf("%w: %q", errInvalidFileName, element)
+        }
+    }
+    return nil
+}
+
+// verifyDataChecksum checks content against the checksum supplied by its sender, if any.
+func verifyDataChecksum(data *datamgmt.Data, checksum string) error {
+    if data.Checksum == "" {
+        return nil
+    }
+    if err := datamgmt.VerifyChecksum(data.Checksum, checksum); err != nil {
+        logger.Log.WithError(err).WithField("key", data.Key()).Error("Rejecting corrupted data")
+        return err
+    }
+    return nil
+}
+
+// commitManifest records a new version of the file described by data. The caller must hold
+// the mutex.
+func (s *StorageService) commitManifest(data *datamgmt.Data, refs []datamgmt.ChunkRef, checksum string) error {
+    path, err := s.generateFilePath(data)
+    if err != nil {
+        logger.Log.WithError(err).Error("Error generating file path")
+        return err
+    }
+
+    manifest := &Manifest{
+        ID:        data.ID,
+        Filename:  data.Filename,
+        Extension: data.Extension,
+        OriginID:  data.OriginID,
+        Chunks:    refs,
+        Checksum:  checksum,
+        Clock:      data.Clock,
+        ModifiedAt: data.ModifiedAt,
+        ExpiresAt:  data.Expiry(time.Now()),
+        Tags:       data.Tags,
+        Bucket:     data.Bucket,
+    }
+    for _, ref := range refs {
+        manifest.Size += ref.Size
+    }
+    if err := s.writeVersion(path, manifest); err != nil {
+        logger.Log.WithError(err).Error("Error writing manifest")
+        return err
+    }
+    return nil
+}
+
+// loadManifest reads the manifest stored at path. Manifests written before versioning
+// are given a version ID derived from their creation time.
+func (s *StorageService) loadManifest(path string) (*Manifest, error) {
+    content, err := os.ReadFile(filepath.Clean(path))
+    if err != nil {
+        return nil, err
+    }
+    var manifest Manifest
+    if err := json.Unmarshal(content, &manifest); err != nil {
+        return nil, fmt.Errorf("invalid manifest %s: %w", path, err)
+    }
+    if manifest.VersionID == "" {
+        manifest.VersionID = versionID(manifest.CreatedAt, 0)
+    }
+    return &manifest, nil
+}
+
+// saveManifest writes a manifest to path. The caller must hold the mutex.
+func (s *StorageService) saveManifest(path string, manifest *Manifest) error {
+    content, err := json.Marshal(manifest)
+    if err != nil {
+        logger.Log.WithError(err).Error("Error encoding manifest")
+        return err
+    }
+    if err := writeFileAtomic(path, content); err != nil {
+        return err
+    }
+    s.trackUsage(path, manifest)
+    return nil
+}
+
+// removeManifest removes the manifest at path. The caller must hold the mutex.
+func (s *StorageService) removeManifest(path string) error {
+    if err := os.Remove(path); err != nil {
+        return err
+    }
+    s.trackUsage(path, nil)
+    return nil
+}
+
+// walkManifests calls fn for every file manifest under the storage root. The caller must
+// hold the mutex.
+func (s *StorageService) walkManifests(fn func(path string, manifest *Manifest) error) error {
+    return filepath.WalkDir(s.rootPath, func(path string, entry fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if entry.IsDir() {
+            if path != s.rootPath && filepath.Dir(path) == s.rootPath && isReservedDir(entry.Name()) {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+        if strings.Contains(entry.Name(), tempFileMarker) {
+            return nil
+        }
+        manifest, err := s.loadManifest(path)
+        if err != nil {
+            logger.Log.WithError(err).WithField("path", path).Warn("Skipping unreadable manifest")
+            return nil
+        }
+        return fn(path, manifest)
+    })
+}
+
+// isReservedDir reports whether a top-level directory holds internal state rather than
+// file manifests.
+func isReservedDir(name string) bool {
+    return name == chunkDirName || name == uploadDirName || name == downloadDirName || name == quarantineDirName || name == keyDirName || name == erasureDirName || name == versionDirName || name == clockDirName || name == bucketDirName
+}
+
+const tempFileMarker = ".tmp-"
+
+// writeFileAtomic replaces the file at path so readers never observe a partial write.
+func writeFileAtomic(path string, content []byte) error {
+    if err := os.MkdirAll(filepath.Dir(path), 0740); err != nil {
+        return err
+    }
+    temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+tempFileMarker+"*")
+    if err != nil {
+        return err
+    }
+    defer os.Remove(temp.Name())
+
+    if _, err := temp.Write(content); err != nil {
+        temp.Close()
+        return err
+    }
+    if err := temp.Sync(); err != nil {
+        temp.Close()
+        return err
+    }
+    if err := temp.Close(); err != nil {
+        return err
+    }
+    return os.Rename(temp.Name(), path)
+}
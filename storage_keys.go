@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/tejasprabhu/GopherStore/encryption"
+	"github.com/tejasprabhu/GopherStore/logger"
+)
+
+const (
+	keyDirName      = "keys"
+	keyringFileName = "keyring.json"
+)
+
+var errMissingMasterKey = errors.New("chunk is encrypted at rest but no master key is configured")
+
+// EnableEncryption encrypts chunks written from now on with the node's data key, which is
+// kept in a keyring under the storage root wrapped by master. Chunks written before are
+// still read as they are.
+func (s *StorageService) EnableEncryption(master []byte) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    var state *encryption.KeyringState
+    content, err := os.ReadFile(s.keyringPath())
+    if err == nil {
+        state = &encryption.KeyringState{}
+        if err := json.Unmarshal(content, state); err != nil {
+            logger.Log.WithError(err).Error("Error decoding keyring")
+            return err
+        }
+    } else if !errors.Is(err, fs.ErrNotExist) {
+        logger.Log.WithError(err).Error("Error reading keyring")
+        return err
+    }
+
+    keys, err := encryption.NewKeyring(master, state)
+    if err != nil {
+        logger.Log.WithError(err).Error("Error unlocking keyring, check the master key")
+        return err
+    }
+    if state == nil {
+        if err := s.saveKeyring(keys); err != nil {
+            return err
+        }
+        logger.Log.Info("Created data key for encryption at rest")
+    }
+    s.keys = keys
+    return nil
+}
+
+// RotateKeys switches new writes to a fresh data key and, when newMaster is given, wraps
+// every data key under it. Existing chunks are not rewritten: they stay readable through
+// the older data keys kept in the keyring.
+func (s *StorageService) RotateKeys(newMaster []byte) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if s.keys == nil {
+        return errors.New("encryption at rest is not enabled")
+    }
+    if err := s.keys.RotateDataKey(); err != nil {
+        return err
+    }
+    if newMaster != nil {
+        if err := s.keys.Rewrap(newMaster); err != nil {
+            return err
+        }
+    }
+    if err := s.saveKeyring(s.keys); err != nil {
+        return err
+    }
+    logger.Log.WithField("master_key_rotated", newMaster != nil).Info("Keys rotated")
+    return nil
+}
+
+func (s *StorageService) keyringPath() string {
+    return filepath.Join(s.rootPath, keyDirName, keyringFileName)
+}
+
+// saveKeyring persists the wrapped data keys. The caller must hold the mutex.
+func (s *StorageService) saveKeyring(keys *encryption.Keyring) error {
+    content, err := json.Marshal(keys.State())
+    if err != nil {
+        return err
+    }
+    if err := writeFileAtomic(s.keyringPath(), content); err != nil {
+        logger.Log.WithError(err).Error("Error writing keyring")
+        return err
+    }
+    return nil
+}
@@ -2,12 +2,17 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"errors"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/encryption"
 )
 
 func TestStorageService_GenerateFilePath(t *testing.T) {
@@ -97,9 +102,385 @@ func TestStorageService_DeleteData(t *testing.T) {
         t.Errorf("DeleteData() error = %v", err)
     }
 
-    // Verify file does not exist
+    // Verify the file is gone but its content is kept as an older version
+    if _, err := service.ReadData(data); !errors.Is(err, fs.ErrNotExist) {
+        t.Errorf("Expected deleted file to be unreadable, got %v", err)
+    }
+    versions, err := service.Versions(data)
+    if err != nil || len(versions) != 2 || !versions[0].Deleted || versions[1].Deleted {
+        t.Fatalf("Expected a tombstone above the stored version, got %+v, %v", versions, err)
+    }
+    previous := *data
+    previous.Version = versions[1].VersionID
+    if result := readStored(t, service, &previous); string(result) != "Hello, world!" {
+        t.Errorf("Expected 'Hello, world!', got '%s'", result)
+    }
+}
+
+func TestStorageService_DeduplicatesChunks(t *testing.T) {
+    service := NewStorageService("test_address")
+    defer os.RemoveAll(service.rootPath) // Clean up after test
+
+    content := bytes.Repeat([]byte("GopherStore chunk deduplication "), 20000)
+    first := &datamgmt.Data{ID: "1", Filename: "first", Extension: "txt"}
+    second := &datamgmt.Data{ID: "1", Filename: "second", Extension: "txt"}
+    if err := service.StoreData(first, bytes.NewReader(content)); err != nil {
+        t.Fatalf("StoreData() error = %v", err)
+    }
+    chunkFiles, _ := filepath.Glob(filepath.Join(service.rootPath, chunkDirName, "*", "*"))
+    if err := service.StoreData(second, bytes.NewReader(content)); err != nil {
+        t.Fatalf("StoreData() error = %v", err)
+    }
+    afterSecond, _ := filepath.Glob(filepath.Join(service.rootPath, chunkDirName, "*", "*"))
+    if len(afterSecond) != len(chunkFiles) {
+        t.Errorf("Expected identical content to reuse %d chunks, found %d", len(chunkFiles), len(afterSecond))
+    }
+
+    // Deleting one file must keep the chunks the other still uses
+    if err := service.DeleteData(first); err != nil {
+        t.Fatalf("DeleteData() error = %v", err)
+    }
+    reader, err := service.ReadData(second)
+    if err != nil {
+        t.Fatalf("ReadData() error = %v", err)
+    }
+    result, _ := io.ReadAll(reader)
+    reader.Close()
+    if !bytes.Equal(result, content) {
+        t.Errorf("Content of remaining file changed after delete")
+    }
+
+    // Chunks are only removed once no version of either file refers to them
+    for _, data := range []*datamgmt.Data{first, second} {
+        versions, err := service.Versions(data)
+        if err != nil {
+            t.Fatalf("Versions() error = %v", err)
+        }
+        for _, version := range versions {
+            purge := *data
+            purge.Version = version.VersionID
+            if err := service.DeleteData(&purge); err != nil {
+                t.Fatalf("DeleteData() error = %v", err)
+            }
+        }
+    }
+    remaining, _ := filepath.Glob(filepath.Join(service.rootPath, chunkDirName, "*", "*"))
+    if len(remaining) != 0 {
+        t.Errorf("Expected unused chunks to be removed, %d left", len(remaining))
+    }
+}
+
+func TestStorageService_PurgeDuringRead(t *testing.T) {
+    service := NewStorageService("test_address")
+    defer os.RemoveAll(service.rootPath) // Clean up after test
+
+    content := make([]byte, 500000)
+    if _, err := rand.Read(content); err != nil {
+        t.Fatal(err)
+    }
+    data := &datamgmt.Data{ID: "1", Filename: "purged", Extension: "bin"}
+    if err := service.StoreData(data, bytes.NewReader(content)); err != nil {
+        t.Fatalf("StoreData() error = %v", err)
+    }
+    reader, err := service.ReadData(data)
+    if err != nil {
+        t.Fatalf("ReadData() error = %v", err)
+    }
+    first := make([]byte, 1000)
+    if _, err := io.ReadFull(reader, first); err != nil {
+        t.Fatalf("Read() error = %v", err)
+    }
+
+    // Purging the only version while it is read keeps its chunks until the reader closes.
+    versions, err := service.Versions(data)
+    if err != nil || len(versions) != 1 {
+        t.Fatalf("Versions() = %v, %v", versions, err)
+    }
+    purge := *data
+    purge.Version = versions[0].VersionID
+    if err := service.DeleteData(&purge); err != nil {
+        t.Fatalf("DeleteData() error = %v", err)
+    }
+    rest, err := io.ReadAll(reader)
+    if err != nil {
+        t.Fatalf("Read() error after purge = %v", err)
+    }
+    if !bytes.Equal(append(first, rest...), content) {
+        t.Errorf("Content read during the purge does not match the file")
+    }
+    if countChunks(service.rootPath) == 0 {
+        t.Errorf("Expected the chunks to be kept while they are read")
+    }
+    reader.Close()
+    if remaining := countChunks(service.rootPath); remaining != 0 {
+        t.Errorf("Expected the chunks to be removed once the reader closed, %d left", remaining)
+    }
+}
+
+func TestStorageService_Versions(t *testing.T) {
+    service := NewStorageService("test_address")
+    defer os.RemoveAll(service.rootPath) // Clean up after test
+
+    data := &datamgmt.Data{ID: "1", Filename: "testfile", Extension: "txt"}
+    for _, content := range []string{"first", "second"} {
+        if err := service.StoreData(data, bytes.NewReader([]byte(content))); err != nil {
+            t.Fatalf("StoreData() error = %v", err)
+        }
+    }
+    versions, err := service.Versions(data)
+    if err != nil || len(versions) != 2 || !versions[0].Latest {
+        t.Fatalf("Expected 2 versions, latest first, got %+v, %v", versions, err)
+    }
+    if result := readStored(t, service, data); string(result) != "second" {
+        t.Errorf("Expected latest version 'second', got '%s'", result)
+    }
+    older := *data
+    older.Version = versions[1].VersionID
+    if result := readStored(t, service, &older); string(result) != "first" {
+        t.Errorf("Expected older version 'first', got '%s'", result)
+    }
+
+    // Erasing the latest version makes the previous one current again
+    latest := *data
+    latest.Version = versions[0].VersionID
+    if err := service.DeleteData(&latest); err != nil {
+        t.Fatalf("DeleteData() error = %v", err)
+    }
+    if result := readStored(t, service, data); string(result) != "first" {
+        t.Errorf("Expected 'first' after erasing the latest version, got '%s'", result)
+    }
+    if _, err := service.ReadData(&latest); !errors.Is(err, fs.ErrNotExist) {
+        t.Errorf("Expected erased version to be unreadable, got %v", err)
+    }
+}
+
+func TestStorageService_ConcurrentWrites(t *testing.T) {
+    service := NewStorageService("test_address")
+    defer os.RemoveAll(service.rootPath) // Clean up after test
+    service.resolver = KeepBoth{}
+
+    write := func(content string, clock datamgmt.VectorClock) error {
+        data := &datamgmt.Data{ID: "1", Filename: "testfile", Extension: "txt", Clock: clock}
+        return service.StoreData(data, bytes.NewReader([]byte(content)))
+    }
+    data := &datamgmt.Data{ID: "1", Filename: "testfile", Extension: "txt"}
+    if err := write("base", datamgmt.VectorClock{"a": 1}); err != nil {
+        t.Fatalf("StoreData() error = %v", err)
+    }
+    if err := write("from a", datamgmt.VectorClock{"a": 2}); err != nil {
+        t.Fatalf("StoreData() error = %v", err)
+    }
+    if err := write("from b", datamgmt.VectorClock{"a": 1, "b": 1}); err != nil {
+        t.Fatalf("StoreData() of a concurrent write error = %v", err)
+    }
+
+    var info datamgmt.ObjectInfo
+    if err := service.DescribeVersions(data, &info); err != nil {
+        t.Fatalf("DescribeVersions() error = %v", err)
+    }
+    if len(info.Siblings) != 1 || info.Clock.Compare(datamgmt.VectorClock{"a": 2, "b": 1}) != datamgmt.Equal {
+        t.Fatalf("Expected one sibling and a merged clock, got %v and %v", info.Siblings, info.Clock)
+    }
+    versions, _ := service.Versions(data)
+    conflicts := 0
+    for _, version := range versions {
+        if version.Conflict {
+            conflicts++
+        }
+    }
+    if conflicts != 2 {
+        t.Errorf("Expected 2 conflicting versions, got %+v", versions)
+    }
+
+    if err := write("stale", datamgmt.VectorClock{"a": 1}); !errors.Is(err, errStaleWrite) {
+        t.Errorf("Expected a stale write to be rejected, got %v", err)
+    }
+    // A write that saw both siblings resolves the conflict.
+    if err := write("merged", info.Clock.Increment("b")); err != nil {
+        t.Fatalf("StoreData() error = %v", err)
+    }
+    if err := service.DescribeVersions(data, &info); err != nil || len(info.Siblings) != 0 {
+        t.Errorf("Expected no siblings after a merging write, got %v, %v", info.Siblings, err)
+    }
+    if result := readStored(t, service, data); string(result) != "merged" {
+        t.Errorf("Expected 'merged', got '%s'", result)
+    }
+}
+
+func TestStorageService_LastWriterWins(t *testing.T) {
+    service := NewStorageService("test_address")
+    defer os.RemoveAll(service.rootPath) // Clean up after test
+
+    now := time.Now()
+    later := &datamgmt.Data{ID: "1", Filename: "testfile", Extension: "txt", Clock: datamgmt.VectorClock{"a": 1}, ModifiedAt: now}
+    earlier := &datamgmt.Data{ID: "1", Filename: "testfile", Extension: "txt", Clock: datamgmt.VectorClock{"b": 1}, ModifiedAt: now.Add(-time.Minute)}
+    if err := service.StoreData(later, bytes.NewReader([]byte("later"))); err != nil {
+        t.Fatalf("StoreData() error = %v", err)
+    }
+    // The earlier write arrives last but loses, and is kept as an older version.
+    if err := service.StoreData(earlier, bytes.NewReader([]byte("earlier"))); err != nil {
+        t.Fatalf("StoreData() error = %v", err)
+    }
+    if result := readStored(t, service, later); string(result) != "later" {
+        t.Errorf("Expected 'later' to win, got '%s'", result)
+    }
+    if versions, _ := service.Versions(later); len(versions) != 2 || versions[0].Conflict {
+        t.Errorf("Expected 2 versions without a conflict, got %+v", versions)
+    }
+}
+
+func TestStorageService_ReadDataRange(t *testing.T) {
+    service := NewStorageService("test_address")
+    defer os.RemoveAll(service.rootPath) // Clean up after test
+
+    content := make([]byte, 3*datamgmt.MaxChunkSize)
+    for i := range content {
+        content[i] = byte(i * 7)
+    }
+    data := &datamgmt.Data{ID: "1", Filename: "testfile", Extension: "bin"}
+    if err := service.StoreData(data, bytes.NewReader(content)); err != nil {
+        t.Fatalf("StoreData() error = %v", err)
+    }
+
+    data.Offset, data.Length = datamgmt.MaxChunkSize-10, datamgmt.MaxChunkSize
+    reader, err := service.ReadData(data)
+    if err != nil {
+        t.Fatalf("ReadData() error = %v", err)
+    }
+    result, _ := io.ReadAll(reader)
+    reader.Close()
+    if !bytes.Equal(result, content[data.Offset:data.Offset+data.Length]) {
+        t.Errorf("Range read returned the wrong bytes")
+    }
+}
+
+func TestStorageService_StoreDataRejectsChecksumMismatch(t *testing.T) {
+    service := NewStorageService("test_address")
+    defer os.RemoveAll(service.rootPath) // Clean up after test
+
+    data := &datamgmt.Data{
+        ID:        "1",
+        Filename:  "testfile",
+        Extension: "txt",
+        Checksum:  datamgmt.HashChunk([]byte("Hello, world!")),
+    }
+    err := service.StoreData(data, bytes.NewReader([]byte("Hello, world?")))
+    if !errors.Is(err, datamgmt.ErrChecksumMismatch) {
+        t.Fatalf("Expected ErrChecksumMismatch, got %v", err)
+    }
     filePath, _ := service.generateFilePath(data)
     if _, err := os.Stat(filePath); !os.IsNotExist(err) {
-        t.Errorf("File still exists after delete: %s", filePath)
+        t.Errorf("Corrupted data was committed to %s", filePath)
+    }
+
+    if err := service.StoreData(data, bytes.NewReader([]byte("Hello, world!"))); err != nil {
+        t.Errorf("StoreData() error = %v", err)
+    }
+}
+
+func TestStorageService_EncryptionAtRest(t *testing.T) {
+    service := NewStorageService("test_address")
+    defer os.RemoveAll(service.rootPath) // Clean up after test
+
+    master, _ := encryption.GenerateKey()
+    if err := service.EnableEncryption(master); err != nil {
+        t.Fatalf("EnableEncryption() error = %v", err)
+    }
+    first := &datamgmt.Data{ID: "1", Filename: "first", Extension: "txt"}
+    content := bytes.Repeat([]byte("secret data "), 1000)
+    if err := service.StoreData(first, bytes.NewReader(content)); err != nil {
+        t.Fatalf("StoreData() error = %v", err)
+    }
+    raw, err := os.ReadFile(service.chunkPath(datamgmt.HashChunk(content)))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !encryption.IsSealed(raw) || bytes.Contains(raw, []byte("secret data")) {
+        t.Fatalf("Chunk is stored in plaintext")
+    }
+
+    // Rotate both keys, then store more data under the new data key
+    newMaster, _ := encryption.GenerateKey()
+    if err := service.RotateKeys(newMaster); err != nil {
+        t.Fatalf("RotateKeys() error = %v", err)
     }
-}
\ No newline at end of file
+    second := &datamgmt.Data{ID: "1", Filename: "second", Extension: "txt"}
+    if err := service.StoreData(second, bytes.NewReader([]byte("more secrets"))); err != nil {
+        t.Fatalf("StoreData() error = %v", err)
+    }
+
+    reopened := &StorageService{rootPath: service.rootPath}
+    if err := reopened.EnableEncryption(master); err == nil {
+        t.Errorf("Keyring unlocked with the retired master key")
+    }
+    if err := reopened.EnableEncryption(newMaster); err != nil {
+        t.Fatalf("EnableEncryption() error = %v", err)
+    }
+    if result := readStored(t, reopened, first); !bytes.Equal(result, content) {
+        t.Errorf("Data written before rotation is unreadable")
+    }
+    if result := readStored(t, reopened, second); string(result) != "more secrets" {
+        t.Errorf("Expected 'more secrets', got '%s'", result)
+    }
+}
+
+func TestStorageService_RejectsMisreportedChunkSizes(t *testing.T) {
+    service := NewStorageService("test_address")
+    defer os.RemoveAll(service.rootPath) // Clean up after test
+
+    chunk := []byte("a chunk of ten")
+    ref := datamgmt.ChunkRef{Hash: datamgmt.HashChunk(chunk), Size: int64(len(chunk))}
+    if err := service.PutChunk(datamgmt.ChunkRef{Hash: ref.Hash, Size: ref.Size + 1}, chunk); err == nil {
+        t.Errorf("Expected a chunk of another size than listed to be rejected")
+    }
+    if err := service.PutChunk(ref, chunk); err != nil {
+        t.Fatalf("PutChunk() error = %v", err)
+    }
+
+    data := &datamgmt.Data{ID: "1", Filename: "inflated", Extension: "txt"}
+    for _, refs := range [][]datamgmt.ChunkRef{
+        {{Hash: ref.Hash, Size: datamgmt.MaxChunkSize}},
+        {{Hash: ref.Hash, Size: datamgmt.MaxChunkSize + 1}},
+        {ref, {Hash: ref.Hash, Size: ref.Size + 1}},
+    } {
+        if err := service.CommitManifest(data, refs); err == nil {
+            t.Errorf("Expected a manifest listing %v to be rejected", refs)
+        }
+    }
+    if err := service.CommitManifest(data, []datamgmt.ChunkRef{ref}); err != nil {
+        t.Fatalf("CommitManifest() error = %v", err)
+    }
+    report, err := service.Usage()
+    if err != nil {
+        t.Fatalf("Usage() error = %v", err)
+    }
+    if usage := report.Namespaces["1"]; usage.Bytes != ref.Size {
+        t.Errorf("Expected usage of %d bytes, got %+v", ref.Size, usage)
+    }
+}
+
+func TestStorageService_GenerateFilePathStaysInBucket(t *testing.T) {
+    service := NewStorageService("test_address")
+    defer os.RemoveAll(service.rootPath) // Clean up after test
+
+    for _, data := range []*datamgmt.Data{
+        {ID: "1", Filename: "notes", Extension: "txt"},
+        {ID: "1", Filename: "archive.tar", Extension: "gz", Bucket: "photos"},
+    } {
+        if _, err := service.generateFilePath(data); err != nil {
+            t.Errorf("generateFilePath(%s.%s) error = %v", data.Filename, data.Extension, err)
+        }
+    }
+    for _, data := range []*datamgmt.Data{
+        {ID: "1", Filename: "../private/secret", Extension: "txt", Bucket: "photos"},
+        {ID: "1", Filename: "..", Extension: "txt"},
+        {ID: "1", Filename: ".", Extension: "txt"},
+        {ID: "1", Filename: "notes", Extension: "txt/../../secret"},
+        {ID: "1", Filename: `..\secret`, Extension: "txt"},
+        {ID: "1", Filename: "/etc/passwd", Extension: "txt"},
+    } {
+        if _, err := service.generateFilePath(data); !errors.Is(err, errInvalidFileName) {
+            t.Errorf("generateFilePath(%s.%s) error = %v, want errInvalidFileName", data.Filename, data.Extension, err)
+        }
+    }
+}
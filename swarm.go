@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/logger"
+)
+
+const (
+	connectionsPerSource = 2
+	maxPieceAttempts     = 5
+	maxSourceFailures    = 3
+)
+
+// swarmFetch downloads an object from several peers at once, verifying every piece against
+// the piece hashes advertised by the sources, and stores the result locally. The result must
+// match data.Checksum if set, or otherwise the checksum the sources agree on.
+func (s *Server) swarmFetch(data *datamgmt.Data, sources []string) error {
+    info, sources, err := s.agreeOnObjectInfo(data, sources)
+    if err != nil {
+        return err
+    }
+
+    temp, err := os.CreateTemp("", "gopherstore-swarm-*")
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to create temporary file")
+        return err
+    }
+    defer os.Remove(temp.Name())
+    defer temp.Close()
+
+    scheduler := newPieceScheduler(info.PieceCount(), sources)
+    var wg sync.WaitGroup
+    for _, source := range sources {
+        for i := 0; i < connectionsPerSource; i++ {
+            wg.Add(1)
+            go func(source string) {
+                defer wg.Done()
+                s.swarmWorker(data, info, source, scheduler, temp)
+            }(source)
+        }
+    }
+    wg.Wait()
+
+    if err := scheduler.result(); err != nil {
+        return err
+    }
+    if _, err := temp.Seek(0, io.SeekStart); err != nil {
+        return err
+    }
+
+    logger.Log.WithFields(map[string]interface{}{
+        "key":     data.Key(),
+        "pieces":  info.PieceCount(),
+        "sources": len(sources),
+    }).Info("Swarm download complete")
+
+    data.Command = "send"
+    if data.Checksum == "" {
+        data.Checksum = info.Checksum
+    }
+    if data.Clock == nil {
+        data.Clock, data.ModifiedAt = info.Clock, info.ModifiedAt
+    }
+    if data.ExpiresAt.IsZero() {
+        data.ExpiresAt = info.ExpiresAt
+    }
+    if data.Tags == nil {
+        data.Tags = info.Tags
+    }
+    warnSiblings(data, info)
+    if err := s.storage.StoreData(data, temp); err != nil {
+        logger.Log.WithError(err).Error("Failed to store data")
+        return err
+    }
+    go s.announce(data)
+    return nil
+}
+
+// swarmWorker repeatedly claims pieces for source, downloads and verifies them, and writes
+// them into place until no work is left or the source has failed too often.
+func (s *Server) swarmWorker(data *datamgmt.Data, info *datamgmt.ObjectInfo, source string, scheduler *pieceScheduler, out io.WriterAt) {
+    failures := 0
+    for {
+        index, ok := scheduler.next(source)
+        if !ok {
+            return
+        }
+
+        offset, length := info.PieceRange(index)
+        piece, err := s.fetchRange(source, data, offset, length)
+        if err == nil && !info.VerifyPiece(index, piece) {
+            err = fmt.Errorf("piece %d failed hash verification", index)
+        }
+        if err == nil {
+            _, err = out.WriteAt(piece, offset)
+        }
+        if err != nil {
+            logger.Log.WithError(err).WithField("address", source).WithField("piece", index).Warn("Failed to download piece")
+            scheduler.fail(index, source)
+            failures++
+            if failures >= maxSourceFailures {
+                scheduler.retire(source)
+                return
+            }
+            continue
+        }
+        failures = 0
+        scheduler.complete(index)
+    }
+}
+
+// agreeOnObjectInfo asks every source for the object's piece hashes and keeps only the
+// sources that agree with the majority, so a single bad peer cannot poison the download.
+func (s *Server) agreeOnObjectInfo(data *datamgmt.Data, sources []string) (*datamgmt.ObjectInfo, []string, error) {
+    type answer struct {
+        source string
+        info   *datamgmt.ObjectInfo
+    }
+    answers := make(chan answer, len(sources))
+    for _, source := range sources {
+        go func(source string) {
+            info, err := s.statObject(source, data)
+            if err != nil {
+                logger.Log.WithError(err).WithField("address", source).Warn("Failed to stat object")
+                info = nil
+            }
+            answers <- answer{source: source, info: info}
+        }(source)
+    }
+
+    groups := make(map[string][]answer)
+    var best string
+    for range sources {
+        a := <-answers
+        if a.info == nil {
+            continue
+        }
+        fingerprint := fmt.Sprint(a.info.Size, a.info.PieceSize, a.info.PieceHashes, a.info.Checksum)
+        groups[fingerprint] = append(groups[fingerprint], a)
+        if len(groups[fingerprint]) > len(groups[best]) {
+            best = fingerprint
+        }
+    }
+    if len(groups[best]) == 0 {
+        return nil, nil, errors.New("no source could describe the object")
+    }
+
+    var agreed []string
+    for _, a := range groups[best] {
+        agreed = append(agreed, a.source)
+    }
+    return groups[best][0].info, agreed, nil
+}
+
+// statObject asks a peer for the size and piece hashes of an object.
+func (s *Server) statObject(address string, data *datamgmt.Data) (*datamgmt.ObjectInfo, error) {
+    request := *data
+    request.Command = "stat"
+    request.Offset, request.Length = 0, 0
+
+    response, err := s.request(address, &request)
+    if err != nil {
+        return nil, err
+    }
+    defer response.Close()
+
+    var info datamgmt.ObjectInfo
+    if err := datamgmt.ReadEncodedData(response.reader.GzipReader, &info); err != nil {
+        return nil, err
+    }
+    return &info, nil
+}
+
+// fetchRange downloads length bytes of an object starting at offset from a peer.
+func (s *Server) fetchRange(address string, data *datamgmt.Data, offset, length int64) ([]byte, error) {
+    request := *data
+    request.Command = "fetch"
+    request.Offset, request.Length = offset, length
+
+    response, err := s.request(address, &request)
+    if err != nil {
+        return nil, err
+    }
+    defer response.Close()
+
+    var content bytes.Buffer
+    if _, err := datamgmt.ReadStreamWithSizePrefix(response.reader.GzipReader, &content); err != nil {
+        return nil, err
+    }
+    if int64(content.Len()) != length {
+        return nil, fmt.Errorf("expected %d bytes, received %d", length, content.Len())
+    }
+    return content.Bytes(), nil
+}
+
+// fetchRanges reads several byte ranges of an object from a peer in a single request and
+// returns the resolved ranges together with the bytes of each.
+func (s *Server) fetchRanges(address string, data *datamgmt.Data, ranges []datamgmt.ByteRange) ([]datamgmt.ByteRange, [][]byte, error) {
+    request := *data
+    request.Command = "fetch"
+    request.Offset, request.Length = 0, 0
+    request.Ranges = ranges
+
+    response, err := s.request(address, &request)
+    if err != nil {
+        return nil, nil, err
+    }
+    defer response.Close()
+
+    var buffer bytes.Buffer
+    if _, err := datamgmt.ReadStreamWithSizePrefix(response.reader.GzipReader, &buffer); err != nil {
+        return nil, nil, err
+    }
+
+    content := buffer.Bytes()
+    resolved := response.Data.Ranges
+    parts := make([][]byte, 0, len(resolved))
+    for _, r := range resolved {
+        if r.Length > int64(len(content)) {
+            return nil, nil, fmt.Errorf("peer returned %d bytes less than the requested ranges", r.Length-int64(len(content)))
+        }
+        parts = append(parts, content[:r.Length])
+        content = content[r.Length:]
+    }
+    return resolved, parts, nil
+}
+
+// pieceScheduler hands out pieces to source workers, steering retries of a failed piece
+// towards sources that have not failed it yet.
+type pieceScheduler struct {
+    mu       sync.Mutex
+    cond     *sync.Cond
+    pending  []int
+    failed   map[int]map[string]bool
+    attempts map[int]int
+    active   map[string]bool
+    total    int
+    done     int
+    err      error
+}
+
+func newPieceScheduler(total int, sources []string) *pieceScheduler {
+    ps := &pieceScheduler{
+        failed:   make(map[int]map[string]bool),
+        attempts: make(map[int]int),
+        active:   make(map[string]bool),
+        total:    total,
+    }
+    ps.cond = sync.NewCond(&ps.mu)
+    for i := 0; i < total; i++ {
+        ps.pending = append(ps.pending, i)
+    }
+    for _, source := range sources {
+        ps.active[source] = true
+    }
+    return ps
+}
+
+// next blocks until a piece is available for source, returning false once the download has
+// finished or failed.
+func (ps *pieceScheduler) next(source string) (int, bool) {
+    ps.mu.Lock()
+    defer ps.mu.Unlock()
+    for {
+        if ps.done == ps.total || ps.err != nil || !ps.active[source] {
+            return 0, false
+        }
+        for i, index := range ps.pending {
+            if !ps.failed[index][source] || ps.failedByAllActive(index) {
+                ps.pending = append(ps.pending[:i], ps.pending[i+1:]...)
+                return index, true
+            }
+        }
+        ps.cond.Wait()
+    }
+}
+
+func (ps *pieceScheduler) complete(index int) {
+    ps.mu.Lock()
+    defer ps.mu.Unlock()
+    ps.done++
+    ps.cond.Broadcast()
+}
+
+func (ps *pieceScheduler) fail(index int, source string) {
+    ps.mu.Lock()
+    defer ps.mu.Unlock()
+    if ps.failed[index] == nil {
+        ps.failed[index] = make(map[string]bool)
+    }
+    ps.failed[index][source] = true
+    ps.attempts[index]++
+    if ps.attempts[index] >= maxPieceAttempts {
+        ps.err = fmt.Errorf("piece %d failed after %d attempts", index, ps.attempts[index])
+    }
+    ps.pending = append(ps.pending, index)
+    ps.cond.Broadcast()
+}
+
+// retire stops handing out work to a source that keeps failing.
+func (ps *pieceScheduler) retire(source string) {
+    ps.mu.Lock()
+    defer ps.mu.Unlock()
+    delete(ps.active, source)
+    if len(ps.active) == 0 && ps.done < ps.total && ps.err == nil {
+        ps.err = errors.New("all sources failed")
+    }
+    ps.cond.Broadcast()
+}
+
+func (ps *pieceScheduler) failedByAllActive(index int) bool {
+    for source := range ps.active {
+        if !ps.failed[index][source] {
+            return false
+        }
+    }
+    return true
+}
+
+func (ps *pieceScheduler) result() error {
+    ps.mu.Lock()
+    defer ps.mu.Unlock()
+    return ps.err
+}
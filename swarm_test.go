@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+)
+
+// startTestServer starts a node on address, configured by options before it starts, and
+// stores content on it as swarm.bin if given.
+func startTestServer(t *testing.T, address string, content []byte, options ...func(*Server)) *Server {
+    server := NewServer(address)
+    for _, option := range options {
+        option(server)
+    }
+    if err := server.Start(); err != nil {
+        t.Fatalf("Start() error = %v", err)
+    }
+    t.Cleanup(func() {
+        server.Shutdown()
+        os.RemoveAll(server.storage.rootPath)
+    })
+
+    if content != nil {
+        data := &datamgmt.Data{ID: "1", Filename: "swarm", Extension: "bin"}
+        if err := server.storage.StoreData(data, bytes.NewReader(content)); err != nil {
+            t.Fatalf("StoreData() error = %v", err)
+        }
+    }
+    return server
+}
+
+// testClient returns a server that is never started, to make requests with token.
+func testClient(t *testing.T, token string) *Server {
+    server := NewServer("127.0.0.1:0")
+    t.Cleanup(func() { os.RemoveAll(server.storage.rootPath) })
+    server.token = token
+    return server
+}
+
+func TestServer_SwarmFetch(t *testing.T) {
+    content := make([]byte, 2*datamgmt.DefaultPieceSize+1234)
+    if _, err := rand.Read(content); err != nil {
+        t.Fatal(err)
+    }
+    corrupted := bytes.Clone(content)
+    corrupted[10] ^= 0xff
+
+    startTestServer(t, "127.0.0.1:3311", content)
+    startTestServer(t, "127.0.0.1:3312", content)
+    startTestServer(t, "127.0.0.1:3313", corrupted)
+
+    client := NewServer("127.0.0.1:3310")
+    defer os.RemoveAll(client.storage.rootPath)
+
+    data := &datamgmt.Data{ID: "1", Filename: "swarm", Extension: "bin", Command: "fetch"}
+    sources := []string{"127.0.0.1:3311", "127.0.0.1:3312", "127.0.0.1:3313", "127.0.0.1:3319"}
+    if err := client.swarmFetch(data, sources); err != nil {
+        t.Fatalf("swarmFetch() error = %v", err)
+    }
+
+    reader, err := client.storage.ReadData(&datamgmt.Data{ID: "1", Filename: "swarm", Extension: "bin"})
+    if err != nil {
+        t.Fatalf("ReadData() error = %v", err)
+    }
+    defer reader.Close()
+    result, _ := io.ReadAll(reader)
+    if !bytes.Equal(result, content) {
+        t.Errorf("Downloaded content does not match the original")
+    }
+}
+
+func TestServer_FetchRanges(t *testing.T) {
+    content := make([]byte, 300000)
+    if _, err := rand.Read(content); err != nil {
+        t.Fatal(err)
+    }
+    startTestServer(t, "127.0.0.1:3341", content)
+    client := NewServer("127.0.0.1:3340")
+    defer os.RemoveAll(client.storage.rootPath)
+
+    ranges, err := datamgmt.ParseRanges("0-15,150000-150099,-64")
+    if err != nil {
+        t.Fatal(err)
+    }
+    data := &datamgmt.Data{ID: "1", Filename: "swarm", Extension: "bin"}
+    resolved, parts, err := client.fetchRanges("127.0.0.1:3341", data, ranges)
+    if err != nil {
+        t.Fatalf("fetchRanges() error = %v", err)
+    }
+    if len(parts) != 3 {
+        t.Fatalf("Expected 3 ranges, got %d", len(parts))
+    }
+    for i, r := range resolved {
+        if !bytes.Equal(parts[i], content[r.Offset:r.Offset+r.Length]) {
+            t.Errorf("Range %d (%d+%d) returned the wrong bytes", i, r.Offset, r.Length)
+        }
+    }
+    if resolved[2].Offset != int64(len(content))-64 {
+        t.Errorf("Suffix range resolved to offset %d", resolved[2].Offset)
+    }
+
+    // Ranges past the end of the object are rejected by the peer
+    if _, _, err := client.fetchRanges("127.0.0.1:3341", data, []datamgmt.ByteRange{{Offset: 400000}}); err == nil {
+        t.Errorf("Expected unsatisfiable range to fail")
+    }
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/logger"
+)
+
+// Chunks live in one of two tiers: the hot tier, a fast disk holding the storage root by
+// default, and an optional cold tier, a capacity disk with its own root. Manifests stay in
+// the storage root, and reads find a chunk in whichever tier holds it, so tiering is
+// invisible to readers. New chunks go to the hot tier and spill to the cold one when the hot
+// tier is full. A periodic pass promotes files read often back to the hot tier and demotes
+// files left unread to the cold tier.
+
+const (
+	hotTier  = "hot"
+	coldTier = "cold"
+
+	defaultDemoteAfter = 7 * 24 * time.Hour
+	promoteReads       = 3 // Reads between passes that make a file hot
+	tieringInterval    = 10 * time.Minute
+)
+
+var errStorageFull = errors.New("not enough storage capacity left")
+
+// storageTier is a directory holding chunks, with an optional capacity limit.
+type storageTier struct {
+    name     string
+    root     string
+    capacity int64 // Bytes the tier may hold, zero for no limit
+    used     int64 // Bytes of chunks in the tier
+}
+
+func (t *storageTier) chunkPath(hash string) string {
+    return filepath.Join(t.root, chunkDirName, hash[:2], hash)
+}
+
+// TierUsage reports how much of a tier is in use.
+type TierUsage struct {
+    Name     string
+    Root     string
+    Used     int64
+    Capacity int64 // Zero for no limit
+}
+
+// ConfigureTiers places the hot tier in hotDir, or the storage root if empty, adds a cold
+// tier in coldDir if set, and limits each tier to its capacity, zero meaning no limit.
+func (s *StorageService) ConfigureTiers(hotDir, coldDir string, hotCapacity, coldCapacity int64) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    if hotDir == "" {
+        hotDir = s.rootPath
+    }
+    s.hot = &storageTier{name: hotTier, root: hotDir, capacity: hotCapacity}
+    s.cold = nil
+    if coldDir != "" {
+        s.cold = &storageTier{name: coldTier, root: coldDir, capacity: coldCapacity}
+    }
+    for _, tier := range s.chunkTiers() {
+        if err := os.MkdirAll(filepath.Join(tier.root, chunkDirName), 0740); err != nil {
+            return err
+        }
+        used, err := directorySize(filepath.Join(tier.root, chunkDirName))
+        if err != nil {
+            return err
+        }
+        tier.used = used
+        logger.Log.WithFields(map[string]interface{}{
+            "tier":     tier.name,
+            "root":     tier.root,
+            "used":     used,
+            "capacity": tier.capacity,
+        }).Info("Storage tier ready")
+    }
+    return nil
+}
+
+// chunkTiers returns the hot tier followed by the cold tier if there is one. The caller must
+// hold the mutex.
+func (s *StorageService) chunkTiers() []*storageTier {
+    if s.hot == nil {
+        s.hot = &storageTier{name: hotTier, root: s.rootPath}
+    }
+    if s.cold == nil {
+        return []*storageTier{s.hot}
+    }
+    return []*storageTier{s.hot, s.cold}
+}
+
+// locateChunk returns the tier holding a chunk, or nil if no tier does.
+func (s *StorageService) locateChunk(hash string) *storageTier {
+    for _, tier := range s.chunkTiers() {
+        if _, err := os.Stat(tier.chunkPath(hash)); err == nil {
+            return tier
+        }
+    }
+    return nil
+}
+
+// tierPaths returns where a chunk would be in the hot and cold tiers, the latter empty
+// without a cold tier. The tiers are fixed once configured, so it needs no mutex.
+func (s *StorageService) tierPaths(hash string) (string, string) {
+    hot := filepath.Join(s.rootPath, chunkDirName, hash[:2], hash)
+    if s.hot != nil {
+        hot = s.hot.chunkPath(hash)
+    }
+    if s.cold == nil {
+        return hot, ""
+    }
+    return hot, s.cold.chunkPath(hash)
+}
+
+// placeChunk picks the tier a new chunk of size bytes is written to, the hot tier unless it
+// is out of space.
+func (s *StorageService) placeChunk(size int64) (*storageTier, error) {
+    for _, tier := range s.chunkTiers() {
+        if s.tierSpace(tier) >= size {
+            return tier, nil
+        }
+    }
+    return nil, errStorageFull
+}
+
+// moveChunk moves a chunk to another tier. The copy is complete before the original is
+// removed, so a concurrent read finds the chunk in one tier or the other.
+func (s *StorageService) moveChunk(hash string, from, to *storageTier) error {
+    content, err := os.ReadFile(from.chunkPath(hash))
+    if err != nil {
+        return err
+    }
+    size := int64(len(content))
+    if s.tierSpace(to) < size {
+        return fmt.Errorf("%s tier: %w", to.name, errStorageFull)
+    }
+    if err := writeFileAtomic(to.chunkPath(hash), content); err != nil {
+        return err
+    }
+    if err := os.Remove(from.chunkPath(hash)); err != nil {
+        return err
+    }
+    to.used += size
+    from.used -= size
+    return nil
+}
+
+// removeChunk deletes a chunk from whichever tier holds it.
+func (s *StorageService) removeChunk(hash string) error {
+    tier := s.locateChunk(hash)
+    if tier == nil {
+        return nil
+    }
+    info, err := os.Stat(tier.chunkPath(hash))
+    if err != nil {
+        return err
+    }
+    if err := os.Remove(tier.chunkPath(hash)); err != nil {
+        return err
+    }
+    tier.used -= info.Size()
+    return nil
+}
+
+// Demote moves the chunks of a file to the cold tier and records it as cold. Chunks that a
+// file outside the cold tier shares stay where they are.
+func (s *StorageService) Demote(data *datamgmt.Data) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    path, manifest, err := s.latestManifest(data)
+    if err != nil {
+        return err
+    }
+    if s.cold != nil {
+        shared := make(map[string]bool)
+        err := s.walkManifests(func(other string, version *Manifest) error {
+            if other != path && version.Tier != coldTier {
+                for _, ref := range version.Chunks {
+                    shared[ref.Hash] = true
+                }
+            }
+            return nil
+        })
+        if err != nil {
+            return err
+        }
+        for _, ref := range manifest.Chunks {
+            if !shared[ref.Hash] && s.locateChunk(ref.Hash) == s.hot {
+                if err := s.moveChunk(ref.Hash, s.hot, s.cold); err != nil {
+                    return err
+                }
+            }
+        }
+    }
+    manifest.Tier = coldTier
+    return s.saveManifest(path, manifest)
+}
+
+// Promote moves the chunks of a file to the hot tier and records it as hot.
+func (s *StorageService) Promote(data *datamgmt.Data) error {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    path, manifest, err := s.latestManifest(data)
+    if err != nil {
+        return err
+    }
+    if s.cold != nil {
+        for _, ref := range manifest.Chunks {
+            if s.locateChunk(ref.Hash) == s.cold {
+                if err := s.moveChunk(ref.Hash, s.cold, s.hot); err != nil {
+                    return err
+                }
+            }
+        }
+    }
+    manifest.Tier = ""
+    return s.saveManifest(path, manifest)
+}
+
+// latestManifest loads the latest version of a file. The caller must hold the mutex.
+func (s *StorageService) latestManifest(data *datamgmt.Data) (string, *Manifest, error) {
+    path, err := s.generateFilePath(data)
+    if err != nil {
+        return "", nil, err
+    }
+    manifest, err := s.loadManifest(path)
+    return path, manifest, err
+}
+
+// TierUsage reports the usage of every storage tier.
+func (s *StorageService) TierUsage() []TierUsage {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    var usage []TierUsage
+    for _, tier := range s.chunkTiers() {
+        usage = append(usage, TierUsage{Name: tier.name, Root: tier.root, Used: tier.used, Capacity: tier.capacity})
+    }
+    return usage
+}
+
+// Tiered reports whether the storage has a cold tier.
+func (s *StorageService) Tiered() bool {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return s.cold != nil
+}
+
+// directorySize returns the total size of the files under dir.
+func directorySize(dir string) (int64, error) {
+    var size int64
+    err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if entry.IsDir() {
+            return nil
+        }
+        info, err := entry.Info()
+        if err != nil {
+            return err
+        }
+        size += info.Size()
+        return nil
+    })
+    if errors.Is(err, fs.ErrNotExist) {
+        return 0, nil
+    }
+    return size, err
+}
+
+// tieringLoop periodically moves files between tiers until the server shuts down.
+func (s *Server) tieringLoop() {
+    defer s.wg.Done()
+    if !s.storage.Tiered() {
+        return
+    }
+    ticker := time.NewTicker(tieringInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-s.quit:
+            return
+        case <-ticker.C:
+            s.rebalanceTiers()
+        }
+    }
+}
+
+// rebalanceTiers promotes files read at least promoteReads times since the last pass and
+// demotes files not read for demoteAfter, returning how many files it moved.
+func (s *Server) rebalanceTiers() (int, int) {
+    files, err := s.storage.StoredFiles()
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to list stored files for tiering")
+        return 0, 0
+    }
+    now := time.Now()
+    promoted, demoted := 0, 0
+    for _, manifest := range files {
+        data := manifestData(manifest)
+        accessed, reads := s.storage.AccessStats(data, manifest)
+        switch {
+        case manifest.Tier == coldTier && reads >= promoteReads:
+            if err := s.storage.Promote(data); err != nil {
+                logger.Log.WithError(err).WithField("key", data.Key()).Warn("Failed to promote file")
+                continue
+            }
+            promoted++
+        case manifest.Tier != coldTier && s.demoteAfter > 0 && now.Sub(accessed) >= s.demoteAfter:
+            if err := s.storage.Demote(data); err != nil {
+                logger.Log.WithError(err).WithField("key", data.Key()).Warn("Failed to demote file")
+                continue
+            }
+            demoted++
+        }
+    }
+    s.storage.resetReads()
+    if promoted > 0 || demoted > 0 {
+        logger.Log.WithField("promoted", promoted).WithField("demoted", demoted).Info("Storage tiers rebalanced")
+    }
+    return promoted, demoted
+}
+
+// parseSize parses a byte count such as "512M" or "2G", with binary K, M, G and T suffixes.
+func parseSize(text string) (int64, error) {
+    multiplier := int64(1)
+    number := strings.TrimSuffix(strings.ToUpper(text), "B")
+    if n := len(number); n > 0 {
+        if shift := strings.IndexByte("KMGT", number[n-1]); shift >= 0 {
+            multiplier = 1 << (10 * (shift + 1))
+            number = number[:n-1]
+        }
+    }
+    value, err := strconv.ParseInt(number, 10, 64)
+    if err != nil || value < 0 {
+        return 0, fmt.Errorf("invalid size %q", text)
+    }
+    return value * multiplier, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+)
+
+func countChunks(root string) int {
+    chunks, _ := filepath.Glob(filepath.Join(root, chunkDirName, "*", "*"))
+    return len(chunks)
+}
+
+func TestStorageService_Tiers(t *testing.T) {
+    service := NewStorageService("test_address")
+    defer os.RemoveAll(service.rootPath) // Clean up after test
+    cold := t.TempDir()
+    if err := service.ConfigureTiers("", cold, 0, 0); err != nil {
+        t.Fatalf("ConfigureTiers() error = %v", err)
+    }
+
+    data := &datamgmt.Data{ID: "1", Filename: "tiered", Extension: "txt"}
+    if err := service.StoreData(data, bytes.NewReader([]byte("tiered content"))); err != nil {
+        t.Fatalf("StoreData() error = %v", err)
+    }
+    if countChunks(service.rootPath) != 1 || countChunks(cold) != 0 {
+        t.Fatalf("Expected new chunks in the hot tier")
+    }
+
+    if err := service.Demote(data); err != nil {
+        t.Fatalf("Demote() error = %v", err)
+    }
+    if countChunks(service.rootPath) != 0 || countChunks(cold) != 1 {
+        t.Fatalf("Expected demoted chunks in the cold tier")
+    }
+    if result := readStored(t, service, data); string(result) != "tiered content" {
+        t.Errorf("Expected demoted file to read back, got '%s'", result)
+    }
+
+    if err := service.Promote(data); err != nil {
+        t.Fatalf("Promote() error = %v", err)
+    }
+    if countChunks(service.rootPath) != 1 || countChunks(cold) != 0 {
+        t.Errorf("Expected promoted chunks back in the hot tier")
+    }
+    usage := service.TierUsage()
+    if len(usage) != 2 || usage[0].Used == 0 || usage[1].Used != 0 {
+        t.Errorf("Unexpected tier usage %+v", usage)
+    }
+}
+
+func TestStorageService_TierCapacity(t *testing.T) {
+    service := NewStorageService("test_address")
+    defer os.RemoveAll(service.rootPath) // Clean up after test
+    cold := t.TempDir()
+    if err := service.ConfigureTiers("", cold, 10, 20); err != nil {
+        t.Fatalf("ConfigureTiers() error = %v", err)
+    }
+
+    // The hot tier cannot hold the chunk, so it spills to the cold tier.
+    data := &datamgmt.Data{ID: "1", Filename: "spilled", Extension: "txt"}
+    if err := service.StoreData(data, bytes.NewReader([]byte("sixteen bytes!!!"))); err != nil {
+        t.Fatalf("StoreData() error = %v", err)
+    }
+    if countChunks(service.rootPath) != 0 || countChunks(cold) != 1 {
+        t.Fatalf("Expected the chunk to spill to the cold tier")
+    }
+    if result := readStored(t, service, data); string(result) != "sixteen bytes!!!" {
+        t.Errorf("Expected spilled file to read back, got '%s'", result)
+    }
+
+    full := &datamgmt.Data{ID: "1", Filename: "full", Extension: "txt"}
+    if err := service.StoreData(full, bytes.NewReader([]byte("sixteen more!!!!"))); !errors.Is(err, errStorageFull) {
+        t.Errorf("Expected errStorageFull, got %v", err)
+    }
+    if countChunks(cold) != 1 {
+        t.Errorf("Expected no chunk of the rejected file to remain")
+    }
+}
+
+func TestServer_RebalanceTiers(t *testing.T) {
+    server := NewServer("127.0.0.1:3375")
+    defer os.RemoveAll(server.storage.rootPath)
+    if err := server.storage.ConfigureTiers("", t.TempDir(), 0, 0); err != nil {
+        t.Fatalf("ConfigureTiers() error = %v", err)
+    }
+    server.demoteAfter = 50 * time.Millisecond
+
+    idle := &datamgmt.Data{ID: "1", Filename: "idle", Extension: "txt"}
+    busy := &datamgmt.Data{ID: "1", Filename: "busy", Extension: "txt"}
+    for _, data := range []*datamgmt.Data{idle, busy} {
+        if err := server.storage.StoreData(data, bytes.NewReader([]byte(data.Filename+" content"))); err != nil {
+            t.Fatalf("StoreData() error = %v", err)
+        }
+    }
+    if err := server.storage.Demote(busy); err != nil {
+        t.Fatalf("Demote() error = %v", err)
+    }
+    time.Sleep(server.demoteAfter)
+    for i := 0; i < promoteReads; i++ {
+        readStored(t, server.storage, busy)
+    }
+
+    if promoted, demoted := server.rebalanceTiers(); promoted != 1 || demoted != 1 {
+        t.Fatalf("rebalanceTiers() = %d, %d, expected 1, 1", promoted, demoted)
+    }
+    tiers := make(map[string]string)
+    files, _ := server.storage.StoredFiles()
+    for _, manifest := range files {
+        tiers[manifest.Filename] = manifest.Tier
+    }
+    if tiers["idle"] != coldTier || tiers["busy"] != "" {
+        t.Errorf("Unexpected tiers %v", tiers)
+    }
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/logger"
+	"github.com/tejasprabhu/GopherStore/p2p"
+)
+
+// A delete leaves a tombstone as the latest version of the file, carrying the clock and
+// time of the delete. The node that receives the delete forwards it to the other peers
+// providing the file, and keeps forwarding it at every sweep while the tombstone is within
+// its grace period, so replicas that were unreachable record it once they are back. While
+// the tombstone is kept, copies of the file from replicas that missed the delete are
+// rejected as stale, and once the grace period is over the file is erased with its history.
+
+const (
+	defaultTombstoneGrace  = 7 * 24 * time.Hour
+	tombstoneSweepInterval = time.Hour
+)
+
+var errResurrection = errors.New("file was deleted, send it from a node that has seen the delete")
+
+// Tombstones returns the latest manifests of the deleted files this node holds.
+func (s *StorageService) Tombstones() ([]*Manifest, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    var tombstones []*Manifest
+    err := s.walkManifests(func(path string, manifest *Manifest) error {
+        if manifest.Deleted {
+            tombstones = append(tombstones, manifest)
+        }
+        return nil
+    })
+    return tombstones, err
+}
+
+// CollectTombstones erases the deleted files whose tombstone is older than grace, together
+// with their older versions and any chunks nothing else refers to, and returns how many
+// files it erased.
+func (s *StorageService) CollectTombstones(grace time.Duration) (int, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    var expired []string
+    err := s.walkManifests(func(path string, manifest *Manifest) error {
+        if manifest.Deleted && time.Since(manifest.ModifiedAt) > grace {
+            expired = append(expired, path)
+        }
+        return nil
+    })
+    if err != nil {
+        return 0, err
+    }
+    for i, path := range expired {
+        if err := s.eraseFile(path); err != nil {
+            return i, err
+        }
+    }
+    return len(expired), nil
+}
+
+// eraseFile removes every version of the file at path. The caller must hold the mutex.
+func (s *StorageService) eraseFile(path string) error {
+    versions, err := s.archivedVersions(path)
+    if err != nil {
+        return err
+    }
+    if latest, err := s.loadManifest(path); err == nil {
+        versions = append(versions, latest)
+    }
+    if err := s.removeManifest(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+        return err
+    }
+    if err := os.RemoveAll(s.versionDir(path)); err != nil {
+        return err
+    }
+    for _, version := range versions {
+        s.trackUsage(s.versionPath(path, version.VersionID), nil)
+    }
+    for _, version := range versions {
+        s.collectChunks(version.Chunks)
+    }
+    logger.Log.WithField("path", path).WithField("versions", len(versions)).Info("Deleted file erased")
+    return nil
+}
+
+// tombstoneLoop periodically sweeps tombstones until the server shuts down.
+func (s *Server) tombstoneLoop() {
+    defer s.wg.Done()
+    ticker := time.NewTicker(tombstoneSweepInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-s.quit:
+            return
+        case <-ticker.C:
+            s.sweepTombstones()
+        }
+    }
+}
+
+// sweepTombstones erases deleted files past the grace period, unless it is zero, and forwards
+// the remaining tombstones to the peers still providing their files.
+func (s *Server) sweepTombstones() {
+    if s.tombstoneGrace > 0 {
+        collected, err := s.storage.CollectTombstones(s.tombstoneGrace)
+        if err != nil {
+            logger.Log.WithError(err).Error("Failed to collect tombstones")
+        } else if collected > 0 {
+            logger.Log.WithField("files", collected).Info("Tombstones collected")
+        }
+    }
+
+    tombstones, err := s.storage.Tombstones()
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to list tombstones")
+        return
+    }
+    for _, tombstone := range tombstones {
+        s.propagateDelete(tombstoneData(tombstone))
+    }
+}
+
+// tombstoneData describes the delete a tombstone records.
+func tombstoneData(tombstone *Manifest) *datamgmt.Data {
+    return &datamgmt.Data{
+        ID:         tombstone.ID,
+        Filename:   tombstone.Filename,
+        Extension:  tombstone.Extension,
+        OriginID:   tombstone.OriginID,
+        Clock:      tombstone.Clock,
+        ModifiedAt: tombstone.ModifiedAt,
+        Bucket:     tombstone.Bucket,
+    }
+}
+
+// propagateDelete forwards a delete to every other peer providing the file, and returns
+// how many it reached.
+func (s *Server) propagateDelete(data *datamgmt.Data) int {
+    providers, err := s.locateProviders(data)
+    if err != nil {
+        if !errors.Is(err, p2p.ErrNoProviders) {
+            logger.Log.WithError(err).WithField("key", data.Key()).Warn("Failed to locate replicas")
+        }
+        return 0
+    }
+
+    request := *data
+    request.Command = "delete"
+    request.Version = ""
+    request.Forwarded = true
+    forwarded := 0
+    for _, address := range providers {
+        conn, err := s.sendCommand(address, &request)
+        if err != nil {
+            continue
+        }
+        conn.Close()
+        forwarded++
+    }
+    if forwarded > 0 {
+        logger.Log.WithField("key", data.Key()).WithField("replicas", forwarded).Info("Delete forwarded to replicas")
+    }
+    return forwarded
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+)
+
+func TestStorageService_TombstonesSuppressResurrection(t *testing.T) {
+    service := NewStorageService("test_address")
+    defer os.RemoveAll(service.rootPath) // Clean up after test
+
+    original := &datamgmt.Data{ID: "1", Filename: "testfile", Extension: "txt", Clock: datamgmt.VectorClock{"a": 1}}
+    if err := service.StoreData(original, bytes.NewReader([]byte("content"))); err != nil {
+        t.Fatalf("StoreData() error = %v", err)
+    }
+    deletion := &datamgmt.Data{ID: "1", Filename: "testfile", Extension: "txt", Clock: datamgmt.VectorClock{"a": 1, "b": 1}}
+    if err := service.DeleteData(deletion); err != nil {
+        t.Fatalf("DeleteData() error = %v", err)
+    }
+
+    // Copies from replicas that missed the delete, with or without their clock, stay deleted.
+    if err := service.StoreData(original, bytes.NewReader([]byte("content"))); !errors.Is(err, errStaleWrite) {
+        t.Errorf("Expected a stale copy to be rejected, got %v", err)
+    }
+    unclocked := &datamgmt.Data{ID: "1", Filename: "testfile", Extension: "txt"}
+    if err := service.StoreData(unclocked, bytes.NewReader([]byte("content"))); !errors.Is(err, errResurrection) {
+        t.Errorf("Expected a write without a clock to be rejected, got %v", err)
+    }
+    if service.HasData(unclocked) {
+        t.Fatalf("Deleted file was resurrected")
+    }
+
+    if collected, err := service.CollectTombstones(time.Hour); err != nil || collected != 0 {
+        t.Errorf("CollectTombstones() within the grace period = %d, %v", collected, err)
+    }
+    if collected, err := service.CollectTombstones(0); err != nil || collected != 1 {
+        t.Fatalf("CollectTombstones() after the grace period = %d, %v", collected, err)
+    }
+    if _, err := service.Versions(unclocked); !errors.Is(err, fs.ErrNotExist) {
+        t.Errorf("Expected no versions after collection, got %v", err)
+    }
+    if chunks, _ := filepath.Glob(filepath.Join(service.rootPath, chunkDirName, "*", "*")); len(chunks) != 0 {
+        t.Errorf("Expected chunks to be collected, %d left", len(chunks))
+    }
+    // Once the tombstone is gone the file can be stored again.
+    if err := service.StoreData(unclocked, bytes.NewReader([]byte("content"))); err != nil {
+        t.Errorf("StoreData() after collection error = %v", err)
+    }
+}
+
+func TestServer_DeletePropagatesToReplicas(t *testing.T) {
+    content := []byte("replicated content")
+    first := startTestServer(t, "127.0.0.1:3370", content)
+    second := startTestServer(t, "127.0.0.1:3371", content)
+    first.dht.Bootstrap([]string{"127.0.0.1:3371"})
+    second.dht.Bootstrap([]string{"127.0.0.1:3370"})
+
+    data := &datamgmt.Data{ID: "1", Filename: "swarm", Extension: "bin"}
+    first.announce(data)
+    second.announce(data)
+
+    first.deleteData(&datamgmt.Data{ID: "1", Filename: "swarm", Extension: "bin"})
+    for attempt := 1; second.storage.HasData(data); attempt++ {
+        if attempt == 50 {
+            t.Fatalf("Delete did not reach the other replica")
+        }
+        time.Sleep(100 * time.Millisecond)
+    }
+    versions, err := second.storage.Versions(data)
+    if err != nil || !versions[0].Deleted {
+        t.Fatalf("Expected a tombstone on the other replica, got %+v, %v", versions, err)
+    }
+    tombstones, _ := first.storage.Tombstones()
+    if len(tombstones) != 1 || versions[0].Clock.Compare(tombstones[0].Clock) != datamgmt.Equal {
+        t.Errorf("Expected the replica's tombstone to carry the same clock")
+    }
+}
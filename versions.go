@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tejasprabhu/GopherStore/datamgmt"
+	"github.com/tejasprabhu/GopherStore/logger"
+)
+
+// Every store of a file creates a new immutable version. The manifest of the latest version
+// stays at the file's path, so reads and the scrubber find it as before, and older versions
+// are kept under versions/ at the same relative path, one manifest per version.
+const versionDirName = "versions"
+
+var errObjectDeleted = fmt.Errorf("object was deleted: %w", fs.ErrNotExist)
+
+// ObjectVersion describes one version of a stored file.
+type ObjectVersion struct {
+    VersionID string
+    CreatedAt time.Time
+    Size      int64
+    Checksum  string
+    Deleted   bool // The version is a tombstone left by a delete
+    Latest    bool
+    Conflict  bool // The version is current alongside concurrent siblings
+    Clock     datamgmt.VectorClock
+    ExpiresAt time.Time
+    Tier      string
+}
+
+// versionID formats a version ID that sorts by creation time.
+func versionID(created time.Time, suffix uint32) string {
+    return fmt.Sprintf("%016x%08x", created.UnixNano(), suffix)
+}
+
+func newVersionID(created time.Time) string {
+    var suffix [4]byte
+    rand.Read(suffix[:])
+    return versionID(created, binary.BigEndian.Uint32(suffix[:]))
+}
+
+// isVersionID reports whether id is a well-formed version ID, which also keeps
+// peer-supplied IDs from escaping the storage directories.
+func isVersionID(id string) bool {
+    _, err := hex.DecodeString(id)
+    return err == nil && len(id) == 24
+}
+
+// versionDir returns the directory holding the older versions of the file at path.
+func (s *StorageService) versionDir(path string) string {
+    relative, err := filepath.Rel(s.rootPath, path)
+    if err != nil {
+        relative = filepath.Base(path)
+    }
+    return filepath.Join(s.rootPath, versionDirName, relative)
+}
+
+func (s *StorageService) versionPath(path, id string) string {
+    return filepath.Join(s.versionDir(path), id+".json")
+}
+
+// isVersionPath reports whether path is the manifest of an older version rather than that of
+// the latest version of a file.
+func (s *StorageService) isVersionPath(path string) bool {
+    return strings.HasPrefix(path, filepath.Join(s.rootPath, versionDirName)+string(filepath.Separator))
+}
+
+// writeVersion adds manifest as a new version of the file at path. The versions it
+// replaces, and siblings the conflict resolver does not keep current, become older versions,
+// unless the file's bucket keeps no versions; siblings it keeps are listed by the latest
+// version. The caller must hold the mutex.
+func (s *StorageService) writeVersion(path string, manifest *Manifest) error {
+    manifest.CreatedAt = time.Now()
+    manifest.VersionID = newVersionID(manifest.CreatedAt)
+    if manifest.ModifiedAt.IsZero() {
+        manifest.ModifiedAt = manifest.CreatedAt
+    }
+
+    previous, err := s.loadManifest(path)
+    if err != nil && !errors.Is(err, fs.ErrNotExist) {
+        logger.Log.WithError(err).Warn("Replacing unreadable manifest")
+    }
+    // A file keeps its owner and grants across versions, including its tombstone and a file
+    // written again after it was deleted or quarantined, and a new file is owned by the origin
+    // that wrote it.
+    inherited := previous
+    if inherited == nil {
+        inherited = s.quarantinedManifest(path)
+    }
+    if inherited != nil {
+        manifest.ACL = inherited.ACL
+    } else if manifest.ACL.Owner == "" {
+        manifest.ACL.Owner = manifest.OriginID
+    }
+    current, err := s.resolveWrite(s.currentVersions(path, previous), manifest)
+    if err != nil {
+        return err
+    }
+    latest := current[len(current)-1]
+    for _, version := range []*Manifest{previous, manifest} {
+        if version != nil && version != latest {
+            archived := *version
+            archived.Siblings = nil
+            if err := s.saveManifest(s.versionPath(path, version.VersionID), &archived); err != nil {
+                return err
+            }
+        }
+    }
+    latest.Siblings = nil
+    for _, sibling := range current[:len(current)-1] {
+        latest.Siblings = append(latest.Siblings, sibling.VersionID)
+    }
+    if err := s.saveManifest(path, latest); err != nil {
+        return err
+    }
+    if !s.versioned(latest.Bucket) {
+        _, err := s.pruneVersions(path, 0)
+        return err
+    }
+    return nil
+}
+
+// loadVersion reads the given version of the file at path, or its latest version if id is
+// empty. The caller must hold the mutex.
+func (s *StorageService) loadVersion(path, id string) (*Manifest, error) {
+    latest, err := s.loadManifest(path)
+    if id == "" || (err == nil && latest.VersionID == id) {
+        return latest, err
+    }
+    if !isVersionID(id) {
+        return nil, fmt.Errorf("invalid version ID %q", id)
+    }
+    return s.loadManifest(s.versionPath(path, id))
+}
+
+// purgeVersion erases one version of the file at path. When it is the latest version, its
+// newest sibling, or otherwise the newest remaining version, takes its place. The caller must
+// hold the mutex.
+func (s *StorageService) purgeVersion(path, id string) error {
+    if !isVersionID(id) {
+        return fmt.Errorf("invalid version ID %q", id)
+    }
+    latest, err := s.loadManifest(path)
+    if err != nil && !errors.Is(err, fs.ErrNotExist) {
+        return err
+    }
+
+    var purged *Manifest
+    if latest != nil && latest.VersionID == id {
+        purged = latest
+        if err := s.promoteVersion(path, latest); err != nil {
+            return err
+        }
+    } else {
+        purged, err = s.loadManifest(s.versionPath(path, id))
+        if err != nil {
+            return err
+        }
+        if err := s.removeManifest(s.versionPath(path, id)); err != nil {
+            return err
+        }
+        if latest != nil && slices.Contains(latest.Siblings, id) {
+            latest.Siblings = slices.DeleteFunc(latest.Siblings, func(sibling string) bool {
+                return sibling == id
+            })
+            if err := s.saveManifest(path, latest); err != nil {
+                return err
+            }
+        }
+    }
+    os.Remove(s.versionDir(path)) // Only succeeds once no version is left
+    s.collectChunks(purged.Chunks)
+
+    logger.Log.WithField("path", path).WithField("version", id).Info("Version erased")
+    return nil
+}
+
+// promoteVersion replaces the latest version of the file at path, which is being erased, by
+// its newest sibling or else the newest older version. The caller must hold the mutex.
+func (s *StorageService) promoteVersion(path string, latest *Manifest) error {
+    siblings := s.currentVersions(path, latest)
+    siblings = siblings[:len(siblings)-1]
+    if len(siblings) > 0 {
+        sortVersions(siblings)
+        newest := siblings[len(siblings)-1]
+        newest.Siblings = nil
+        for _, sibling := range siblings[:len(siblings)-1] {
+            newest.Siblings = append(newest.Siblings, sibling.VersionID)
+        }
+        if err := s.saveManifest(path, newest); err != nil {
+            return err
+        }
+        return s.removeManifest(s.versionPath(path, newest.VersionID))
+    }
+
+    older, err := s.archivedVersions(path)
+    if err != nil {
+        return err
+    }
+    if len(older) == 0 {
+        return s.removeManifest(path)
+    }
+    newest := s.versionPath(path, older[len(older)-1].VersionID)
+    if err := os.Rename(newest, path); err != nil {
+        return err
+    }
+    s.trackUsage(newest, nil)
+    s.trackUsage(path, older[len(older)-1])
+    return nil
+}
+
+// archivedVersions returns the older versions of the file at path, oldest first. The
+// caller must hold the mutex.
+func (s *StorageService) archivedVersions(path string) ([]*Manifest, error) {
+    entries, err := os.ReadDir(s.versionDir(path))
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil, nil
+    }
+    if err != nil {
+        return nil, err
+    }
+    var versions []*Manifest
+    for _, entry := range entries {
+        id, ok := strings.CutSuffix(entry.Name(), ".json")
+        if !ok || !isVersionID(id) {
+            continue
+        }
+        manifest, err := s.loadManifest(filepath.Join(s.versionDir(path), entry.Name()))
+        if err != nil {
+            logger.Log.WithError(err).WithField("version", id).Warn("Skipping unreadable version")
+            continue
+        }
+        versions = append(versions, manifest)
+    }
+    sort.Slice(versions, func(i, j int) bool {
+        return versions[i].VersionID < versions[j].VersionID
+    })
+    return versions, nil
+}
+
+// Versions lists every version of a file, newest first.
+func (s *StorageService) Versions(data *datamgmt.Data) ([]ObjectVersion, error) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    path, err := s.generateFilePath(data)
+    if err != nil {
+        return nil, err
+    }
+    manifests, err := s.archivedVersions(path)
+    if err != nil {
+        return nil, err
+    }
+    latest, err := s.loadManifest(path)
+    if err != nil && !errors.Is(err, fs.ErrNotExist) {
+        return nil, err
+    }
+    if latest != nil {
+        manifests = append(manifests, latest)
+    }
+    if len(manifests) == 0 {
+        return nil, fs.ErrNotExist
+    }
+    conflicted := make(map[string]bool)
+    if latest != nil && len(latest.Siblings) > 0 {
+        conflicted[latest.VersionID] = true
+        for _, id := range latest.Siblings {
+            conflicted[id] = true
+        }
+    }
+
+    versions := make([]ObjectVersion, 0, len(manifests))
+    seen := make(map[string]bool)
+    for i := len(manifests) - 1; i >= 0; i-- {
+        manifest := manifests[i]
+        // A version may be both latest and archived if replacing it was interrupted.
+        if seen[manifest.VersionID] {
+            continue
+        }
+        seen[manifest.VersionID] = true
+        versions = append(versions, ObjectVersion{
+            VersionID: manifest.VersionID,
+            CreatedAt: manifest.CreatedAt,
+            Size:      manifest.Size,
+            Checksum:  manifest.Checksum,
+            Deleted:   manifest.Deleted,
+            Latest:    latest != nil && manifest.VersionID == latest.VersionID,
+            Conflict:  conflicted[manifest.VersionID],
+            Clock:     manifest.Clock,
+            ExpiresAt: manifest.ExpiresAt,
+            Tier:      manifest.Tier,
+        })
+    }
+    return versions, nil
+}
+
+// HasData reports whether the latest version of a file is readable, i.e. the file exists
+// and was neither deleted nor has expired.
+func (s *StorageService) HasData(data *datamgmt.Data) bool {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+
+    path, err := s.generateFilePath(data)
+    if err != nil {
+        return false
+    }
+    manifest, err := s.loadManifest(path)
+    return err == nil && !manifest.Deleted && !manifest.expired(time.Now())
+}
+
+// walkVersions calls fn for every older version of every file. The caller must hold the
+// mutex.
+func (s *StorageService) walkVersions(fn func(path string, manifest *Manifest) error) error {
+    root := filepath.Join(s.rootPath, versionDirName)
+    err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+        if err != nil {
+            return err
+        }
+        if entry.IsDir() || strings.Contains(entry.Name(), tempFileMarker) {
+            return nil
+        }
+        manifest, err := s.loadManifest(path)
+        if err != nil {
+            logger.Log.WithError(err).WithField("path", path).Warn("Skipping unreadable version")
+            return nil
+        }
+        return fn(path, manifest)
+    })
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil
+    }
+    return err
+}
+
+// handleVersionsCommand replies with the version history of a stored file. The checksums
+// are left out for a caller that may not read the file, as the checksum of a file made of
+// one chunk is that chunk's hash.
+func (s *Server) handleVersionsCommand(caller *caller, data *datamgmt.Data, conn net.Conn) error {
+    writer, err := datamgmt.NewWriteStreamAdapter(conn)
+    if err != nil {
+        logger.Log.WithError(err).Error("Failed to create write stream adapter")
+        return err
+    }
+    defer writer.Close()
+
+    versions, err := s.storage.Versions(data)
+    read := *data
+    read.Command = "fetch"
+    if s.authorize(caller, &read) != nil {
+        for i := range versions {
+            versions[i].Checksum = ""
+        }
+    }
+    if err := s.reply(writer, data, err); err != nil {
+        return err
+    }
+    if err := datamgmt.SendEncodedData(writer.GzipWriter, versions); err != nil {
+        logger.Log.WithError(err).Error("Failed to send versions")
+        return err
+    }
+    if err := writer.GzipWriter.Flush(); err != nil {
+        logger.Log.WithError(err).Error("Failed to flush data")
+        return err
+    }
+    return nil
+}
+
+// requestVersions asks a peer for the version history of a file.
+func (s *Server) requestVersions(address string, data *datamgmt.Data) ([]ObjectVersion, error) {
+    request := *data
+    request.Command = "versions"
+
+    response, err := s.request(address, &request)
+    if err != nil {
+        return nil, err
+    }
+    defer response.Close()
+
+    var versions []ObjectVersion
+    if err := datamgmt.ReadEncodedData(response.reader.GzipReader, &versions); err != nil {
+        return nil, err
+    }
+    return versions, nil
+}